@@ -0,0 +1,218 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// configFileFlag is the flag for specifying the config file. It can't be set in the config file itself.
+const configFileFlag = "config"
+
+// Config is the content of the config file. Every field corresponds to the flag of the same name, see its usage for
+// documentation. Unset fields keep the flag's value. Flags that can be specified multiple times are lists, durations
+// use Go duration strings, and sizes are quantities.
+type Config struct {
+	MetricsAddr                         *string            `json:"metrics-bind-address,omitempty"`
+	ProbeAddr                           *string            `json:"health-probe-bind-address,omitempty"`
+	EnableLeaderElection                *bool              `json:"leader-elect,omitempty"`
+	BackupRegistry                      *string            `json:"backup-registry,omitempty"`
+	AllowPublicBackup                   *bool              `json:"allow-public-backup,omitempty"`
+	EnableDeployments                   *bool              `json:"enable-deployment-controller,omitempty"`
+	EnableDaemonSets                    *bool              `json:"enable-daemonset-controller,omitempty"`
+	CleanupOnDelete                     *bool              `json:"cleanup-on-delete,omitempty"`
+	SkipStartupChecks                   *bool              `json:"skip-startup-checks,omitempty"`
+	StartupCheckPush                    *bool              `json:"startup-check-push,omitempty"`
+	CopyProgressInterval                *metav1.Duration   `json:"copy-progress-interval,omitempty"`
+	CopyProgressBytes                   *resource.Quantity `json:"copy-progress-bytes,omitempty"`
+	CopyStallTimeout                    *metav1.Duration   `json:"copy-stall-timeout,omitempty"`
+	StorageFullProbeInterval            *metav1.Duration   `json:"storage-full-probe-interval,omitempty"`
+	RegistryHostRewrites                []string           `json:"registry-host-rewrite,omitempty"`
+	SourceNotFoundGracePeriod           *metav1.Duration   `json:"source-not-found-grace-period,omitempty"`
+	SourceNotFoundRetryInterval         *metav1.Duration   `json:"source-not-found-retry-interval,omitempty"`
+	RepositoryMappings                  []string           `json:"repository-mapping,omitempty"`
+	RequirePlatforms                    []string           `json:"require-platforms,omitempty"`
+	WatchNamespaces                     []string           `json:"watch-namespaces,omitempty"`
+	NamespacedRBAC                      *bool              `json:"namespaced-rbac,omitempty"`
+	AnnotatedEvents                     *bool              `json:"annotated-events,omitempty"`
+	NamespaceSummaryEvents              *bool              `json:"namespace-summary-events,omitempty"`
+	EnforcePlatforms                    *bool              `json:"enforce-platforms,omitempty"`
+	PreviousBackupRegistries            []string           `json:"previous-backup-registries,omitempty"`
+	EnableDebugEndpoint                 *bool              `json:"enable-debug-endpoint,omitempty"`
+	DebugEndpointToken                  *string            `json:"debug-endpoint-token,omitempty"`
+	AsyncCopies                         *bool              `json:"async-copies,omitempty"`
+	CopyPendingRequeueInterval          *metav1.Duration   `json:"copy-pending-requeue-interval,omitempty"`
+	ValidateBackupReferences            *bool              `json:"validate-backup-references,omitempty"`
+	HealBackupReferences                *bool              `json:"heal-backup-references,omitempty"`
+	ReconcileTimeout                    *metav1.Duration   `json:"reconcile-timeout,omitempty"`
+	FailureAnnotation                   *bool              `json:"failure-annotation,omitempty"`
+	FailureAnnotationThreshold          *metav1.Duration   `json:"failure-annotation-threshold,omitempty"`
+	RegistryClientCerts                 []string           `json:"registry-client-cert,omitempty"`
+	RewriteEphemeralContainers          *bool              `json:"rewrite-ephemeral-containers,omitempty"`
+	NotifyURL                           *string            `json:"notify-url,omitempty"`
+	SourceCredentials                   []string           `json:"source-credentials,omitempty"`
+	PatchStrategy                       *string            `json:"patch-strategy,omitempty"`
+	DigestTagStyle                      *string            `json:"digest-tag-style,omitempty"`
+	ReplicatePullSecret                 *string            `json:"replicate-pull-secret,omitempty"`
+	ReplicatePullSecretCascadeDelete    *bool              `json:"replicate-pull-secret-cascade-delete,omitempty"`
+	CopyReferrers                       *bool              `json:"copy-referrers,omitempty"`
+	UserAgentPrefix                     *string            `json:"user-agent-prefix,omitempty"`
+	CopyParentIndex                     *bool              `json:"copy-parent-index,omitempty"`
+	DenylistedDigestsFile               *string            `json:"denylisted-digests-file,omitempty"`
+	MirrorProhibitedFile                *string            `json:"mirror-prohibited-file,omitempty"`
+	MaxImageSize                        *resource.Quantity `json:"max-image-size,omitempty"`
+	MaxCopyBytesPerHour                 *resource.Quantity `json:"max-copy-bytes-per-hour,omitempty"`
+	ReservedInteractiveCopyBytesPerHour *resource.Quantity `json:"reserved-interactive-copy-bytes-per-hour,omitempty"`
+	MaxConcurrentCopies                 *int               `json:"max-concurrent-copies,omitempty"`
+	ReservedInteractiveCopies           *int               `json:"reserved-interactive-copies,omitempty"`
+	RegistryConcurrency                 []string           `json:"per-registry-concurrency,omitempty"`
+	RegistryCheckConcurrency            []string           `json:"per-registry-check-concurrency,omitempty"`
+	RewriteLoopThreshold                *int               `json:"rewrite-loop-threshold,omitempty"`
+	RewriteLoopWindow                   *metav1.Duration   `json:"rewrite-loop-window,omitempty"`
+	RewriteDecisionTTL                  *metav1.Duration   `json:"rewrite-decision-ttl,omitempty"`
+	ForceSyncRetention                  *metav1.Duration   `json:"force-sync-retention,omitempty"`
+	SetPullPolicy                       []string           `json:"set-pull-policy,omitempty"`
+	ExcludeImages                       []string           `json:"exclude-images,omitempty"`
+	SkipProviderImages                  *bool              `json:"skip-provider-images,omitempty"`
+	RespectFieldManagers                []string           `json:"respect-field-managers,omitempty"`
+	MirrorAnnotatedArtifacts            []string           `json:"mirror-annotated-artifacts,omitempty"`
+	PreserveShortNames                  *bool              `json:"preserve-short-names,omitempty"`
+	WaitForRollout                      *bool              `json:"wait-for-rollout,omitempty"`
+	WaitForRolloutTimeout               *metav1.Duration   `json:"wait-for-rollout-timeout,omitempty"`
+	PatchWindows                        []string           `json:"patch-window,omitempty"`
+	BusyMarkers                         []string           `json:"busy-marker,omitempty"`
+	BusyMarkerMaxDelay                  *metav1.Duration   `json:"busy-marker-max-delay,omitempty"`
+	RequirePullAccess                   *bool              `json:"require-pull-access,omitempty"`
+	NodePullCredentials                 *bool              `json:"node-pull-credentials,omitempty"`
+	ResyncSpread                        *metav1.Duration   `json:"resync-spread,omitempty"`
+	CacheResyncPeriod                   *metav1.Duration   `json:"cache-resync-period,omitempty"`
+	Offline                             *bool              `json:"offline,omitempty"`
+	OfflineRequeueInterval              *metav1.Duration   `json:"offline-requeue-interval,omitempty"`
+	RetryBudget                         *int               `json:"retry-budget,omitempty"`
+	RetryBudgetRequeueInterval          *metav1.Duration   `json:"retry-budget-requeue-interval,omitempty"`
+	RewriteOnlyPreapproved              *bool              `json:"rewrite-only-preapproved,omitempty"`
+	PreapprovalVerifyDigests            *bool              `json:"preapproval-verify-digests,omitempty"`
+	PreapprovalRequeueInterval          *metav1.Duration   `json:"preapproval-requeue-interval,omitempty"`
+	StrictDigestConsistency             *bool              `json:"strict-digest-consistency,omitempty"`
+	DropImageUnchangedUpdates           *bool              `json:"drop-image-unchanged-updates,omitempty"`
+	MaxPatchesPerMinute                 *int               `json:"max-patches-per-minute,omitempty"`
+	MaxPatchesPerMinutePerNamespace     *int               `json:"max-patches-per-minute-per-namespace,omitempty"`
+	ShardCount                          *int               `json:"shard-count,omitempty"`
+	ShardIndex                          *int               `json:"shard-index,omitempty"`
+	ForceBlobDownloadsViaRegistry       *bool              `json:"force-blob-downloads-via-registry,omitempty"`
+	BlobRedirectRequeueInterval         *metav1.Duration   `json:"blob-redirect-requeue-interval,omitempty"`
+	CopyHistoryConfigMap                *string            `json:"copy-history-configmap,omitempty"`
+	PendingJournalConfigMap             *string            `json:"pending-journal-configmap,omitempty"`
+	StatusConfigMap                     *string            `json:"status-configmap,omitempty"`
+	StatusUpdateInterval                *metav1.Duration   `json:"status-update-interval,omitempty"`
+	CoverageInterval                    *metav1.Duration   `json:"coverage-interval,omitempty"`
+	CoverageNamespaceLimit              *int               `json:"coverage-namespace-limit,omitempty"`
+	ReadyWithoutSync                    *bool              `json:"ready-without-sync,omitempty"`
+	InitialSyncThreshold                *int               `json:"initial-sync-threshold,omitempty"`
+	Dedupe                              *bool              `json:"dedupe,omitempty"`
+	DedupeDryRun                        *bool              `json:"dedupe-dry-run,omitempty"`
+	DedupeDelete                        *bool              `json:"dedupe-delete,omitempty"`
+	DedupeChunkSize                     *int64             `json:"dedupe-chunk-size,omitempty"`
+	ExportMapping                       *string            `json:"export-mapping,omitempty"`
+	Kubeconfig                          *string            `json:"kubeconfig,omitempty"`
+	ZapDevel                            *bool              `json:"zap-devel,omitempty"`
+	ZapEncoder                          *string            `json:"zap-encoder,omitempty"`
+	ZapLogLevel                         *string            `json:"zap-log-level,omitempty"`
+	ZapStacktraceLevel                  *string            `json:"zap-stacktrace-level,omitempty"`
+	ZapTimeEncoding                     *string            `json:"zap-time-encoding,omitempty"`
+}
+
+// loadConfigFile reads the given YAML file into a Config. Unknown fields and values of the wrong type are rejected to
+// catch typos early.
+func loadConfigFile(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading config file: %w", err)
+	}
+
+	config := &Config{}
+	if err := yaml.UnmarshalStrict(data, config); err != nil {
+		return nil, fmt.Errorf("failed parsing config file %q: %w", path, err)
+	}
+	return config, nil
+}
+
+// applyConfigFile sets the flags of the given flag set from the given YAML file, see Config. Flags that have been set
+// explicitly on the command line take precedence over the file.
+func applyConfigFile(fs *flag.FlagSet, path string) error {
+	config, err := loadConfigFile(path)
+	if err != nil {
+		return err
+	}
+
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	for name, values := range config.flagValues() {
+		if fs.Lookup(name) == nil {
+			return fmt.Errorf("config file field %q doesn't correspond to a flag", name)
+		}
+		if explicit[name] {
+			continue
+		}
+
+		for _, value := range values {
+			if err := fs.Set(name, value); err != nil {
+				return fmt.Errorf("invalid value for %q in config file %q: %w", name, path, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// flagValues returns the values of all fields that are set in the config file keyed by the corresponding flag names.
+func (c *Config) flagValues() map[string][]string {
+	values := make(map[string][]string)
+
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		if field.IsNil() {
+			continue
+		}
+		name := strings.Split(v.Type().Field(i).Tag.Get("json"), ",")[0]
+
+		switch value := field.Interface().(type) {
+		case []string:
+			values[name] = value
+		case *metav1.Duration:
+			values[name] = []string{value.Duration.String()}
+		case *resource.Quantity:
+			values[name] = []string{value.String()}
+		default:
+			values[name] = []string{fmt.Sprint(field.Elem().Interface())}
+		}
+	}
+
+	return values
+}
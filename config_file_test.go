@@ -0,0 +1,205 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"sigs.k8s.io/yaml"
+)
+
+func TestConfigFileRoundTrip(t *testing.T) {
+	for _, path := range []string{"testdata/config.yaml", "example/config.yaml"} {
+		t.Run(path, func(t *testing.T) {
+			config, err := loadConfigFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := yaml.Marshal(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded := &Config{}
+			if err := yaml.UnmarshalStrict(data, decoded); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(config, decoded) {
+				t.Errorf("config changed during round trip:\n%s", data)
+			}
+			if !reflect.DeepEqual(config.flagValues(), decoded.flagValues()) {
+				t.Errorf("flag values changed during round trip: %v, want %v", decoded.flagValues(), config.flagValues())
+			}
+		})
+	}
+}
+
+func TestConfigFileFlagValues(t *testing.T) {
+	config, err := loadConfigFile("testdata/config.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string][]string{
+		"backup-registry":             {"registry.example.com"},
+		"enable-daemonset-controller": {"true"},
+		"cleanup-on-delete":           {"false"},
+		"copy-progress-interval":      {"30s"},
+		"reconcile-timeout":           {"30m0s"},
+		"max-image-size":              {"10Gi"},
+		"copy-progress-bytes":         {"0"},
+		"max-concurrent-copies":       {"10"},
+		"dedupe-chunk-size":           {"500"},
+		"registry-host-rewrite": {
+			"localhost:5001=http://registry.registry.svc.cluster.local:5001",
+			"localhost:5002=http://registry.registry.svc.cluster.local:5002",
+		},
+		"patch-window":   {"Mon-Fri 22:00-06:00 Europe/Berlin"},
+		"patch-strategy": {"ssa"},
+		"zap-log-level":  {"debug"},
+	}
+	if got := config.flagValues(); !reflect.DeepEqual(got, want) {
+		t.Errorf("flag values = %v, want %v", got, want)
+	}
+}
+
+func TestApplyConfigFile(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	backupRegistry := fs.String("backup-registry", "", "")
+	enableDaemonSets := fs.Bool("enable-daemonset-controller", false, "")
+	fs.Bool("cleanup-on-delete", false, "")
+	copyProgressInterval := fs.Duration("copy-progress-interval", time.Minute, "")
+	fs.Duration("reconcile-timeout", time.Minute, "")
+	fs.String("max-image-size", "", "")
+	fs.String("copy-progress-bytes", "", "")
+	maxConcurrentCopies := fs.Int("max-concurrent-copies", 0, "")
+	fs.Int64("dedupe-chunk-size", 0, "")
+	var registryHostRewrites stringSliceFlag
+	fs.Var(&registryHostRewrites, "registry-host-rewrite", "")
+	var patchWindows stringArrayFlag
+	fs.Var(&patchWindows, "patch-window", "")
+	patchStrategy := fs.String("patch-strategy", "", "")
+	fs.String("zap-log-level", "", "")
+
+	// explicit flags take precedence over the file
+	if err := fs.Parse([]string{"--patch-strategy=json", "--copy-progress-interval=5s"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyConfigFile(fs, "testdata/config.yaml"); err != nil {
+		t.Fatal(err)
+	}
+
+	if *backupRegistry != "registry.example.com" || !*enableDaemonSets || *maxConcurrentCopies != 10 {
+		t.Errorf("flags weren't set from the file: backup-registry=%s enable-daemonset-controller=%t max-concurrent-copies=%d",
+			*backupRegistry, *enableDaemonSets, *maxConcurrentCopies)
+	}
+	if len(registryHostRewrites) != 2 || len(patchWindows) != 1 || patchWindows[0] != "Mon-Fri 22:00-06:00 Europe/Berlin" {
+		t.Errorf("lists weren't set from the file: registry-host-rewrite=%v patch-window=%v", registryHostRewrites, patchWindows)
+	}
+	if *patchStrategy != "json" || *copyProgressInterval != 5*time.Second {
+		t.Errorf("explicit flags were overwritten: patch-strategy=%s copy-progress-interval=%s", *patchStrategy, *copyProgressInterval)
+	}
+
+	// fields without a corresponding flag are programming errors
+	if err := applyConfigFile(flag.NewFlagSet("empty", flag.ContinueOnError), "testdata/config.yaml"); err == nil {
+		t.Error("expected an error for fields without a flag")
+	}
+}
+
+func TestConfigFileStrict(t *testing.T) {
+	for name, content := range map[string]string{
+		"unknown field":      "backup-regsitry: registry.example.com\n",
+		"config file flag":   "config: other.yaml\n",
+		"boolean as string":  "cleanup-on-delete: \"yes\"\n",
+		"invalid duration":   "copy-progress-interval: 30\n",
+		"invalid quantity":   "max-image-size: ten gigabytes\n",
+		"string as list":     "registry-host-rewrite: localhost:5001=http://registry:5001\n",
+		"integer as string":  "max-concurrent-copies: ten\n",
+		"duplicate field":    "backup-registry: a.example.com\nbackup-registry: b.example.com\n",
+		"non-object content": "- backup-registry\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := loadConfigFile(path); err == nil {
+				t.Errorf("expected an error for %q", content)
+			}
+		})
+	}
+}
+
+// TestConfigCoversFlags verifies that every flag registered in main.go can be set in the config file.
+func TestConfigCoversFlags(t *testing.T) {
+	file, err := parser.ParseFile(token.NewFileSet(), "main.go", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	flags := map[string]bool{}
+	ast.Inspect(file, func(n ast.Node) bool {
+		call, ok := n.(*ast.CallExpr)
+		if !ok || len(call.Args) < 2 {
+			return true
+		}
+		sel, ok := call.Fun.(*ast.SelectorExpr)
+		if !ok || !strings.HasSuffix(sel.Sel.Name, "Var") {
+			return true
+		}
+		if pkg, ok := sel.X.(*ast.Ident); !ok || pkg.Name != "flag" {
+			return true
+		}
+		if lit, ok := call.Args[1].(*ast.BasicLit); ok && lit.Kind == token.STRING {
+			name, err := strconv.Unquote(lit.Value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			flags[name] = true
+		}
+		return true
+	})
+	if len(flags) == 0 {
+		t.Fatal("didn't find any flags in main.go")
+	}
+
+	// flags registered by controller-runtime
+	fields := map[string]bool{"kubeconfig": true, "zap-devel": true, "zap-encoder": true, "zap-log-level": true, "zap-stacktrace-level": true, "zap-time-encoding": true}
+	configType := reflect.TypeOf(Config{})
+	for i := 0; i < configType.NumField(); i++ {
+		name := strings.Split(configType.Field(i).Tag.Get("json"), ",")[0]
+		if !flags[name] && !fields[name] {
+			t.Errorf("config field %s doesn't correspond to a flag", configType.Field(i).Name)
+		}
+		fields[name] = true
+	}
+	for name := range flags {
+		if !fields[name] {
+			t.Errorf("flag %q can't be set in the config file", name)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"github.com/google/go-containerregistry/pkg/name"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/timebertt/image-clone-controller/pkg/copier"
+	"github.com/timebertt/image-clone-controller/pkg/naming"
+)
+
+// ValidateArtifactAnnotations verifies that the given annotation keys of MirrorAnnotatedArtifacts are valid.
+func ValidateArtifactAnnotations(keys []string) error {
+	for _, key := range keys {
+		if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+			return fmt.Errorf("invalid annotation key %q: %s", key, strings.Join(errs, ", "))
+		}
+	}
+	return nil
+}
+
+// parseArtifactReference parses the value of an annotation of MirrorAnnotatedArtifacts, e.g.,
+// oci://ghcr.io/example/charts/app:1.2.3 as used by Helm. The reference must specify a tag or digest explicitly, as
+// artifacts like Helm charts usually don't have a latest tag.
+func parseArtifactReference(value string) (name.Reference, error) {
+	ref, err := name.ParseReference(strings.TrimPrefix(strings.TrimSpace(value), "oci://"), name.StrictValidation)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OCI reference %q: %w", value, err)
+	}
+	return ref, nil
+}
+
+// mirrorAnnotatedArtifacts copies the OCI artifacts (e.g., Helm charts) referenced by the MirrorAnnotatedArtifacts
+// annotations of the given workload to the backup registry using the same naming scheme as images. The annotations are
+// never modified. Failures are reported as warning events, but don't block reconciling the workload's images.
+// Artifacts that have been mirrored for the workload already are not checked again until their destination changes.
+func (c *ImageCloneController) mirrorAnnotatedArtifacts(ctx context.Context, log logr.Logger, obj client.Object, backupRegistry name.Registry, prefix string) {
+	if !c.contactsSourceRegistries() {
+		// artifacts can't be copied without contacting their source registries
+		return
+	}
+
+	for _, key := range c.MirrorAnnotatedArtifacts {
+		value, ok := obj.GetAnnotations()[key]
+		if !ok {
+			continue
+		}
+		artifactLog := log.WithValues("annotation", key, "artifact", value)
+
+		if err := c.mirrorArtifact(ctx, artifactLog, obj, key, value, backupRegistry, prefix); err != nil {
+			artifactLog.Error(err, "Failed mirroring annotated artifact")
+			annotatedArtifactsTotal.WithLabelValues("failed").Inc()
+			c.event(obj, corev1.EventTypeWarning, ReasonFailedMirroringArtifact, "Failed mirroring annotated artifact to the backup registry",
+				eventKeyAnnotation, key, eventKeySource, value, eventKeyError, err.Error())
+		}
+	}
+}
+
+func (c *ImageCloneController) mirrorArtifact(ctx context.Context, log logr.Logger, obj client.Object, key, value string, backupRegistry name.Registry, prefix string) error {
+	src, err := parseArtifactReference(value)
+	if err != nil {
+		return err
+	}
+	if naming.SameRegistry(src.Context().Registry, backupRegistry) || c.isExcluded(src) {
+		log.V(1).Info("Annotated artifact is already in the backup registry or excluded, skipping it")
+		return nil
+	}
+	if pattern, prohibited, err := c.mirrorProhibited(src); err != nil {
+		return err
+	} else if prohibited {
+		log.V(1).Info("Mirroring annotated artifact is prohibited, skipping it", "pattern", pattern)
+		return nil
+	}
+
+	dst, err := c.destinationImage(src, backupRegistry, prefix)
+	if err != nil {
+		return fmt.Errorf("failed rewriting artifact %q: %w", src.Name(), err)
+	}
+
+	mirroredKey := string(obj.GetUID()) + "/" + key
+	if mirrored, ok := c.mirroredArtifacts.Load(mirroredKey); ok && mirrored.(string) == dst.Name() {
+		return nil
+	}
+
+	log = log.WithValues("destination", dst.Name())
+	// the workload's pods don't reference the artifact, don't delay copies of its images
+	copied, err := c.Copier.Copy(copier.WithPriority(ctx, copier.PriorityBackground), log, src, dst)
+	if copier.IsEgressBudgetExhausted(err) {
+		// not a failure, the artifact is mirrored in one of the next reconciliations
+		log.V(1).Info("Deferring copy of annotated artifact until the egress budget allows it", "error", err.Error())
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error copying artifact %q to %q: %w", src.Name(), dst.Name(), err)
+	}
+	c.mirroredArtifacts.Store(mirroredKey, dst.Name())
+
+	if !copied {
+		annotatedArtifactsTotal.WithLabelValues("existing").Inc()
+		return nil
+	}
+	log.Info("Mirrored annotated artifact to the backup registry")
+	annotatedArtifactsTotal.WithLabelValues("copied").Inc()
+	c.event(obj, corev1.EventTypeNormal, ReasonArtifactMirrored, "Mirrored annotated artifact to the backup registry",
+		eventKeyAnnotation, key, eventKeySource, src.String(), eventKeyDestination, dst.Name())
+	return nil
+}
@@ -0,0 +1,100 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/timebertt/image-clone-controller/pkg/test"
+)
+
+const chartAnnotation = "meta.helm.sh/oci-chart"
+
+func TestMirrorAnnotatedArtifacts(t *testing.T) {
+	upstream, backup := newTestRegistry(t), newTestRegistry(t)
+	if _, err := upstream.SeedImage("charts/app:1.2.3", 1); err != nil {
+		t.Fatal(err)
+	}
+	chart := "oci://" + upstream.Registry.RegistryStr() + "/charts/app:1.2.3"
+
+	deployment := test.NewDeployment("default", "app", "nginx:1.23")
+	deployment.Annotations = map[string]string{chartAnnotation: chart}
+	other := test.NewDeployment("default", "other", "nginx:1.23")
+	other.Annotations = map[string]string{chartAnnotation: chart}
+	c := newTestController(t, deployment, other)
+	c.BackupRegistry = backup.Registry
+	c.MirrorAnnotatedArtifacts = []string{chartAnnotation}
+	recorder := c.Recorder.(*record.FakeRecorder)
+	ctx := context.Background()
+
+	c.mirrorAnnotatedArtifacts(ctx, logr.Discard(), deployment, c.BackupRegistry, "")
+	src, err := parseArtifactReference(chart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst, err := c.destinationImage(src, c.BackupRegistry, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := remote.Head(dst); err != nil {
+		t.Fatalf("artifact was not mirrored to %s: %v", dst, err)
+	}
+	if e := <-recorder.Events; !strings.Contains(e, ReasonArtifactMirrored) {
+		t.Errorf("event %q, want %s", e, ReasonArtifactMirrored)
+	}
+	if deployment.Annotations[chartAnnotation] != chart {
+		t.Errorf("annotation was changed to %q", deployment.Annotations[chartAnnotation])
+	}
+
+	// mirrored artifacts are not checked again
+	c.mirrorAnnotatedArtifacts(ctx, logr.Discard(), deployment, c.BackupRegistry, "")
+	c.mirrorAnnotatedArtifacts(ctx, logr.Discard(), other, c.BackupRegistry, "")
+	if _, ok := c.mirroredArtifacts.Load(string(deployment.UID) + "/" + chartAnnotation); !ok {
+		t.Fatal("mirrored artifact was not recorded")
+	}
+	if len(recorder.Events) != 0 {
+		t.Errorf("unexpected event %q for mirrored artifact", <-recorder.Events)
+	}
+
+	// the state of deleted workloads is dropped
+	c.forgetWorkload(deployment.UID)
+	if _, ok := c.mirroredArtifacts.Load(string(deployment.UID) + "/" + chartAnnotation); ok {
+		t.Error("mirrored artifact of deleted workload was kept")
+	}
+	if _, ok := c.mirroredArtifacts.Load(string(other.UID) + "/" + chartAnnotation); !ok {
+		t.Error("mirrored artifact of other workload was dropped")
+	}
+
+	t.Run("invalid reference", func(t *testing.T) {
+		deployment.Annotations[chartAnnotation] = "oci://ghcr.io/example/charts/app"
+		c.mirrorAnnotatedArtifacts(ctx, logr.Discard(), deployment, c.BackupRegistry, "")
+		select {
+		case e := <-recorder.Events:
+			if !strings.Contains(e, ReasonFailedMirroringArtifact) {
+				t.Errorf("event %q, want %s", e, ReasonFailedMirroringArtifact)
+			}
+		default:
+			t.Errorf("no %s event was emitted", ReasonFailedMirroringArtifact)
+		}
+	})
+}
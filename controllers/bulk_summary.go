@@ -0,0 +1,295 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+const (
+	// initialSyncPass is the ID of the bulk pass of the initial sync after startup.
+	initialSyncPass = "initial-sync"
+	// bulkPassFlushTimeout is the time after enqueueing all workloads of a bulk pass after which its summaries are
+	// emitted, even if not all workloads have been reconciled, e.g., because they are filtered.
+	bulkPassFlushTimeout = 30 * time.Minute
+	// maxSummaryFailures is the number of failed workloads that are listed in a summary event.
+	maxSummaryFailures = 5
+)
+
+// namespaceSummary aggregates the results of a bulk pass in one namespace.
+type namespaceSummary struct {
+	processed int
+	// failures maps the failed workloads (kind/name) to the reason of their first warning event
+	failures map[string]string
+}
+
+// bulkPass is a pass over many workloads, e.g., the initial sync or a full resync.
+type bulkPass struct {
+	id          string
+	description string
+	// pending are the workloads of the pass that have not been reconciled yet by kind and key
+	pending map[string]struct{}
+	// enqueued is true once all workloads of the pass have been enqueued
+	enqueued   bool
+	namespaces map[string]*namespaceSummary
+}
+
+// bulkPasses aggregates the results of bulk passes per namespace and emits one summary event per namespace on the
+// Namespace object when a pass completes, instead of one event per workload. While a workload belongs to a pass, its
+// Normal events are suppressed. Warning events are still emitted individually and listed in the summary.
+type bulkPasses struct {
+	emit func(obj runtime.Object, eventType, reason, summary string, keysAndValues ...string)
+
+	lock   sync.Mutex
+	passes map[string]*bulkPass
+	// members maps the workloads by kind and key to the pass they belong to
+	members map[string]*bulkPass
+}
+
+func newBulkPasses(emit func(obj runtime.Object, eventType, reason, summary string, keysAndValues ...string)) *bulkPasses {
+	return &bulkPasses{
+		emit:    emit,
+		passes:  make(map[string]*bulkPass),
+		members: make(map[string]*bulkPass),
+	}
+}
+
+func bulkPassKey(kind string, key types.NamespacedName) string {
+	return kind + "/" + key.String()
+}
+
+// start starts a bulk pass with the given ID over the given workloads (see bulkPassKey). Workloads that already belong
+// to another pass stay in that pass. A running pass with the same ID is flushed first.
+func (b *bulkPasses) start(id, description string, keys []string) {
+	if b == nil {
+		return
+	}
+	b.finish(id)
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	pass := &bulkPass{id: id, description: description, pending: make(map[string]struct{}, len(keys)), namespaces: make(map[string]*namespaceSummary)}
+	for _, key := range keys {
+		if _, ok := b.members[key]; ok {
+			continue
+		}
+		b.members[key] = pass
+		pass.pending[key] = struct{}{}
+	}
+	b.passes[id] = pass
+}
+
+// allEnqueued marks that all workloads of the given pass have been enqueued. The pass is flushed once all of them are
+// reconciled.
+func (b *bulkPasses) allEnqueued(id string) {
+	if b == nil {
+		return
+	}
+
+	b.lock.Lock()
+	pass, ok := b.passes[id]
+	if !ok {
+		b.lock.Unlock()
+		return
+	}
+	pass.enqueued = true
+	flush := len(pass.pending) == 0
+	b.lock.Unlock()
+
+	if flush {
+		b.finish(id)
+	}
+}
+
+// suppress checks whether the Normal events of the given object are suppressed, as it belongs to a running pass.
+func (b *bulkPasses) suppress(obj runtime.Object) bool {
+	if b == nil {
+		return false
+	}
+	workload, ok := obj.(client.Object)
+	if !ok {
+		return false
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	_, ok = b.members[bulkPassKey(kindOf(workload), client.ObjectKeyFromObject(workload))]
+	return ok
+}
+
+// warned records a warning event of the given object for the summary of its pass.
+func (b *bulkPasses) warned(obj runtime.Object, reason string) {
+	if b == nil {
+		return
+	}
+	workload, ok := obj.(client.Object)
+	if !ok {
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if pass, ok := b.members[bulkPassKey(kindOf(workload), client.ObjectKeyFromObject(workload))]; ok {
+		pass.fail(kindOf(workload), client.ObjectKeyFromObject(workload), reason)
+	}
+}
+
+// done records that the given workload has been reconciled. If it is the last pending workload of its pass, the pass
+// is flushed.
+func (b *bulkPasses) done(kind string, key types.NamespacedName, err error) {
+	if b == nil {
+		return
+	}
+
+	b.lock.Lock()
+	pass, ok := b.members[bulkPassKey(kind, key)]
+	if !ok {
+		b.lock.Unlock()
+		return
+	}
+	if err != nil {
+		pass.fail(kind, key, "Error")
+	}
+	pass.namespace(key.Namespace).processed++
+	delete(pass.pending, bulkPassKey(kind, key))
+	delete(b.members, bulkPassKey(kind, key))
+	flush := pass.enqueued && len(pass.pending) == 0
+	b.lock.Unlock()
+
+	if flush {
+		b.finish(pass.id)
+	}
+}
+
+// track returns a reconciler recording all workloads reconciled by the given reconciler as done.
+func (b *bulkPasses) track(kind string, r reconcile.Func) reconcile.Func {
+	if b == nil {
+		return r
+	}
+	return func(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
+		result, err := r(ctx, req)
+		b.done(kind, req.NamespacedName, err)
+		return result, err
+	}
+}
+
+// finishAfter flushes the given pass after the given timeout, unless it has been flushed already.
+func (b *bulkPasses) finishAfter(id string, timeout time.Duration) {
+	if b == nil {
+		return
+	}
+
+	b.lock.Lock()
+	pass := b.passes[id]
+	b.lock.Unlock()
+
+	time.AfterFunc(timeout, func() {
+		b.lock.Lock()
+		current := b.passes[id]
+		b.lock.Unlock()
+		if current == pass {
+			b.finish(id)
+		}
+	})
+}
+
+// finish ends the given pass and emits its summaries. Workloads that have not been reconciled yet are removed from the
+// pass, so that they emit their events individually.
+func (b *bulkPasses) finish(id string) {
+	if b == nil {
+		return
+	}
+
+	b.lock.Lock()
+	pass, ok := b.passes[id]
+	if !ok {
+		b.lock.Unlock()
+		return
+	}
+	delete(b.passes, id)
+	for key := range pass.pending {
+		delete(b.members, key)
+	}
+	b.lock.Unlock()
+
+	// emit outside of the lock, as emitting checks whether the events are suppressed
+	namespaces := make([]string, 0, len(pass.namespaces))
+	for namespace := range pass.namespaces {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+	for _, namespace := range namespaces {
+		pass.emitSummary(b.emit, namespace)
+	}
+}
+
+// namespace returns the summary of the given namespace. The lock of the bulkPasses must be held.
+func (p *bulkPass) namespace(namespace string) *namespaceSummary {
+	summary, ok := p.namespaces[namespace]
+	if !ok {
+		summary = &namespaceSummary{failures: make(map[string]string)}
+		p.namespaces[namespace] = summary
+	}
+	return summary
+}
+
+// fail records a failure of the given workload. Only the first failure reason is kept. The lock of the bulkPasses must
+// be held.
+func (p *bulkPass) fail(kind string, key types.NamespacedName, reason string) {
+	failures := p.namespace(key.Namespace).failures
+	if _, ok := failures[kind+"/"+key.Name]; !ok {
+		failures[kind+"/"+key.Name] = reason
+	}
+}
+
+func (p *bulkPass) emitSummary(emit func(obj runtime.Object, eventType, reason, summary string, keysAndValues ...string), namespace string) {
+	summary := p.namespaces[namespace]
+	namespaceObj := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: namespace}}
+
+	if len(summary.failures) == 0 {
+		emit(namespaceObj, corev1.EventTypeNormal, ReasonBulkPassSummary, fmt.Sprintf("Finished %s of workloads", p.description),
+			eventKeyPass, p.id, eventKeyWorkloads, strconv.Itoa(summary.processed), eventKeyFailures, "0")
+		return
+	}
+
+	failed := make([]string, 0, len(summary.failures))
+	for workload, reason := range summary.failures {
+		failed = append(failed, fmt.Sprintf("%s (%s)", workload, reason))
+	}
+	sort.Strings(failed)
+	if len(failed) > maxSummaryFailures {
+		failed = append(failed[:maxSummaryFailures], fmt.Sprintf("and %d more", len(failed)-maxSummaryFailures))
+	}
+
+	emit(namespaceObj, corev1.EventTypeWarning, ReasonBulkPassSummary, fmt.Sprintf("Finished %s of workloads with failures", p.description),
+		eventKeyPass, p.id, eventKeyWorkloads, strconv.Itoa(summary.processed), eventKeyFailures, strconv.Itoa(len(summary.failures)),
+		eventKeyFailed, strings.Join(failed, ", "))
+}
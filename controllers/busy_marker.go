@@ -0,0 +1,194 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// BusyMaxDelayAnnotation can be set on workloads to override BusyMarkerMaxDelay, e.g., for workloads whose mutators
+// take longer. The value is a duration, 0 disables deferring patches of the workload because of busy markers.
+const BusyMaxDelayAnnotation = "image-clone.timebertt.dev/busy-max-delay"
+
+// busyMarkerRequeueInterval is the interval for checking again whether the busy markers of a workload have cleared.
+// Annotation changes trigger reconciliations, but status changes don't, so we need to poll.
+const busyMarkerRequeueInterval = 15 * time.Second
+
+const (
+	busyMarkerTypeAnnotation = "annotation"
+	busyMarkerTypeCondition  = "condition"
+)
+
+var patchesDeferredByBusyMarkerTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "patches_deferred_by_busy_marker_total",
+	Help:      "Total number of patches per workload kind and busy marker that were deferred because another mutator was updating the workload.",
+}, []string{"kind", "marker"})
+
+func init() {
+	metrics.Registry.MustRegister(patchesDeferredByBusyMarkerTotal)
+}
+
+// BusyMarker indicates that another mutator (e.g., the updater of a VerticalPodAutoscaler) is in the middle of updating
+// a workload. Patching the workload at the same time amplifies disruptions and causes conflict loops.
+type BusyMarker struct {
+	spec string
+	// markerType is either busyMarkerTypeAnnotation or busyMarkerTypeCondition
+	markerType string
+	// key is the annotation key or condition type
+	key string
+	// value is the annotation value or condition status that marks the workload as busy. Any value of the annotation
+	// marks the workload as busy if it is empty.
+	value string
+}
+
+func (m BusyMarker) String() string {
+	return m.spec
+}
+
+// ParseBusyMarker parses a marker in the form annotation:<key>[=<value>] or condition:<type>[=<status>], e.g.,
+// annotation:example.com/resizing=true. Conditions mark the workload as busy if they have the given status, which
+// defaults to True.
+func ParseBusyMarker(spec string) (BusyMarker, error) {
+	markerType, rest, ok := strings.Cut(spec, ":")
+	if !ok || (markerType != busyMarkerTypeAnnotation && markerType != busyMarkerTypeCondition) {
+		return BusyMarker{}, fmt.Errorf("invalid busy marker %q, expected annotation:<key>[=<value>] or condition:<type>[=<status>]", spec)
+	}
+
+	key, value, _ := strings.Cut(rest, "=")
+	if key == "" {
+		return BusyMarker{}, fmt.Errorf("invalid busy marker %q, %s must not be empty", spec, markerType)
+	}
+	if markerType == busyMarkerTypeCondition {
+		switch corev1.ConditionStatus(value) {
+		case "":
+			value = string(corev1.ConditionTrue)
+		case corev1.ConditionTrue, corev1.ConditionFalse, corev1.ConditionUnknown:
+		default:
+			return BusyMarker{}, fmt.Errorf("invalid status in busy marker %q, supported: [True False Unknown]", spec)
+		}
+	}
+
+	return BusyMarker{spec: spec, markerType: markerType, key: key, value: value}, nil
+}
+
+// ParseBusyMarkers parses the given markers, see ParseBusyMarker.
+func ParseBusyMarkers(values []string) ([]BusyMarker, error) {
+	markers := make([]BusyMarker, 0, len(values))
+	for _, value := range values {
+		marker, err := ParseBusyMarker(value)
+		if err != nil {
+			return nil, err
+		}
+		markers = append(markers, marker)
+	}
+	return markers, nil
+}
+
+// present checks whether the marker is present on the given workload.
+func (m BusyMarker) present(obj client.Object) bool {
+	if m.markerType == busyMarkerTypeAnnotation {
+		value, ok := obj.GetAnnotations()[m.key]
+		return ok && (m.value == "" || value == m.value)
+	}
+
+	status, ok := workloadConditions(obj)[m.key]
+	return ok && string(status) == m.value
+}
+
+// workloadConditions returns the status of the given workload's conditions by type.
+func workloadConditions(obj client.Object) map[string]corev1.ConditionStatus {
+	conditions := make(map[string]corev1.ConditionStatus)
+	switch o := obj.(type) {
+	case *appsv1.Deployment:
+		for _, condition := range o.Status.Conditions {
+			conditions[string(condition.Type)] = condition.Status
+		}
+	case *appsv1.DaemonSet:
+		for _, condition := range o.Status.Conditions {
+			conditions[string(condition.Type)] = condition.Status
+		}
+	}
+	return conditions
+}
+
+// busyMaxDelayFor returns the maximum duration for deferring patches of the given workload because of busy markers. If
+// its BusyMaxDelayAnnotation is invalid, a warning event is emitted and BusyMarkerMaxDelay is used.
+func (c *ImageCloneController) busyMaxDelayFor(obj client.Object) time.Duration {
+	value, ok := obj.GetAnnotations()[BusyMaxDelayAnnotation]
+	if !ok {
+		return c.BusyMarkerMaxDelay
+	}
+
+	maxDelay, err := time.ParseDuration(value)
+	if err == nil && maxDelay < 0 {
+		err = fmt.Errorf("must not be negative")
+	}
+	if err != nil {
+		c.event(obj, corev1.EventTypeWarning, ReasonInvalidBusyMaxDelay, "Invalid busy max delay annotation, using the configured maximum delay",
+			"annotation", BusyMaxDelayAnnotation, "value", value, eventKeyError, err.Error())
+		return c.BusyMarkerMaxDelay
+	}
+	return maxDelay
+}
+
+// waitForBusyMarkers checks whether patching the given workload should be deferred because one of the BusyMarkers is
+// present, i.e., another mutator is updating it. The copies have already been done at this point. Patching is deferred
+// for at most the workload's maximum delay, see busyMaxDelayFor.
+func (c *ImageCloneController) waitForBusyMarkers(log logr.Logger, kind string, obj client.Object, now time.Time) (time.Duration, bool) {
+	var busy *BusyMarker
+	for i := range c.BusyMarkers {
+		if c.BusyMarkers[i].present(obj) {
+			busy = &c.BusyMarkers[i]
+			break
+		}
+	}
+	if busy == nil {
+		c.busySince.Delete(obj.GetUID())
+		return 0, false
+	}
+
+	maxDelay := c.busyMaxDelayFor(obj)
+	if maxDelay == 0 {
+		c.busySince.Delete(obj.GetUID())
+		return 0, false
+	}
+	since, _ := c.busySince.LoadOrStore(obj.GetUID(), now)
+	waited := now.Sub(since.(time.Time))
+	if waited >= maxDelay {
+		log.Info("Workload is still busy, patching anyway", "marker", busy.String(), "maxDelay", maxDelay)
+		c.busySince.Delete(obj.GetUID())
+		return 0, false
+	}
+
+	requeueAfter := busyMarkerRequeueInterval
+	if remaining := maxDelay - waited; remaining < requeueAfter {
+		requeueAfter = remaining
+	}
+	log.Info("Workload is busy, deferring patch", "marker", busy.String(), "requeueAfter", requeueAfter)
+	patchesDeferredByBusyMarkerTotal.WithLabelValues(kind, busy.String()).Inc()
+	return requeueAfter, true
+}
@@ -0,0 +1,81 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/rest"
+	toolscache "k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// NewCacheFunc returns a cache.NewCacheFunc that creates the manager's cache using newCache (defaults to cache.New) with
+// transform functions that strip fields from cached workloads, which the controller never reads, see
+// TransformWorkload. On large clusters, managedFields and last-applied annotations make up most of the cache's memory.
+// Transforms must be configured when creating the manager, as the cache is created along with it.
+func NewCacheFunc(newCache cache.NewCacheFunc, respectFieldManagers []string) cache.NewCacheFunc {
+	if newCache == nil {
+		newCache = cache.New
+	}
+	transform := TransformWorkload(respectFieldManagers)
+
+	return func(config *rest.Config, opts cache.Options) (cache.Cache, error) {
+		opts.TransformByObject = cache.TransformByObject{
+			&appsv1.Deployment{}: transform,
+			&appsv1.DaemonSet{}:  transform,
+		}
+		return newCache(config, opts)
+	}
+}
+
+// TransformWorkload returns a transform function for cached workloads that
+//   - drops the fields of managedFields entries, only the timestamps are read (see lastUpdateTime). The fields of
+//     entries of the given respected field managers are kept (see RespectFieldManagers), as well as the fields of the
+//     controller's own apply entries (see appliedBefore).
+//   - empties the value of the kubectl last-applied-configuration annotation. The key is kept, so that JSON patches
+//     only change individual annotations instead of replacing all annotations, see annotationOperations.
+//
+// Patches are computed from the transformed objects, so stripped fields are never changed on the server.
+func TransformWorkload(respectFieldManagers []string) toolscache.TransformFunc {
+	respected := sets.NewString(respectFieldManagers...)
+
+	return func(in interface{}) (interface{}, error) {
+		obj, ok := in.(client.Object)
+		if !ok {
+			// e.g., DeletedFinalStateUnknown
+			return in, nil
+		}
+
+		managedFields := obj.GetManagedFields()
+		for i := range managedFields {
+			if !respected.Has(managedFields[i].Manager) && !appliedByController(managedFields[i]) {
+				managedFields[i].FieldsV1 = nil
+			}
+		}
+		obj.SetManagedFields(managedFields)
+
+		annotations := obj.GetAnnotations()
+		if _, ok := annotations[corev1.LastAppliedConfigAnnotation]; ok {
+			annotations[corev1.LastAppliedConfigAnnotation] = ""
+			obj.SetAnnotations(annotations)
+		}
+		return obj, nil
+	}
+}
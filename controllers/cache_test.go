@@ -0,0 +1,153 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	toolscache "k8s.io/client-go/tools/cache"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/timebertt/image-clone-controller/pkg/test"
+)
+
+// transformingClient applies the given transform to workloads read via Get like the manager's cache does.
+type transformingClient struct {
+	client.Client
+	transform toolscache.TransformFunc
+}
+
+func (c transformingClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	if err := c.Client.Get(ctx, key, obj); err != nil {
+		return err
+	}
+	if _, ok := obj.(*corev1.Namespace); ok {
+		return nil
+	}
+	_, err := c.transform(obj)
+	return err
+}
+
+// managedFieldsEntry returns a managedFields entry of the given manager that owns the image of the given container.
+func managedFieldsEntry(manager string, operation metav1.ManagedFieldsOperationType, container string, updated time.Time) metav1.ManagedFieldsEntry {
+	return metav1.ManagedFieldsEntry{
+		Manager:    manager,
+		Operation:  operation,
+		Time:       &metav1.Time{Time: updated},
+		FieldsType: "FieldsV1",
+		FieldsV1: &metav1.FieldsV1{Raw: []byte(`{"f:spec":{"f:template":{"f:spec":{"f:containers":{` +
+			`"k:{\"name\":\"` + container + `\"}":{".":{},"f:image":{},"f:name":{}}}}}}}`)},
+	}
+}
+
+func TestTransformWorkload(t *testing.T) {
+	updated := time.Date(2022, 7, 1, 12, 0, 0, 0, time.UTC)
+	lastApplied := `{"apiVersion":"apps/v1","kind":"Deployment","spec":{"template":{"spec":{"containers":[]}}}}`
+	deployment := test.NewDeployment("default", "app", "nginx:1.23", "busybox:1.35", "alpine:3.16")
+	deployment.Annotations = map[string]string{corev1.LastAppliedConfigAnnotation: lastApplied}
+	deployment.ManagedFields = []metav1.ManagedFieldsEntry{
+		managedFieldsEntry("kubectl-client-side-apply", metav1.ManagedFieldsOperationUpdate, "container-2", updated.Add(-time.Hour)),
+		managedFieldsEntry("argocd-controller", metav1.ManagedFieldsOperationUpdate, "container-0", updated),
+		managedFieldsEntry(string(fieldOwner), metav1.ManagedFieldsOperationApply, "container-1", updated.Add(-time.Minute)),
+	}
+
+	transformed, err := TransformWorkload([]string{"argocd-controller"})(deployment.DeepCopy())
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj := transformed.(*appsv1.Deployment)
+
+	if obj.ManagedFields[0].FieldsV1 != nil {
+		t.Error("fields of other field managers were kept")
+	}
+	if obj.ManagedFields[1].FieldsV1 == nil || obj.ManagedFields[2].FieldsV1 == nil {
+		t.Error("fields of respected field managers or of the controller's apply configuration were dropped")
+	}
+	if value, ok := obj.Annotations[corev1.LastAppliedConfigAnnotation]; !ok || value != "" {
+		t.Errorf("last-applied annotation = %q (present: %v), want an empty value", value, ok)
+	}
+
+	// the controller reads the same information from the transformed object
+	c := newTestController(t)
+	c.RespectFieldManagers = []string{"argocd-controller"}
+	if got := lastUpdateTime(obj); !got.Equal(lastUpdateTime(deployment)) || !got.Equal(updated) {
+		t.Errorf("last update time = %s, want %s", got, updated)
+	}
+	images := c.containerImages(&obj.Spec.Template)
+	if manager, ok := c.imageFieldManager(obj, images[0]); !ok || manager != "argocd-controller" {
+		t.Errorf("image field manager of container-0 = %q, want argocd-controller", manager)
+	}
+	if !appliedBefore(obj, images[1], "f:image") {
+		t.Error("image of container-1 is not recognized as applied by the controller")
+	}
+}
+
+func TestReconcileTransformedWorkload(t *testing.T) {
+	upstream, backup := newTestRegistry(t), newTestRegistry(t)
+	var images []string
+	for _, image := range []string{"upstream/app:v1", "upstream/sidecar:v1", "upstream/init:v1"} {
+		if _, err := upstream.SeedImage(image, 1); err != nil {
+			t.Fatal(err)
+		}
+		images = append(images, upstream.Registry.RegistryStr()+"/"+image)
+	}
+
+	lastApplied := `{"apiVersion":"apps/v1","kind":"Deployment","spec":{"template":{"spec":{"containers":[]}}}}`
+	deployment := test.NewDeployment("default", "app", images...)
+	deployment.Annotations = map[string]string{corev1.LastAppliedConfigAnnotation: lastApplied}
+	deployment.ManagedFields = []metav1.ManagedFieldsEntry{
+		managedFieldsEntry("kubectl-client-side-apply", metav1.ManagedFieldsOperationUpdate, "container-2", time.Now()),
+		managedFieldsEntry("argocd-controller", metav1.ManagedFieldsOperationUpdate, "container-0", time.Now()),
+	}
+	c := newTestController(t, deployment, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}})
+	c.BackupRegistry = backup.Registry
+	c.RespectFieldManagers = []string{"argocd-controller"}
+	c.Client = transformingClient{Client: c.Client, transform: TransformWorkload(c.RespectFieldManagers)}
+
+	if _, err := c.ReconcileDeployment(context.Background(), ctrl.Request{NamespacedName: client.ObjectKeyFromObject(deployment)}); err != nil {
+		t.Fatal(err)
+	}
+
+	// read the stored object without the transform
+	stored := &appsv1.Deployment{}
+	if err := c.Client.(transformingClient).Client.Get(context.Background(), client.ObjectKeyFromObject(deployment), stored); err != nil {
+		t.Fatal(err)
+	}
+	containers := stored.Spec.Template.Spec.Containers
+	if containers[0].Image != images[0] {
+		t.Errorf("image owned by a respected field manager was rewritten to %s", containers[0].Image)
+	}
+	for _, container := range containers[1:] {
+		if !strings.HasPrefix(container.Image, backup.Registry.RegistryStr()+"/") {
+			t.Errorf("image %s of %s was not rewritten", container.Image, container.Name)
+		}
+	}
+	// the patch doesn't touch the stripped fields
+	if stored.Annotations[corev1.LastAppliedConfigAnnotation] != lastApplied {
+		t.Errorf("last-applied annotation was changed to %q", stored.Annotations[corev1.LastAppliedConfigAnnotation])
+	}
+	if stored.ManagedFields[0].FieldsV1 == nil {
+		t.Error("fields of managedFields entries were removed")
+	}
+}
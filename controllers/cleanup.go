@@ -0,0 +1,225 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-logr/logr"
+	"github.com/google/go-containerregistry/pkg/name"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	"github.com/timebertt/image-clone-controller/pkg/copier"
+	"github.com/timebertt/image-clone-controller/pkg/naming"
+)
+
+// FinalizerName is the finalizer that is added to workloads if cleanup on deletion is enabled.
+const FinalizerName = "image-clone.timebertt.dev/cleanup"
+
+// ImageIndexField is the field index for all container images referenced in a workload's pod template.
+const ImageIndexField = "spec.template.spec.containers.image"
+
+// podTemplateOf returns the pod template of the given workload or nil for unsupported kinds.
+func podTemplateOf(obj client.Object) *corev1.PodTemplateSpec {
+	switch workload := obj.(type) {
+	case *appsv1.Deployment:
+		return &workload.Spec.Template
+	case *appsv1.DaemonSet:
+		return &workload.Spec.Template
+	}
+	return nil
+}
+
+// indexImages indexes all container images referenced in the pod template of the given workload.
+func indexImages(obj client.Object) []string {
+	template := podTemplateOf(obj)
+	if template == nil {
+		return nil
+	}
+
+	var images []string
+	forEachContainer(template, func(_ containerList, _ int, container containerFields) {
+		images = append(images, *container.Image)
+	})
+	return images
+}
+
+// finalizeWorkload deletes all images in the backup registry that were copied for the given workload and are not
+// referenced by any other workload anymore. Afterwards, it removes our finalizer from the workload.
+func (c *ImageCloneController) finalizeWorkload(ctx context.Context, log logr.Logger, kind string, obj client.Object, template *corev1.PodTemplateSpec, backupRegistry name.Registry) error {
+	if !controllerutil.ContainsFinalizer(obj, FinalizerName) {
+		return nil
+	}
+
+	// if cleanup was disabled in the meantime, we only remove our finalizer to not block deletion forever
+	if c.CleanupOnDelete {
+		var containers []containerFields
+		forEachContainer(template, func(_ containerList, _ int, container containerFields) {
+			containers = append(containers, container)
+		})
+		for _, container := range containers {
+			if err := c.cleanupImage(ctx, log.WithValues("container", container.Name, "image", *container.Image), obj, *container.Image, backupRegistry); err != nil {
+				return err
+			}
+		}
+	}
+
+	log.Info("Removing finalizer from " + kind)
+	before := obj.DeepCopyObject().(client.Object)
+	controllerutil.RemoveFinalizer(obj, FinalizerName)
+	return client.IgnoreNotFound(c.patch(ctx, obj, before))
+}
+
+// cleanupImage deletes the given image from the backup registry if it is not referenced by any other workload. The
+// manifest is deleted by digest, as registries like registry:2 reject deleting tags. As this removes all tags
+// referencing the manifest, it is kept if another tag with the same digest is still referenced.
+func (c *ImageCloneController) cleanupImage(ctx context.Context, log logr.Logger, obj client.Object, image string, backupRegistry name.Registry) error {
+	ref, err := name.ParseReference(image)
+	if err != nil || !naming.SameRegistry(ref.Context().Registry, backupRegistry) {
+		// we never copied this image, nothing to clean up
+		return nil
+	}
+
+	referenced, err := c.isImageReferenced(ctx, obj, image)
+	if err != nil {
+		return err
+	}
+	if referenced {
+		log.V(1).Info("Image is still referenced by other workloads, skipping deletion")
+		return nil
+	}
+
+	digest, err := c.resolveDigest(ctx, ref)
+	if err != nil || digest == nil {
+		return err
+	}
+	if tag, shared, err := c.isDigestReferenced(ctx, obj, ref, *digest); err != nil || shared {
+		if shared {
+			log.V(1).Info("Image digest is still referenced by other workloads via another tag, skipping deletion", "tag", tag)
+		}
+		return err
+	}
+
+	log.Info("Deleting orphaned image from the backup registry", "digest", digest.DigestStr())
+	if err := c.Copier.Delete(ctx, *digest); err != nil {
+		if copier.IsNotFound(err) {
+			return nil
+		}
+		if copier.IsUnsupported(err) {
+			// the registry doesn't support deletion, don't block deletion of the workload forever
+			log.Info("Backup registry doesn't support deleting images, skipping cleanup", "error", err.Error())
+			c.event(obj, corev1.EventTypeWarning, ReasonFailedDeletingImage, "Backup registry doesn't support deleting image",
+				eventKeyImage, image, eventKeyError, err.Error())
+			return nil
+		}
+		return fmt.Errorf("error deleting image %q: %w", image, err)
+	}
+
+	return nil
+}
+
+// resolveDigest returns the digest of the manifest that the given reference points to, or nil if it doesn't exist.
+func (c *ImageCloneController) resolveDigest(ctx context.Context, ref name.Reference) (*name.Digest, error) {
+	if digest, ok := ref.(name.Digest); ok {
+		return &digest, nil
+	}
+
+	hash, exists, err := c.Copier.Exists(ctx, ref)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving digest of image %q: %w", ref.Name(), err)
+	}
+	if !exists {
+		return nil, nil
+	}
+	digest := ref.Context().Digest(hash.String())
+	return &digest, nil
+}
+
+// isDigestReferenced checks whether any workload other than obj references the given digest, either directly or via
+// another tag in the same repository. It returns the referenced tag.
+func (c *ImageCloneController) isDigestReferenced(ctx context.Context, obj client.Object, ref name.Reference, digest name.Digest) (string, bool, error) {
+	if referenced, err := c.isImageReferenced(ctx, obj, digest.Name()); err != nil || referenced {
+		return digest.Name(), referenced, err
+	}
+
+	tags, err := c.Copier.Tags(ctx, ref.Context())
+	if err != nil {
+		if copier.IsNotFound(err) {
+			return "", false, nil
+		}
+		return "", false, fmt.Errorf("error listing tags of repository %q: %w", ref.Context().Name(), err)
+	}
+	for _, tag := range tags {
+		other := ref.Context().Tag(tag)
+		if other.Name() == ref.Name() {
+			continue
+		}
+		referenced, err := c.isImageReferenced(ctx, obj, other.Name())
+		if err != nil {
+			return "", false, err
+		}
+		if !referenced {
+			continue
+		}
+		hash, exists, err := c.Copier.Exists(ctx, other)
+		if err != nil {
+			return "", false, fmt.Errorf("error resolving digest of image %q: %w", other.Name(), err)
+		}
+		if exists && hash.String() == digest.DigestStr() {
+			return other.Name(), true, nil
+		}
+	}
+	return "", false, nil
+}
+
+// isImageReferenced checks whether any workload of an enabled kind other than obj references the given image.
+func (c *ImageCloneController) isImageReferenced(ctx context.Context, obj client.Object, image string) (bool, error) {
+	var lists []client.ObjectList
+	if c.EnableDeployments {
+		lists = append(lists, &appsv1.DeploymentList{})
+	}
+	if c.EnableDaemonSets {
+		lists = append(lists, &appsv1.DaemonSetList{})
+	}
+
+	for _, list := range lists {
+		if err := c.List(ctx, list, client.MatchingFields{ImageIndexField: image}); err != nil {
+			return false, fmt.Errorf("error listing workloads referencing image %q: %w", image, err)
+		}
+
+		var referenced bool
+		if err := meta.EachListItem(list, func(o runtime.Object) error {
+			if o.(client.Object).GetUID() != obj.GetUID() {
+				referenced = true
+			}
+			return nil
+		}); err != nil {
+			return false, err
+		}
+		if referenced {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
@@ -0,0 +1,94 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/timebertt/image-clone-controller/pkg/test"
+)
+
+func TestCleanupImage(t *testing.T) {
+	tests := []struct {
+		name string
+		// other returns the workload that is not deleted, given the image of the deleted workload and another tag of
+		// the same manifest
+		other         func(image, sameDigest string) client.Object
+		disableDaemon bool
+		wantDeleted   bool
+	}{
+		{
+			name:        "unreferenced image",
+			other:       func(_, _ string) client.Object { return test.NewDeployment("other", "app", "nginx:1.23") },
+			wantDeleted: true,
+		},
+		{
+			name:  "image referenced by another workload",
+			other: func(image, _ string) client.Object { return test.NewDeployment("other", "app", image) },
+		},
+		{
+			name:  "digest referenced by another workload via another tag",
+			other: func(_, sameDigest string) client.Object { return test.NewDaemonSet("other", "app", sameDigest) },
+		},
+		{
+			name:          "image referenced by a workload of a disabled kind",
+			other:         func(image, _ string) client.Object { return test.NewDaemonSet("other", "app", image) },
+			disableDaemon: true,
+			wantDeleted:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg := newTestRegistry(t)
+			img, err := reg.SeedImage("library/app:v1", 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sameDigest, err := reg.Reference("library/app:stable")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := remote.Write(sameDigest, img); err != nil {
+				t.Fatal(err)
+			}
+			digest, err := img.Digest()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			image := reg.Registry.RegistryStr() + "/library/app:v1"
+			deleted := test.NewDeployment("default", "app", image)
+			c := newTestController(t, deleted, tt.other(image, sameDigest.Name()))
+			c.EnableDaemonSets = !tt.disableDaemon
+
+			if err := c.cleanupImage(context.Background(), logr.Discard(), deleted, image, reg.Registry); err != nil {
+				t.Fatalf("cleanupImage returned error: %v", err)
+			}
+
+			_, err = test.Digest(reg.Registry.RegistryStr() + "/library/app@" + digest.String())
+			if gotDeleted := err != nil; gotDeleted != tt.wantDeleted {
+				t.Errorf("manifest deleted = %v, want %v (lookup error: %v)", gotDeleted, tt.wantDeleted, err)
+			}
+		})
+	}
+}
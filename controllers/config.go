@@ -0,0 +1,310 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"runtime/debug"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/timebertt/image-clone-controller/pkg/copier"
+	"github.com/timebertt/image-clone-controller/pkg/naming"
+	"github.com/timebertt/image-clone-controller/pkg/version"
+)
+
+// ConfigPath is the path of the configuration debug endpoint on the metrics server.
+const ConfigPath = "/debug/config"
+
+// Config is the effective configuration of the controller. main constructs it from the command line flags.
+// Fields tagged with `config:"redact"` are not shown in snapshots, fields tagged with `config:"url"` are shown without
+// credentials.
+type Config struct {
+	// PatchStrategy configures how workloads are patched. Defaults to PatchStrategyStrategic.
+	PatchStrategy  PatchStrategy
+	BackupRegistry name.Registry
+	PodNamespace   string
+	// AllowPublicBackup allows well-known public registries as backup registry, see CheckPublicBackupRegistry.
+	AllowPublicBackup bool
+	// EnableDeployments and EnableDaemonSets configure whether the respective workload kind is reconciled.
+	EnableDeployments bool
+	EnableDaemonSets  bool
+	// SourceNotFoundGracePeriod is the duration after the last update of a workload in which missing source images are
+	// retried every SourceNotFoundRetryInterval instead of using the default exponential backoff.
+	SourceNotFoundGracePeriod   time.Duration
+	SourceNotFoundRetryInterval time.Duration
+	// CleanupOnDelete enables deleting copied images from the backup registry when the last workload referencing them
+	// is deleted.
+	CleanupOnDelete bool
+	// PreviousBackupRegistries are registries that were used as backup registry before. Images referencing them are
+	// mapped back to their original reference and copied to the current backup registry under the correct name.
+	PreviousBackupRegistries []name.Registry
+	// AsyncCopies enables copying images in the background. Workloads waiting for copies are reconciled again as soon as
+	// the copies have finished, or after CopyPendingRequeueInterval at the latest.
+	AsyncCopies                bool
+	CopyPendingRequeueInterval time.Duration
+	// ValidateBackupReferences enables verifying that images already referencing the backup registry exist.
+	// HealBackupReferences additionally copies missing images from their original source if possible.
+	ValidateBackupReferences bool
+	HealBackupReferences     bool
+	// RewriteEphemeralContainers enables rewriting images of ephemeral containers in pod templates.
+	RewriteEphemeralContainers bool
+	// ReconcileTimeout limits the duration of a single reconciliation. When it expires, the images that have been
+	// copied so far are patched and the workload is requeued. Zero disables the timeout.
+	ReconcileTimeout time.Duration
+	// FailureAnnotation enables setting the LastErrorAnnotation on workloads whose images have been failing to be copied
+	// for longer than FailureAnnotationThreshold.
+	FailureAnnotation          bool
+	FailureAnnotationThreshold time.Duration
+	// RetryBudget is the number of retries of failing workloads per minute that are shared by all reconcilers. Further
+	// retries are deferred by RetryBudgetRequeueInterval. Newly created workloads are never throttled. The budget is
+	// disabled if it is 0.
+	RetryBudget                int
+	RetryBudgetRequeueInterval time.Duration
+	// SetPullPolicyAlways enables setting the pull policy of containers rewritten from mutable tags to Always, as the
+	// destination tag is overwritten when the source tag changes. SetPullPolicyIfNotPresent enables setting the pull
+	// policy of containers rewritten from digests to IfNotPresent, as their destination tag never changes.
+	SetPullPolicyAlways       bool
+	SetPullPolicyIfNotPresent bool
+	// ExcludeImages are patterns of images that are not copied, see isExcluded.
+	ExcludeImages []string
+	// MirrorProhibitedFile is a file of repository patterns that must never be mirrored, e.g., for license compliance, see
+	// ReadMirrorProhibitedPatterns. Unlike ExcludeImages, prohibited images are reported via events. The file is reloaded
+	// when it changes.
+	MirrorProhibitedFile string
+	// RespectFieldManagers are names of field managers (e.g., trusted operators) whose container images are never
+	// rewritten.
+	RespectFieldManagers []string
+	// Offline disables contacting source registries, e.g., in air-gapped clusters. Images are only rewritten if the
+	// destination image already exists in the backup registry. Workloads with missing images are checked again after
+	// OfflineRequeueInterval.
+	Offline                bool
+	OfflineRequeueInterval time.Duration
+	// RewriteOnlyPreapproved never copies images. Images are only rewritten if they have been pre-approved, i.e., pushed
+	// to the backup registry by a separate pipeline. Unlike Offline, source registries may still be contacted for
+	// verifying that the pre-approved image matches the source digest if PreapprovalVerifyDigests is enabled. Workloads
+	// with images pending approval are checked again after PreapprovalRequeueInterval.
+	RewriteOnlyPreapproved     bool
+	PreapprovalVerifyDigests   bool
+	PreapprovalRequeueInterval time.Duration
+	// StrictDigestConsistency verifies before patching that the destination tag of every copied image serves the
+	// resolved source digest, and doesn't rewrite images whose destination tag diverges, see checkDigestConsistency.
+	StrictDigestConsistency bool
+	// MaxPatchesPerMinute and MaxPatchesPerMinutePerNamespace pace patches that rewrite images, so that rewriting a
+	// popular image doesn't roll out many workloads at once, see patchPacer. Zero disables the respective limit.
+	MaxPatchesPerMinute             int
+	MaxPatchesPerMinutePerNamespace int
+	// BlobRedirectRequeueInterval is the interval for retrying copies that failed because a blob download was redirected
+	// to an unreachable host, see copier.BlobRedirectError. Retrying more often doesn't help until egress is opened.
+	BlobRedirectRequeueInterval time.Duration
+	// WatchNamespaces restricts the controller to workloads in the given namespaces. All namespaces are watched if it is
+	// empty.
+	WatchNamespaces []string
+	// NamespacedRBAC makes the controller work with namespaced permissions in WatchNamespaces only, i.e., it never reads
+	// cluster-scoped objects like Namespaces, see DisableClusterScopedFeatures.
+	NamespacedRBAC bool
+	// AnnotatedEvents adds the structured fields of events as annotations, see EventAnnotationPrefix.
+	AnnotatedEvents bool
+	// DropImageUnchangedUpdates drops workload spec updates that don't change any image if all images are already backed
+	// up, instead of reconciling them, see specChangedPredicate. Drift of dropped workloads is corrected by full resyncs.
+	DropImageUnchangedUpdates bool
+	// ShardCount distributes workloads across the given number of replicas, each of them reconciling only the workloads
+	// of its shard ShardIndex, see ShardOf. Leader election is then only used for singleton background tasks.
+	ShardCount int
+	ShardIndex int
+	// NamespaceSummaryEvents replaces the Normal events of workloads during bulk passes (initial sync and full resyncs)
+	// with one summary event per namespace on the Namespace object, see bulkPasses.
+	NamespaceSummaryEvents bool
+	// RequiredPlatforms are the platforms that copied images need to provide. Missing platforms are reported via events
+	// and metrics. If DetectPlatforms is set, the platforms of the cluster's Nodes are required instead.
+	// EnforcePlatforms skips rewriting images that don't provide all required platforms.
+	RequiredPlatforms []v1.Platform
+	DetectPlatforms   bool
+	EnforcePlatforms  bool
+	// PreserveShortNames makes destination repositories of Docker Hub images mirror the literal image reference, e.g.,
+	// docker_io/nginx instead of index_docker_io/library/nginx.
+	PreserveShortNames bool
+	// DigestTagStyle configures how images referenced by digest are represented in destination tags. Defaults to
+	// naming.DigestTagStylePrefixed.
+	DigestTagStyle naming.DigestTagStyle
+	// WaitForRollout enables delaying patches of workloads while a rollout is in progress for at most
+	// WaitForRolloutTimeout.
+	WaitForRollout        bool
+	WaitForRolloutTimeout time.Duration
+	// PatchWindows defers patches of workloads until one of the windows of their kind opens, see PatchWindowAnnotation.
+	// Images are copied immediately nonetheless.
+	PatchWindows PatchWindows
+	// BusyMarkers defer patches of workloads while another mutator is updating them, e.g., the updater of a
+	// VerticalPodAutoscaler, for at most BusyMarkerMaxDelay, see waitForBusyMarkers and BusyMaxDelayAnnotation.
+	BusyMarkers        []BusyMarker
+	BusyMarkerMaxDelay time.Duration
+	// RequirePullAccess defers patches of workloads whose pods don't have credentials for the backup registry, i.e., none
+	// of the pull secrets of their pod template or service account contains credentials for it, see checkPullAccess.
+	// NodePullCredentials asserts that all nodes have credentials for the backup registry, which satisfies the check.
+	RequirePullAccess   bool
+	NodePullCredentials bool
+	// ResyncSpread is the duration over which full resyncs triggered via ResyncPath enqueue all workloads.
+	ResyncSpread time.Duration
+	// RepositoryMappings maps source repositories to fixed destination repositories in the backup registry.
+	RepositoryMappings naming.RepositoryMappings
+	// CopyHistoryConfigMap is the name of the ConfigMap in PodNamespace that stores the last successful copy of source
+	// images referenced by tag. An empty name disables the copy history.
+	CopyHistoryConfigMap string
+	// PendingJournalConfigMap is the name of the ConfigMap in PodNamespace that journals workloads whose images have been
+	// copied but not patched yet, so that they are reconciled first after a restart. An empty name disables the journal.
+	PendingJournalConfigMap string
+	// StatusConfigMap is the name of the ConfigMap in PodNamespace that is updated with a summary of recent activity at
+	// most every StatusUpdateInterval. An empty name disables the status ConfigMap.
+	StatusConfigMap      string
+	StatusUpdateInterval time.Duration
+	// CoverageInterval is the interval in which the protection coverage metrics are calculated. Zero disables them.
+	// CoverageNamespaceLimit is the number of namespaces with the most containers that get their own namespace label,
+	// the remaining namespaces are aggregated.
+	CoverageInterval       time.Duration
+	CoverageNamespaceLimit int
+	// RewriteLoopThreshold is the number of times the same container may be rewritten from the same source to the same
+	// destination within RewriteLoopWindow before patching the workload is stopped. Zero disables loop detection.
+	RewriteLoopThreshold int
+	RewriteLoopWindow    time.Duration
+	// ForceSyncRetention is the duration after which an acknowledged ForceSyncAnnotation is removed from workloads along
+	// with its ForceSyncAcknowledgedAnnotation. Zero disables pruning.
+	ForceSyncRetention time.Duration
+	// ReadyWithoutSync reports the controller as ready right after startup. By default, it is only reported ready once
+	// all workloads have been reconciled after startup, except for at most InitialSyncThreshold workloads.
+	ReadyWithoutSync     bool
+	InitialSyncThreshold int
+	// MirrorAnnotatedArtifacts are annotation keys whose values on workloads reference OCI artifacts (e.g., Helm charts)
+	// that are mirrored to the backup registry along with the workload's images, see mirrorAnnotatedArtifacts.
+	MirrorAnnotatedArtifacts []string
+
+	// CopierOptions configures the Copier.
+	CopierOptions copier.Options
+	// NotifyURL is the URL that notifications are sent to. Notifications are disabled if it is empty.
+	NotifyURL string `config:"url"`
+	// DebugEndpoint enables the debug endpoints, which require DebugEndpointToken if it is set.
+	DebugEndpoint      bool
+	DebugEndpointToken string `config:"redact"`
+	// ReplicatePullSecret is the pull secret that is replicated to all namespaces by the PullSecretController.
+	// Replication is disabled if it is empty.
+	ReplicatePullSecret types.NamespacedName
+	// ReplicatePullSecretCascadeDelete enables deleting replicated pull secrets when the source secret is deleted.
+	ReplicatePullSecretCascadeDelete bool
+}
+
+// Snapshot returns the configuration including build information and the ignored namespaces, e.g., for logging it on
+// startup. Secrets are redacted, but paths of credential files are shown.
+func (c *Config) Snapshot() map[string]interface{} {
+	return map[string]interface{}{
+		"build":             buildInfo(),
+		"config":            snapshotValue(reflect.ValueOf(c).Elem(), ""),
+		"ignoredNamespaces": c.IgnoredNamespaces().List(),
+	}
+}
+
+// ConfigHandler serves a snapshot of the given configuration, see Config.Snapshot.
+func ConfigHandler(config *Config, token string) http.Handler {
+	return copier.NewDebugHandler(token, func() interface{} {
+		return config.Snapshot()
+	})
+}
+
+func buildInfo() map[string]string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return nil
+	}
+
+	result := map[string]string{
+		"goVersion": info.GoVersion,
+		"version":   version.Version,
+	}
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision", "vcs.time", "vcs.modified":
+			result[setting.Key] = setting.Value
+		}
+	}
+	return result
+}
+
+var stringerType = reflect.TypeOf((*fmt.Stringer)(nil)).Elem()
+
+// snapshotValue converts the given value to a representation that can be marshalled to JSON. Unexported fields are
+// omitted, and values implementing fmt.Stringer (e.g., registries and durations) are converted to strings.
+func snapshotValue(v reflect.Value, tag string) interface{} {
+	switch tag {
+	case "redact":
+		if v.IsZero() {
+			return ""
+		}
+		return "<redacted>"
+	case "url":
+		u, err := url.Parse(v.String())
+		if err != nil {
+			return "<invalid>"
+		}
+		// don't show credentials in the user info or query
+		u.RawQuery = ""
+		return u.Redacted()
+	}
+
+	if v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil
+		}
+		return snapshotValue(v.Elem(), "")
+	}
+	if v.Type().Implements(stringerType) {
+		return v.Interface().(fmt.Stringer).String()
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		result := make(map[string]interface{}, v.NumField())
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			result[field.Name] = snapshotValue(v.Field(i), field.Tag.Get("config"))
+		}
+		return result
+	case reflect.Map:
+		result := make(map[string]interface{}, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			result[fmt.Sprint(iter.Key().Interface())] = snapshotValue(iter.Value(), "")
+		}
+		return result
+	case reflect.Slice, reflect.Array:
+		result := make([]interface{}, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			result[i] = snapshotValue(v.Index(i), "")
+		}
+		return result
+	case reflect.Func, reflect.Chan:
+		return nil
+	default:
+		return v.Interface()
+	}
+}
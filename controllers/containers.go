@@ -0,0 +1,84 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	corev1 "k8s.io/api/core/v1"
+)
+
+// containerList is a list of containers in a PodSpec, named like its JSON field.
+type containerList string
+
+const (
+	containerListContainers          containerList = "containers"
+	containerListInitContainers      containerList = "initContainers"
+	containerListEphemeralContainers containerList = "ephemeralContainers"
+)
+
+// containerFields references the fields of a container that the controller reads and rewrites, regardless of the
+// container list it belongs to.
+type containerFields struct {
+	Name            string
+	Image           *string
+	ImagePullPolicy *corev1.PullPolicy
+}
+
+// forEachContainer calls fn for every container in all container lists of the given pod template, i.e., containers,
+// init containers (including native sidecars), and ephemeral containers, in this order. The index is the container's
+// index in its list. This is the only place that knows about the container lists of PodSpec, so new lists only need to
+// be added here.
+func forEachContainer(template *corev1.PodTemplateSpec, fn func(list containerList, index int, container containerFields)) {
+	spec := &template.Spec
+	for i := range spec.Containers {
+		c := &spec.Containers[i]
+		fn(containerListContainers, i, containerFields{Name: c.Name, Image: &c.Image, ImagePullPolicy: &c.ImagePullPolicy})
+	}
+	for i := range spec.InitContainers {
+		c := &spec.InitContainers[i]
+		fn(containerListInitContainers, i, containerFields{Name: c.Name, Image: &c.Image, ImagePullPolicy: &c.ImagePullPolicy})
+	}
+	for i := range spec.EphemeralContainers {
+		c := &spec.EphemeralContainers[i]
+		fn(containerListEphemeralContainers, i, containerFields{Name: c.Name, Image: &c.Image, ImagePullPolicy: &c.ImagePullPolicy})
+	}
+}
+
+// containerAt returns the container at the given index of the given list in the pod template.
+func containerAt(template *corev1.PodTemplateSpec, list containerList, index int) (containerFields, bool) {
+	var (
+		result containerFields
+		found  bool
+	)
+	forEachContainer(template, func(l containerList, i int, container containerFields) {
+		if l == list && i == index {
+			result, found = container, true
+		}
+	})
+	return result, found
+}
+
+// hashPrefix returns the prefix of the list's containers in the images hash. Regular containers don't have a prefix, so
+// that the hash of existing workloads doesn't change.
+func (l containerList) hashPrefix() string {
+	switch l {
+	case containerListContainers:
+		return ""
+	case containerListEphemeralContainers:
+		return "ephemeral:"
+	}
+	return string(l) + ":"
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/timebertt/image-clone-controller/pkg/test"
+)
+
+// newDeploymentWithAllContainerLists returns a deployment with two containers, two init containers (e.g., a native
+// sidecar), and an ephemeral container.
+func newDeploymentWithAllContainerLists() *appsv1.Deployment {
+	deployment := test.NewDeployment("default", "app", "nginx:1.23", "busybox:1.35")
+	spec := &deployment.Spec.Template.Spec
+	spec.InitContainers = []corev1.Container{
+		{Name: "sidecar", Image: "envoyproxy/envoy:v1.22.0"},
+		{Name: "init", Image: "alpine:3.16"},
+	}
+	spec.EphemeralContainers = []corev1.EphemeralContainer{
+		{EphemeralContainerCommon: corev1.EphemeralContainerCommon{Name: "debug", Image: "busybox:1.36"}},
+	}
+	return deployment
+}
+
+func TestForEachContainer(t *testing.T) {
+	template := &newDeploymentWithAllContainerLists().Spec.Template
+
+	var visited []string
+	forEachContainer(template, func(list containerList, index int, container containerFields) {
+		visited = append(visited, fmt.Sprintf("%s/%d/%s", list, index, container.Name))
+
+		// indexes map back to the visited container
+		if at, ok := containerAt(template, list, index); !ok || at.Name != container.Name {
+			t.Errorf("container at %s/%d = %q, want %q", list, index, at.Name, container.Name)
+		}
+		*container.Image = "rewritten/" + container.Name
+	})
+
+	want := []string{"containers/0/container-0", "containers/1/container-1", "initContainers/0/sidecar", "initContainers/1/init", "ephemeralContainers/0/debug"}
+	if strings.Join(visited, ",") != strings.Join(want, ",") {
+		t.Errorf("visited containers %v, want %v", visited, want)
+	}
+
+	// the fields reference the containers in the template
+	spec := template.Spec
+	for _, image := range []string{spec.Containers[1].Image, spec.InitContainers[0].Image, spec.EphemeralContainers[0].Image} {
+		if !strings.HasPrefix(image, "rewritten/") {
+			t.Errorf("image %q was not rewritten in the template", image)
+		}
+	}
+
+	if _, ok := containerAt(template, containerListInitContainers, 2); ok {
+		t.Error("found container at index out of range")
+	}
+}
+
+func TestContainerImages(t *testing.T) {
+	before := newDeploymentWithAllContainerLists()
+	before.ResourceVersion = "42"
+	c := newTestController(t)
+
+	var names []string
+	for _, container := range c.containerImages(&before.Spec.Template) {
+		names = append(names, container.Name)
+	}
+	if want := "container-0,container-1,sidecar,init"; strings.Join(names, ",") != want {
+		t.Errorf("rewritten containers = %v, want %s without ephemeral containers", names, want)
+	}
+	c.RewriteEphemeralContainers = true
+	if images := c.containerImages(&before.Spec.Template); len(images) != 5 {
+		t.Errorf("rewritten containers = %v, want all containers including ephemeral containers", images)
+	}
+
+	// the rewrite of an init container is patched at its index in the init containers
+	images := c.containerImages(&before.Spec.Template)
+	obj := before.DeepCopy()
+	images[3].setImage(&obj.Spec.Template, rewrittenImage)
+	images[3].setPullPolicy(&obj.Spec.Template, corev1.PullAlways)
+	if init := obj.Spec.Template.Spec.InitContainers[1]; init.Image != rewrittenImage || init.ImagePullPolicy != corev1.PullAlways {
+		t.Fatalf("init container = %+v, want rewritten image and pull policy", init)
+	}
+
+	data, err := c.jsonPatch(obj, before)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `[{"op":"test","path":"/metadata/resourceVersion","value":"42"},` +
+		`{"op":"test","path":"/spec/template/spec/initContainers/1/image","value":"alpine:3.16"},` +
+		`{"op":"replace","path":"/spec/template/spec/initContainers/1/image","value":"` + rewrittenImage + `"},` +
+		`{"op":"add","path":"/spec/template/spec/initContainers/1/imagePullPolicy","value":"Always"}]`
+	if string(data) != want {
+		t.Errorf("json patch = %s, want %s", data, want)
+	}
+}
@@ -0,0 +1,134 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/timebertt/image-clone-controller/pkg/copier"
+	"github.com/timebertt/image-clone-controller/pkg/test"
+)
+
+// manifestGate holds back manifest uploads until it is opened, so that copies only finish when the test allows it.
+type manifestGate struct {
+	open chan struct{}
+}
+
+func (t *manifestGate) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == http.MethodPut && strings.Contains(req.URL.Path, "/manifests/") {
+		<-t.open
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestCopyFinishedReconcilesWaitingWorkloads(t *testing.T) {
+	upstream, backup := newTestRegistry(t), newTestRegistry(t)
+	if _, err := upstream.SeedImage("upstream/app:v1", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	deployment := test.NewDeployment("default", "app", upstream.Registry.RegistryStr()+"/upstream/app:v1")
+	c := newTestController(t, deployment, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}})
+	c.BackupRegistry = backup.Registry
+	c.AsyncCopies = true
+	c.CopyPendingRequeueInterval = time.Hour
+	gate := &manifestGate{open: make(chan struct{})}
+	c.Copier = &copier.Copier{Transport: gate}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// wire the copier to a queue like SetupWithManager does and reconcile everything that is enqueued
+	queue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	defer queue.ShutDown()
+	src := c.copyFinishedSource()
+	if err := src.InjectStopChannel(ctx.Done()); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.Start(ctx, enqueueWorkloadsWaitingForImage(c.Client, &appsv1.DeploymentList{}, predicate.Funcs{}), queue); err != nil {
+		t.Fatal(err)
+	}
+
+	key := client.ObjectKeyFromObject(deployment)
+	result, err := c.ReconcileDeployment(ctx, reconcile.Request{NamespacedName: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.RequeueAfter != c.CopyPendingRequeueInterval {
+		t.Fatalf("workload isn't waiting for the copy: %+v", result)
+	}
+
+	go func() {
+		for {
+			item, shutdown := queue.Get()
+			if shutdown {
+				return
+			}
+			if _, err := c.ReconcileDeployment(ctx, item.(reconcile.Request)); err != nil {
+				t.Errorf("reconciliation failed: %v", err)
+			}
+			queue.Done(item)
+		}
+	}()
+
+	close(gate.open)
+	finished := time.Now()
+
+	stored := &appsv1.Deployment{}
+	for time.Since(finished) < time.Second {
+		if err := c.Get(ctx, key, stored); err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(test.ContainerImages(stored)[0], backup.Registry.RegistryStr()+"/") {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("workload wasn't rewritten within 1s after the copy finished, image = %s", test.ContainerImages(stored)[0])
+}
+
+func TestCopyFinishedDoesNotBlock(t *testing.T) {
+	c := newTestController(t)
+	// nobody consumes the events
+	c.copyFinishedSource()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			c.Copier.OnCopyFinished("registry.example.com/app:v1")
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("notifying about finished copies blocked the copier")
+	}
+}
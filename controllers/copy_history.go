@@ -0,0 +1,226 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// CopyHistoryPath is the path that the copy history handler is served on.
+const CopyHistoryPath = "/debug/copy-history"
+
+const (
+	// copyHistoryKey is the key in the copy history ConfigMap that contains the last copy times.
+	copyHistoryKey = "history.json"
+	// copyHistoryFlushInterval is the interval in which the copy history is persisted if it was changed.
+	copyHistoryFlushInterval = 30 * time.Second
+)
+
+// backupAgeBuckets are the buckets of the backup age histogram in seconds: 1h, 6h, 1d, 7d, 30d, 90d.
+var backupAgeBuckets = []float64{3600, 6 * 3600, 24 * 3600, 7 * 24 * 3600, 30 * 24 * 3600, 90 * 24 * 3600}
+
+// copyHistory keeps track of the last successful copy of source images referenced by tag. As tags are mutable, this
+// shows how stale the backup copies are. Images referenced by digest never become stale, so they are not tracked.
+// The history is persisted in a ConfigMap, so that it survives controller restarts.
+type copyHistory struct {
+	client client.Client
+	// reader is used for reading the ConfigMap, so that we don't start an informer for all ConfigMaps.
+	reader client.Reader
+	key    client.ObjectKey
+
+	lock       sync.Mutex
+	lastCopied map[string]time.Time
+	dirty      bool
+
+	desc *prometheus.Desc
+}
+
+func newCopyHistory(c client.Client, reader client.Reader, key client.ObjectKey) *copyHistory {
+	return &copyHistory{
+		client:     c,
+		reader:     reader,
+		key:        key,
+		lastCopied: make(map[string]time.Time),
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "", "backup_age_seconds"),
+			"Time since the last successful copy of source images referenced by tag.",
+			nil, nil,
+		),
+	}
+}
+
+// record stores the time of a successful copy of the given source image.
+func (h *copyHistory) record(source string, t time.Time) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.lastCopied[source] = t
+	h.dirty = true
+}
+
+// Start implements manager.Runnable. It loads the persisted history and persists changes periodically.
+func (h *copyHistory) Start(ctx context.Context) error {
+	log := logf.FromContext(ctx).WithValues("configMap", h.key)
+
+	if err := h.load(ctx); err != nil {
+		return fmt.Errorf("error loading copy history: %w", err)
+	}
+
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		if err := h.flush(ctx); err != nil {
+			log.Error(err, "Failed persisting copy history")
+		}
+	}, copyHistoryFlushInterval)
+
+	// persist the latest copies on shutdown
+	flushCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := h.flush(flushCtx); err != nil {
+		log.Error(err, "Failed persisting copy history")
+	}
+	return nil
+}
+
+func (h *copyHistory) load(ctx context.Context) error {
+	configMap := &corev1.ConfigMap{}
+	if err := h.reader.Get(ctx, h.key, configMap); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+
+	persisted := make(map[string]time.Time)
+	if data, ok := configMap.Data[copyHistoryKey]; ok {
+		if err := json.Unmarshal([]byte(data), &persisted); err != nil {
+			return err
+		}
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	// copies recorded before loading the history are more recent
+	for source, t := range persisted {
+		if _, ok := h.lastCopied[source]; !ok {
+			h.lastCopied[source] = t
+		}
+	}
+	return nil
+}
+
+func (h *copyHistory) flush(ctx context.Context) error {
+	h.lock.Lock()
+	if !h.dirty {
+		h.lock.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(h.lastCopied)
+	h.dirty = false
+	h.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := h.persist(ctx, string(data)); err != nil {
+		// try again in the next interval
+		h.lock.Lock()
+		h.dirty = true
+		h.lock.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (h *copyHistory) persist(ctx context.Context, data string) error {
+	configMap := &corev1.ConfigMap{}
+	if err := h.reader.Get(ctx, h.key, configMap); err != nil {
+		if !apierrors.IsNotFound(err) {
+			return err
+		}
+
+		configMap.Namespace = h.key.Namespace
+		configMap.Name = h.key.Name
+		configMap.Data = map[string]string{copyHistoryKey: data}
+		return h.client.Create(ctx, configMap)
+	}
+
+	if configMap.Data == nil {
+		configMap.Data = make(map[string]string, 1)
+	}
+	configMap.Data[copyHistoryKey] = data
+	return h.client.Update(ctx, configMap)
+}
+
+// CopyHistoryEntry describes the last successful copy of a source image.
+type CopyHistoryEntry struct {
+	Source     string    `json:"source"`
+	LastCopied time.Time `json:"lastCopied"`
+	Age        string    `json:"age"`
+}
+
+// entries returns the copy history sorted by staleness, i.e., the images that have not been copied for the longest
+// time come first.
+func (h *copyHistory) entries() []CopyHistoryEntry {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	now := time.Now()
+	entries := make([]CopyHistoryEntry, 0, len(h.lastCopied))
+	for source, t := range h.lastCopied {
+		entries = append(entries, CopyHistoryEntry{Source: source, LastCopied: t, Age: now.Sub(t).Round(time.Second).String()})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if !entries[i].LastCopied.Equal(entries[j].LastCopied) {
+			return entries[i].LastCopied.Before(entries[j].LastCopied)
+		}
+		return entries[i].Source < entries[j].Source
+	})
+	return entries
+}
+
+func (h *copyHistory) Describe(ch chan<- *prometheus.Desc) {
+	ch <- h.desc
+}
+
+func (h *copyHistory) Collect(ch chan<- prometheus.Metric) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	now := time.Now()
+	buckets := make(map[float64]uint64, len(backupAgeBuckets))
+	var sum float64
+	for _, t := range h.lastCopied {
+		age := now.Sub(t).Seconds()
+		sum += age
+		for _, bucket := range backupAgeBuckets {
+			if age <= bucket {
+				buckets[bucket]++
+			}
+		}
+	}
+
+	ch <- prometheus.MustNewConstHistogram(h.desc, uint64(len(h.lastCopied)), sum, buckets)
+}
@@ -0,0 +1,186 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/prometheus/client_golang/prometheus"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// otherNamespaces is the namespace label value for all namespaces that are not among the top namespaces.
+const otherNamespaces = "other"
+
+var (
+	coverageContainers = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "coverage_containers",
+		Help:      "Number of containers in reconciled workloads per namespace.",
+	}, []string{"namespace"})
+
+	coverageProtectedContainers = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "coverage_protected_containers",
+		Help:      "Number of containers in reconciled workloads per namespace that reference the backup registry.",
+	}, []string{"namespace"})
+
+	coverageRatio = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "coverage_ratio",
+		Help:      "Fraction of containers in reconciled workloads that reference the backup registry.",
+	})
+)
+
+func init() {
+	metrics.Registry.MustRegister(
+		coverageContainers,
+		coverageProtectedContainers,
+		coverageRatio,
+	)
+}
+
+// coverageReporter periodically calculates how many containers reference the backup registry. It only reads from the
+// cache, so it doesn't cause any API requests.
+type coverageReporter struct {
+	reader         client.Reader
+	controller     *ImageCloneController
+	kinds          []client.ObjectList
+	interval       time.Duration
+	namespaceLimit int
+}
+
+// Start implements manager.Runnable.
+func (r *coverageReporter) Start(ctx context.Context) error {
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		if err := r.report(ctx); err != nil {
+			logf.FromContext(ctx).Error(err, "Failed calculating protection coverage")
+		}
+	}, r.interval)
+	return nil
+}
+
+type namespaceCoverage struct {
+	namespace string
+	total     int
+	protected int
+}
+
+func (r *coverageReporter) report(ctx context.Context) error {
+	backupRegistries := make(map[string]name.Registry)
+	namespaces := &corev1.NamespaceList{}
+	if err := r.reader.List(ctx, namespaces); err != nil {
+		return err
+	}
+	skipped := make(map[string]bool)
+	for i := range namespaces.Items {
+		skipped[namespaces.Items[i].Name] = isSkipped(&namespaces.Items[i])
+		// invalid annotations are reported on the workloads by the reconciliation, use the default backup registry
+		if backupRegistry, err := r.controller.namespaceBackupRegistry(&namespaces.Items[i]); err == nil {
+			backupRegistries[namespaces.Items[i].Name] = backupRegistry
+		}
+	}
+
+	coverage := make(map[string]*namespaceCoverage)
+	for _, list := range r.kinds {
+		list = list.DeepCopyObject().(client.ObjectList)
+		if err := r.reader.List(ctx, list); err != nil {
+			return err
+		}
+
+		for _, obj := range workloads(list) {
+			if r.controller.ignoredNamespaces.Has(obj.GetNamespace()) || skipped[obj.GetNamespace()] {
+				continue
+			}
+			nc, ok := coverage[obj.GetNamespace()]
+			if !ok {
+				nc = &namespaceCoverage{namespace: obj.GetNamespace()}
+				coverage[obj.GetNamespace()] = nc
+			}
+
+			backupRegistry, ok := backupRegistries[obj.GetNamespace()]
+			if !ok {
+				backupRegistry = r.controller.BackupRegistry
+			}
+			prefix := backupRegistry.RegistryStr() + "/"
+			for _, container := range r.controller.containerImages(podTemplateOf(obj)) {
+				nc.total++
+				if strings.HasPrefix(container.Image, prefix) {
+					nc.protected++
+				}
+			}
+		}
+	}
+
+	// bound the cardinality to the namespaces with the most containers
+	sorted := make([]*namespaceCoverage, 0, len(coverage))
+	for _, nc := range coverage {
+		sorted = append(sorted, nc)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].total != sorted[j].total {
+			return sorted[i].total > sorted[j].total
+		}
+		return sorted[i].namespace < sorted[j].namespace
+	})
+
+	coverageContainers.Reset()
+	coverageProtectedContainers.Reset()
+	var total, protected int
+	for i, nc := range sorted {
+		label := nc.namespace
+		if i >= r.namespaceLimit {
+			label = otherNamespaces
+		}
+		coverageContainers.WithLabelValues(label).Add(float64(nc.total))
+		coverageProtectedContainers.WithLabelValues(label).Add(float64(nc.protected))
+		total += nc.total
+		protected += nc.protected
+	}
+
+	ratio := 1.0
+	if total > 0 {
+		ratio = float64(protected) / float64(total)
+	}
+	coverageRatio.Set(ratio)
+	return nil
+}
+
+// workloads returns the items of the given workload list.
+func workloads(list client.ObjectList) []client.Object {
+	var objects []client.Object
+	switch l := list.(type) {
+	case *appsv1.DeploymentList:
+		for i := range l.Items {
+			objects = append(objects, &l.Items[i])
+		}
+	case *appsv1.DaemonSetList:
+		for i := range l.Items {
+			objects = append(objects, &l.Items[i])
+		}
+	}
+	return objects
+}
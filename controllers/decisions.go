@@ -0,0 +1,147 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// RewriteDecisions remembers which rewrites were recently found to be up to date, i.e., whose destination image was
+// copied or found to exist already. It is instantiated once and shared by all consumers of the rewrite decision logic
+// (see planRewrites), so that the same image is only checked once per TTL and all consumers see the same decisions.
+// Decisions of a workload are dropped when its ForceSyncAnnotation changes, all decisions are dropped by Invalidate,
+// e.g., when source credentials change. It is safe for concurrent use.
+type RewriteDecisions struct {
+	// TTL is the duration for which a rewrite is considered up to date without checking the registries again.
+	TTL time.Duration
+
+	lock sync.Mutex
+	// upToDate stores the up-to-date decisions by source and destination
+	upToDate map[string]decision
+	// forceSync stores the last observed value of the ForceSyncAnnotation of workloads by UID
+	forceSync map[types.UID]string
+}
+
+// decision is a recorded up-to-date decision.
+type decision struct {
+	expiry time.Time
+	// digest is the source digest that the destination was found up to date with, see rewrite.Digest.
+	digest v1.Hash
+}
+
+func decisionKey(r rewrite) string {
+	return r.Source.Name() + "\n" + r.Destination.Name()
+}
+
+// isUpToDate checks whether the given rewrite was recently found to be up to date. A nil RewriteDecisions never
+// remembers any decision.
+func (d *RewriteDecisions) isUpToDate(r rewrite, now time.Time) bool {
+	_, ok := d.lookup(r, now)
+	return ok
+}
+
+// upToDateDigest returns the source digest that the given rewrite was recently found to be up to date with, so that
+// planning doesn't need to resolve it again. It returns false if there is no such decision or its digest is unknown.
+func (d *RewriteDecisions) upToDateDigest(r rewrite, now time.Time) (v1.Hash, bool) {
+	dec, ok := d.lookup(r, now)
+	return dec.digest, ok && dec.digest != (v1.Hash{})
+}
+
+func (d *RewriteDecisions) lookup(r rewrite, now time.Time) (decision, bool) {
+	if d == nil {
+		return decision{}, false
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	dec, ok := d.upToDate[decisionKey(r)]
+	if ok && !now.Before(dec.expiry) {
+		delete(d.upToDate, decisionKey(r))
+		return decision{}, false
+	}
+	return dec, ok
+}
+
+// recordUpToDate records that the destination image of the given rewrite was copied or found to exist already.
+func (d *RewriteDecisions) recordUpToDate(r rewrite, now time.Time) {
+	if d == nil || d.TTL <= 0 {
+		return
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.upToDate == nil {
+		d.upToDate = make(map[string]decision)
+	}
+	d.upToDate[decisionKey(r)] = decision{expiry: now.Add(d.TTL), digest: r.Digest}
+}
+
+// observeForceSync drops the decisions for the given plan of a workload if its ForceSyncAnnotation was changed since
+// the last reconciliation, so that a force sync checks all of its images against the registries again.
+func (d *RewriteDecisions) observeForceSync(obj client.Object, plan []rewrite) {
+	if d == nil {
+		return
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	value, ok := obj.GetAnnotations()[ForceSyncAnnotation]
+	if previous, observed := d.forceSync[obj.GetUID()]; !ok || (observed && previous == value) {
+		return
+	}
+
+	if d.forceSync == nil {
+		d.forceSync = make(map[types.UID]string)
+	}
+	d.forceSync[obj.GetUID()] = value
+	for _, r := range plan {
+		if r.Destination != (name.Tag{}) {
+			delete(d.upToDate, decisionKey(r))
+		}
+	}
+}
+
+// forget drops the state that is kept for the workload with the given UID.
+func (d *RewriteDecisions) forget(uid types.UID) {
+	if d == nil {
+		return
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	delete(d.forceSync, uid)
+}
+
+// Invalidate drops all decisions, e.g., because credentials changed and images might not be accessible anymore.
+func (d *RewriteDecisions) Invalidate() {
+	if d == nil {
+		return
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.upToDate = nil
+}
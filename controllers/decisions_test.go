@@ -0,0 +1,138 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	"github.com/timebertt/image-clone-controller/pkg/copier"
+	"github.com/timebertt/image-clone-controller/pkg/test"
+)
+
+// requestCounter counts the registry requests sent through it and the manifests pushed.
+type requestCounter struct {
+	lock             sync.Mutex
+	requests, pushes int
+}
+
+func (r *requestCounter) RoundTrip(req *http.Request) (*http.Response, error) {
+	r.lock.Lock()
+	r.requests++
+	if req.Method == http.MethodPut && strings.Contains(req.URL.Path, "/manifests/") {
+		r.pushes++
+	}
+	r.lock.Unlock()
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func (r *requestCounter) counts() (int, int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.requests, r.pushes
+}
+
+func TestRewriteDecisions(t *testing.T) {
+	upstream, backup := newTestRegistry(t), newTestRegistry(t)
+	if _, err := upstream.SeedImage("upstream/app:v1", 1); err != nil {
+		t.Fatal(err)
+	}
+	image := upstream.Registry.RegistryStr() + "/upstream/app:v1"
+	deployment := test.NewDeployment("default", "app", image)
+	daemonSet := test.NewDaemonSet("default", "app", image)
+
+	// both consumers share the copier and the decisions like they are shared with an admission webhook in main
+	counter := &requestCounter{}
+	sharedCopier := &copier.Copier{Transport: counter}
+	decisions := &RewriteDecisions{TTL: time.Hour}
+	deployments, daemonSets := newTestController(t, deployment), newTestController(t, daemonSet)
+	for _, c := range []*ImageCloneController{deployments, daemonSets} {
+		c.Copier = sharedCopier
+		c.Decisions = decisions
+		c.BackupRegistry = backup.Registry
+	}
+
+	// execute plans and executes the rewrites of the given workload and returns the number of registry requests sent
+	// and manifests pushed
+	execute := func(t *testing.T, c *ImageCloneController, obj client.Object, template *corev1.PodTemplateSpec) (int, int) {
+		t.Helper()
+
+		requestsBefore, pushesBefore := counter.counts()
+		plan, _, err := c.planRewrites(template, backup.Registry, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rewritten, err := c.executeRewrites(context.Background(), logr.Discard(), obj, plan, backup.Registry, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rewritten) != 1 || !strings.HasPrefix(rewritten[0].Destination.Name(), backup.Registry.RegistryStr()+"/") {
+			t.Fatalf("rewrites = %v, want one rewrite to the backup registry", rewritten)
+		}
+		requests, pushes := counter.counts()
+		return requests - requestsBefore, pushes - pushesBefore
+	}
+
+	if _, pushes := execute(t, deployments, deployment, &deployment.Spec.Template); pushes != 1 {
+		t.Fatalf("first consumer pushed %d manifests, want 1", pushes)
+	}
+	if requests, _ := execute(t, daemonSets, daemonSet, &daemonSet.Spec.Template); requests != 0 {
+		t.Errorf("second consumer sent %d registry requests for the shared image, want 0", requests)
+	}
+
+	t.Run("force sync", func(t *testing.T) {
+		daemonSet.Annotations = map[string]string{ForceSyncAnnotation: "now"}
+		requests, pushes := execute(t, daemonSets, daemonSet, &daemonSet.Spec.Template)
+		if requests == 0 || pushes != 0 {
+			t.Errorf("force sync sent %d registry requests and pushed %d manifests, want checks without copies", requests, pushes)
+		}
+		if requests, _ := execute(t, deployments, deployment, &deployment.Spec.Template); requests != 0 {
+			t.Errorf("other consumer sent %d registry requests after the force sync, want 0", requests)
+		}
+	})
+
+	t.Run("invalidate", func(t *testing.T) {
+		decisions.Invalidate()
+		if requests, _ := execute(t, deployments, deployment, &deployment.Spec.Template); requests == 0 {
+			t.Error("no registry requests were sent after the decisions were invalidated")
+		}
+	})
+
+	t.Run("expiry", func(t *testing.T) {
+		plan, _, err := deployments.planRewrites(&deployment.Spec.Template, backup.Registry, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decisions.isUpToDate(plan[0], time.Now().Add(decisions.TTL)) {
+			t.Error("decision is still up to date after the TTL")
+		}
+	})
+
+	daemonSets.forgetDeletedWorkloads().Delete(event.DeleteEvent{Object: daemonSet}, nil)
+	if _, ok := decisions.forceSync[daemonSet.GetUID()]; ok {
+		t.Error("force sync value was not forgotten when the workload was deleted")
+	}
+}
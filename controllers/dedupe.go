@@ -0,0 +1,323 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/timebertt/image-clone-controller/pkg/copier"
+	"github.com/timebertt/image-clone-controller/pkg/naming"
+)
+
+// DedupeOptions configures Dedupe.
+type DedupeOptions struct {
+	// DryRun only logs the planned actions without changing the backup registry or any workload.
+	DryRun bool
+	// DeleteDuplicates deletes the images in duplicate repositories once they have been merged into the canonical
+	// repository and no workload references them anymore.
+	DeleteDuplicates bool
+	// ChunkSize is the number of workloads that are listed and processed at once. Defaults to DefaultListChunkSize.
+	ChunkSize int64
+}
+
+func (o DedupeOptions) chunkSize() int64 {
+	if o.ChunkSize <= 0 {
+		return DefaultListChunkSize
+	}
+	return o.ChunkSize
+}
+
+// dedupeSummary counts the results of Dedupe.
+type dedupeSummary struct {
+	repositories, copied, conflicts, patched, deleted int
+}
+
+// Dedupe merges repositories in the backup registry that earlier versions created for aliases of Docker Hub (e.g.,
+// registry-1_docker_io/library/nginx) into the canonical repository (index_docker_io/library/nginx). For every tag of
+// a duplicate repository, it verifies that the canonical tag doesn't reference a different digest and copies the image
+// to the canonical repository otherwise. Afterwards, workloads referencing the duplicate repository are patched to
+// reference the canonical repository, and the duplicate images are optionally deleted.
+// Every step checks the current state of the backup registry and workloads first, so an interrupted run can be resumed
+// by starting it again.
+func (c *ImageCloneController) Dedupe(ctx context.Context, log logr.Logger, opts DedupeOptions) error {
+	repositories, err := c.Copier.Repositories(ctx, c.BackupRegistry)
+	if err != nil {
+		return fmt.Errorf("error listing repositories of backup registry: %w", err)
+	}
+
+	duplicates := make(map[string]string)
+	for _, repository := range repositories {
+		if canonical, ok := c.canonicalRepository(repository); ok {
+			duplicates[repository] = canonical
+		}
+	}
+	sorted := make([]string, 0, len(duplicates))
+	for repository := range duplicates {
+		sorted = append(sorted, repository)
+	}
+	sort.Strings(sorted)
+
+	log.Info("Found duplicate repositories", "repositories", len(repositories), "duplicates", len(sorted), "dryRun", opts.DryRun)
+
+	summary := &dedupeSummary{}
+	for i, repository := range sorted {
+		log := log.WithValues("repository", repository, "canonical", duplicates[repository], "progress", fmt.Sprintf("%d/%d", i+1, len(sorted)))
+		log.Info("Deduplicating repository")
+
+		if err := c.dedupeRepository(ctx, log, repository, duplicates[repository], opts, summary); err != nil {
+			return fmt.Errorf("error deduplicating repository %q: %w", repository, err)
+		}
+		summary.repositories++
+	}
+
+	log.Info("Finished deduplication", "repositories", summary.repositories, "copiedImages", summary.copied,
+		"conflictingTags", summary.conflicts, "patchedWorkloads", summary.patched, "deletedImages", summary.deleted, "dryRun", opts.DryRun)
+	return nil
+}
+
+// dockerHubAliasEncodings are the encoded Docker Hub hosts that don't match the canonical index_docker_io.
+var dockerHubAliasEncodings = map[string]bool{
+	"registry-1_docker_io":    true,
+	"registry_hub_docker_com": true,
+	"docker_io":               true,
+}
+
+// canonicalRepository returns the canonical repository of the given repository in the backup registry, if it
+// references Docker Hub via an alias, e.g.:
+// registry-1_docker_io/library/nginx       -> index_docker_io/library/nginx
+// docker_io/nginx                          -> index_docker_io/library/nginx
+// team-billing/registry-1_docker_io/nginx  -> team-billing/index_docker_io/library/nginx
+// If PreserveShortNames is set, docker_io repositories are canonical and kept.
+func (c *ImageCloneController) canonicalRepository(repository string) (string, bool) {
+	parts := strings.Split(repository, "/")
+	for i, part := range parts[:len(parts)-1] {
+		if !dockerHubAliasEncodings[part] {
+			if naming.LooksLikeEncodedRegistry(part) {
+				return "", false
+			}
+			// destination prefix
+			continue
+		}
+		if part == "docker_io" && c.PreserveShortNames {
+			return "", false
+		}
+
+		rest := parts[i+1:]
+		if len(rest) == 1 {
+			// official images, see name.NewRepository
+			rest = append([]string{"library"}, rest...)
+		}
+		canonical := append(append(append([]string{}, parts[:i]...), naming.EncodeRegistry(name.DefaultRegistry)), rest...)
+		return strings.Join(canonical, "/"), true
+	}
+	return "", false
+}
+
+func (c *ImageCloneController) dedupeRepository(ctx context.Context, log logr.Logger, repository, canonical string, opts DedupeOptions, summary *dedupeSummary) error {
+	duplicateRepo, err := name.NewRepository(c.BackupRegistry.RegistryStr() + "/" + repository)
+	if err != nil {
+		return err
+	}
+	canonicalRepo, err := name.NewRepository(c.BackupRegistry.RegistryStr() + "/" + canonical)
+	if err != nil {
+		return err
+	}
+
+	tags, err := c.Copier.Tags(ctx, duplicateRepo)
+	if err != nil {
+		if copier.IsNotFound(err) {
+			// already deleted in a previous run
+			return nil
+		}
+		return fmt.Errorf("error listing tags: %w", err)
+	}
+
+	// merged are the tags that reference the same digest in both repositories (after copying them)
+	merged := make(map[string]v1.Hash, len(tags))
+	for _, tag := range tags {
+		log := log.WithValues("tag", tag)
+
+		digest, exists, err := c.Copier.Exists(ctx, duplicateRepo.Tag(tag))
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+
+		canonicalDigest, exists, err := c.Copier.Exists(ctx, canonicalRepo.Tag(tag))
+		if err != nil {
+			return err
+		}
+		switch {
+		case exists && canonicalDigest != digest:
+			log.Info("Tag references different digests in both repositories, keeping duplicate", "digest", digest.String(), "canonicalDigest", canonicalDigest.String())
+			summary.conflicts++
+			continue
+		case exists:
+			merged[tag] = digest
+			continue
+		case opts.DryRun:
+			log.Info("Would copy image to canonical repository", "digest", digest.String())
+			summary.copied++
+			merged[tag] = digest
+			continue
+		}
+
+		// copy by digest, so that the canonical tag is guaranteed to reference the same digest
+		if _, err := c.Copier.Copy(copier.WithoutSizeLimit(ctx), log, duplicateRepo.Digest(digest.String()), canonicalRepo.Tag(tag)); err != nil {
+			return fmt.Errorf("error copying tag %q: %w", tag, err)
+		}
+		log.Info("Copied image to canonical repository", "digest", digest.String())
+		summary.copied++
+		merged[tag] = digest
+	}
+
+	referenced, err := c.dedupeWorkloads(ctx, log, duplicateRepo, canonicalRepo, merged, opts, summary)
+	if err != nil {
+		return err
+	}
+
+	if !opts.DeleteDuplicates || len(merged) < len(tags) || referenced {
+		return nil
+	}
+	return c.deleteDuplicates(ctx, log, duplicateRepo, merged, opts, summary)
+}
+
+// dedupeWorkloads patches all workloads referencing merged tags of the duplicate repository to reference the canonical
+// repository. It returns true if any workload still references the duplicate repository.
+// Workloads are listed and processed in chunks of opts.ChunkSize, so that large namespaces are never held in memory at
+// once.
+func (c *ImageCloneController) dedupeWorkloads(ctx context.Context, log logr.Logger, duplicateRepo, canonicalRepo name.Repository, merged map[string]v1.Hash, opts DedupeOptions, summary *dedupeSummary) (bool, error) {
+	namespaces := c.WatchNamespaces
+	if len(namespaces) == 0 {
+		namespaces = []string{metav1.NamespaceAll}
+	}
+
+	var referenced bool
+	for _, namespace := range namespaces {
+		for _, kind := range []struct {
+			name string
+			list client.ObjectList
+		}{{"Deployment", &appsv1.DeploymentList{}}, {"DaemonSet", &appsv1.DaemonSetList{}}} {
+			processed := 0
+			err := listWorkloadsInChunks(ctx, c, kind.list, namespace, opts.chunkSize(), func(objects []client.Object) error {
+				for _, obj := range objects {
+					stillReferenced, err := c.dedupeWorkload(ctx, log, obj, duplicateRepo, canonicalRepo, merged, opts, summary)
+					if err != nil {
+						return err
+					}
+					referenced = referenced || stillReferenced
+				}
+				processed += len(objects)
+				log.Info("Processed chunk of workloads", "kind", kind.name, "namespace", namespace, "processedWorkloads", processed)
+				return nil
+			})
+			if err != nil {
+				return false, err
+			}
+		}
+	}
+	return referenced, nil
+}
+
+// dedupeWorkload patches the given workload to reference the canonical repository for all merged tags. It returns true
+// if the workload still references the duplicate repository.
+func (c *ImageCloneController) dedupeWorkload(ctx context.Context, log logr.Logger, obj client.Object, duplicateRepo, canonicalRepo name.Repository, merged map[string]v1.Hash, opts DedupeOptions, summary *dedupeSummary) (bool, error) {
+	var referenced bool
+	before := obj.DeepCopyObject().(client.Object)
+	template := podTemplateOf(obj)
+
+	changed := false
+	for _, container := range c.containerImages(template) {
+		ref, err := name.ParseReference(container.Image)
+		if err != nil || ref.Context().Name() != duplicateRepo.Name() {
+			continue
+		}
+		image := canonicalRepo.Tag(ref.Identifier()).Name()
+		digest, ok := merged[ref.Identifier()]
+		if tag, pinned := pinnedTag(ref); pinned {
+			// keep the pinned digest, which the canonical tag must serve
+			image = canonicalRepo.Tag(tag.TagStr()).Name() + "@" + ref.Identifier()
+			digest, ok = merged[tag.TagStr()]
+			ok = ok && digest.String() == ref.Identifier()
+		}
+		if !ok {
+			// conflicting tags are kept in the duplicate repository
+			referenced = true
+			continue
+		}
+		container.setImage(template, image)
+		changed = true
+	}
+	if !changed {
+		return referenced, nil
+	}
+
+	log = log.WithValues("object", client.ObjectKeyFromObject(obj), "kind", kindOf(obj))
+	if opts.DryRun {
+		log.Info("Would patch workload to reference canonical repository")
+		summary.patched++
+		return referenced, nil
+	}
+	if err := c.patch(ctx, obj, before); err != nil {
+		return false, fmt.Errorf("error patching %s %s: %w", kindOf(obj), client.ObjectKeyFromObject(obj), err)
+	}
+	log.Info("Patched workload to reference canonical repository")
+	summary.patched++
+	return referenced, nil
+}
+
+// deleteDuplicates deletes the merged images from the duplicate repository.
+func (c *ImageCloneController) deleteDuplicates(ctx context.Context, log logr.Logger, duplicateRepo name.Repository, merged map[string]v1.Hash, opts DedupeOptions, summary *dedupeSummary) error {
+	digests := make(map[v1.Hash]struct{}, len(merged))
+	for _, digest := range merged {
+		digests[digest] = struct{}{}
+	}
+
+	for digest := range digests {
+		if opts.DryRun {
+			log.Info("Would delete duplicate image", "digest", digest.String())
+			summary.deleted++
+			continue
+		}
+
+		if err := c.Copier.Delete(ctx, duplicateRepo.Digest(digest.String())); err != nil {
+			if copier.IsNotFound(err) {
+				continue
+			}
+			if copier.IsUnsupported(err) {
+				log.Info("Backup registry doesn't support deleting images, keeping duplicates", "error", err.Error())
+				return nil
+			}
+			return fmt.Errorf("error deleting digest %q: %w", digest, err)
+		}
+		log.Info("Deleted duplicate image", "digest", digest.String())
+		summary.deleted++
+	}
+	return nil
+}
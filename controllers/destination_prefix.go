@@ -0,0 +1,49 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/timebertt/image-clone-controller/pkg/naming"
+)
+
+// DestinationPrefixAnnotation can be set on workloads to insert a path prefix into the destination repositories of all
+// their images, e.g., <backupRegistry>/team-billing/index_docker_io/library/nginx:1.23 for chargeback.
+const DestinationPrefixAnnotation = "image-clone.timebertt.dev/destination-prefix"
+
+// destinationPrefixFor returns the validated DestinationPrefixAnnotation of the given workload. If the annotation is
+// invalid, no prefix is used and a warning is returned, which is also emitted as an event unless dryRun is set.
+func (c *ImageCloneController) destinationPrefixFor(obj client.Object, dryRun bool) (string, string) {
+	prefix := obj.GetAnnotations()[DestinationPrefixAnnotation]
+	if prefix == "" {
+		return "", ""
+	}
+
+	if err := naming.ValidatePrefix(prefix); err != nil {
+		// retrying doesn't help, the workload is reconciled again when the annotation is corrected
+		if !dryRun {
+			c.event(obj, corev1.EventTypeWarning, ReasonInvalidDestinationPrefix, "Invalid destination prefix annotation, using the default destination repositories",
+				"annotation", DestinationPrefixAnnotation, "value", prefix, eventKeyError, err.Error())
+		}
+		return "", fmt.Sprintf("invalid %s annotation, using the default destination repositories: %v", DestinationPrefixAnnotation, err)
+	}
+	return prefix, ""
+}
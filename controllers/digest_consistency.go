@@ -0,0 +1,98 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/go-logr/logr"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	"github.com/timebertt/image-clone-controller/pkg/copier"
+)
+
+// AllowDigestDivergenceAnnotation can be set to "true" on workloads to rewrite their images with
+// StrictDigestConsistency even if the destination tag serves a different digest than the source image.
+const AllowDigestDivergenceAnnotation = "image-clone.timebertt.dev/allow-digest-divergence"
+
+var digestDivergencesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "digest_divergences_total",
+	Help:      "Total number of container images that were not rewritten because the destination tag served a different digest than the source image.",
+})
+
+func init() {
+	metrics.Registry.MustRegister(digestDivergencesTotal)
+}
+
+func allowsDigestDivergence(obj client.Object) bool {
+	return obj.GetAnnotations()[AllowDigestDivergenceAnnotation] == "true"
+}
+
+// DigestDivergenceError is returned by reconcilePodTemplate with StrictDigestConsistency if the destination tags of
+// some images serve a different digest than their source images. The other images are rewritten anyway.
+type DigestDivergenceError struct {
+	Images []string
+}
+
+func (e *DigestDivergenceError) Error() string {
+	return fmt.Sprintf("%d destination images serve a different digest than their source images: %s", len(e.Images), strings.Join(e.Images, ", "))
+}
+
+// digestDivergence is returned by checkDigestConsistency if the destination tag serves a different digest than the
+// source image.
+type digestDivergence struct {
+	SourceDigest, DestinationDigest v1.Hash
+}
+
+func (e *digestDivergence) Error() string {
+	return fmt.Sprintf("destination tag serves digest %s instead of source digest %s", e.DestinationDigest, e.SourceDigest)
+}
+
+// checkDigestConsistency verifies that the destination tag of the given rewrite serves the digest that the source
+// image resolved to when planning the rewrite (see rewrite.Digest), i.e., that the destination tag doesn't serve a
+// different image than the container, e.g., because it was overwritten with an older digest in the meantime. This only
+// sends a single request for the destination tag. The given context must not carry prefetched results, so that the
+// destination is checked after copying.
+func (c *ImageCloneController) checkDigestConsistency(uncachedCtx context.Context, log logr.Logger, obj client.Object, r rewrite) error {
+	if !c.StrictDigestConsistency || !c.contactsSourceRegistries() || allowsDigestDivergence(obj) {
+		return nil
+	}
+
+	srcDigest := r.Digest
+	if srcDigest == (v1.Hash{}) {
+		return fmt.Errorf("digest of source image %q couldn't be resolved", r.Source.Name())
+	}
+
+	dstDigest, exists, err := c.Copier.Exists(copier.WithOperation(uncachedCtx, copier.OperationVerify), r.Destination)
+	if err != nil {
+		return fmt.Errorf("error checking digest of image %q: %w", r.Destination.Name(), err)
+	}
+	if exists && dstDigest == srcDigest {
+		return nil
+	}
+
+	log.Info("Destination tag serves a different digest than the source image", "destination", r.Destination.Name(),
+		"sourceDigest", srcDigest.String(), "destinationDigest", dstDigest.String())
+	digestDivergencesTotal.Inc()
+	return &digestDivergence{SourceDigest: srcDigest, DestinationDigest: dstDigest}
+}
@@ -0,0 +1,141 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/timebertt/image-clone-controller/pkg/copier"
+	"github.com/timebertt/image-clone-controller/pkg/test"
+)
+
+// overwritingTransport overwrites every manifest that is pushed to the given registry with the given image, like a
+// concurrent push to the same destination tag.
+type overwritingTransport struct {
+	http.RoundTripper
+	registry name.Registry
+	image    v1.Image
+}
+
+func (t *overwritingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err != nil || req.Method != http.MethodPut || req.URL.Host != t.registry.RegistryStr() || !strings.Contains(req.URL.Path, "/manifests/") {
+		return resp, err
+	}
+
+	repository, tag, _ := strings.Cut(strings.TrimPrefix(req.URL.Path, "/v2/"), "/manifests/")
+	ref, err := name.NewTag(t.registry.RegistryStr()+"/"+repository+":"+tag, name.Insecure)
+	if err != nil {
+		return nil, err
+	}
+	if err := remote.Write(ref, t.image); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func TestDigestConsistencyDowngrade(t *testing.T) {
+	upstream := newTestRegistry(t)
+	older, err := upstream.SeedImage("upstream/app:v1", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	olderDigest, err := older.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the source tag was moved to a newer image
+	newer, err := upstream.SeedImage("upstream/app:v1", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newerDigest, err := newer.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := upstream.Registry.RegistryStr() + "/upstream/app:v1"
+
+	tests := []struct {
+		name   string
+		strict bool
+		allow  bool
+		// wantRewrite is true if the container is rewritten although the destination tag serves the older digest
+		wantRewrite bool
+	}{
+		{name: "strict", strict: true},
+		{name: "strict with allowed divergence", strict: true, allow: true, wantRewrite: true},
+		{name: "not strict", wantRewrite: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backup := newTestRegistry(t)
+			deployment := test.NewDeployment("default", "app", source)
+			if tt.allow {
+				deployment.Annotations = map[string]string{AllowDigestDivergenceAnnotation: "true"}
+			}
+			c := newTestController(t, deployment)
+			c.BackupRegistry = backup.Registry
+			c.StrictDigestConsistency = tt.strict
+			// a stale copy of the older image overwrites the destination tag right after copying the newer image
+			c.Copier = &copier.Copier{Transport: &overwritingTransport{RoundTripper: http.DefaultTransport, registry: backup.Registry, image: older}}
+			recorder := c.Recorder.(*record.FakeRecorder)
+
+			_, err := c.reconcilePodTemplate(context.Background(), logr.Discard(), deployment, &deployment.Spec.Template, backup.Registry, "")
+			image := deployment.Spec.Template.Spec.Containers[0].Image
+			if !tt.wantRewrite {
+				var divergenceErr *DigestDivergenceError
+				if !errors.As(err, &divergenceErr) {
+					t.Fatalf("error = %v, want a DigestDivergenceError", err)
+				}
+				if image != source {
+					t.Errorf("image was rewritten to %s, which serves the older digest", image)
+				}
+
+				e := <-recorder.Events
+				if !strings.Contains(e, ReasonDigestDivergence) || !strings.Contains(e, newerDigest.String()) || !strings.Contains(e, olderDigest.String()) {
+					t.Errorf("event %q, want %s with both digests", e, ReasonDigestDivergence)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			if image == source {
+				t.Fatal("image was not rewritten")
+			}
+			// the container is pinned to the copied digest, so it doesn't run the older image served by the tag
+			if !strings.HasSuffix(image, "@"+newerDigest.String()) {
+				t.Errorf("image = %s, want it pinned to the newer digest %s", image, newerDigest)
+			}
+			if digest, err := test.Digest(image); err != nil || digest != newerDigest {
+				t.Errorf("destination digest = %s (error: %v), want the newer digest %s", digest, err, newerDigest)
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/timebertt/image-clone-controller/pkg/naming"
+)
+
+// SourceDigestsAnnotation is set on workloads with images whose destination tag doesn't contain the full digest of the
+// source image, see naming.DigestTagStyleOriginalTagPlusDigest. It maps the destination images to the source digests as JSON,
+// so that the original reference can be determined, e.g., for healing missing images.
+const SourceDigestsAnnotation = "image-clone.timebertt.dev/source-digests"
+
+// sourceDigests maps destination images to the digests of their source images, see SourceDigestsAnnotation.
+type sourceDigests map[string]string
+
+// sourceDigestsOf returns the source digests of the given workload. Invalid annotations are ignored.
+func sourceDigestsOf(obj client.Object) sourceDigests {
+	digests := make(sourceDigests)
+	if value, ok := obj.GetAnnotations()[SourceDigestsAnnotation]; ok {
+		_ = json.Unmarshal([]byte(value), &digests)
+	}
+	return digests
+}
+
+// original returns the original reference of the given destination image including the recorded source digest, if the
+// destination tag was derived from it, e.g., index.docker.io/library/nginx:1.25@sha256:33cef... for a destination tag
+// 1.25-33cef0123456. Otherwise, the given original reference is returned.
+func (d sourceDigests) original(dstImg, original name.Reference) (name.Reference, error) {
+	digest, ok := d[dstImg.Name()]
+	tag, isTag := original.(name.Tag)
+	if !ok || !isTag {
+		return original, nil
+	}
+
+	_, hex, _ := strings.Cut(digest, ":")
+	if len(hex) < naming.ShortDigestLength || !strings.HasSuffix(tag.TagStr(), "-"+hex[:naming.ShortDigestLength]) {
+		// the annotation doesn't belong to this tag
+		return original, nil
+	}
+	return name.NewDigest(fmt.Sprintf("%s:%s@%s", tag.Context().Name(), strings.TrimSuffix(tag.TagStr(), "-"+hex[:naming.ShortDigestLength]), digest))
+}
+
+// setSourceDigests records the source digests of the given rewrites whose destination tag doesn't contain the full
+// digest in the SourceDigestsAnnotation, and removes entries of images that the template doesn't reference anymore.
+func setSourceDigests(obj client.Object, template *corev1.PodTemplateSpec, rewritten []rewrite) error {
+	digests := sourceDigestsOf(obj)
+	for _, r := range rewritten {
+		digest, ok := r.Original.(name.Digest)
+		if !ok {
+			continue
+		}
+		if _, hex, _ := strings.Cut(digest.DigestStr(), ":"); !strings.Contains(r.Destination.TagStr(), hex) {
+			digests[r.Destination.Name()] = digest.DigestStr()
+		}
+	}
+
+	referenced := make(map[string]bool)
+	forEachContainer(template, func(_ containerList, _ int, container containerFields) {
+		if ref, err := name.ParseReference(*container.Image); err == nil {
+			if tag, ok := pinnedTag(ref); ok {
+				ref = tag
+			}
+			referenced[ref.Name()] = true
+		}
+	})
+	for image := range digests {
+		if !referenced[image] {
+			delete(digests, image)
+		}
+	}
+
+	if len(digests) == 0 {
+		annotations := obj.GetAnnotations()
+		if _, ok := annotations[SourceDigestsAnnotation]; ok {
+			delete(annotations, SourceDigestsAnnotation)
+			obj.SetAnnotations(annotations)
+		}
+		return nil
+	}
+
+	data, err := json.Marshal(digests)
+	if err != nil {
+		return err
+	}
+	setAnnotation(obj, SourceDigestsAnnotation, string(data))
+	return nil
+}
@@ -0,0 +1,74 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+
+	"github.com/timebertt/image-clone-controller/pkg/naming"
+	"github.com/timebertt/image-clone-controller/pkg/test"
+)
+
+func TestSourceDigests(t *testing.T) {
+	hex := strings.Repeat("0123456789abcdef", 4)
+	source := "nginx:1.25@sha256:" + hex
+	deployment := test.NewDeployment("default", "app", source, "busybox:1.35")
+	c := newTestController(t, deployment)
+	c.DigestTagStyle = naming.DigestTagStyleOriginalTagPlusDigest
+	c.BackupRegistry = name.MustParseReference("registry.example.com/app").Context().Registry
+
+	plan, _, err := c.planRewrites(&deployment.Spec.Template, c.BackupRegistry, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range plan {
+		r.Container.setImage(&deployment.Spec.Template, r.Destination.Name())
+	}
+	if err := setSourceDigests(deployment, &deployment.Spec.Template, plan); err != nil {
+		t.Fatal(err)
+	}
+
+	// only the lossy destination tag is recorded
+	const destination = "registry.example.com/index_docker_io/library/nginx:1.25-0123456789ab"
+	if digests := sourceDigestsOf(deployment); len(digests) != 1 || digests[destination] != "sha256:"+hex {
+		t.Fatalf("source digests = %v, want the digest of %s", digests, destination)
+	}
+
+	// the rewritten image is mapped back to the full source reference, e.g., for healing it
+	original, err := c.originalImage(name.MustParseReference(destination), "", sourceDigestsOf(deployment))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "index.docker.io/library/nginx:1.25@sha256:" + hex; original.String() != want {
+		t.Errorf("original = %s, want %s", original, want)
+	}
+	if dst, err := c.destinationImage(original, c.BackupRegistry, ""); err != nil || dst.Name() != destination {
+		t.Errorf("destination of original = %s (error: %v), want %s", dst, err, destination)
+	}
+
+	// digests of images that are not referenced anymore are removed
+	deployment.Spec.Template.Spec.Containers[0].Image = "nginx:1.26"
+	if err := setSourceDigests(deployment, &deployment.Spec.Template, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := deployment.Annotations[SourceDigestsAnnotation]; ok {
+		t.Errorf("annotation %s was kept without lossy destination tags", SourceDigestsAnnotation)
+	}
+}
@@ -0,0 +1,139 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// Event reasons emitted by the controller. They are part of the controller's API, tooling may rely on them, so they
+// must not be renamed.
+const (
+	ReasonImagesCloned                    = "ImagesCloned"
+	ReasonImagesRelinked                  = "ImagesRelinked"
+	ReasonFailedCopyingImages             = "FailedCopyingImages"
+	ReasonImageFromPreviousBackupRegistry = "ImageFromPreviousBackupRegistry"
+	ReasonInvalidImageReference           = "InvalidImageReference"
+	ReasonImageTooLarge                   = "ImageTooLarge"
+	ReasonOfflineCopyPending              = "OfflineCopyPending"
+	ReasonPendingApproval                 = "PendingApproval"
+	ReasonDeniedImage                     = "DeniedImage"
+	ReasonMirrorProhibited                = "MirrorProhibited"
+	ReasonIncompletePlatforms             = "IncompletePlatforms"
+	ReasonBackupImageMissing              = "BackupImageMissing"
+	ReasonHealedBackupImage               = "HealedBackupImage"
+	ReasonRewriteLoopDetected             = "RewriteLoopDetected"
+	ReasonPatchRejected                   = "PatchRejected"
+	ReasonInvalidBackupRegistryAnnotation = "InvalidBackupRegistryAnnotation"
+	ReasonInvalidDestinationPrefix        = "InvalidDestinationPrefix"
+	ReasonFailedDeletingImage             = "FailedDeletingImage"
+	ReasonDestinationEqualsSource         = "DestinationEqualsSource"
+	ReasonBlobRedirectBlocked             = "BlobRedirectBlocked"
+	ReasonInvalidPatchWindow              = "InvalidPatchWindow"
+	ReasonInvalidBusyMaxDelay             = "InvalidBusyMaxDelay"
+	ReasonArtifactMirrored                = "ArtifactMirrored"
+	ReasonFailedMirroringArtifact         = "FailedMirroringArtifact"
+	ReasonBulkPassSummary                 = "BulkPassSummary"
+	ReasonDigestDivergence                = "DigestDivergence"
+	ReasonSinglePlatformCopy              = "SinglePlatformCopy"
+	ReasonMissingPullAccess               = "MissingPullAccess"
+)
+
+// EventAnnotationPrefix is the prefix of the annotations carrying the structured fields of events if AnnotatedEvents
+// is enabled, e.g., image-clone.timebertt.dev/container.
+const EventAnnotationPrefix = "image-clone.timebertt.dev/"
+
+// Keys of the structured fields of events.
+const (
+	eventKeyContainer   = "container"
+	eventKeySource      = "source"
+	eventKeyDestination = "destination"
+	eventKeyImage       = "image"
+	eventKeyError       = "error"
+	eventKeyAnnotation  = "annotation"
+	eventKeyPattern     = "pattern"
+	eventKeyPass        = "pass"
+	eventKeyWorkloads   = "workloads"
+	eventKeyFailures    = "failures"
+	eventKeyFailed      = "failed"
+
+	eventKeySourceDigest      = "sourceDigest"
+	eventKeyDestinationDigest = "destinationDigest"
+)
+
+// event emits an event with a message consisting of the given summary followed by the given keys and values in the
+// form key=value, e.g., `Failed copying images container=app error="..."`. Values are quoted if necessary, keys keep
+// the given order, so that messages have a stable structure. If AnnotatedEvents is enabled, the fields are additionally
+// added as annotations with the EventAnnotationPrefix.
+// Normal events of workloads in a running bulk pass are suppressed in favor of the pass's summary, see bulkPasses.
+func (c *ImageCloneController) event(obj runtime.Object, eventType, reason, summary string, keysAndValues ...string) {
+	if eventType == corev1.EventTypeNormal && c.bulkPasses.suppress(obj) {
+		return
+	}
+	if eventType == corev1.EventTypeWarning {
+		c.bulkPasses.warned(obj, reason)
+	}
+
+	message := formatEventMessage(summary, keysAndValues...)
+	if !c.AnnotatedEvents {
+		c.Recorder.Event(obj, eventType, reason, message)
+		return
+	}
+
+	annotations := make(map[string]string, len(keysAndValues)/2)
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		annotations[EventAnnotationPrefix+keysAndValues[i]] = keysAndValues[i+1]
+	}
+	c.Recorder.AnnotatedEventf(obj, annotations, eventType, reason, "%s", message)
+}
+
+func formatEventMessage(summary string, keysAndValues ...string) string {
+	var b strings.Builder
+	b.WriteString(summary)
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		b.WriteString(" ")
+		b.WriteString(keysAndValues[i])
+		b.WriteString("=")
+		b.WriteString(quoteEventValue(keysAndValues[i+1]))
+	}
+	return b.String()
+}
+
+func quoteEventValue(value string) string {
+	if value == "" || strings.ContainsAny(value, " \t\n\"=") || !strconv.CanBackquote(value) {
+		return strconv.Quote(value)
+	}
+	return value
+}
+
+// containerEventFields returns the structured event field of the failed containers if the given error is a
+// *ContainersError or a *ContainerError.
+func containerEventFields(err error) []string {
+	if containers := failedContainers(err); len(containers) > 0 {
+		return []string{eventKeyContainer, strings.Join(containers, ",")}
+	}
+	return nil
+}
+
+// errorEventFields returns the structured event fields for the given error, including the failed container if known.
+func errorEventFields(err error) []string {
+	return append(containerEventFields(err), eventKeyError, err.Error())
+}
@@ -0,0 +1,148 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/timebertt/image-clone-controller/pkg/test"
+)
+
+// TestEventReasons locks the event reasons, tooling relies on them. Don't change this test when renaming a constant.
+func TestEventReasons(t *testing.T) {
+	for got, want := range map[string]string{
+		ReasonImagesCloned:                    "ImagesCloned",
+		ReasonImagesRelinked:                  "ImagesRelinked",
+		ReasonFailedCopyingImages:             "FailedCopyingImages",
+		ReasonImageFromPreviousBackupRegistry: "ImageFromPreviousBackupRegistry",
+		ReasonInvalidImageReference:           "InvalidImageReference",
+		ReasonImageTooLarge:                   "ImageTooLarge",
+		ReasonOfflineCopyPending:              "OfflineCopyPending",
+		ReasonPendingApproval:                 "PendingApproval",
+		ReasonDeniedImage:                     "DeniedImage",
+		ReasonMirrorProhibited:                "MirrorProhibited",
+		ReasonIncompletePlatforms:             "IncompletePlatforms",
+		ReasonBackupImageMissing:              "BackupImageMissing",
+		ReasonHealedBackupImage:               "HealedBackupImage",
+		ReasonRewriteLoopDetected:             "RewriteLoopDetected",
+		ReasonPatchRejected:                   "PatchRejected",
+		ReasonInvalidBackupRegistryAnnotation: "InvalidBackupRegistryAnnotation",
+		ReasonInvalidDestinationPrefix:        "InvalidDestinationPrefix",
+		ReasonFailedDeletingImage:             "FailedDeletingImage",
+		ReasonDestinationEqualsSource:         "DestinationEqualsSource",
+		ReasonBlobRedirectBlocked:             "BlobRedirectBlocked",
+		ReasonInvalidPatchWindow:              "InvalidPatchWindow",
+		ReasonInvalidBusyMaxDelay:             "InvalidBusyMaxDelay",
+		ReasonArtifactMirrored:                "ArtifactMirrored",
+		ReasonFailedMirroringArtifact:         "FailedMirroringArtifact",
+		ReasonBulkPassSummary:                 "BulkPassSummary",
+		ReasonDigestDivergence:                "DigestDivergence",
+		ReasonSinglePlatformCopy:              "SinglePlatformCopy",
+		ReasonMissingPullAccess:               "MissingPullAccess",
+	} {
+		if got != want {
+			t.Errorf("event reason %q was renamed to %q", want, got)
+		}
+	}
+}
+
+func TestFormatEventMessage(t *testing.T) {
+	tests := []struct {
+		name          string
+		keysAndValues []string
+		want          string
+	}{
+		{name: "no fields", want: "Failed copying images"},
+		{
+			name:          "plain values",
+			keysAndValues: []string{eventKeyContainer, "app", eventKeySource, "nginx:1.23"},
+			want:          "Failed copying images container=app source=nginx:1.23",
+		},
+		{
+			name:          "quoted values",
+			keysAndValues: []string{eventKeyContainer, "", eventKeyError, `unexpected status "401 Unauthorized"`},
+			want:          `Failed copying images container="" error="unexpected status \"401 Unauthorized\""`,
+		},
+		{
+			name:          "values with equal signs and newlines",
+			keysAndValues: []string{eventKeyImage, "a=b", eventKeyError, "first\nsecond"},
+			want:          `Failed copying images image="a=b" error="first\nsecond"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := formatEventMessage("Failed copying images", tt.keysAndValues...); got != tt.want {
+				t.Errorf("formatEventMessage() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// annotationRecorder records the annotations of the last annotated event.
+type annotationRecorder struct {
+	messages    []string
+	annotations map[string]string
+}
+
+func (r *annotationRecorder) Event(_ runtime.Object, eventType, reason, message string) {
+	r.messages = append(r.messages, eventType+" "+reason+" "+message)
+}
+
+func (r *annotationRecorder) Eventf(obj runtime.Object, eventType, reason, messageFmt string, args ...interface{}) {
+	r.Event(obj, eventType, reason, fmt.Sprintf(messageFmt, args...))
+}
+
+func (r *annotationRecorder) AnnotatedEventf(obj runtime.Object, annotations map[string]string, eventType, reason, messageFmt string, args ...interface{}) {
+	r.annotations = annotations
+	r.Eventf(obj, eventType, reason, messageFmt, args...)
+}
+
+func TestAnnotatedEvents(t *testing.T) {
+	deployment := test.NewDeployment("default", "app", "nginx:1.23")
+	c := newTestController(t, deployment)
+	recorder := &annotationRecorder{}
+	c.Recorder = recorder
+
+	fields := []string{eventKeyContainer, "nginx", eventKeyError, "copy failed"}
+	c.event(deployment, corev1.EventTypeWarning, ReasonFailedCopyingImages, "Failed copying images", fields...)
+	if recorder.annotations != nil {
+		t.Errorf("event was annotated with %v although annotated events are disabled", recorder.annotations)
+	}
+
+	c.AnnotatedEvents = true
+	c.event(deployment, corev1.EventTypeWarning, ReasonFailedCopyingImages, "Failed copying images", fields...)
+	want := map[string]string{EventAnnotationPrefix + "container": "nginx", EventAnnotationPrefix + "error": "copy failed"}
+	if len(recorder.annotations) != len(want) {
+		t.Errorf("event annotations = %v, want %v", recorder.annotations, want)
+	}
+	for key, value := range want {
+		if recorder.annotations[key] != value {
+			t.Errorf("event annotation %s = %q, want %q", key, recorder.annotations[key], value)
+		}
+	}
+
+	// the message is the same with and without annotations
+	wantMessage := `Warning FailedCopyingImages Failed copying images container=nginx error="copy failed"`
+	if len(recorder.messages) != 2 || recorder.messages[0] != wantMessage || recorder.messages[1] != wantMessage {
+		t.Errorf("event messages = %q, want %q twice", recorder.messages, wantMessage)
+	}
+}
@@ -0,0 +1,85 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// ProviderImages are patterns of well-known provider-internal images, which can't be pulled from outside the
+// provider's network, e.g., the pause images of managed clusters.
+var ProviderImages = []string{
+	"gke.gcr.io",
+	"*.amazonaws.com/eks",
+	"mcr.microsoft.com/oss/kubernetes/pause",
+}
+
+// ValidateExcludePatterns verifies that the given patterns are valid, see isExcluded.
+func ValidateExcludePatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid exclude pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// isExcluded checks whether the repository of the given image matches any of the ExcludeImages patterns. Patterns use
+// the path.Match syntax and match the repository (including the registry host) or any of its parent paths, e.g.,
+// gke.gcr.io matches all repositories in that registry.
+func (c *ImageCloneController) isExcluded(img name.Reference) bool {
+	_, excluded := c.excludeReason(img)
+	return excluded
+}
+
+// excludeReason checks whether the given image is excluded, see isExcluded. It returns SkipReasonExcludedRegistry if a
+// pattern matches the registry host itself and SkipReasonExcludedPattern otherwise.
+func (c *ImageCloneController) excludeReason(img name.Reference) (SkipReason, bool) {
+	_, registry, matched := matchRepositoryPatterns(c.ExcludeImages, img)
+	if !matched {
+		return "", false
+	}
+	if registry {
+		return SkipReasonExcludedRegistry, true
+	}
+	return SkipReasonExcludedPattern, true
+}
+
+// matchRepositoryPatterns returns the first of the given path.Match patterns that matches the repository of the given
+// image (including the registry host) or any of its parent paths. registry is true if the pattern matches the registry
+// host itself.
+func matchRepositoryPatterns(patterns []string, img name.Reference) (pattern string, registry, matched bool) {
+	repository := img.Context().Name()
+	for _, pattern := range patterns {
+		for prefix := repository; prefix != ""; {
+			i := strings.LastIndex(prefix, "/")
+			if matched, _ := path.Match(pattern, prefix); matched {
+				return pattern, i < 0, true
+			}
+
+			if i < 0 {
+				break
+			}
+			prefix = prefix[:i]
+		}
+	}
+	return "", false, false
+}
@@ -0,0 +1,97 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/go-logr/logr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// LastErrorAnnotation is set on workloads if FailureAnnotation is enabled and copying their images has been failing for
+// longer than FailureAnnotationThreshold. It is removed once the images have been copied successfully.
+const LastErrorAnnotation = "image-clone.timebertt.dev/last-error"
+
+// maxLastErrorMessageLength is the maximum length of the error message in the LastErrorAnnotation. Registry errors can
+// contain whole response bodies, which would bloat the workload.
+const maxLastErrorMessageLength = 512
+
+// recordFailure sets the LastErrorAnnotation on the given workload if copying its images has been failing for longer
+// than FailureAnnotationThreshold. obj must not contain any changes made by the failed reconciliation.
+func (c *ImageCloneController) recordFailure(ctx context.Context, log logr.Logger, obj client.Object, err error) {
+	c.retryBudget.failed(obj.GetUID())
+	if !c.FailureAnnotation {
+		return
+	}
+
+	since, _ := c.failingSince.LoadOrStore(obj.GetUID(), time.Now())
+	failingSince := since.(time.Time)
+	if time.Since(failingSince) < c.FailureAnnotationThreshold {
+		return
+	}
+
+	// the value only changes if the error changes, which prevents patching the workload on every retry
+	value := fmt.Sprintf("since=%s containers=%s: %s", failingSince.UTC().Format(time.RFC3339), strings.Join(failedContainers(err), ","),
+		lastErrorMessage(err))
+	if obj.GetAnnotations()[LastErrorAnnotation] == value {
+		return
+	}
+
+	// changing annotations doesn't increment the generation, so this doesn't trigger another reconciliation
+	before := obj.DeepCopyObject().(client.Object)
+	setAnnotation(obj, LastErrorAnnotation, value)
+	if err := c.patch(ctx, obj, before); err != nil {
+		log.Error(err, "Failed setting last error annotation")
+	}
+}
+
+// clearFailure removes the LastErrorAnnotation from the given workload. The change is included in the following patch.
+func (c *ImageCloneController) clearFailure(obj client.Object) {
+	c.failingSince.Delete(obj.GetUID())
+	c.retryBudget.recovered(obj.GetUID())
+
+	annotations := obj.GetAnnotations()
+	if _, ok := annotations[LastErrorAnnotation]; ok {
+		delete(annotations, LastErrorAnnotation)
+		obj.SetAnnotations(annotations)
+	}
+}
+
+// lastErrorMessage returns the message of the given error for the LastErrorAnnotation. Whitespace and control
+// characters are collapsed into single spaces, so that the value stays on one line, and the message is truncated to
+// maxLastErrorMessageLength.
+func lastErrorMessage(err error) string {
+	message := strings.Join(strings.FieldsFunc(err.Error(), func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsControl(r)
+	}), " ")
+	if len(message) <= maxLastErrorMessageLength {
+		return message
+	}
+
+	// don't cut multi-byte characters in half
+	message = message[:maxLastErrorMessageLength]
+	for !utf8.ValidString(message) {
+		message = message[:len(message)-1]
+	}
+	return message + "..."
+}
@@ -0,0 +1,80 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	"github.com/timebertt/image-clone-controller/pkg/test"
+)
+
+func TestRecordFailure(t *testing.T) {
+	deployment := test.NewDeployment("default", "app", "nginx:1.23", "busybox:1.35")
+	c := newTestController(t, deployment)
+	c.FailureAnnotation = true
+
+	err := &ContainersError{Errors: []*ContainerError{
+		{Container: "container-0", err: errors.New("failed pulling image:\n<html>" + strings.Repeat("x", 1000) + "</html>")},
+		{Container: "container-1", err: errors.New("unauthorized")},
+	}}
+	c.recordFailure(context.Background(), logr.Discard(), deployment, err)
+
+	if err := c.Get(context.Background(), client.ObjectKeyFromObject(deployment), deployment); err != nil {
+		t.Fatal(err)
+	}
+	value := deployment.Annotations[LastErrorAnnotation]
+	if !strings.Contains(value, " containers=container-0,container-1: ") {
+		t.Errorf("annotation %q doesn't list all failing containers", value)
+	}
+	if strings.Contains(value, "\n") {
+		t.Errorf("annotation %q contains a newline", value)
+	}
+	if _, message, _ := strings.Cut(value, ": "); len(message) > maxLastErrorMessageLength+len("...") {
+		t.Errorf("error message in annotation has length %d, want at most %d", len(message), maxLastErrorMessageLength+len("..."))
+	}
+
+	c.forgetDeletedWorkloads().Delete(event.DeleteEvent{Object: deployment}, nil)
+	if _, ok := c.failingSince.Load(deployment.GetUID()); ok {
+		t.Error("failingSince was not cleared when the workload was deleted")
+	}
+}
+
+func TestLastErrorMessage(t *testing.T) {
+	tests := []struct {
+		name, err, want string
+	}{
+		{name: "short", err: "unauthorized", want: "unauthorized"},
+		{name: "whitespace", err: "GET https://registry:\n\t500  Internal", want: "GET https://registry: 500 Internal"},
+		{name: "truncated", err: strings.Repeat("a", maxLastErrorMessageLength+1), want: strings.Repeat("a", maxLastErrorMessageLength) + "..."},
+		{name: "multi-byte", err: strings.Repeat("a", maxLastErrorMessageLength-1) + "ä", want: strings.Repeat("a", maxLastErrorMessageLength-1) + "..."},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := lastErrorMessage(errors.New(tt.err)); got != tt.want {
+				t.Errorf("lastErrorMessage() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
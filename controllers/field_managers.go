@@ -0,0 +1,123 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/go-logr/logr"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// skipRespectedFieldManagers removes all rewrites from the given plan whose container image is owned by one of the
+// RespectFieldManagers, so that we don't fight with trusted controllers that expect to own the image field.
+func (c *ImageCloneController) skipRespectedFieldManagers(log logr.Logger, obj client.Object, plan []rewrite) []rewrite {
+	if len(c.RespectFieldManagers) == 0 {
+		return plan
+	}
+
+	result := plan[:0]
+	for _, r := range plan {
+		if !r.BackedUp {
+			if manager, ok := c.imageFieldManager(obj, r.Container); ok {
+				recordSkip(log, SkipReasonGitOpsSkip).V(1).Info("Container image is owned by a respected field manager, skipping it", "container", r.Container.Name, "manager", manager)
+				continue
+			}
+		}
+		result = append(result, r)
+	}
+	return result
+}
+
+// imageFieldManager returns the first of the RespectFieldManagers that owns the image field of the given container
+// according to the object's managedFields.
+func (c *ImageCloneController) imageFieldManager(obj client.Object, container containerImage) (string, bool) {
+	return containerFieldManager(obj, container, "f:image", func(entry metav1.ManagedFieldsEntry) bool {
+		return c.isRespectedFieldManager(entry.Manager)
+	})
+}
+
+// containerFieldManager returns the first field manager whose managedFields entry matches the given func and owns the
+// given field (e.g., f:image) of the given container.
+func containerFieldManager(obj client.Object, container containerImage, field string, matches func(entry metav1.ManagedFieldsEntry) bool) (string, bool) {
+	list := "f:" + string(container.List)
+
+	for _, entry := range obj.GetManagedFields() {
+		if entry.FieldsV1 == nil || !matches(entry) {
+			continue
+		}
+
+		fields := map[string]interface{}{}
+		if err := json.Unmarshal(entry.FieldsV1.Raw, &fields); err != nil {
+			continue
+		}
+
+		containers, ok := nestedFields(fields, "f:spec", "f:template", "f:spec", list)
+		if !ok {
+			continue
+		}
+		for key, value := range containers {
+			if !isContainerKey(key, container.Name) {
+				continue
+			}
+			if containerFields, ok := value.(map[string]interface{}); ok {
+				if _, ok := containerFields[field]; ok {
+					return entry.Manager, true
+				}
+			}
+		}
+	}
+
+	return "", false
+}
+
+func (c *ImageCloneController) isRespectedFieldManager(manager string) bool {
+	for _, m := range c.RespectFieldManagers {
+		if m == manager {
+			return true
+		}
+	}
+	return false
+}
+
+// nestedFields returns the nested map at the given path in a FieldsV1 set.
+func nestedFields(fields map[string]interface{}, path ...string) (map[string]interface{}, bool) {
+	for _, key := range path {
+		next, ok := fields[key].(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		fields = next
+	}
+	return fields, true
+}
+
+// isContainerKey checks whether the given key of a FieldsV1 set refers to the list item of the container with the
+// given name, e.g., k:{"name":"nginx"}.
+func isContainerKey(key, name string) bool {
+	if !strings.HasPrefix(key, "k:") {
+		return false
+	}
+
+	var keyFields map[string]interface{}
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(key, "k:")), &keyFields); err != nil {
+		return false
+	}
+	return keyFields["name"] == name
+}
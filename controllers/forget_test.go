@@ -0,0 +1,66 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	"github.com/timebertt/image-clone-controller/pkg/test"
+)
+
+// TestForgetDeletedWorkload verifies that the state of deleted workloads is dropped even if they don't have a finalizer,
+// e.g., because cleanup on deletion is disabled.
+func TestForgetDeletedWorkload(t *testing.T) {
+	now := time.Now()
+	deployment := test.NewDeployment("default", "app", "nginx:1.23")
+	deployment.CreationTimestamp = metav1.NewTime(now.Add(-time.Hour))
+	other := test.NewDeployment("default", "other", "nginx:1.23")
+	other.CreationTimestamp = metav1.NewTime(now.Add(-time.Hour))
+	c := newTestController(t, deployment, other)
+	c.retryBudget = newRetryBudget(1)
+	c.patchPacer = newPatchPacer(1, 0)
+
+	// the other workload uses up the current slot, so that the deleted workload is scheduled for the next one
+	c.retryBudget.failed(deployment.UID)
+	c.failingSince.Store(deployment.UID, now)
+	if _, wait := c.patchPacer.wait(logr.Discard(), "Deployment", other, now); wait {
+		t.Fatal("first patch was deferred")
+	}
+	if _, wait := c.patchPacer.wait(logr.Discard(), "Deployment", deployment, now); !wait {
+		t.Fatal("second patch wasn't deferred")
+	}
+
+	queue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	defer queue.ShutDown()
+	c.forgetDeletedWorkloads().Delete(event.DeleteEvent{Object: deployment}, queue)
+
+	if _, ok := c.retryBudget.failing[deployment.UID]; ok {
+		t.Error("retry budget still tracks the deleted workload")
+	}
+	if _, ok := c.patchPacer.scheduled[deployment.UID]; ok {
+		t.Error("patch pacer still has a slot scheduled for the deleted workload")
+	}
+	if _, ok := c.failingSince.Load(deployment.UID); ok {
+		t.Error("failure state of the deleted workload wasn't dropped")
+	}
+}
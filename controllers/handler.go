@@ -0,0 +1,137 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// resetBackoffOnImageChange resets the rate limiter state of objects whose pod template images were changed.
+// Without this, objects that failed before (e.g., because of a typo in an image reference) would still be requeued
+// with the accumulated backoff after the user fixed the image reference.
+// It doesn't enqueue any objects itself, this is done by the handler of the For() watch.
+var resetBackoffOnImageChange = handler.Funcs{
+	UpdateFunc: func(e event.UpdateEvent, q workqueue.RateLimitingInterface) {
+		if e.ObjectOld == nil || e.ObjectNew == nil {
+			return
+		}
+
+		if !imagesEqual(indexImages(e.ObjectOld), indexImages(e.ObjectNew)) {
+			q.Forget(reconcile.Request{NamespacedName: types.NamespacedName{
+				Namespace: e.ObjectNew.GetNamespace(),
+				Name:      e.ObjectNew.GetName(),
+			}})
+		}
+	},
+}
+
+// forgetDeletedWorkloads drops the state that is kept for workloads by UID when they are deleted, see forgetWorkload.
+// Workloads without our finalizer are gone when they are reconciled, so the reconciler doesn't know their UID anymore.
+// It doesn't enqueue any objects itself.
+func (c *ImageCloneController) forgetDeletedWorkloads() handler.EventHandler {
+	return handler.Funcs{
+		DeleteFunc: func(e event.DeleteEvent, _ workqueue.RateLimitingInterface) {
+			if e.Object != nil {
+				c.forgetWorkload(e.Object.GetUID())
+			}
+		},
+	}
+}
+
+func imagesEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// copyFinishedObject wraps the source image of a finished copy into an object that can be sent as a GenericEvent.
+func copyFinishedObject(image string) client.Object {
+	return &metav1.PartialObjectMetadata{ObjectMeta: metav1.ObjectMeta{Name: image}}
+}
+
+// copyFinishedSource returns a source of GenericEvents for copies finished by the Copier (see copyFinishedObject), which
+// are sent by Copier.OnCopyFinished.
+func (c *ImageCloneController) copyFinishedSource() *source.Channel {
+	events := make(chan event.GenericEvent, 100)
+	c.Copier.OnCopyFinished = func(image string) {
+		select {
+		case events <- event.GenericEvent{Object: copyFinishedObject(image)}:
+		default:
+			// never block the copier if the controllers can't keep up, waiting workloads are requeued after
+			// CopyPendingRequeueInterval in this case
+			logf.Log.V(1).Info("Dropping notification for finished copy, waiting workloads are requeued later", "image", image)
+		}
+	}
+	return &source.Channel{Source: events}
+}
+
+// enqueueWorkloadsWaitingForImage maps GenericEvents for finished copies (see copyFinishedObject) to all workloads of
+// the given list type that reference the copied source image and pass the given filter.
+func enqueueWorkloadsWaitingForImage(reader client.Reader, list client.ObjectList, filter predicate.Predicate) handler.EventHandler {
+	return handler.EnqueueRequestsFromMapFunc(func(obj client.Object) []reconcile.Request {
+		workloads := list.DeepCopyObject().(client.ObjectList)
+		if err := reader.List(context.Background(), workloads, client.MatchingFields{ImageIndexField: obj.GetName()}); err != nil {
+			logf.Log.Error(err, "Failed listing workloads waiting for image", "image", obj.GetName())
+			return nil
+		}
+
+		var requests []reconcile.Request
+		_ = meta.EachListItem(workloads, func(o runtime.Object) error {
+			workload := o.(client.Object)
+			if filter.Generic(event.GenericEvent{Object: workload}) {
+				requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(workload)})
+			}
+			return nil
+		})
+		return requests
+	})
+}
+
+// annotationChanged lets through updates of objects that change the given annotation, as annotation changes don't
+// increment the generation.
+func annotationChanged(key string) predicate.Funcs {
+	return predicate.Funcs{
+		CreateFunc:  func(event.CreateEvent) bool { return false },
+		DeleteFunc:  func(event.DeleteEvent) bool { return false },
+		GenericFunc: func(event.GenericEvent) bool { return false },
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			if e.ObjectOld == nil || e.ObjectNew == nil {
+				return false
+			}
+			return e.ObjectOld.GetAnnotations()[key] != e.ObjectNew.GetAnnotations()[key]
+		},
+	}
+}
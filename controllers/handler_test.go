@@ -0,0 +1,105 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/workqueue"
+	testingclock "k8s.io/utils/clock/testing"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/timebertt/image-clone-controller/pkg/test"
+)
+
+// fakeClockQueue is a rate limiting queue on a fake clock, as workqueue.NewRateLimitingQueue always uses the real clock.
+type fakeClockQueue struct {
+	workqueue.DelayingInterface
+	rateLimiter workqueue.RateLimiter
+}
+
+func (q *fakeClockQueue) AddRateLimited(item interface{}) {
+	q.DelayingInterface.AddAfter(item, q.rateLimiter.When(item))
+}
+
+func (q *fakeClockQueue) Forget(item interface{}) {
+	q.rateLimiter.Forget(item)
+}
+
+func (q *fakeClockQueue) NumRequeues(item interface{}) int {
+	return q.rateLimiter.NumRequeues(item)
+}
+
+// eventually polls the given condition until it is true or the timeout expires and returns its last result.
+func eventually(timeout time.Duration, condition func() bool) bool {
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if condition() {
+			return true
+		}
+	}
+	return condition()
+}
+
+func TestResetBackoffOnImageChange(t *testing.T) {
+	tests := []struct {
+		name         string
+		newImage     string
+		wantRequeued bool
+	}{
+		{name: "image fixed", newImage: "nginx:1.23", wantRequeued: true},
+		{name: "image unchanged", newImage: "nginxx:1.23", wantRequeued: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := testingclock.NewFakeClock(time.Now())
+			q := &fakeClockQueue{
+				DelayingInterface: workqueue.NewDelayingQueueWithCustomClock(clock, "test"),
+				rateLimiter:       workqueue.NewItemExponentialFailureRateLimiter(time.Second, time.Hour),
+			}
+			defer q.ShutDown()
+
+			req := reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "app"}}
+			// accumulate a long backoff with an image reference that contains a typo
+			for i := 0; i < 10; i++ {
+				q.rateLimiter.When(req)
+			}
+
+			old := test.NewDeployment("default", "app", "nginxx:1.23")
+			updated := old.DeepCopy()
+			updated.Spec.Template.Spec.Containers[0].Image = tt.newImage
+			updated.Labels = map[string]string{"changed": "true"}
+			resetBackoffOnImageChange.Update(event.UpdateEvent{ObjectOld: old, ObjectNew: updated}, q)
+
+			// the reconciliation fails once more before the fix is observed
+			q.AddRateLimited(req)
+			clock.Step(2 * time.Second)
+
+			timeout := 100 * time.Millisecond
+			if tt.wantRequeued {
+				timeout = 5 * time.Second
+			}
+			requeued := eventually(timeout, func() bool { return q.Len() > 0 })
+			if requeued != tt.wantRequeued {
+				t.Errorf("requeued within 2s = %v, want %v", requeued, tt.wantRequeued)
+			}
+		})
+	}
+}
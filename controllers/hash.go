@@ -0,0 +1,70 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// ImagesHashAnnotation is set on workloads when patching images. It contains a hash of all images in the pod template
+// after rewriting them, which allows skipping unchanged workloads without parsing and checking every image.
+const ImagesHashAnnotation = "image-clone.timebertt.dev/images-hash"
+
+// imagesHash calculates the hash of all images in the given pod template that the controller rewrites.
+func (c *ImageCloneController) imagesHash(template *corev1.PodTemplateSpec) string {
+	h := sha256.New()
+	for _, container := range c.containerImages(template) {
+		h.Write([]byte(container.List.hashPrefix() + container.Name + "=" + container.Image + "\n"))
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// imagesUnchanged checks whether the pod template's images were not changed since the controller last patched them,
+// and all of them reference the given backup registry and destination prefix.
+func (c *ImageCloneController) imagesUnchanged(obj client.Object, template *corev1.PodTemplateSpec, backupRegistry name.Registry, destinationPrefix string) bool {
+	hash, ok := obj.GetAnnotations()[ImagesHashAnnotation]
+	if !ok || hash != c.imagesHash(template) {
+		return false
+	}
+
+	// the hash could have been copied from another workload, so we cheaply verify the registries as well
+	prefix := backupRegistry.RegistryStr() + "/"
+	if destinationPrefix != "" {
+		prefix += destinationPrefix + "/"
+	}
+	for _, container := range c.containerImages(template) {
+		if !strings.HasPrefix(container.Image, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+func setAnnotation(obj client.Object, key, value string) {
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		annotations = make(map[string]string, 1)
+	}
+	annotations[key] = value
+	obj.SetAnnotations(annotations)
+}
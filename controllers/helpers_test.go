@@ -0,0 +1,99 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/timebertt/image-clone-controller/pkg/copier"
+	"github.com/timebertt/image-clone-controller/pkg/test"
+)
+
+// indexedClient serves List requests with a field selector for ImageIndexField like the manager's cache does. The
+// fake client ignores field selectors.
+type indexedClient struct {
+	client.Client
+}
+
+func (c indexedClient) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	listOpts := &client.ListOptions{}
+	listOpts.ApplyOptions(opts)
+
+	image, indexed := "", false
+	if listOpts.FieldSelector != nil {
+		image, indexed = listOpts.FieldSelector.RequiresExactMatch(ImageIndexField)
+		listOpts.FieldSelector = nil
+	}
+	if err := c.Client.List(ctx, list, listOpts); err != nil || !indexed {
+		return err
+	}
+
+	items, err := meta.ExtractList(list)
+	if err != nil {
+		return err
+	}
+	var filtered []runtime.Object
+	for _, item := range items {
+		if sets.NewString(indexImages(item.(client.Object))...).Has(image) {
+			filtered = append(filtered, item)
+		}
+	}
+	return meta.SetList(list, filtered)
+}
+
+// newTestController returns a controller for the given objects with a fake client, a fake event recorder, and a
+// copier using the default transport. objs without a UID get one derived from their name.
+func newTestController(t *testing.T, objs ...client.Object) *ImageCloneController {
+	t.Helper()
+
+	for _, obj := range objs {
+		if obj.GetUID() == "" {
+			obj.SetUID(types.UID(obj.GetNamespace() + "/" + obj.GetName()))
+		}
+	}
+
+	c := &ImageCloneController{
+		Client:   indexedClient{fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithObjects(objs...).Build()},
+		Recorder: record.NewFakeRecorder(100),
+		Copier:   &copier.Copier{},
+	}
+	c.EnableDeployments = true
+	c.EnableDaemonSets = true
+	return c
+}
+
+// newTestRegistry starts an in-process registry that is closed when the test finishes.
+func newTestRegistry(t *testing.T) *test.Registry {
+	t.Helper()
+
+	reg, err := test.NewRegistry()
+	if err != nil {
+		t.Fatalf("error starting registry: %v", err)
+	}
+	t.Cleanup(reg.Close)
+	return reg
+}
@@ -0,0 +1,69 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	"github.com/timebertt/image-clone-controller/pkg/test"
+)
+
+func TestIgnoredNamespacesPerController(t *testing.T) {
+	// set up two controllers like SetupWithManager does, each running in a different namespace
+	controllers := make([]*ImageCloneController, 2)
+	for i, namespace := range []string{"image-clone-a", "image-clone-b"} {
+		c := newTestController(t)
+		c.PodNamespace = namespace
+		c.ignoredNamespaces = c.IgnoredNamespaces()
+		controllers[i] = c
+	}
+
+	tests := []struct {
+		namespace                  string
+		wantIgnoredA, wantIgnoredB bool
+	}{
+		{namespace: metav1.NamespaceSystem, wantIgnoredA: true, wantIgnoredB: true},
+		{namespace: RegistryNamespace, wantIgnoredA: true, wantIgnoredB: true},
+		{namespace: "image-clone-a", wantIgnoredA: true},
+		{namespace: "image-clone-b", wantIgnoredB: true},
+		{namespace: "default"},
+	}
+
+	for _, tt := range tests {
+		obj := test.NewDeployment(tt.namespace, "app", "nginx:1.23")
+		for i, wantIgnored := range []bool{tt.wantIgnoredA, tt.wantIgnoredB} {
+			if ignored := !controllers[i].namespacePredicate().Create(event.CreateEvent{Object: obj}); ignored != wantIgnored {
+				t.Errorf("controller %d ignores namespace %s: %v, want %v", i, tt.namespace, ignored, wantIgnored)
+			}
+		}
+	}
+}
+
+func TestDefaultIgnoredNamespaces(t *testing.T) {
+	defaults := DefaultIgnoredNamespaces()
+	defaults[0] = "default"
+
+	if DefaultIgnoredNamespaces()[0] != metav1.NamespaceSystem {
+		t.Error("modifying the returned defaults changed the defaults")
+	}
+	if (&Config{}).IgnoredNamespaces().Has("default") {
+		t.Error("modifying the returned defaults changed the ignored namespaces")
+	}
+}
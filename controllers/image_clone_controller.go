@@ -18,26 +18,40 @@ package controllers
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/go-logr/logr"
-	"github.com/google/go-containerregistry/pkg/crane"
 	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	apiequality "k8s.io/apimachinery/pkg/api/equality"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	"github.com/timebertt/image-clone-controller/pkg/copier"
+	"github.com/timebertt/image-clone-controller/pkg/naming"
+	"github.com/timebertt/image-clone-controller/pkg/notify"
 )
 
 // ImageCloneControllerName is the name of the image-clone-controller.
@@ -48,55 +62,351 @@ type ImageCloneController struct {
 	client.Client
 	Recorder record.EventRecorder
 
-	BackupRegistry name.Registry
-	PodNamespace   string
+	Copier *copier.Copier
+	// Decisions remembers up-to-date rewrites, it is shared with other consumers of the rewrite decisions. Optional.
+	Decisions *RewriteDecisions
+	// Notifier receives notifications about copies and patched workloads. Defaults to notify.NopSink.
+	Notifier notify.Sink
+
+	Config
+
+	// failingSince stores the time of the first failure of consecutively failing workloads by UID
+	failingSince sync.Map
+	// rewriteLoops stores the *rewriteLoop of workloads by UID
+	rewriteLoops sync.Map
+	// rolloutWaitingSince stores the time since when patching workloads has been delayed because of a rollout by UID
+	rolloutWaitingSince sync.Map
+	// busySince stores the time since when patching workloads has been deferred because of a busy marker by UID
+	busySince sync.Map
+	// patchWindowDeferred stores the value of the ForceSyncAnnotation of workloads whose patch has been deferred until
+	// a patch window opens by UID
+	patchWindowDeferred sync.Map
+	// mirroredArtifacts stores the destination of the artifacts mirrored for the MirrorAnnotatedArtifacts annotations by
+	// UID and annotation key
+	mirroredArtifacts sync.Map
+	// resyncing stores the UIDs of workloads enqueued by a full resync, see resyncer
+	resyncing sync.Map
+	// pendingApprovals tracks the workloads whose images are pending approval with RewriteOnlyPreapproved
+	pendingApprovals pendingApprovals
+	// missingPullAccess tracks the workloads whose patch is deferred because of missing pull access with RequirePullAccess
+	missingPullAccess missingPullAccess
+	// mirrorProhibitedList holds the patterns of MirrorProhibitedFile
+	mirrorProhibitedList mirrorProhibitedList
+	// copyHistory is set if CopyHistoryConfigMap is configured
+	copyHistory *copyHistory
+	// pendingJournal is set if PendingJournalConfigMap is configured
+	pendingJournal *pendingJournal
+	// retryBudget is set if RetryBudget is configured
+	retryBudget *retryBudget
+	// patchPacer is set if MaxPatchesPerMinute or MaxPatchesPerMinutePerNamespace is configured
+	patchPacer *patchPacer
+	// status is set if StatusConfigMap is configured
+	status *statusReporter
+	// nodePlatforms is set if DetectPlatforms is enabled
+	nodePlatforms *nodePlatforms
+	// initialSync is set unless ReadyWithoutSync is enabled
+	initialSync *initialSync
+	// bulkPasses is set if NamespaceSummaryEvents is enabled
+	bulkPasses *bulkPasses
+	// ignoredNamespaces are the namespaces whose workloads are never reconciled, set up from the Config
+	ignoredNamespaces sets.String
+	// apiReader reads objects directly from the API server, e.g., secrets, which must not be cached cluster-wide. It is
+	// set up from the manager and defaults to the Client.
+	apiReader client.Reader
 }
 
-//+kubebuilder:rbac:groups=apps,resources=deployments,verbs=get;list;watch;update;patch
-//+kubebuilder:rbac:groups=apps,resources=daemonsets,verbs=get;list;watch;update;patch
+//+kubebuilder:rbac:groups=apps,resources=deployments,verbs=get;list;watch;patch
+//+kubebuilder:rbac:groups=apps,resources=daemonsets,verbs=get;list;watch;patch
 //+kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+//+kubebuilder:rbac:groups="",resources=configmaps,verbs=get;create;update
 
 // SetupWithManager sets up the controller with the Manager.
 func (c *ImageCloneController) SetupWithManager(mgr ctrl.Manager) error {
-	if c.PodNamespace != "" {
-		// ignore the namespace that this controller is running in
-		ignoredNamespaces.Insert(c.PodNamespace)
+	c.ignoredNamespaces = c.IgnoredNamespaces()
+	c.apiReader = mgr.GetAPIReader()
+
+	if !c.EnableDeployments && !c.EnableDaemonSets {
+		return fmt.Errorf("at least one of the Deployment or DaemonSet controllers must be enabled")
+	}
+
+	// workloads of other shards never enter the queue, and all runnables tracking workloads run on every replica
+	workloadFilter := c.workloadFilter()
+	workloadMgr := c.workloadManager(mgr)
+	if c.sharded() {
+		kinds := make(map[string]client.ObjectList)
+		if c.EnableDeployments {
+			kinds["Deployment"] = &appsv1.DeploymentList{}
+		}
+		if c.EnableDaemonSets {
+			kinds["DaemonSet"] = &appsv1.DaemonSetList{}
+		}
+		if err := metrics.Registry.Register(newShardWorkloadsCollector(mgr.GetCache(), c, kinds)); err != nil {
+			return err
+		}
 	}
 
-	if err := ctrl.NewControllerManagedBy(mgr).
-		Named(ImageCloneControllerName).
-		For(&appsv1.Deployment{}, builder.WithPredicates(predicate.GenerationChangedPredicate{}, namespacePredicate)).
-		WithOptions(controller.Options{
-			MaxConcurrentReconciles: 5,
-		}).
-		Complete(reconcile.Func(c.ReconcileDeployment)); err != nil {
+	ctx := context.Background()
+	if err := mgr.GetFieldIndexer().IndexField(ctx, &appsv1.Deployment{}, ImageIndexField, indexImages); err != nil {
 		return err
 	}
-	if err := ctrl.NewControllerManagedBy(mgr).
-		Named(ImageCloneControllerName).
-		For(&appsv1.DaemonSet{}, builder.WithPredicates(predicate.GenerationChangedPredicate{}, namespacePredicate)).
-		WithOptions(controller.Options{
-			MaxConcurrentReconciles: 5,
-		}).
-		Complete(reconcile.Func(c.ReconcileDaemonSet)); err != nil {
+	if err := mgr.GetFieldIndexer().IndexField(ctx, &appsv1.DaemonSet{}, ImageIndexField, indexImages); err != nil {
 		return err
 	}
+
+	if len(c.PreviousBackupRegistries) > 0 {
+		var kinds []client.ObjectList
+		if c.EnableDeployments {
+			kinds = append(kinds, &appsv1.DeploymentList{})
+		}
+		if c.EnableDaemonSets {
+			kinds = append(kinds, &appsv1.DaemonSetList{})
+		}
+		if err := metrics.Registry.Register(newPreviousBackupRegistryReferencesCollector(mgr.GetCache(), c.PreviousBackupRegistries, kinds)); err != nil {
+			return err
+		}
+	}
+
+	if c.CopyHistoryConfigMap != "" {
+		if c.PodNamespace == "" {
+			return fmt.Errorf("the copy history requires the POD_NAMESPACE environment variable")
+		}
+		c.copyHistory = newCopyHistory(mgr.GetClient(), mgr.GetAPIReader(), client.ObjectKey{Namespace: c.PodNamespace, Name: c.shardConfigMapName(c.CopyHistoryConfigMap)})
+		if err := workloadMgr.Add(c.copyHistory); err != nil {
+			return err
+		}
+		if err := metrics.Registry.Register(c.copyHistory); err != nil {
+			return err
+		}
+		if c.DebugEndpoint {
+			if err := mgr.AddMetricsExtraHandler(CopyHistoryPath, copier.NewDebugHandler(c.DebugEndpointToken, func() interface{} {
+				return c.copyHistory.entries()
+			})); err != nil {
+				return err
+			}
+		}
+	}
+
+	if c.PendingJournalConfigMap != "" {
+		if c.PodNamespace == "" {
+			return fmt.Errorf("the pending journal requires the POD_NAMESPACE environment variable")
+		}
+		c.pendingJournal = newPendingJournal(mgr.GetClient(), mgr.GetAPIReader(), client.ObjectKey{Namespace: c.PodNamespace, Name: c.shardConfigMapName(c.PendingJournalConfigMap)}, &c.resyncing)
+		if err := workloadMgr.Add(c.pendingJournal); err != nil {
+			return err
+		}
+	}
+
+	if c.RetryBudget > 0 {
+		c.retryBudget = newRetryBudget(c.RetryBudget)
+	}
+	if c.MaxPatchesPerMinute > 0 || c.MaxPatchesPerMinutePerNamespace > 0 {
+		c.patchPacer = newPatchPacer(c.MaxPatchesPerMinute, c.MaxPatchesPerMinutePerNamespace)
+	}
+
+	if c.DetectPlatforms {
+		var err error
+		if c.nodePlatforms, err = newNodePlatforms(ctx, mgr.GetCache()); err != nil {
+			return err
+		}
+	}
+
+	if c.StatusConfigMap != "" {
+		if c.PodNamespace == "" {
+			// the status ConfigMap is enabled by default, don't fail when running outside the cluster
+			mgr.GetLogger().Info("Not writing the status ConfigMap as the POD_NAMESPACE environment variable is not set")
+		} else {
+			c.status = newStatusReporter(mgr.GetClient(), mgr.GetAPIReader(), client.ObjectKey{Namespace: c.PodNamespace, Name: c.shardConfigMapName(c.StatusConfigMap)},
+				c.StatusUpdateInterval, c.BackupRegistry, c.Copier)
+			if err := workloadMgr.Add(c.status); err != nil {
+				return err
+			}
+		}
+	}
+
+	if c.NamespaceSummaryEvents {
+		c.bulkPasses = newBulkPasses(c.event)
+	}
+
+	if !c.ReadyWithoutSync {
+		kinds := make(map[string]client.ObjectList)
+		if c.EnableDeployments {
+			kinds["Deployment"] = &appsv1.DeploymentList{}
+		}
+		if c.EnableDaemonSets {
+			kinds["DaemonSet"] = &appsv1.DaemonSetList{}
+		}
+		c.initialSync = newInitialSync(mgr.GetCache(), kinds, c.InitialSyncThreshold, workloadFilter, c.bulkPasses)
+		if err := workloadMgr.Add(c.initialSync); err != nil {
+			return err
+		}
+	}
+
+	if c.CoverageInterval > 0 {
+		var kinds []client.ObjectList
+		if c.EnableDeployments {
+			kinds = append(kinds, &appsv1.DeploymentList{})
+		}
+		if c.EnableDaemonSets {
+			kinds = append(kinds, &appsv1.DaemonSetList{})
+		}
+		if err := mgr.Add(&coverageReporter{
+			reader:         mgr.GetCache(),
+			controller:     c,
+			kinds:          kinds,
+			interval:       c.CoverageInterval,
+			namespaceLimit: c.CoverageNamespaceLimit,
+		}); err != nil {
+			return err
+		}
+	}
+
+	// full resyncs can only be triggered with a token, so that tenants can't cause cluster-wide registry load
+	var resync *resyncer
+	if c.DebugEndpoint && c.DebugEndpointToken != "" {
+		resync = &resyncer{reader: mgr.GetCache(), filter: workloadFilter, spread: c.ResyncSpread, pending: &c.resyncing, passes: c.bulkPasses}
+		if err := workloadMgr.Add(resync); err != nil {
+			return err
+		}
+		if err := mgr.AddMetricsExtraHandler(ResyncPath, resync.handler(c.DebugEndpointToken)); err != nil {
+			return err
+		}
+		// generating the mapping manifest checks every tag in the backup registry, so it also requires a token
+		if err := mgr.AddMetricsExtraHandler(MappingManifestPath, c.mappingManifestHandler(mgr.GetLogger().WithName("mapping-manifest"), mgr.GetCache(), c.DebugEndpointToken)); err != nil {
+			return err
+		}
+	}
+
+	if c.DebugEndpoint {
+		// planning doesn't contact any registry or write anything, so it is also served if no token is configured, but
+		// requires the token otherwise like all debug endpoints
+		if err := mgr.AddMetricsExtraHandler(PlanPath, c.planHandler(mgr.GetCache(), c.DebugEndpointToken)); err != nil {
+			return err
+		}
+	}
+
+	var copyFinishedSource *source.Channel
+	if c.AsyncCopies {
+		copyFinishedSource = c.copyFinishedSource()
+	}
+
+	if c.EnableDeployments {
+		b := ctrl.NewControllerManagedBy(workloadMgr).
+			Named(ImageCloneControllerName+"-deployment").
+			For(&appsv1.Deployment{}, builder.WithPredicates(predicate.Or(c.workloadPredicates()...), workloadFilter)).
+			Watches(&source.Kind{Type: &appsv1.Deployment{}}, resetBackoffOnImageChange, builder.WithPredicates(workloadFilter)).
+			Watches(&source.Kind{Type: &appsv1.Deployment{}}, c.forgetDeletedWorkloads()).
+			WithOptions(controller.Options{
+				MaxConcurrentReconciles: 5,
+			})
+		if !c.NamespacedRBAC {
+			b = b.Watches(&source.Kind{Type: &corev1.Namespace{}}, c.enqueueWorkloadsInNamespace(mgr.GetClient(), &appsv1.DeploymentList{}, workloadFilter), builder.WithPredicates(namespaceAnnotationsChanged))
+		}
+		if c.RequirePullAccess && !c.NodePullCredentials {
+			// pull secrets might be added to the namespace or service accounts of workloads with missing pull access, only
+			// their namespace is needed for enqueueing the workloads, so don't cache their contents
+			b = b.Watches(&source.Kind{Type: &corev1.Secret{}}, c.missingPullAccess.enqueueWorkloads("Deployment"), builder.OnlyMetadata).
+				Watches(&source.Kind{Type: &corev1.ServiceAccount{}}, c.missingPullAccess.enqueueWorkloads("Deployment"), builder.OnlyMetadata)
+		}
+		if copyFinishedSource != nil {
+			b = b.Watches(copyFinishedSource, enqueueWorkloadsWaitingForImage(mgr.GetClient(), &appsv1.DeploymentList{}, workloadFilter))
+		}
+		if resync != nil {
+			events := make(chan event.GenericEvent, 100)
+			resync.kinds = append(resync.kinds, resyncKind{name: "Deployment", list: &appsv1.DeploymentList{}, events: events})
+			b = b.Watches(&source.Channel{Source: events}, &handler.EnqueueRequestForObject{}, builder.WithPredicates(workloadFilter))
+		}
+		if c.pendingJournal != nil {
+			events := make(chan event.GenericEvent, 100)
+			c.pendingJournal.kinds["Deployment"] = events
+			b = b.Watches(&source.Channel{Source: events}, &handler.EnqueueRequestForObject{}, builder.WithPredicates(workloadFilter))
+		}
+		if err := b.Complete(instrumentReconciler("Deployment", c.initialSync.track("Deployment", c.bulkPasses.track("Deployment", c.ReconcileDeployment)))); err != nil {
+			return err
+		}
+	}
+	if c.EnableDaemonSets {
+		b := ctrl.NewControllerManagedBy(workloadMgr).
+			Named(ImageCloneControllerName+"-daemonset").
+			For(&appsv1.DaemonSet{}, builder.WithPredicates(predicate.Or(c.workloadPredicates()...), workloadFilter)).
+			Watches(&source.Kind{Type: &appsv1.DaemonSet{}}, resetBackoffOnImageChange, builder.WithPredicates(workloadFilter)).
+			Watches(&source.Kind{Type: &appsv1.DaemonSet{}}, c.forgetDeletedWorkloads()).
+			WithOptions(controller.Options{
+				MaxConcurrentReconciles: 5,
+			})
+		if !c.NamespacedRBAC {
+			b = b.Watches(&source.Kind{Type: &corev1.Namespace{}}, c.enqueueWorkloadsInNamespace(mgr.GetClient(), &appsv1.DaemonSetList{}, workloadFilter), builder.WithPredicates(namespaceAnnotationsChanged))
+		}
+		if c.RequirePullAccess && !c.NodePullCredentials {
+			// pull secrets might be added to the namespace or service accounts of workloads with missing pull access, only
+			// their namespace is needed for enqueueing the workloads, so don't cache their contents
+			b = b.Watches(&source.Kind{Type: &corev1.Secret{}}, c.missingPullAccess.enqueueWorkloads("DaemonSet"), builder.OnlyMetadata).
+				Watches(&source.Kind{Type: &corev1.ServiceAccount{}}, c.missingPullAccess.enqueueWorkloads("DaemonSet"), builder.OnlyMetadata)
+		}
+		if copyFinishedSource != nil {
+			b = b.Watches(copyFinishedSource, enqueueWorkloadsWaitingForImage(mgr.GetClient(), &appsv1.DaemonSetList{}, workloadFilter))
+		}
+		if resync != nil {
+			events := make(chan event.GenericEvent, 100)
+			resync.kinds = append(resync.kinds, resyncKind{name: "DaemonSet", list: &appsv1.DaemonSetList{}, events: events})
+			b = b.Watches(&source.Channel{Source: events}, &handler.EnqueueRequestForObject{}, builder.WithPredicates(workloadFilter))
+		}
+		if c.pendingJournal != nil {
+			events := make(chan event.GenericEvent, 100)
+			c.pendingJournal.kinds["DaemonSet"] = events
+			b = b.Watches(&source.Channel{Source: events}, &handler.EnqueueRequestForObject{}, builder.WithPredicates(workloadFilter))
+		}
+		if err := b.Complete(instrumentReconciler("DaemonSet", c.initialSync.track("DaemonSet", c.bulkPasses.track("DaemonSet", c.ReconcileDaemonSet)))); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// workloadPredicates returns the predicates for workload changes that require reconciling the workload.
+func (c *ImageCloneController) workloadPredicates() []predicate.Predicate {
+	predicates := []predicate.Predicate{
+		c.specChangedPredicate(),
+		annotationChanged(AllowLargeImagesAnnotation),
+		annotationChanged(ForceSyncAnnotation),
+		annotationChanged(DestinationPrefixAnnotation),
+		annotationChanged(PatchWindowAnnotation),
+	}
+	for _, key := range c.MirrorAnnotatedArtifacts {
+		predicates = append(predicates, annotationChanged(key))
+	}
+	return predicates
+}
+
 // RegistryNamespace is the namespace that our local registry is running in.
 const RegistryNamespace = "registry"
 
-var ignoredNamespaces = sets.NewString(
+var defaultIgnoredNamespaces = [...]string{
 	metav1.NamespaceSystem,
 	RegistryNamespace,
 	"local-path-storage", // kind system component
-)
+}
+
+// DefaultIgnoredNamespaces returns the system namespaces that are ignored by default. The returned slice is a copy.
+func DefaultIgnoredNamespaces() []string {
+	return append([]string(nil), defaultIgnoredNamespaces[:]...)
+}
+
+// IgnoredNamespaces returns the namespaces that are ignored with this configuration, i.e., the default system namespaces
+// and the namespace that the controller is running in.
+func (c *Config) IgnoredNamespaces() sets.String {
+	ignored := sets.NewString(defaultIgnoredNamespaces[:]...)
+	if c.PodNamespace != "" {
+		ignored.Insert(c.PodNamespace)
+	}
+	return ignored
+}
 
-// namespacePredicate ignores objects in system namespaces.
-var namespacePredicate = predicate.NewPredicateFuncs(func(obj client.Object) bool {
-	return !ignoredNamespaces.Has(obj.GetNamespace())
-})
+// namespacePredicate ignores objects in the ignored namespaces.
+func (c *ImageCloneController) namespacePredicate() predicate.Predicate {
+	return predicate.NewPredicateFuncs(func(obj client.Object) bool {
+		return !c.ignoredNamespaces.Has(obj.GetNamespace())
+	})
+}
 
 // ReconcileDeployment implements the reconciliation loop for Deployment objects.
 func (c *ImageCloneController) ReconcileDeployment(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
@@ -106,26 +416,15 @@ func (c *ImageCloneController) ReconcileDeployment(ctx context.Context, req ctrl
 	if err := c.Get(ctx, req.NamespacedName, deployment); err != nil {
 		if apierrors.IsNotFound(err) {
 			log.Info("Object is gone, stop reconciling")
+			c.pendingJournal.remove("Deployment", req.NamespacedName)
+			c.pendingApprovals.set("Deployment", req.NamespacedName, false)
+			c.missingPullAccess.set("Deployment", req.NamespacedName, false)
 			return reconcile.Result{}, nil
 		}
 		return reconcile.Result{}, fmt.Errorf("error reading object: %w", err)
 	}
 
-	before := deployment.DeepCopy()
-	if err := c.reconcilePodTemplate(log, &deployment.Spec.Template); err != nil {
-		c.Recorder.Event(deployment, corev1.EventTypeWarning, "FailedCopyingImages", err.Error())
-		return ctrl.Result{}, err
-	}
-
-	// update deployment if reconciliation changed any images
-	if !apiequality.Semantic.DeepEqual(before, deployment) {
-		// use optimistic locking for patching the deployment, we should retry with exponential backoff if new containers or
-		// images were added in the meantime
-		log.Info("Patching images in Deployment")
-		return ctrl.Result{}, c.Patch(ctx, deployment, client.StrategicMergeFrom(before, client.MergeFromWithOptimisticLock{}))
-	}
-
-	return ctrl.Result{}, nil
+	return c.reconcileWorkload(ctx, log, "Deployment", deployment, &deployment.Spec.Template)
 }
 
 // ReconcileDaemonSet implements the reconciliation loop for DaemonSet objects.
@@ -136,83 +435,657 @@ func (c *ImageCloneController) ReconcileDaemonSet(ctx context.Context, req ctrl.
 	if err := c.Get(ctx, req.NamespacedName, daemonSet); err != nil {
 		if apierrors.IsNotFound(err) {
 			log.Info("Object is gone, stop reconciling")
+			c.pendingJournal.remove("DaemonSet", req.NamespacedName)
+			c.pendingApprovals.set("DaemonSet", req.NamespacedName, false)
+			c.missingPullAccess.set("DaemonSet", req.NamespacedName, false)
 			return reconcile.Result{}, nil
 		}
 		return reconcile.Result{}, fmt.Errorf("error reading object: %w", err)
 	}
 
-	before := daemonSet.DeepCopy()
-	if err := c.reconcilePodTemplate(log, &daemonSet.Spec.Template); err != nil {
-		c.Recorder.Event(daemonSet, corev1.EventTypeWarning, "FailedCopyingImages", err.Error())
+	return c.reconcileWorkload(ctx, log, "DaemonSet", daemonSet, &daemonSet.Spec.Template)
+}
+
+// forgetWorkload drops the state that is kept for the workload with the given UID, e.g., when it is deleted.
+func (c *ImageCloneController) forgetWorkload(uid types.UID) {
+	c.failingSince.Delete(uid)
+	c.rewriteLoops.Delete(uid)
+	c.Decisions.forget(uid)
+	c.retryBudget.forget(uid)
+	c.patchPacer.forget(uid)
+
+	// artifacts are stored by UID and annotation key
+	c.mirroredArtifacts.Range(func(key, _ interface{}) bool {
+		if strings.HasPrefix(key.(string), string(uid)+"/") {
+			c.mirroredArtifacts.Delete(key)
+		}
+		return true
+	})
+}
+
+// reconcileWorkload implements the reconciliation logic shared by all workload kinds. template must point to the pod
+// template contained in obj, so that changes to the template are reflected in the patch sent for obj.
+func (c *ImageCloneController) reconcileWorkload(ctx context.Context, log logr.Logger, kind string, obj client.Object, template *corev1.PodTemplateSpec) (ctrl.Result, error) {
+	// attribute registry requests to the workload kind
+	ctx = copier.WithKind(ctx, kind)
+
+	// workloads in skipped namespaces are still finalized, so that cleanup doesn't block their deletion
+	target, err := c.targetFor(ctx, c.Client, obj, false)
+	if err != nil {
 		return ctrl.Result{}, err
 	}
+	if target.Skipped != "" {
+		log.V(1).Info("Skipping workload", "reason", target.Skipped)
+		return ctrl.Result{}, nil
+	}
+
+	c.status.workloadProcessed()
+
+	backupRegistry, prefix := target.BackupRegistry, target.Prefix
+	if backupRegistry != c.BackupRegistry {
+		log = log.WithValues("backupRegistry", backupRegistry.Name())
+	}
+	if prefix != "" {
+		log = log.WithValues("destinationPrefix", prefix)
+	}
+
+	if obj.GetDeletionTimestamp() != nil {
+		c.pendingJournal.remove(kind, client.ObjectKeyFromObject(obj))
+		c.pendingApprovals.set(kind, client.ObjectKeyFromObject(obj), false)
+		c.missingPullAccess.set(kind, client.ObjectKeyFromObject(obj), false)
+		c.forgetWorkload(obj.GetUID())
+		return ctrl.Result{}, c.finalizeWorkload(ctx, log, kind, obj, template, backupRegistry)
+	}
+
+	// artifacts are mirrored independently of the images, which might be unchanged
+	c.mirrorAnnotatedArtifacts(ctx, log, obj, backupRegistry, prefix)
+
+	if c.rewriteLoopBroken(obj) {
+		log.V(1).Info("Rewrite loop was detected, not patching images until the " + ForceSyncAnnotation + " annotation is changed")
+		return ctrl.Result{}, nil
+	}
+
+	if !c.resyncPending(obj.GetUID()) && c.imagesUnchanged(obj, template, backupRegistry, prefix) && (!c.CleanupOnDelete || controllerutil.ContainsFinalizer(obj, FinalizerName)) &&
+		obj.GetAnnotations()[LastErrorAnnotation] == "" {
+		log.V(1).Info("Images were not changed since the last patch, nothing to do")
+		c.pendingJournal.remove(kind, client.ObjectKeyFromObject(obj))
+		c.pendingApprovals.set(kind, client.ObjectKeyFromObject(obj), false)
+		c.missingPullAccess.set(kind, client.ObjectKeyFromObject(obj), false)
+		return c.pruneAnnotations(ctx, log, obj)
+	}
+
+	if !c.retryBudget.allow(obj.GetUID()) {
+		// the workload has been failing, retry later instead of adding to the load of a probably ongoing outage
+		log.Info("Retry budget exhausted, deferring retry of failing workload", "requeueAfter", c.RetryBudgetRequeueInterval)
+		return ctrl.Result{RequeueAfter: c.RetryBudgetRequeueInterval}, nil
+	}
+
+	ctx, copyCtx, cancel := c.withReconcileTimeout(ctx)
+	defer cancel()
+
+	result := ctrl.Result{}
+	before := obj.DeepCopyObject().(client.Object)
+	rewritten, err := c.reconcilePodTemplate(copyCtx, log, obj, template, backupRegistry, prefix)
+	if len(rewritten) > 0 || copier.IsCopyPending(err) {
+		// record the workload until it is patched, so that the patch isn't lost if the controller crashes in between
+		c.pendingJournal.add(kind, obj)
+	}
+	var (
+		offlineErr  *OfflineImagesMissingError
+		approvalErr *PendingApprovalError
+	)
+	if pendingApproval := errors.As(err, &approvalErr); pendingApproval || err == nil {
+		c.pendingApprovals.set(kind, client.ObjectKeyFromObject(obj), pendingApproval)
+	}
+	if errors.As(err, &offlineErr) {
+		// patch the existing images and check the missing images again later, retrying earlier doesn't help
+		log.Info("Images are missing in the backup registry in offline mode, checking again later", "images", offlineErr.Images, "requeueAfter", c.OfflineRequeueInterval)
+		result.RequeueAfter = c.OfflineRequeueInterval
+	} else if errors.As(err, &approvalErr) {
+		// patch the pre-approved images and check the others again later, they are never copied by us
+		log.Info("Images are pending approval in the backup registry, checking again later", "images", approvalErr.Images, "requeueAfter", c.PreapprovalRequeueInterval)
+		result.RequeueAfter = c.PreapprovalRequeueInterval
+	} else if err != nil {
+		if !errors.Is(copyCtx.Err(), context.DeadlineExceeded) || ctx.Err() != nil {
+			return c.handlePodTemplateError(ctx, log, before, err)
+		}
+
+		// patch partial progress and continue copying the remaining images in the next reconciliation
+		log.Info("Reconcile timeout reached, patching images that have been copied so far", "error", err.Error())
+		result.Requeue = true
+	}
+
+	if !result.Requeue {
+		c.clearFailure(obj)
+	}
+
+	if c.CleanupOnDelete {
+		// we only need to clean up images that we have copied for this workload, so add the finalizer in the same patch
+		// that rewrites the images
+		controllerutil.AddFinalizer(obj, FinalizerName)
+	}
+
+	// acknowledge in the same patch, removing the annotations is left to pruneAnnotations
+	c.acknowledgeForceSync(obj, time.Now())
+
+	// update object if reconciliation changed any images
+	if !apiequality.Semantic.DeepEqual(before, obj) {
+		templateChanged := !apiequality.Semantic.DeepEqual(podTemplateOf(before), template)
+		if templateChanged {
+			if requeueAfter, wait := c.waitForPatchWindow(log, kind, obj, time.Now()); wait {
+				// the workload is reconciled again when the window opens, the copied images exist by then
+				return ctrl.Result{RequeueAfter: requeueAfter}, nil
+			}
+			requeueAfter, wait, err := c.waitForPullAccess(ctx, log, kind, obj, template, backupRegistry)
+			if err != nil {
+				return result, err
+			}
+			if wait {
+				// the workload is reconciled again when secrets or service accounts in its namespace change
+				return ctrl.Result{RequeueAfter: requeueAfter}, nil
+			}
+		}
+		if requeueAfter, wait := c.waitForBusyMarkers(log, kind, before, time.Now()); wait {
+			// check the markers before using up a pacing slot, the copied images exist when reconciling again
+			return ctrl.Result{RequeueAfter: requeueAfter}, nil
+		}
+		if templateChanged {
+			if requeueAfter, wait := c.patchPacer.wait(log, kind, obj, time.Now()); wait {
+				// the workload stays in the pending journal until its slot has come
+				return ctrl.Result{RequeueAfter: requeueAfter}, nil
+			}
+		}
+		if requeueAfter, wait := c.waitForRollout(log, kind, before); wait {
+			// the copied images exist when reconciling again, so the patch is cheap then
+			return ctrl.Result{RequeueAfter: requeueAfter}, nil
+		}
 
-	// update daemonSet if reconciliation changed any images
-	if !apiequality.Semantic.DeepEqual(before, daemonSet) {
-		// use optimistic locking for patching the daemonSet, we should retry with exponential backoff if new containers or
+		setAnnotation(obj, ImagesHashAnnotation, c.imagesHash(template))
+		if len(rewritten) > 0 {
+			if err := setLastRewrite(obj, rewritten, time.Now()); err != nil {
+				return result, fmt.Errorf("error setting %s annotation: %w", LastRewriteAnnotation, err)
+			}
+		}
+		if err := setSourceDigests(obj, template, rewritten); err != nil {
+			return result, fmt.Errorf("error setting %s annotation: %w", SourceDigestsAnnotation, err)
+		}
+		// use optimistic locking for patching the object, we should retry with exponential backoff if new containers or
 		// images were added in the meantime
-		log.Info("Patching images in DaemonSet")
-		return ctrl.Result{}, c.Patch(ctx, daemonSet, client.StrategicMergeFrom(before, client.MergeFromWithOptimisticLock{}))
+		log.Info("Patching images in " + kind)
+		if err := c.patchWorkload(ctx, obj, before); err != nil {
+			return result, err
+		}
+		c.pendingJournal.remove(kind, client.ObjectKeyFromObject(obj))
+		c.recordRewrites(obj, rewritten)
+		c.trackRewrites(obj, rewritten)
+		c.notifier().Notify(notify.Event{Type: notify.TypeWorkloadPatched, Kind: kind, Namespace: obj.GetNamespace(), Name: obj.GetName()})
 	}
 
-	return ctrl.Result{}, nil
+	if !result.IsZero() {
+		// the workload is reconciled again anyway, prune annotations once it is healthy
+		return result, nil
+	}
+	return c.pruneAnnotations(ctx, log, obj)
+}
+
+// recordRewrites emits metrics and an event for the images that have been rewritten in the given workload.
+// ImagesCloned is used if any image was copied, ImagesRelinked if all images already existed in the backup registry.
+func (c *ImageCloneController) recordRewrites(obj client.Object, rewritten []rewrite) {
+	if len(rewritten) == 0 {
+		return
+	}
+
+	var (
+		copied, relinked []string
+		stats            copier.ImageStats
+	)
+	for _, r := range rewritten {
+		if r.Copied {
+			copied = append(copied, r.Destination.Name())
+			if r.Stats != nil {
+				stats.Size += r.Stats.Size
+				stats.Layers += r.Stats.Layers
+			}
+		} else {
+			relinked = append(relinked, r.Destination.Name())
+		}
+	}
+	imagesCopiedTotal.Add(float64(len(copied)))
+	imagesRewrittenTotal.Add(float64(len(relinked)))
+
+	if len(copied) > 0 {
+		c.event(obj, corev1.EventTypeNormal, ReasonImagesCloned, "Copied images to the backup registry and rewrote them",
+			"copied", strconv.Itoa(len(copied)), "rewritten", strconv.Itoa(len(rewritten)), "images", strings.Join(append(copied, relinked...), ","),
+			"size", strconv.FormatInt(stats.Size, 10), "layers", strconv.Itoa(stats.Layers))
+		return
+	}
+	c.event(obj, corev1.EventTypeNormal, ReasonImagesRelinked, "Rewrote images that already existed in the backup registry",
+		"rewritten", strconv.Itoa(len(relinked)), "images", strings.Join(relinked, ","))
+}
+
+// handlePodTemplateError determines the result of a reconciliation for errors returned by reconcilePodTemplate.
+// obj must not contain any changes made by reconcilePodTemplate.
+func (c *ImageCloneController) handlePodTemplateError(ctx context.Context, log logr.Logger, obj client.Object, err error) (ctrl.Result, error) {
+	if copier.IsCopyPending(err) {
+		// the workload is enqueued again once the copies have finished, requeue anyway in case we miss the notification
+		log.Info("Waiting for image copies to finish")
+		return ctrl.Result{RequeueAfter: c.CopyPendingRequeueInterval}, nil
+	}
+
+	var budgetErr *copier.EgressBudgetExhaustedError
+	if errors.As(err, &budgetErr) {
+		// the copy isn't failing, it is only delayed to stay within the configured egress budget
+		log.Info("Egress budget exhausted, deferring copies", "requeueAfter", budgetErr.RetryAfter)
+		return ctrl.Result{RequeueAfter: budgetErr.RetryAfter}, nil
+	}
+
+	var storageErr *copier.StorageFullError
+	if errors.As(err, &storageErr) {
+		// the outage is announced once by the copier, don't emit events for every workload and don't compete with
+		// whatever is freeing space in the meantime
+		log.Info("Storage of backup registry is full, retrying after the next probe copy", "error", err.Error(), "requeueAfter", storageErr.RetryAfter)
+		c.recordFailure(ctx, log, obj, err)
+		return ctrl.Result{RequeueAfter: storageErr.RetryAfter}, nil
+	}
+
+	if requeueAfter, ok := c.sourceNotFoundRequeue(obj, err); ok {
+		// the source image might not have been pushed yet, e.g., in CI pipelines, retry soon without alerting anyone
+		log.Info("Source image not found yet, retrying", "error", err.Error(), "requeueAfter", requeueAfter)
+		return ctrl.Result{RequeueAfter: requeueAfter}, nil
+	}
+
+	var previousErr *ImageFromPreviousBackupRegistryError
+	if errors.As(err, &previousErr) {
+		// retrying doesn't help until the controller is restarted with the corresponding flag
+		c.event(obj, corev1.EventTypeWarning, ReasonImageFromPreviousBackupRegistry, "Image seems to reference a previous backup registry, add its registry to --previous-backup-registries to migrate it",
+			append(containerEventFields(err), eventKeyImage, previousErr.Image)...)
+		return ctrl.Result{}, nil
+	}
+
+	var sameErr *DestinationEqualsSourceError
+	if errors.As(err, &sameErr) {
+		// retrying doesn't help until the backup registry configuration is corrected
+		log.Error(err, "Refusing to copy image onto itself")
+		c.event(obj, corev1.EventTypeWarning, ReasonDestinationEqualsSource, "Destination of image equals its source, the backup registry seems to be misconfigured",
+			append(containerEventFields(err), eventKeyImage, sameErr.Image)...)
+		return ctrl.Result{}, nil
+	}
+
+	var divergenceErr *DigestDivergenceError
+	if errors.As(err, &divergenceErr) {
+		// the diverging images have been reported individually, retry with backoff as copying again usually resolves the
+		// divergence
+		log.Error(err, "Not rewriting images whose destination tags serve a different digest")
+		c.recordFailure(ctx, log, obj, err)
+		return ctrl.Result{}, err
+	}
+
+	var redirectErr *copier.BlobRedirectError
+	if errors.As(err, &redirectErr) {
+		// retrying quickly only hammers the firewall, retry less often until egress to the redirect host is opened
+		log.Error(err, "Blob download was redirected to an unreachable host", "host", redirectErr.Host, "requeueAfter", c.BlobRedirectRequeueInterval)
+		c.event(obj, corev1.EventTypeWarning, ReasonBlobRedirectBlocked, "Registry redirected blob download to an unreachable host, allow egress to it or configure a proxy",
+			errorEventFields(err)...)
+		c.recordFailure(ctx, log, obj, err)
+		return ctrl.Result{RequeueAfter: c.BlobRedirectRequeueInterval}, nil
+	}
+
+	c.event(obj, corev1.EventTypeWarning, ReasonFailedCopyingImages, "Failed copying images", errorEventFields(err)...)
+	c.recordFailure(ctx, log, obj, err)
+	return ctrl.Result{}, err
 }
 
 // reconcilePodTemplate copies all images in the given PodTemplate to our backup registry if they don't reference the
-// backup registry already. It updates the PodTemplate to reference the copied images.
-func (c *ImageCloneController) reconcilePodTemplate(log logr.Logger, template *corev1.PodTemplateSpec) error {
-	for i, container := range template.Spec.Containers {
-		containerLog := log.WithValues("container", container.Name, "image", container.Image)
+// backup registry (below the given destination prefix) already. It updates the PodTemplate to reference the copied images. If copying any image fails,
+// the images that have been copied successfully are still updated.
+func (c *ImageCloneController) reconcilePodTemplate(ctx context.Context, log logr.Logger, obj client.Object, template *corev1.PodTemplateSpec, backupRegistry name.Registry, prefix string) ([]rewrite, error) {
+	plan, invalid, err := c.planRewrites(template, backupRegistry, prefix, sourceDigestsOf(obj))
+	if err != nil {
+		return nil, err
+	}
+	plan = c.skipRespectedFieldManagers(log, obj, plan)
+	for _, invalidErr := range invalid {
+		// retrying doesn't help, the workload is reconciled again when its spec is corrected
+		log.Info("Skipping container with invalid image reference", "container", invalidErr.Container, "image", invalidErr.Image)
+		invalidImageReferencesTotal.Inc()
+		c.event(obj, corev1.EventTypeWarning, ReasonInvalidImageReference, "Skipping container with invalid image reference",
+			eventKeyContainer, invalidErr.Container, eventKeyImage, invalidErr.Image, eventKeyError, invalidErr.Unwrap().Error())
+	}
+
+	rewritten, err := c.executeRewrites(ctx, log, obj, plan, backupRegistry, prefix)
+	for _, r := range rewritten {
+		r.Container.setImage(template, r.image())
+		// change the pull policy in the same patch, so that no pod is started with the new image and the old policy
+		if policy := c.pullPolicy(r); policy != "" {
+			r.Container.setPullPolicy(template, policy)
+		}
+	}
+	return rewritten, err
+}
+
+// executeRewrites copies the images of the given plan and returns the rewrites whose images were copied successfully
+// or already existed.
+func (c *ImageCloneController) executeRewrites(ctx context.Context, log logr.Logger, obj client.Object, plan []rewrite, backupRegistry name.Registry, prefix string) ([]rewrite, error) {
+	var copyImage copyFunc = c.Copier.Copy
+	if c.AsyncCopies {
+		copyImage = c.Copier.CopyAsync
+	}
+
+	// record the size of copied images for the LastRewriteAnnotation
+	ctx = copier.WithImageStats(ctx)
+	// the digest consistency check needs the state of destinations after copying
+	uncachedCtx := ctx
+	c.Decisions.observeForceSync(obj, plan)
+	// check all images concurrently instead of one after another, most of them usually exist already
+	ctx = c.prefetch(ctx, plan)
+	c.resolveDigests(ctx, log, plan)
+
+	var (
+		rewritten       []rewrite
+		pending         bool
+		deferred        error
+		offlineMissing  []string
+		pendingApproval []string
+		diverged        []string
+		failed          []*ContainerError
+	)
+	for _, r := range plan {
+		containerLog := log.WithValues("container", r.Container.Name, "image", r.Source.String())
 
-		srcImg, err := name.ParseReference(container.Image)
+		copied, err := c.executeRewrite(ctx, containerLog, obj, r, backupRegistry, prefix, copyImage)
 		if err != nil {
-			return fmt.Errorf("failed parsing image %q: %w", container.Image, err)
+			if copier.IsCopyPending(err) {
+				// start copying the remaining images as well, but don't rewrite any image before all copies have finished
+				pending = true
+				continue
+			}
+			if copier.IsEgressBudgetExhausted(err) {
+				// check the remaining images anyway, they might exist already
+				containerLog.V(1).Info("Deferring copy until the egress budget allows it", "error", err.Error())
+				deferred = err
+				continue
+			}
+			if copier.IsImageTooLarge(err) || errors.Is(err, errOfflineImageMissing) || errors.Is(err, errNotPreapproved) || copier.IsDeniedImage(err) || IsIncompletePlatforms(err) {
+				c.status.recordImage(imageSkipped)
+			}
+			if copier.IsImageTooLarge(err) {
+				// retrying doesn't help, keep referencing the source image and continue with the other containers
+				recordSkip(containerLog, SkipReasonTooLarge).Info("Skipping image that exceeds the maximum image size", "error", err.Error())
+				c.event(obj, corev1.EventTypeWarning, ReasonImageTooLarge, "Not copying image that exceeds the maximum image size, set the "+AllowLargeImagesAnnotation+"=true annotation to copy it anyway",
+					eventKeyContainer, r.Container.Name, eventKeySource, r.Source.String(), eventKeyError, err.Error())
+				continue
+			}
+			if errors.Is(err, errOfflineImageMissing) {
+				// keep referencing the source image until the image is pre-seeded in the backup registry
+				recordSkip(containerLog, SkipReasonOfflineMissing).Info("Image doesn't exist in the backup registry, can't copy it in offline mode", "destination", r.Destination.Name())
+				c.event(obj, corev1.EventTypeWarning, ReasonOfflineCopyPending, "Image doesn't exist in the backup registry and can't be copied in offline mode",
+					eventKeyContainer, r.Container.Name, eventKeySource, r.Source.String(), eventKeyDestination, r.Destination.Name())
+				offlineMissing = append(offlineMissing, r.Destination.Name())
+				continue
+			}
+			if errors.Is(err, errNotPreapproved) {
+				// never copy the image ourselves, keep referencing the source image until the image is pre-approved
+				recordSkip(containerLog, SkipReasonPendingApproval).Info("Image has not been pre-approved in the backup registry", "destination", r.Destination.Name())
+				c.event(obj, corev1.EventTypeWarning, ReasonPendingApproval, "Image has not been pre-approved in the backup registry",
+					eventKeyContainer, r.Container.Name, eventKeySource, r.Source.String(), eventKeyDestination, r.Destination.Name())
+				pendingApproval = append(pendingApproval, r.Destination.Name())
+				continue
+			}
+			if IsIncompletePlatforms(err) {
+				// the image has been copied anyway, keep referencing the source image and continue with the other containers
+				recordSkip(containerLog, SkipReasonIncompletePlatforms).Info("Skipping image that doesn't provide all required platforms", "error", err.Error())
+				continue
+			}
+			if copier.IsDeniedImage(err) {
+				// never mirror denylisted images, keep referencing the source image and continue with the other containers
+				recordSkip(containerLog, SkipReasonDeniedDigest).Info("Skipping image with denylisted digest", "error", err.Error())
+				deniedImagesTotal.WithLabelValues("false").Inc()
+				c.event(obj, corev1.EventTypeWarning, ReasonDeniedImage, "Not copying image with denylisted digest",
+					eventKeyContainer, r.Container.Name, eventKeySource, r.Source.String(), eventKeyError, err.Error())
+				continue
+			}
+			// continue with the other containers, so that all failures are reported
+			c.status.recordFailure(obj, r.Container.Name, r.Source.String(), err)
+			failed = append(failed, &ContainerError{Container: r.Container.Name, err: err})
+			continue
 		}
 
-		if srcImg.Context().Registry == c.BackupRegistry {
-			containerLog.V(1).Info("Container image is already specifying the backup registry")
+		if copied {
+			c.status.recordImage(imageCopied)
+		} else {
+			c.status.recordImage(imageSkipped)
+		}
+		if r.BackedUp || r.Excluded || r.ProhibitedBy != "" {
 			continue
 		}
 
-		dstImg, err := toDestinationImage(srcImg, c.BackupRegistry)
-		if err != nil {
-			return fmt.Errorf("failed rewriting image %q: %w", srcImg.Name(), err)
+		if err := c.checkDigestConsistency(uncachedCtx, containerLog, obj, r); err != nil {
+			var divergence *digestDivergence
+			if !errors.As(err, &divergence) {
+				c.status.recordFailure(obj, r.Container.Name, r.Source.String(), err)
+				failed = append(failed, &ContainerError{Container: r.Container.Name, err: err})
+				continue
+			}
+			// don't change the image that the container runs, keep referencing the source image
+			recordSkip(containerLog, SkipReasonDigestDivergence).Info("Not rewriting image whose destination tag serves a different digest")
+			c.event(obj, corev1.EventTypeWarning, ReasonDigestDivergence, "Destination tag serves a different digest than the source image, not rewriting the image. "+
+				"Reference the source image by digest to use an immutable destination tag, or set the "+AllowDigestDivergenceAnnotation+"=true annotation to accept the divergence",
+				eventKeyContainer, r.Container.Name, eventKeySource, r.Source.String(), eventKeyDestination, r.Destination.Name(),
+				eventKeySourceDigest, divergence.SourceDigest.String(), eventKeyDestinationDigest, divergence.DestinationDigest.String())
+			diverged = append(diverged, r.Destination.Name())
+			continue
 		}
 
-		containerLog = containerLog.WithValues("destination", dstImg.Name())
-		containerLog.Info("Copying image to the backup registry")
+		r.Copied = copied
+		if stats, ok := copier.ImageStatsFrom(ctx, r.Destination); ok && copied {
+			r.Stats = &stats
+			if stats.PinnedPlatform && stats.ParentIndex == "" && c.Copier.CopyParentIndex {
+				c.event(obj, corev1.EventTypeNormal, ReasonSinglePlatformCopy, "Copied only the platform image that the container pins by digest, no index containing it was found in the source repository",
+					eventKeyContainer, r.Container.Name, eventKeySource, r.Source.String(), eventKeyDestination, r.Destination.Name())
+			}
+		}
+		rewritten = append(rewritten, r)
+	}
 
-		if err := crane.Copy(srcImg.Name(), dstImg.Name()); err != nil {
-			return fmt.Errorf("error copying image %q to %q: %w", srcImg.Name(), dstImg.Name(), err)
+	if len(failed) == 1 {
+		return rewritten, failed[0]
+	}
+	if len(failed) > 1 {
+		return rewritten, &ContainersError{Errors: failed}
+	}
+	if pending {
+		return rewritten, copier.ErrCopyPending
+	}
+	if deferred != nil {
+		return rewritten, deferred
+	}
+	if len(offlineMissing) > 0 {
+		return rewritten, &OfflineImagesMissingError{Images: offlineMissing}
+	}
+	if len(pendingApproval) > 0 {
+		return rewritten, &PendingApprovalError{Images: pendingApproval}
+	}
+	if len(diverged) > 0 {
+		return rewritten, &DigestDivergenceError{Images: diverged}
+	}
+	return rewritten, nil
+}
+
+// prefetch checks the existence of all images that executing the given plan checks, see copier.Copier.Prefetch.
+func (c *ImageCloneController) prefetch(ctx context.Context, plan []rewrite) context.Context {
+	var sources, destinations []name.Reference
+	for _, r := range plan {
+		switch {
+		case r.Excluded, r.ProhibitedBy != "":
+		case r.BackedUp:
+			if c.ValidateBackupReferences || c.Copier.DenylistedDigestsFile != "" {
+				destinations = append(destinations, r.Source)
+			}
+		case c.Decisions.isUpToDate(r, time.Now()):
+		default:
+			if c.contactsSourceRegistries() {
+				sources = append(sources, r.Source)
+			}
+			destinations = append(destinations, r.Destination)
 		}
+	}
 
-		containerLog.Info("Finished copying image")
-		template.Spec.Containers[i].Image = dstImg.Name()
+	if len(sources)+len(destinations) <= 1 {
+		return ctx
 	}
+	return c.Copier.Prefetch(ctx, sources, destinations)
+}
 
-	return nil
+func (c *ImageCloneController) executeRewrite(ctx context.Context, log logr.Logger, obj client.Object, r rewrite, backupRegistry name.Registry, prefix string, copyImage copyFunc) (bool, error) {
+	if r.ProhibitedBy != "" {
+		recordSkip(log, r.SkipReason).Info("Mirroring container image is prohibited, skipping it", "pattern", r.ProhibitedBy)
+		mirrorProhibitedImagesTotal.WithLabelValues(obj.GetNamespace()).Inc()
+		c.event(obj, corev1.EventTypeWarning, ReasonMirrorProhibited, "Not copying image whose repository must not be mirrored to the backup registry",
+			eventKeyContainer, r.Container.Name, eventKeySource, r.Source.String(), eventKeyPattern, r.ProhibitedBy)
+		return false, nil
+	}
+
+	if r.Excluded {
+		recordSkip(log, r.SkipReason).V(1).Info("Container image matches an exclude pattern, skipping it")
+		excludedImagesTotal.Inc()
+		return false, nil
+	}
+
+	if r.BackedUp {
+		recordSkip(log, r.SkipReason).V(1).Info("Container image is already specifying the backup registry")
+		if c.ValidateBackupReferences {
+			return false, c.validateBackupReference(ctx, log, obj, r.Container.Name, r.Source, backupRegistry, prefix, copyImage)
+		}
+		if c.Copier.DenylistedDigestsFile != "" {
+			c.checkDeniedBackupReference(ctx, log, obj, r.Container.Name, r.Source)
+		}
+		return false, nil
+	}
+
+	if r.Original != r.Source {
+		log = log.WithValues("original", r.Original.Name())
+		log.Info("Container image is referencing a previous backup registry, migrating it")
+		// the workload is already protected by the previous backup registry, don't delay copies of new workloads
+		ctx = copier.WithPriority(ctx, copier.PriorityBackground)
+	}
+
+	if c.Offline {
+		return false, c.rewriteOffline(ctx, log, r)
+	}
+	if c.RewriteOnlyPreapproved {
+		return false, c.rewritePreapproved(ctx, log, r)
+	}
+
+	log = log.WithValues("destination", r.Destination.Name())
+	if c.Decisions.isUpToDate(r, time.Now()) {
+		log.V(1).Info("Image was copied or found in the backup registry recently, skipping copy")
+		// the required platforms might have changed in the meantime
+		return false, c.checkPlatforms(ctx, log, obj, r)
+	}
+	log.Info("Copying image to the backup registry")
+
+	if allowsLargeImages(obj) {
+		ctx = copier.WithoutSizeLimit(ctx)
+	}
+	if r.Digest != (v1.Hash{}) {
+		// copy exactly the digest that the container is rewritten to
+		ctx = copier.WithSourceDigest(ctx, r.Digest)
+	}
+
+	start := time.Now()
+	copied, err := copyImage(ctx, log, r.Source, r.Destination)
+	if err != nil {
+		if copier.IsCopyPending(err) || copier.IsEgressBudgetExhausted(err) {
+			return false, err
+		}
+		err = fmt.Errorf("error copying image %q to %q: %w", r.Source.Name(), r.Destination.Name(), err)
+		c.notifyCopy(obj, r, time.Since(start), err)
+		return false, err
+	}
+	c.notifyCopy(obj, r, time.Since(start), nil)
+	if _, ok := r.Original.(name.Tag); ok && c.copyHistory != nil {
+		c.copyHistory.record(r.Original.Name(), time.Now())
+	}
+
+	if err := c.checkPlatforms(ctx, log, obj, r); err != nil {
+		return false, err
+	}
+	c.Decisions.recordUpToDate(r, time.Now())
+
+	if stats, ok := copier.ImageStatsFrom(ctx, r.Destination); ok && copied {
+		log = log.WithValues("size", stats.Size, "layers", stats.Layers)
+	}
+	log.Info("Finished copying image", "cached", !copied)
+	return copied, nil
 }
 
-// registryReplacer replaces . and : with _ in registry names to be used as a prefix in rewritten repository names.
-var registryReplacer = strings.NewReplacer(".", "_", ":", "_")
+// ContainerError is returned by reconcilePodTemplate if reconciling a container failed.
+type ContainerError struct {
+	Container string
 
-// toDestinationImage rewrites source image references to corresponding tags in our backup registry, e.g.:
-// nginx                                        -> <dstRegistry>/index_docker_io/library/nginx:latest
-// nginx:1.23                                   -> <dstRegistry>/index_docker_io/library/nginx:1.23
-// nginx@sha256:33cef...                        -> <dstRegistry>/index_docker_io/library/nginx:sha256_33cef...
-// grafana/grafana:main                         -> <dstRegistry>/index_docker_io/grafana/grafana:main
-// ghcr.io/timebertt/speedtest-exporter:v0.1.0  -> <dstRegistry>/ghcr_io/timebertt/speedtest-exporter:v0.1.0
-func toDestinationImage(srcImg name.Reference, dstRegistry name.Registry) (name.Tag, error) {
-	var (
-		newRepository = registryReplacer.Replace(srcImg.Context().Registry.RegistryStr()) + "/" + srcImg.Context().RepositoryStr()
-		newTag        = srcImg.Identifier()
-	)
+	err error
+}
+
+func (e *ContainerError) Error() string {
+	return e.err.Error()
+}
+
+func (e *ContainerError) Unwrap() error {
+	return e.err
+}
+
+// ContainersError is returned by reconcilePodTemplate if reconciling multiple containers failed. It unwraps to the
+// error of the first failed container, which determines how the failure is handled.
+type ContainersError struct {
+	Errors []*ContainerError
+}
 
-	if digest, ok := srcImg.(name.Digest); ok {
-		// if image is identified via digest instead of tag, rewrite digest to tag
-		// (need to replace the : separator, as it is not a valid tag character)
-		newTag = strings.ReplaceAll(digest.DigestStr(), ":", "_")
+func (e *ContainersError) Error() string {
+	messages := make([]string, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		messages = append(messages, fmt.Sprintf("container %q: %v", err.Container, err))
+	}
+	return strings.Join(messages, "; ")
+}
+
+func (e *ContainersError) Unwrap() error {
+	return e.Errors[0]
+}
+
+// failedContainers returns the names of the failed containers if the given error is a *ContainersError or a
+// *ContainerError.
+func failedContainers(err error) []string {
+	var containersErr *ContainersError
+	if errors.As(err, &containersErr) {
+		names := make([]string, 0, len(containersErr.Errors))
+		for _, containerErr := range containersErr.Errors {
+			names = append(names, containerErr.Container)
+		}
+		return names
 	}
 
-	return name.NewTag(fmt.Sprintf("%s/%s:%s", dstRegistry.RegistryStr(), newRepository, newTag))
+	var containerErr *ContainerError
+	if errors.As(err, &containerErr) {
+		return []string{containerErr.Container}
+	}
+	return nil
+}
+
+// ValidateBackupRegistry verifies that images can be rewritten with the given naming configuration, e.g., to catch
+// naming misconfigurations early on startup.
+func ValidateBackupRegistry(config naming.Config) error {
+	for _, image := range []string{
+		"nginx",
+		"ghcr.io/timebertt/speedtest-exporter:v0.1.0",
+		"nginx@sha256:0000000000000000000000000000000000000000000000000000000000000000",
+	} {
+		srcImg, err := name.ParseReference(image)
+		if err != nil {
+			return err
+		}
+		if _, err := naming.Destination(srcImg, config); err != nil {
+			return fmt.Errorf("failed rewriting sample image %q to backup registry %q: %w", image, config.BackupRegistry.Name(), err)
+		}
+	}
+	return nil
 }
@@ -0,0 +1,235 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+var (
+	initialSyncWorkloads = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "initial_sync_workloads",
+		Help:      "Number of workloads that need to be reconciled in the initial sync after startup.",
+	})
+
+	initialSyncPendingWorkloads = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "initial_sync_pending_workloads",
+		Help:      "Number of workloads that have not been reconciled yet in the initial sync after startup.",
+	})
+)
+
+func init() {
+	metrics.Registry.MustRegister(initialSyncWorkloads, initialSyncPendingWorkloads)
+}
+
+// initialSync tracks the first reconciliation of all watched workloads after startup, so that the controller is only
+// reported ready once protection has been re-established.
+type initialSync struct {
+	cache cache.Cache
+	kinds map[string]client.ObjectList
+	// filter selects the workloads that are reconciled by this replica
+	filter    predicate.Predicate
+	threshold int
+
+	lock sync.Mutex
+	// started is true once this replica has been elected as leader
+	started bool
+	// listed is true once all workloads have been listed from the synced cache
+	listed bool
+	synced bool
+	// pending are the workloads that have not been reconciled yet by kind and key
+	pending map[string]struct{}
+	// processed are the workloads reconciled before the workloads have been listed
+	processed map[string]struct{}
+	// passes aggregates the events of the initial sync per namespace, if set
+	passes *bulkPasses
+}
+
+func newInitialSync(c cache.Cache, kinds map[string]client.ObjectList, threshold int, filter predicate.Predicate, passes *bulkPasses) *initialSync {
+	return &initialSync{
+		cache:     c,
+		kinds:     kinds,
+		filter:    filter,
+		threshold: threshold,
+		passes:    passes,
+		pending:   make(map[string]struct{}),
+		processed: make(map[string]struct{}),
+	}
+}
+
+func initialSyncKey(kind string, key types.NamespacedName) string {
+	return kind + "/" + key.String()
+}
+
+// Start implements manager.Runnable. It is only started on the leader, as other replicas don't reconcile, unless
+// workloads are sharded across replicas.
+func (s *initialSync) Start(ctx context.Context) error {
+	s.lock.Lock()
+	s.started = true
+	s.lock.Unlock()
+
+	if !s.cache.WaitForCacheSync(ctx) {
+		return nil
+	}
+
+	pending := make(map[string]struct{})
+	for kind, list := range s.kinds {
+		list = list.DeepCopyObject().(client.ObjectList)
+		if err := s.cache.List(ctx, list); err != nil {
+			return fmt.Errorf("error listing workloads for initial sync: %w", err)
+		}
+		for _, obj := range workloads(list) {
+			if !s.filter.Generic(event.GenericEvent{Object: obj}) {
+				// ignored namespace or other shard, never reconciled
+				continue
+			}
+			pending[initialSyncKey(kind, client.ObjectKeyFromObject(obj))] = struct{}{}
+		}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	initialSyncWorkloads.Set(float64(len(pending)))
+	for key := range s.processed {
+		delete(pending, key)
+	}
+	s.pending, s.processed = pending, nil
+	s.listed = true
+
+	keys := make([]string, 0, len(pending))
+	for key := range pending {
+		keys = append(keys, key)
+	}
+	s.passes.start(initialSyncPass, "initial sync", keys)
+	s.passes.allEnqueued(initialSyncPass)
+	s.update()
+
+	logf.FromContext(ctx).Info("Started initial sync", "workloads", len(pending))
+	return nil
+}
+
+// done marks the given workload as reconciled, regardless of the reconciliation's result.
+func (s *initialSync) done(kind string, key types.NamespacedName) {
+	if s == nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.synced {
+		return
+	}
+	if !s.listed {
+		s.processed[initialSyncKey(kind, key)] = struct{}{}
+		return
+	}
+	delete(s.pending, initialSyncKey(kind, key))
+	s.update()
+}
+
+// track returns a reconciler marking all workloads reconciled by the given reconciler as done.
+func (s *initialSync) track(kind string, r reconcile.Func) reconcile.Func {
+	if s == nil {
+		return r
+	}
+	return func(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
+		result, err := r(ctx, req)
+		s.done(kind, req.NamespacedName)
+		return result, err
+	}
+}
+
+// update must be called with the lock held.
+func (s *initialSync) update() {
+	initialSyncPendingWorkloads.Set(float64(len(s.pending)))
+	if len(s.pending) <= s.threshold {
+		s.synced = true
+		s.pending = nil
+		// the remaining workloads emit their events individually
+		s.passes.finish(initialSyncPass)
+	}
+}
+
+// ReadyzCheck returns a readiness check that fails until the initial sync of all watched workloads has completed,
+// i.e., until at most InitialSyncThreshold workloads have not been reconciled yet. If lease is set, replicas waiting
+// for leader election are ready as long as another replica holds the given leader election lease, as only the leader
+// syncs.
+func (c *ImageCloneController) ReadyzCheck(reader client.Reader, lease *client.ObjectKey) healthz.Checker {
+	return func(req *http.Request) error {
+		s := c.initialSync
+		if s == nil {
+			return nil
+		}
+
+		s.lock.Lock()
+		started, listed, synced, pending := s.started, s.listed, s.synced, len(s.pending)
+		s.lock.Unlock()
+
+		if synced {
+			return nil
+		}
+		if listed {
+			return fmt.Errorf("initial sync in progress: %d workloads pending", pending)
+		}
+		if started {
+			return fmt.Errorf("initial sync waiting for caches to sync")
+		}
+
+		if lease != nil {
+			if held, err := leaseHeld(req.Context(), reader, *lease); err == nil && held {
+				// another replica is the leader and responsible for protecting workloads
+				return nil
+			}
+		}
+		return fmt.Errorf("initial sync has not started yet")
+	}
+}
+
+// leaseHeld checks whether the given lease is held by any replica and has not expired. It is only called on replicas
+// that are not the leader, so the holder is another replica.
+func leaseHeld(ctx context.Context, reader client.Reader, key client.ObjectKey) (bool, error) {
+	lease := &coordinationv1.Lease{}
+	if err := reader.Get(ctx, key, lease); err != nil {
+		return false, client.IgnoreNotFound(err)
+	}
+
+	spec := lease.Spec
+	if spec.HolderIdentity == nil || *spec.HolderIdentity == "" || spec.RenewTime == nil || spec.LeaseDurationSeconds == nil {
+		return false, nil
+	}
+	return time.Since(spec.RenewTime.Time) < time.Duration(*spec.LeaseDurationSeconds)*time.Second, nil
+}
@@ -0,0 +1,187 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+
+	"github.com/timebertt/image-clone-controller/pkg/copier"
+	"github.com/timebertt/image-clone-controller/pkg/naming"
+	"github.com/timebertt/image-clone-controller/pkg/test"
+)
+
+const (
+	integrationTimeout = 30 * time.Second
+	// integrationPodNamespace is the namespace of the controller, which is ignored
+	integrationPodNamespace = "image-clone-system"
+)
+
+// TestIntegration covers the copy and patch flow against a test control plane, using an in-process registry as both
+// the upstream and the backup registry. It is skipped if the envtest binaries are not installed, see `make test`.
+func TestIntegration(t *testing.T) {
+	if os.Getenv("KUBEBUILDER_ASSETS") == "" {
+		t.Skip("KUBEBUILDER_ASSETS is not set, skipping integration tests")
+	}
+
+	reg := newTestRegistry(t)
+	env, err := test.StartEnvironment(func(mgr manager.Manager) error {
+		c := &ImageCloneController{
+			Client:   mgr.GetClient(),
+			Recorder: mgr.GetEventRecorderFor(ImageCloneControllerName + "-controller"),
+			Copier:   &copier.Copier{},
+		}
+		c.BackupRegistry = reg.Registry
+		c.PodNamespace = integrationPodNamespace
+		c.EnableDeployments = true
+		c.EnableDaemonSets = true
+		c.ReadyWithoutSync = true
+		return c.SetupWithManager(mgr)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := env.Stop(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	ctx := context.Background()
+	if err := env.Client.Create(ctx, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: integrationPodNamespace}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// destinationOf returns the expected destination of the given image relative to the registry
+	destinationOf := func(t *testing.T, image string) string {
+		t.Helper()
+		src, err := reg.Reference(image)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dst, err := naming.Destination(src, naming.Config{BackupRegistry: reg.Registry})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return dst.Name()
+	}
+
+	create := func(t *testing.T, obj client.Object) {
+		t.Helper()
+		if err := env.Client.Create(ctx, obj); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = env.Client.Delete(ctx, obj) })
+	}
+
+	t.Run("digest rewrite", func(t *testing.T) {
+		img, err := reg.SeedImage("upstream/digest:v1", 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		digest, err := img.Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		image := "upstream/digest@" + digest.String()
+
+		deployment := test.NewDeployment("default", "digest", reg.Registry.RegistryStr()+"/"+image)
+		create(t, deployment)
+
+		destination := destinationOf(t, image)
+		if err := test.WaitForImages(ctx, env.Client, deployment, integrationTimeout, destination); err != nil {
+			t.Fatal(err)
+		}
+		copied, err := test.Digest(destination)
+		if err != nil {
+			t.Fatalf("destination %q doesn't exist: %v", destination, err)
+		}
+		if copied != digest {
+			t.Errorf("destination %q has digest %s, want %s", destination, copied, digest)
+		}
+	})
+
+	t.Run("already backed up", func(t *testing.T) {
+		if _, err := reg.SeedImage("upstream/backed-up:v1", 1); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := reg.SeedImage("upstream/other:v1", 1); err != nil {
+			t.Fatal(err)
+		}
+		backedUp := destinationOf(t, "upstream/backed-up:v1")
+		if _, err := reg.SeedImage(strings.TrimPrefix(backedUp, reg.Registry.RegistryStr()+"/"), 1); err != nil {
+			t.Fatal(err)
+		}
+
+		// the other container shows that the workload has been reconciled
+		daemonSet := test.NewDaemonSet("default", "backed-up", backedUp, reg.Registry.RegistryStr()+"/upstream/other:v1")
+		create(t, daemonSet)
+
+		if err := test.WaitForImages(ctx, env.Client, daemonSet, integrationTimeout, backedUp, destinationOf(t, "upstream/other:v1")); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("ignored namespace", func(t *testing.T) {
+		if _, err := reg.SeedImage("upstream/ignored:v1", 1); err != nil {
+			t.Fatal(err)
+		}
+		image := reg.Registry.RegistryStr() + "/upstream/ignored:v1"
+
+		ignored := test.NewDeployment(integrationPodNamespace, "ignored", image)
+		create(t, ignored)
+		// the workload in a watched namespace shows that the controller has processed the events of both workloads
+		watched := test.NewDeployment("default", "watched", image)
+		create(t, watched)
+
+		if err := test.WaitForImages(ctx, env.Client, watched, integrationTimeout, destinationOf(t, "upstream/ignored:v1")); err != nil {
+			t.Fatal(err)
+		}
+		// give the controller the chance to (wrongly) patch the ignored workload
+		time.Sleep(2 * time.Second)
+		if err := env.Client.Get(ctx, client.ObjectKeyFromObject(ignored), ignored); err != nil {
+			t.Fatal(err)
+		}
+		if images := test.ContainerImages(ignored); len(images) != 1 || images[0] != image {
+			t.Errorf("workload in ignored namespace was patched to %v", images)
+		}
+	})
+
+	t.Run("failure event", func(t *testing.T) {
+		// nothing listens on port 1, so copying the image fails
+		deployment := test.NewDeployment("default", "failing", "127.0.0.1:1/upstream/failing:v1")
+		create(t, deployment)
+
+		if err := test.WaitForEvent(ctx, env.Client, deployment, ReasonFailedCopyingImages, integrationTimeout); err != nil {
+			t.Fatal(err)
+		}
+		if err := env.Client.Get(ctx, client.ObjectKeyFromObject(deployment), deployment); err != nil {
+			t.Fatal(err)
+		}
+		if images := test.ContainerImages(deployment); images[0] != "127.0.0.1:1/upstream/failing:v1" {
+			t.Errorf("failing image was patched to %v", images)
+		}
+	})
+}
@@ -0,0 +1,56 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// DefaultListChunkSize is the default number of objects per page of paginated List calls in maintenance tasks.
+const DefaultListChunkSize = 100
+
+// listWorkloadsInChunks lists the workloads of the given list type in the given namespace page by page and calls fn
+// for every page, so that large namespaces are never held in memory at once. The reader must support pagination, i.e.,
+// it must not be a cache. If the continue token expires between pages, listing restarts from the beginning, so fn
+// must be idempotent (e.g., by checking the current state first).
+func listWorkloadsInChunks(ctx context.Context, reader client.Reader, list client.ObjectList, namespace string, chunkSize int64, fn func([]client.Object) error) error {
+	continueToken := ""
+	for {
+		page := list.DeepCopyObject().(client.ObjectList)
+		if err := reader.List(ctx, page, client.InNamespace(namespace), client.Limit(chunkSize), client.Continue(continueToken)); err != nil {
+			if apierrors.IsResourceExpired(err) && continueToken != "" {
+				// the workloads of the previous pages are processed again, which is cheap as they are up to date
+				continueToken = ""
+				continue
+			}
+			return fmt.Errorf("error listing workloads: %w", err)
+		}
+
+		if err := fn(workloads(page)); err != nil {
+			return err
+		}
+
+		continueToken = page.GetContinue()
+		if continueToken == "" {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,105 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// ForceSyncAnnotation resets the rewrite loop detection for a workload when its value changes, e.g., after resolving
+// the conflict with another component.
+const ForceSyncAnnotation = "image-clone.timebertt.dev/force-sync"
+
+// rewriteLoop tracks the rewrites of a single workload for detecting rewrite loops, e.g., caused by a mutating webhook
+// that reverts our rewrites.
+type rewriteLoop struct {
+	lock sync.Mutex
+	// rewrites stores the times of recent rewrites per container, source, and destination
+	rewrites map[string][]time.Time
+	// broken is true if a loop was detected, forceSync is the value of the ForceSyncAnnotation at that time
+	broken    bool
+	forceSync string
+}
+
+// rewriteLoopBroken checks whether patching the given workload is stopped because of a detected rewrite loop. If the
+// ForceSyncAnnotation was changed since the loop was detected, the detection is reset.
+func (c *ImageCloneController) rewriteLoopBroken(obj client.Object) bool {
+	if c.RewriteLoopThreshold <= 0 {
+		return false
+	}
+
+	value, ok := c.rewriteLoops.Load(obj.GetUID())
+	if !ok {
+		return false
+	}
+	loop := value.(*rewriteLoop)
+
+	loop.lock.Lock()
+	defer loop.lock.Unlock()
+	if !loop.broken {
+		return false
+	}
+	if obj.GetAnnotations()[ForceSyncAnnotation] != loop.forceSync {
+		c.rewriteLoops.Delete(obj.GetUID())
+		return false
+	}
+	return true
+}
+
+// trackRewrites records the given rewrites of a workload. If the same container was rewritten from the same source to
+// the same destination more than RewriteLoopThreshold times within RewriteLoopWindow, patching the workload is stopped
+// and a warning event is emitted.
+func (c *ImageCloneController) trackRewrites(obj client.Object, rewritten []rewrite) {
+	if c.RewriteLoopThreshold <= 0 || len(rewritten) == 0 {
+		return
+	}
+
+	value, _ := c.rewriteLoops.LoadOrStore(obj.GetUID(), &rewriteLoop{rewrites: make(map[string][]time.Time)})
+	loop := value.(*rewriteLoop)
+
+	loop.lock.Lock()
+	defer loop.lock.Unlock()
+
+	now := time.Now()
+	for _, r := range rewritten {
+		key := r.Container.Name + "\n" + r.Source.String() + "\n" + r.Destination.String()
+
+		// drop rewrites outside of the window
+		times := loop.rewrites[key]
+		for len(times) > 0 && now.Sub(times[0]) > c.RewriteLoopWindow {
+			times = times[1:]
+		}
+		times = append(times, now)
+		loop.rewrites[key] = times
+
+		if len(times) > c.RewriteLoopThreshold && !loop.broken {
+			loop.broken = true
+			loop.forceSync = obj.GetAnnotations()[ForceSyncAnnotation]
+			rewriteLoopsDetectedTotal.Inc()
+			c.event(obj, corev1.EventTypeWarning, ReasonRewriteLoopDetected,
+				"Stopped patching images as the container image was reverted after every rewrite, probably by a conflicting component like a mutating webhook, "+
+					"change the "+ForceSyncAnnotation+" annotation to resume patching",
+				eventKeyContainer, r.Container.Name, eventKeySource, r.Source.String(), eventKeyDestination, r.Destination.Name(),
+				"rewrites", strconv.Itoa(len(times)), "window", c.RewriteLoopWindow.String())
+		}
+	}
+}
@@ -0,0 +1,55 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	"github.com/timebertt/image-clone-controller/pkg/test"
+)
+
+func TestRewriteLoop(t *testing.T) {
+	deployment := test.NewDeployment("default", "app", "nginx:1.23")
+	c := newTestController(t, deployment)
+	c.RewriteLoopThreshold = 2
+	c.RewriteLoopWindow = time.Minute
+
+	r := rewrite{
+		Container:   containerImage{List: containerListContainers, Name: "container-0"},
+		Source:      name.MustParseReference("nginx:1.23"),
+		Destination: name.MustParseReference("registry.example.com/index_docker_io/library/nginx:1.23").(name.Tag),
+	}
+	for i := 0; i < c.RewriteLoopThreshold; i++ {
+		c.trackRewrites(deployment, []rewrite{r})
+		if c.rewriteLoopBroken(deployment) {
+			t.Fatalf("loop detected after %d rewrites, want more than %d", i+1, c.RewriteLoopThreshold)
+		}
+	}
+	c.trackRewrites(deployment, []rewrite{r})
+	if !c.rewriteLoopBroken(deployment) {
+		t.Fatalf("loop not detected after %d rewrites", c.RewriteLoopThreshold+1)
+	}
+
+	c.forgetDeletedWorkloads().Delete(event.DeleteEvent{Object: deployment}, nil)
+	if _, ok := c.rewriteLoops.Load(deployment.GetUID()); ok {
+		t.Error("rewriteLoops was not cleared when the workload was deleted")
+	}
+}
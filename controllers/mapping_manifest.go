@@ -0,0 +1,232 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/google/go-containerregistry/pkg/name"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/timebertt/image-clone-controller/pkg/copier"
+	"github.com/timebertt/image-clone-controller/pkg/naming"
+)
+
+const (
+	// MappingManifestPath is the path that the mapping manifest is served on.
+	MappingManifestPath = "/debug/mapping"
+	// MappingManifestSchemaVersion is the version of the MappingManifest format. It is increased on incompatible
+	// changes, so that restore tooling can reject manifests it doesn't understand.
+	MappingManifestSchemaVersion = 1
+)
+
+// MappingManifest maps the original references of all images in the backup registry to their backup destinations, e.g.,
+// for rewriting workload manifests to the backup registry when restoring a cluster.
+type MappingManifest struct {
+	SchemaVersion  int            `json:"schemaVersion"`
+	BackupRegistry string         `json:"backupRegistry"`
+	Generated      time.Time      `json:"generated"`
+	Images         []MappingEntry `json:"images"`
+}
+
+// MappingEntry maps an original image reference to its destination in the backup registry.
+type MappingEntry struct {
+	// Original is the original reference of the image, including the digest if the image was referenced by digest.
+	Original string `json:"original"`
+	// Destination is the tag of the image in the backup registry.
+	Destination string `json:"destination"`
+	// Digest is the digest that the destination tag references.
+	Digest string `json:"digest"`
+}
+
+// MappingManifest generates the MappingManifest from the contents of the backup registry, i.e., it lists all
+// repositories and tags of the backup registry and maps them back to their original references (see naming.Original).
+// Repositories that were not created by the controller are ignored.
+// The backup registry is the source of truth, so the manifest can be generated without a cluster. If hints is not nil,
+// the source digests recorded on the workloads (see SourceDigestsAnnotation) are used for completing original
+// references that can't be derived from the destination tag alone, and their destination prefixes (see
+// DestinationPrefixAnnotation) are removed before other path elements that look like encoded registry hosts. Workloads
+// are listed in chunks of the given size, which must be 0 if hints is a cache. Failing to list workloads only results
+// in less complete references.
+func (c *ImageCloneController) MappingManifest(ctx context.Context, log logr.Logger, hints client.Reader, chunkSize int64) (*MappingManifest, error) {
+	digests := make(sourceDigests)
+	prefixes := sets.NewString()
+	if hints != nil {
+		if err := c.mappingHints(ctx, hints, chunkSize, digests, prefixes); err != nil {
+			log.Error(err, "Failed listing workloads, generating mapping manifest from the backup registry only")
+		}
+	}
+
+	repositories, err := c.Copier.Repositories(ctx, c.BackupRegistry)
+	if err != nil {
+		return nil, fmt.Errorf("error listing repositories of backup registry: %w", err)
+	}
+	sort.Strings(repositories)
+
+	manifest := &MappingManifest{
+		SchemaVersion:  MappingManifestSchemaVersion,
+		BackupRegistry: c.BackupRegistry.RegistryStr(),
+		Generated:      time.Now().UTC().Truncate(time.Second),
+		Images:         []MappingEntry{},
+	}
+	for i, repository := range repositories {
+		repo, err := name.NewRepository(c.BackupRegistry.RegistryStr() + "/" + repository)
+		if err != nil {
+			continue
+		}
+		prefix, ok := c.backupRepositoryPrefix(repo, prefixes.List())
+		if !ok {
+			continue
+		}
+		log.V(1).Info("Mapping repository", "repository", repository, "progress", fmt.Sprintf("%d/%d", i+1, len(repositories)))
+
+		entries, err := c.mapRepository(ctx, repo, prefix, digests)
+		if err != nil {
+			return nil, fmt.Errorf("error mapping repository %q: %w", repository, err)
+		}
+		manifest.Images = append(manifest.Images, entries...)
+	}
+
+	log.Info("Generated mapping manifest", "repositories", len(repositories), "images", len(manifest.Images))
+	return manifest, nil
+}
+
+// backupRepositoryPrefix checks whether the given repository in the backup registry was created by the controller,
+// i.e., whether it is the destination of a repository mapping or its first path element after the destination prefix
+// looks like an encoded registry host. The given known prefixes are tried first, otherwise the prefix ends before the
+// first path element that looks like an encoded registry host (see naming.StripPrefix). It returns the prefix of the
+// repository.
+func (c *ImageCloneController) backupRepositoryPrefix(repo name.Repository, prefixes []string) (string, bool) {
+	if c.RepositoryMappings.IsDestination(repo.Tag("latest")) {
+		return "", true
+	}
+	stripped := naming.StripPrefix(repo.RepositoryStr(), prefixes...)
+	encodedRegistry, _, ok := strings.Cut(stripped, "/")
+	if !ok || !naming.LooksLikeEncodedRegistry(encodedRegistry) {
+		return "", false
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(repo.RepositoryStr(), stripped), "/"), true
+}
+
+func (c *ImageCloneController) mapRepository(ctx context.Context, repo name.Repository, prefix string, digests sourceDigests) ([]MappingEntry, error) {
+	tags, err := c.Copier.Tags(ctx, repo)
+	if err != nil {
+		if copier.IsNotFound(err) {
+			// deleted after listing the catalog
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error listing tags: %w", err)
+	}
+
+	var entries []MappingEntry
+	for _, tag := range tags {
+		dst := repo.Tag(tag)
+		digest, exists, err := c.Copier.Exists(ctx, dst)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			continue
+		}
+
+		tagDigests := digests
+		if _, ok := digests[dst.Name()]; !ok {
+			// Without a hint, the destination digest is the best guess for the source digest of truncated digest tags.
+			// It is only used if it matches the digest in the tag, see sourceDigests.original.
+			tagDigests = sourceDigests{dst.Name(): digest.String()}
+		}
+		original, err := c.originalImage(dst, prefix, tagDigests)
+		if err != nil {
+			continue
+		}
+
+		entries = append(entries, MappingEntry{
+			Original:    original.String(),
+			Destination: dst.Name(),
+			Digest:      digest.String(),
+		})
+	}
+	return entries, nil
+}
+
+// mappingHints adds the source digests recorded on all workloads to the given digests and their valid destination
+// prefixes to the given prefixes.
+func (c *ImageCloneController) mappingHints(ctx context.Context, reader client.Reader, chunkSize int64, digests sourceDigests, prefixes sets.String) error {
+	namespaces := c.WatchNamespaces
+	if len(namespaces) == 0 {
+		namespaces = []string{metav1.NamespaceAll}
+	}
+
+	for _, namespace := range namespaces {
+		for _, list := range []client.ObjectList{&appsv1.DeploymentList{}, &appsv1.DaemonSetList{}} {
+			if err := listWorkloadsInChunks(ctx, reader, list, namespace, chunkSize, func(objects []client.Object) error {
+				for _, obj := range objects {
+					for dst, digest := range sourceDigestsOf(obj) {
+						digests[dst] = digest
+					}
+					if prefix := obj.GetAnnotations()[DestinationPrefixAnnotation]; prefix != "" && naming.ValidatePrefix(prefix) == nil {
+						prefixes.Insert(prefix)
+					}
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// mappingManifestHandler serves the MappingManifest generated with the cached workloads as hints. As generating it
+// checks every tag in the backup registry, only one manifest is generated at a time.
+func (c *ImageCloneController) mappingManifestHandler(log logr.Logger, reader client.Reader, token string) http.Handler {
+	var lock sync.Mutex
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !copier.AuthorizeDebugRequest(w, r, token) {
+			return
+		}
+
+		lock.Lock()
+		manifest, err := c.MappingManifest(r.Context(), log, reader, 0)
+		lock.Unlock()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(manifest)
+	})
+}
@@ -0,0 +1,78 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-logr/logr"
+
+	"github.com/timebertt/image-clone-controller/pkg/test"
+)
+
+func TestMappingManifestPrefixedDestinations(t *testing.T) {
+	backup := newTestRegistry(t)
+	for _, image := range []string{
+		"ghcr_io/app:v1",
+		// prefixes are recognized without hints if they end before an encoded registry host
+		"team-billing/ghcr_io/app:v2",
+		"team-billing/registry_gitlab_com/group/app:v3",
+		// prefixes of workloads are known from the hints
+		"team-a/prod/registry_example_com_5000/app:v4",
+		// not created by the controller
+		"team-billing/app:v5",
+		"app:v6",
+	} {
+		if _, err := backup.SeedImage(image, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deployment := test.NewDeployment("default", "app", "nginx:1.25")
+	deployment.Annotations = map[string]string{DestinationPrefixAnnotation: "team-a/prod"}
+	c := newTestController(t, deployment)
+	c.BackupRegistry = backup.Registry
+
+	manifest, err := c.MappingManifest(context.Background(), logr.Discard(), c.Client, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	registry := backup.Registry.RegistryStr() + "/"
+	want := map[string]string{
+		registry + "ghcr_io/app:v1":                                "ghcr.io/app:v1",
+		registry + "team-billing/ghcr_io/app:v2":                   "ghcr.io/app:v2",
+		registry + "team-billing/registry_gitlab_com/group/app:v3": "registry.gitlab.com/group/app:v3",
+		registry + "team-a/prod/registry_example_com_5000/app:v4":  "registry.example.com:5000/app:v4",
+	}
+	got := make(map[string]string)
+	for _, entry := range manifest.Images {
+		got[entry.Destination] = entry.Original
+		if entry.Digest == "" {
+			t.Errorf("entry for %s doesn't contain the digest", entry.Destination)
+		}
+	}
+	if len(got) != len(want) {
+		t.Errorf("manifest contains %d images, want %d: %v", len(got), len(want), got)
+	}
+	for destination, original := range want {
+		if got[destination] != original {
+			t.Errorf("original of %s = %q, want %q", destination, got[destination], original)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/timebertt/image-clone-controller/pkg/version"
+)
+
+const metricsNamespace = "image_clone"
+
+var (
+	imagesCopiedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "images_copied_total",
+		Help:      "Total number of container images that were copied to the backup registry and rewritten.",
+	})
+
+	imagesRewrittenTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "images_rewritten_total",
+		Help:      "Total number of container images that were rewritten without copying, as they already existed in the backup registry.",
+	})
+
+	missingBackupImagesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "missing_backup_images_total",
+		Help:      "Total number of container images referencing the backup registry that don't exist in the backup registry.",
+	}, []string{"healed"})
+
+	excludedImagesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "excluded_images_total",
+		Help:      "Total number of container images that were skipped because they match an exclude pattern.",
+	})
+
+	reconcilesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "reconciles_total",
+		Help:      "Total number of reconciliations per workload kind and result.",
+	}, []string{"kind", "result"})
+
+	reconcileDurationSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "reconcile_duration_seconds",
+		Help:      "Duration of reconciliations per workload kind and result.",
+		Buckets:   []float64{0.01, 0.1, 1, 5, 15, 60, 300, 900, 1800},
+	}, []string{"kind", "result"})
+
+	rewriteLoopsDetectedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "rewrite_loops_detected_total",
+		Help:      "Total number of workloads whose images were not patched anymore because their rewrites were reverted repeatedly.",
+	})
+
+	invalidImageReferencesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "invalid_image_references_total",
+		Help:      "Total number of container images that were skipped because their reference is invalid.",
+	})
+
+	offlineRewritesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "offline_rewrites_total",
+		Help:      "Total number of container images in offline mode that were rewritten to existing images or are pending because the image doesn't exist in the backup registry.",
+	}, []string{"result"})
+
+	delayedPatchesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "delayed_patches_total",
+		Help:      "Total number of patches per workload kind that were delayed because a rollout was in progress.",
+	}, []string{"kind"})
+
+	patchesDeferredByWindowTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "patches_deferred_by_window_total",
+		Help:      "Total number of patches per workload kind that were deferred because no patch window was open.",
+	}, []string{"kind"})
+
+	deniedImagesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "denied_images_total",
+		Help:      "Total number of container images with a denylisted digest, by whether they already reference the backup registry.",
+	}, []string{"backed_up"})
+
+	incompletePlatformImagesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "incomplete_platform_images_total",
+		Help:      "Total number of copied container images per required platform that the image doesn't provide.",
+	}, []string{"platform"})
+
+	annotatedArtifactsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "annotated_artifacts_total",
+		Help:      "Total number of OCI artifacts referenced by workload annotations that were copied to the backup registry, already existed, or failed to be mirrored.",
+	}, []string{"result"})
+
+	buildInfoGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "build_info",
+		Help:      "Build information of the controller, always 1.",
+	}, []string{"version"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(
+		imagesCopiedTotal,
+		imagesRewrittenTotal,
+		missingBackupImagesTotal,
+		invalidImageReferencesTotal,
+		rewriteLoopsDetectedTotal,
+		excludedImagesTotal,
+		deniedImagesTotal,
+		incompletePlatformImagesTotal,
+		delayedPatchesTotal,
+		patchesDeferredByWindowTotal,
+		offlineRewritesTotal,
+		annotatedArtifactsTotal,
+		reconcilesTotal,
+		reconcileDurationSeconds,
+		buildInfoGauge,
+	)
+
+	buildInfoGauge.WithLabelValues(version.Version).Set(1)
+}
+
+// instrumentReconciler records the result and duration of all reconciliations of the given reconciler with an explicit
+// kind label, so that dashboards don't depend on controller-runtime's metrics.
+func instrumentReconciler(kind string, r reconcile.Func) reconcile.Func {
+	return func(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
+		start := time.Now()
+		result, err := r(ctx, req)
+
+		resultLabel := "success"
+		if err != nil {
+			resultLabel = "failure"
+		}
+		reconcilesTotal.WithLabelValues(kind, resultLabel).Inc()
+		reconcileDurationSeconds.WithLabelValues(kind, resultLabel).Observe(time.Since(start).Seconds())
+
+		return result, err
+	}
+}
@@ -0,0 +1,129 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/prometheus/client_golang/prometheus"
+	appsv1 "k8s.io/api/apps/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/timebertt/image-clone-controller/pkg/naming"
+)
+
+// ImageFromPreviousBackupRegistryError is returned if an image seems to reference a previous backup registry that is
+// not configured via PreviousBackupRegistries. Copying such images would nest the repository names of the previous
+// backup registry in the current one.
+type ImageFromPreviousBackupRegistryError struct {
+	Image string
+}
+
+func (e *ImageFromPreviousBackupRegistryError) Error() string {
+	return fmt.Sprintf("image %q seems to reference a previous backup registry, refusing to copy it with a double prefix, "+
+		"add its registry to --previous-backup-registries to migrate it", e.Image)
+}
+
+// isPreviousBackupRegistry checks whether the given registry is one of the configured previous backup registries.
+func (c *ImageCloneController) isPreviousBackupRegistry(registry name.Registry) bool {
+	for _, previous := range c.PreviousBackupRegistries {
+		if naming.SameRegistry(previous, registry) {
+			return true
+		}
+	}
+	return false
+}
+
+// previousBackupRegistryReferencesCollector exposes the number of container images that still reference one of the
+// previous backup registries to observe the progress of backup registry migrations.
+type previousBackupRegistryReferencesCollector struct {
+	reader     client.Reader
+	registries []name.Registry
+	kinds      []client.ObjectList
+	desc       *prometheus.Desc
+}
+
+func newPreviousBackupRegistryReferencesCollector(reader client.Reader, registries []name.Registry, kinds []client.ObjectList) *previousBackupRegistryReferencesCollector {
+	return &previousBackupRegistryReferencesCollector{
+		reader:     reader,
+		registries: registries,
+		kinds:      kinds,
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "", "previous_backup_registry_references"),
+			"Number of container images that still reference a previous backup registry.",
+			[]string{"registry"}, nil,
+		),
+	}
+}
+
+func (p *previousBackupRegistryReferencesCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- p.desc
+}
+
+func (p *previousBackupRegistryReferencesCollector) Collect(ch chan<- prometheus.Metric) {
+	// lists are served from the cache, so this is cheap
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	counts := make(map[string]int, len(p.registries))
+	for _, registry := range p.registries {
+		counts[registry.RegistryStr()] = 0
+	}
+
+	for _, list := range p.kinds {
+		list = list.DeepCopyObject().(client.ObjectList)
+		if err := p.reader.List(ctx, list); err != nil {
+			ch <- prometheus.NewInvalidMetric(p.desc, err)
+			return
+		}
+
+		for _, image := range listImages(list) {
+			ref, err := name.ParseReference(image)
+			if err != nil {
+				continue
+			}
+			for _, registry := range p.registries {
+				if naming.SameRegistry(registry, ref.Context().Registry) {
+					counts[registry.RegistryStr()]++
+				}
+			}
+		}
+	}
+
+	for registry, count := range counts {
+		ch <- prometheus.MustNewConstMetric(p.desc, prometheus.GaugeValue, float64(count), registry)
+	}
+}
+
+// listImages returns the container images of all workloads in the given list.
+func listImages(list client.ObjectList) []string {
+	var images []string
+	switch l := list.(type) {
+	case *appsv1.DeploymentList:
+		for i := range l.Items {
+			images = append(images, indexImages(&l.Items[i])...)
+		}
+	case *appsv1.DaemonSetList:
+		for i := range l.Items {
+			images = append(images, indexImages(&l.Items[i])...)
+		}
+	}
+	return images
+}
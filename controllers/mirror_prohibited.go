@@ -0,0 +1,101 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var mirrorProhibitedImagesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "mirror_prohibited_images_total",
+	Help:      "Total number of container images per namespace that were not copied because mirroring their repository is prohibited.",
+}, []string{"namespace"})
+
+func init() {
+	metrics.Registry.MustRegister(mirrorProhibitedImagesTotal)
+}
+
+// ReadMirrorProhibitedPatterns reads the given file of repositories that must not be mirrored to the backup registry,
+// e.g., for license compliance. It contains one path.Match pattern per line, which matches like the patterns of
+// ExcludeImages. Empty lines and lines starting with # are ignored.
+func ReadMirrorProhibitedPatterns(file string) ([]string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var patterns []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		if _, err := path.Match(text, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern in line %d of %q: %w", line, file, err)
+		}
+		patterns = append(patterns, text)
+	}
+	return patterns, scanner.Err()
+}
+
+// mirrorProhibitedList holds the patterns of MirrorProhibitedFile and reloads them when the file changes.
+type mirrorProhibitedList struct {
+	lock     sync.Mutex
+	patterns []string
+	loaded   bool
+	modTime  time.Time
+}
+
+// mirrorProhibited returns the pattern of MirrorProhibitedFile that matches the repository of the given image, if any.
+// It returns an error if the file can't be read, so that prohibited images are never copied by accident.
+func (c *ImageCloneController) mirrorProhibited(img name.Reference) (string, bool, error) {
+	if c.MirrorProhibitedFile == "" {
+		return "", false, nil
+	}
+
+	l := &c.mirrorProhibitedList
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	info, err := os.Stat(c.MirrorProhibitedFile)
+	if err != nil {
+		return "", false, fmt.Errorf("failed reading mirror prohibited repositories: %w", err)
+	}
+	if !l.loaded || !info.ModTime().Equal(l.modTime) {
+		patterns, err := ReadMirrorProhibitedPatterns(c.MirrorProhibitedFile)
+		if err != nil {
+			return "", false, fmt.Errorf("failed reading mirror prohibited repositories: %w", err)
+		}
+		l.patterns, l.loaded, l.modTime = patterns, true, info.ModTime()
+	}
+
+	pattern, _, prohibited := matchRepositoryPatterns(l.patterns, img)
+	return pattern, prohibited, nil
+}
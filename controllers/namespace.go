@@ -0,0 +1,160 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// BackupRegistryAnnotation can be set on Namespaces to override the backup registry for all workloads in the namespace.
+const BackupRegistryAnnotation = "image-clone.timebertt.dev/backup-registry"
+
+// SkipAnnotation can be set to "true" on Namespaces to exclude all workloads in the namespace, like the namespaces
+// ignored by the controller.
+const SkipAnnotation = "image-clone.timebertt.dev/skip"
+
+//+kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch
+
+// workloadTarget is the backup registry and destination prefix that the images of a workload are copied to.
+type workloadTarget struct {
+	BackupRegistry name.Registry
+	Prefix         string
+	// Skipped describes why the workload is not reconciled, e.g., because its namespace has the SkipAnnotation.
+	Skipped string
+	// Warnings describe invalid configuration that is ignored, e.g., invalid annotations.
+	Warnings []string
+}
+
+// targetFor determines the workloadTarget of the given workload, reading its namespace with the given reader. It is
+// shared by reconciliations and PlanWorkload, so that plans show what a reconciliation would do. Warnings are emitted
+// as events unless dryRun is set. With dryRun, a missing namespace is only a warning, as the manifest might not have
+// been applied yet. Workloads that are being deleted are never skipped, so that cleanup doesn't block their deletion.
+func (c *ImageCloneController) targetFor(ctx context.Context, reader client.Reader, obj client.Object, dryRun bool) (workloadTarget, error) {
+	target := workloadTarget{BackupRegistry: c.BackupRegistry}
+	namespaceName := obj.GetNamespace()
+	deleting := obj.GetDeletionTimestamp() != nil
+
+	if namespaceName != "" && !deleting {
+		// the cache doesn't contain such workloads, only manifests passed to PlanWorkload can reference them
+		if c.ignoredNamespaces.Has(namespaceName) {
+			target.Skipped = "namespace is ignored by the controller"
+			return target, nil
+		}
+		if len(c.WatchNamespaces) > 0 && !sets.NewString(c.WatchNamespaces...).Has(namespaceName) {
+			target.Skipped = "namespace is not watched by the controller"
+			return target, nil
+		}
+	}
+
+	// with NamespacedRBAC, we are not allowed to read Namespaces
+	if namespaceName != "" && !c.NamespacedRBAC {
+		namespace := &corev1.Namespace{}
+		if err := reader.Get(ctx, client.ObjectKey{Name: namespaceName}, namespace); err != nil {
+			if !dryRun || !apierrors.IsNotFound(err) {
+				return workloadTarget{}, fmt.Errorf("error reading namespace: %w", err)
+			}
+			target.Warnings = append(target.Warnings, fmt.Sprintf("namespace %q does not exist, using the default backup registry", namespaceName))
+		} else {
+			if isSkipped(namespace) && !deleting {
+				target.Skipped = "namespace is annotated with " + SkipAnnotation + "=true"
+				return target, nil
+			}
+
+			registry, err := c.namespaceBackupRegistry(namespace)
+			if err != nil {
+				if !dryRun {
+					c.event(obj, corev1.EventTypeWarning, ReasonInvalidBackupRegistryAnnotation, "Invalid backup registry annotation on namespace, using default backup registry",
+						"annotation", BackupRegistryAnnotation, "value", namespace.Annotations[BackupRegistryAnnotation], eventKeyError, err.Error())
+				}
+				target.Warnings = append(target.Warnings, fmt.Sprintf("invalid %s annotation on namespace, using the default backup registry: %v", BackupRegistryAnnotation, err))
+			} else {
+				target.BackupRegistry = registry
+			}
+		}
+	}
+
+	prefix, warning := c.destinationPrefixFor(obj, dryRun)
+	if warning != "" {
+		target.Warnings = append(target.Warnings, warning)
+	}
+	target.Prefix = prefix
+	return target, nil
+}
+
+func isSkipped(namespace *corev1.Namespace) bool {
+	return namespace.Annotations[SkipAnnotation] == "true"
+}
+
+// namespaceBackupRegistry returns the backup registry for workloads in the given namespace. It returns an error if the
+// namespace's BackupRegistryAnnotation is invalid.
+func (c *ImageCloneController) namespaceBackupRegistry(namespace *corev1.Namespace) (name.Registry, error) {
+	value, ok := namespace.Annotations[BackupRegistryAnnotation]
+	if !ok || value == "" {
+		return c.BackupRegistry, nil
+	}
+
+	registry, err := name.NewRegistry(value)
+	if err == nil {
+		err = ValidateBackupRegistry(c.NamingConfig(registry, ""))
+	}
+	if err == nil && !c.AllowPublicBackup {
+		err = CheckPublicBackupRegistry(registry)
+	}
+	return registry, err
+}
+
+// namespaceAnnotationsChanged only lets through updates of Namespaces that change the BackupRegistryAnnotation or the
+// SkipAnnotation.
+var namespaceAnnotationsChanged = predicate.Or(annotationChanged(BackupRegistryAnnotation), annotationChanged(SkipAnnotation))
+
+// enqueueWorkloadsInNamespace maps Namespaces to all workloads of the given list type in the namespace.
+func (c *ImageCloneController) enqueueWorkloadsInNamespace(reader client.Reader, list client.ObjectList, filter predicate.Predicate) handler.EventHandler {
+	return handler.EnqueueRequestsFromMapFunc(func(obj client.Object) []reconcile.Request {
+		if c.ignoredNamespaces.Has(obj.GetName()) {
+			return nil
+		}
+
+		workloads := list.DeepCopyObject().(client.ObjectList)
+		if err := reader.List(context.Background(), workloads, client.InNamespace(obj.GetName())); err != nil {
+			logf.Log.Error(err, "Failed listing workloads in namespace", "namespace", obj.GetName())
+			return nil
+		}
+
+		var requests []reconcile.Request
+		_ = meta.EachListItem(workloads, func(o runtime.Object) error {
+			if workload := o.(client.Object); filter.Generic(event.GenericEvent{Object: workload}) {
+				requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(workload)})
+			}
+			return nil
+		})
+		return requests
+	})
+}
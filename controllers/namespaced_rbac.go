@@ -0,0 +1,49 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// DisableClusterScopedFeatures disables all features that require cluster-scoped permissions if NamespacedRBAC is
+// enabled and logs why they are disabled. Namespace annotations are ignored in this mode as well, as Namespaces can't
+// be read.
+func (c *Config) DisableClusterScopedFeatures(log logr.Logger) {
+	if !c.NamespacedRBAC {
+		return
+	}
+
+	log.Info("namespaced RBAC mode: Namespace annotations for overriding the backup registry or skipping namespaces are ignored, as they require reading Namespaces")
+	if c.CoverageInterval > 0 {
+		log.Info("namespaced RBAC mode: disabling coverage metrics, as they require listing Namespaces")
+		c.CoverageInterval = 0
+	}
+	if c.DetectPlatforms {
+		log.Info("namespaced RBAC mode: disabling detection of required platforms, as it requires watching Nodes")
+		c.DetectPlatforms = false
+	}
+	if c.NamespaceSummaryEvents {
+		log.Info("namespaced RBAC mode: disabling namespace summary events, as events on Namespaces are created in the default namespace")
+		c.NamespaceSummaryEvents = false
+	}
+	if c.ReplicatePullSecret.Name != "" {
+		log.Info("namespaced RBAC mode: disabling pull secret replication, as it requires watching Namespaces")
+		c.ReplicatePullSecret = types.NamespacedName{}
+	}
+}
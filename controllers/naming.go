@@ -0,0 +1,55 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"github.com/google/go-containerregistry/pkg/name"
+
+	"github.com/timebertt/image-clone-controller/pkg/naming"
+)
+
+// NamingConfig returns the naming configuration for destination images in the given backup registry with the given
+// destination prefix.
+func (c *Config) NamingConfig(backupRegistry name.Registry, prefix string) naming.Config {
+	return naming.Config{
+		BackupRegistry:     backupRegistry,
+		Prefix:             prefix,
+		PreserveShortNames: c.PreserveShortNames,
+		DigestTagStyle:     c.DigestTagStyle,
+		RepositoryMappings: c.RepositoryMappings,
+	}
+}
+
+// destinationImage returns the destination of the given source image in the given backup registry, see
+// naming.Destination.
+func (c *ImageCloneController) destinationImage(srcImg name.Reference, dstRegistry name.Registry, prefix string) (name.Tag, error) {
+	return naming.Destination(srcImg, c.NamingConfig(dstRegistry, prefix))
+}
+
+// originalImage returns the original source reference of an image in a (previous) backup registry, see
+// naming.Original. Source digests recorded for the image are added to the reference, see SourceDigestsAnnotation.
+// Images that are pinned to a digest by the controller (see rewrite.image) are mapped by their destination tag.
+func (c *ImageCloneController) originalImage(dstImg name.Reference, prefix string, digests sourceDigests) (name.Reference, error) {
+	if tag, ok := pinnedTag(dstImg); ok {
+		dstImg = tag
+	}
+	original, err := naming.Original(dstImg, c.NamingConfig(dstImg.Context().Registry, prefix))
+	if err != nil {
+		return nil, err
+	}
+	return digests.original(dstImg, original)
+}
@@ -0,0 +1,63 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/timebertt/image-clone-controller/pkg/notify"
+)
+
+func (c *ImageCloneController) notifier() notify.Sink {
+	if c.Notifier == nil {
+		return notify.NopSink{}
+	}
+	return c.Notifier
+}
+
+// notifyCopy sends a notification about the copy of the given rewrite.
+func (c *ImageCloneController) notifyCopy(obj client.Object, r rewrite, duration time.Duration, err error) {
+	event := notify.Event{
+		Type:        notify.TypeCopySucceeded,
+		Kind:        kindOf(obj),
+		Namespace:   obj.GetNamespace(),
+		Name:        obj.GetName(),
+		Container:   r.Container.Name,
+		Source:      r.Source.Name(),
+		Destination: r.Destination.Name(),
+		Result:      "success",
+		Duration:    duration.Seconds(),
+	}
+	if err != nil {
+		event.Type, event.Result, event.Error = notify.TypeCopyFailed, "failure", err.Error()
+	}
+	c.notifier().Notify(event)
+}
+
+// kindOf returns the kind of the given workload.
+func kindOf(obj client.Object) string {
+	switch obj.(type) {
+	case *appsv1.Deployment:
+		return "Deployment"
+	case *appsv1.DaemonSet:
+		return "DaemonSet"
+	}
+	return obj.GetObjectKind().GroupVersionKind().Kind
+}
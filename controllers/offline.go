@@ -0,0 +1,57 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/go-logr/logr"
+)
+
+// OfflineImagesMissingError is returned by reconcilePodTemplate in offline mode if some destination images don't
+// exist in the backup registry yet. The other images are rewritten anyway.
+type OfflineImagesMissingError struct {
+	Images []string
+}
+
+func (e *OfflineImagesMissingError) Error() string {
+	return fmt.Sprintf("%d images don't exist in the backup registry and can't be copied in offline mode: %s",
+		len(e.Images), strings.Join(e.Images, ", "))
+}
+
+// errOfflineImageMissing is returned by rewriteOffline if the destination image doesn't exist.
+var errOfflineImageMissing = errors.New("destination image doesn't exist in the backup registry")
+
+// rewriteOffline checks whether the destination image of the given rewrite already exists in the backup registry,
+// e.g., because it was pre-seeded in a connected environment. It never contacts the source registry.
+func (c *ImageCloneController) rewriteOffline(ctx context.Context, log logr.Logger, r rewrite) error {
+	_, exists, err := c.Copier.Exists(ctx, r.Destination)
+	if err != nil {
+		return fmt.Errorf("error checking if image %q exists in the backup registry: %w", r.Destination.Name(), err)
+	}
+	if !exists {
+		offlineRewritesTotal.WithLabelValues("pending").Inc()
+		return errOfflineImageMissing
+	}
+
+	log.Info("Image exists in the backup registry, rewriting it without copying in offline mode", "destination", r.Destination.Name())
+	offlineRewritesTotal.WithLabelValues("rewritten").Inc()
+	return nil
+}
@@ -0,0 +1,329 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// PatchStrategy configures how the controller patches workloads. The controller never updates workloads.
+type PatchStrategy string
+
+const (
+	// PatchStrategyStrategic uses strategic merge patches, which only contain the changed containers.
+	PatchStrategyStrategic PatchStrategy = "strategic"
+	// PatchStrategyMerge uses JSON merge patches, which contain the whole containers list.
+	PatchStrategyMerge PatchStrategy = "merge"
+	// PatchStrategyJSON uses JSON patches, which only replace the changed image fields.
+	PatchStrategyJSON PatchStrategy = "json"
+	// PatchStrategyApply uses server-side apply, which only contains the fields owned by the controller.
+	PatchStrategyApply PatchStrategy = "ssa"
+)
+
+// PatchStrategies are all supported patch strategies.
+var PatchStrategies = []PatchStrategy{PatchStrategyStrategic, PatchStrategyMerge, PatchStrategyJSON, PatchStrategyApply}
+
+// ValidatePatchStrategy checks whether the given patch strategy is supported.
+func ValidatePatchStrategy(strategy PatchStrategy) error {
+	for _, s := range PatchStrategies {
+		if s == strategy {
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported patch strategy %q, supported strategies: %v", strategy, PatchStrategies)
+}
+
+// fieldOwner is the field manager used for all patches of the controller.
+const fieldOwner = client.FieldOwner("image-clone-controller")
+
+// patchWorkload patches the changes from before to obj using the configured PatchStrategy. All strategies use
+// optimistic locking, so that images added in the meantime are not overwritten.
+// If the API server rejects the patch as too large or invalid, the changed containers are patched one after another.
+func (c *ImageCloneController) patchWorkload(ctx context.Context, obj, before client.Object) error {
+	err := c.patch(ctx, obj, before)
+	if err == nil || !(apierrors.IsRequestEntityTooLargeError(err) || apierrors.IsInvalid(err)) {
+		return err
+	}
+
+	logf.FromContext(ctx).Info("Patch was rejected, patching containers one by one", "error", err.Error())
+	c.event(before, corev1.EventTypeWarning, ReasonPatchRejected, "Patch was rejected, patching containers one by one", eventKeyError, err.Error())
+	return c.patchContainerByContainer(ctx, obj, before)
+}
+
+// patchContainerByContainer patches the changes from before to obj in one patch per changed container. The metadata
+// is patched last, so that the images hash is only stored once all images have been patched.
+func (c *ImageCloneController) patchContainerByContainer(ctx context.Context, obj, before client.Object) error {
+	current := before.DeepCopyObject().(client.Object)
+	beforeImages := c.containerImages(podTemplateOf(before))
+	for i, container := range c.containerImages(podTemplateOf(obj)) {
+		if beforeImages[i] == container {
+			continue
+		}
+
+		next := current.DeepCopyObject().(client.Object)
+		container.setImage(podTemplateOf(next), container.Image)
+		container.setPullPolicy(podTemplateOf(next), container.PullPolicy)
+		if err := c.patch(ctx, next, current); err != nil {
+			return fmt.Errorf("error patching container %q: %w", container.Name, err)
+		}
+		current = next
+	}
+
+	next := current.DeepCopyObject().(client.Object)
+	next.SetAnnotations(obj.GetAnnotations())
+	next.SetFinalizers(obj.GetFinalizers())
+	if err := c.patch(ctx, next, current); err != nil {
+		return err
+	}
+
+	// return the latest state like a single patch would
+	reflect.ValueOf(obj).Elem().Set(reflect.ValueOf(next).Elem())
+	return nil
+}
+
+// patch patches the changes from before to obj using the configured PatchStrategy. The patches only contain the changed
+// fields.
+func (c *ImageCloneController) patch(ctx context.Context, obj, before client.Object) error {
+	switch c.PatchStrategy {
+	case PatchStrategyMerge:
+		return c.Patch(ctx, obj, client.MergeFromWithOptions(before, client.MergeFromWithOptimisticLock{}), fieldOwner)
+	case PatchStrategyJSON:
+		data, err := c.jsonPatch(obj, before)
+		if err != nil {
+			return err
+		}
+		return c.Patch(ctx, obj, client.RawPatch(types.JSONPatchType, data), fieldOwner)
+	case PatchStrategyApply:
+		applyConfig, err := c.applyConfiguration(obj, before)
+		if err != nil {
+			return err
+		}
+		desired := obj.DeepCopyObject().(client.Object)
+		if err := c.Patch(ctx, applyConfig, client.Apply, fieldOwner, client.ForceOwnership); err != nil {
+			return err
+		}
+		if err := c.Scheme().Convert(applyConfig, obj, nil); err != nil {
+			return err
+		}
+		return c.removeUnowned(ctx, obj, desired, before)
+	default:
+		return c.Patch(ctx, obj, client.StrategicMergeFrom(before, client.MergeFromWithOptimisticLock{}), fieldOwner)
+	}
+}
+
+// removeUnowned removes annotations and finalizers that were removed from before to desired but are still present on
+// the applied obj, because server-side apply doesn't remove fields owned by other field managers (e.g., the
+// ForceSyncAnnotation owned by users, or annotations set by a different PatchStrategy before). They are removed with a
+// merge patch using optimistic locking.
+func (c *ImageCloneController) removeUnowned(ctx context.Context, obj, desired, before client.Object) error {
+	applied := obj.DeepCopyObject().(client.Object)
+
+	annotations := obj.GetAnnotations()
+	for key := range before.GetAnnotations() {
+		if _, ok := desired.GetAnnotations()[key]; !ok {
+			delete(annotations, key)
+		}
+	}
+	obj.SetAnnotations(annotations)
+	for _, finalizer := range before.GetFinalizers() {
+		if !controllerutil.ContainsFinalizer(desired, finalizer) {
+			controllerutil.RemoveFinalizer(obj, finalizer)
+		}
+	}
+
+	if apiequality.Semantic.DeepEqual(applied, obj) {
+		return nil
+	}
+	return c.Patch(ctx, obj, client.MergeFromWithOptions(applied, client.MergeFromWithOptimisticLock{}), fieldOwner)
+}
+
+type jsonPatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value"`
+}
+
+// jsonPatch calculates a JSON patch that only replaces the changed images and the changed annotations and finalizers. It tests the resourceVersion for optimistic locking.
+func (c *ImageCloneController) jsonPatch(obj, before client.Object) ([]byte, error) {
+	ops := []jsonPatchOperation{{Op: "test", Path: "/metadata/resourceVersion", Value: before.GetResourceVersion()}}
+
+	ops = append(ops, annotationOperations(before.GetAnnotations(), obj.GetAnnotations())...)
+	ops = append(ops, finalizerOperations(before.GetFinalizers(), obj.GetFinalizers())...)
+
+	beforeImages := c.containerImages(podTemplateOf(before))
+	for i, container := range c.containerImages(podTemplateOf(obj)) {
+		path := fmt.Sprintf("/spec/template/spec/%s/%d/", container.List, container.Index)
+
+		if beforeImages[i].Image != container.Image {
+			// test the old image to make sure we replace the image of the expected container
+			ops = append(ops,
+				jsonPatchOperation{Op: "test", Path: path + "image", Value: beforeImages[i].Image},
+				jsonPatchOperation{Op: "replace", Path: path + "image", Value: container.Image},
+			)
+		}
+		if beforeImages[i].PullPolicy != container.PullPolicy {
+			ops = append(ops, jsonPatchOperation{Op: "add", Path: path + "imagePullPolicy", Value: container.PullPolicy})
+		}
+	}
+
+	return json.Marshal(ops)
+}
+
+// jsonPointerEscaper escapes map keys for use in JSON pointers, see RFC 6901.
+var jsonPointerEscaper = strings.NewReplacer("~", "~0", "/", "~1")
+
+// annotationOperations returns JSON patch operations that only add, replace, or remove the changed annotations.
+func annotationOperations(before, after map[string]string) []jsonPatchOperation {
+	if apiequality.Semantic.DeepEqual(before, after) {
+		return nil
+	}
+	if len(before) == 0 {
+		// the annotations field might not exist, so we can't add individual keys
+		return []jsonPatchOperation{{Op: "add", Path: "/metadata/annotations", Value: after}}
+	}
+
+	keys := make([]string, 0, len(before)+len(after))
+	for key := range before {
+		keys = append(keys, key)
+	}
+	for key := range after {
+		if _, ok := before[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var ops []jsonPatchOperation
+	for _, key := range keys {
+		path := "/metadata/annotations/" + jsonPointerEscaper.Replace(key)
+		value, ok := after[key]
+		switch {
+		case !ok:
+			ops = append(ops, jsonPatchOperation{Op: "remove", Path: path})
+		case before[key] != value:
+			ops = append(ops, jsonPatchOperation{Op: "add", Path: path, Value: value})
+		}
+	}
+	return ops
+}
+
+// finalizerOperations returns JSON patch operations that append added finalizers. Other changes replace the whole
+// list after testing the previous list.
+func finalizerOperations(before, after []string) []jsonPatchOperation {
+	if apiequality.Semantic.DeepEqual(before, after) {
+		return nil
+	}
+	if len(before) == 0 || len(after) < len(before) || !apiequality.Semantic.DeepEqual(before, after[:len(before)]) {
+		return []jsonPatchOperation{{Op: "add", Path: "/metadata/finalizers", Value: after}}
+	}
+
+	var ops []jsonPatchOperation
+	for _, finalizer := range after[len(before):] {
+		ops = append(ops, jsonPatchOperation{Op: "add", Path: "/metadata/finalizers/-", Value: finalizer})
+	}
+	return ops
+}
+
+// applyConfiguration returns an object for server-side apply, which only contains the fields managed by the
+// controller: the rewritten images, changed pull policies, the controller's annotations, and the finalizer. Containers
+// that are not rewritten are omitted, so that the controller doesn't take ownership of their images.
+func (c *ImageCloneController) applyConfiguration(obj, before client.Object) (*unstructured.Unstructured, error) {
+	gvk, err := apiutil.GVKForObject(obj, c.Scheme())
+	if err != nil {
+		return nil, err
+	}
+
+	applyConfig := &unstructured.Unstructured{}
+	applyConfig.SetGroupVersionKind(gvk)
+	applyConfig.SetNamespace(obj.GetNamespace())
+	applyConfig.SetName(obj.GetName())
+	// optimistic locking
+	applyConfig.SetResourceVersion(obj.GetResourceVersion())
+
+	annotations := make(map[string]string)
+	for _, key := range []string{ImagesHashAnnotation, LastErrorAnnotation, LastRewriteAnnotation, SourceDigestsAnnotation, ForceSyncAcknowledgedAnnotation} {
+		if value, ok := obj.GetAnnotations()[key]; ok {
+			annotations[key] = value
+		}
+	}
+	applyConfig.SetAnnotations(annotations)
+
+	for _, finalizer := range obj.GetFinalizers() {
+		if finalizer == FinalizerName {
+			applyConfig.SetFinalizers([]string{FinalizerName})
+		}
+	}
+
+	var lists []containerList
+	containers := make(map[containerList][]interface{})
+	beforeImages := c.containerImages(podTemplateOf(before))
+	for i, container := range c.containerImages(podTemplateOf(obj)) {
+		// fields that we applied before are kept in the configuration, as omitting them would remove them
+		setImage := beforeImages[i].Image != container.Image || appliedBefore(before, container, "f:image")
+		setPullPolicy := beforeImages[i].PullPolicy != container.PullPolicy || appliedBefore(before, container, "f:imagePullPolicy")
+		if !setImage && !setPullPolicy {
+			continue
+		}
+
+		fields := map[string]interface{}{"name": container.Name}
+		if setImage {
+			fields["image"] = container.Image
+		}
+		if setPullPolicy {
+			fields["imagePullPolicy"] = string(container.PullPolicy)
+		}
+		if _, ok := containers[container.List]; !ok {
+			lists = append(lists, container.List)
+		}
+		containers[container.List] = append(containers[container.List], fields)
+	}
+	for _, list := range lists {
+		if err := unstructured.SetNestedSlice(applyConfig.Object, containers[list], "spec", "template", "spec", string(list)); err != nil {
+			return nil, err
+		}
+	}
+
+	return applyConfig, nil
+}
+
+// appliedBefore checks whether the given field of the given container is owned by the controller's server-side apply
+// configuration.
+func appliedBefore(obj client.Object, container containerImage, field string) bool {
+	_, ok := containerFieldManager(obj, container, field, appliedByController)
+	return ok
+}
+
+// appliedByController checks whether the given managedFields entry belongs to a server-side apply of the controller.
+func appliedByController(entry metav1.ManagedFieldsEntry) bool {
+	return entry.Manager == string(fieldOwner) && entry.Operation == metav1.ManagedFieldsOperationApply
+}
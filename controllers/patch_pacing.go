@@ -0,0 +1,174 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// newWorkloadPacingGracePeriod is the age of workloads that have never been patched below which they are patched
+// without pacing, as they are protected for the first time and don't run any pods that would be rolled.
+const newWorkloadPacingGracePeriod = 5 * time.Minute
+
+var (
+	pacedPatchesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "paced_patches_total",
+		Help:      "Total number of patches per workload kind that were delayed to stay within the maximum patches per minute.",
+	}, []string{"kind"})
+
+	pacedPatchesPending = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "paced_patches_pending",
+		Help:      "Number of workloads whose images have been copied and that are waiting for their scheduled patch.",
+	})
+)
+
+func init() {
+	metrics.Registry.MustRegister(pacedPatchesTotal, pacedPatchesPending)
+}
+
+// patchPacer meters patches of workloads, so that rewriting a popular image doesn't roll out many workloads at once.
+// Every patch is scheduled in a slot at least interval after the previous one (and namespaceInterval after the
+// previous one in the same namespace) with jitter, workloads are reconciled again when their slot has come. Copies are
+// not paced. Deferred workloads stay in the pending journal until they are patched, so they survive restarts.
+// A nil pacer never delays patches.
+type patchPacer struct {
+	interval, namespaceInterval time.Duration
+
+	lock sync.Mutex
+	// next is the earliest time of the next slot, namespaceNext the earliest time of the next slot per namespace
+	next          time.Time
+	namespaceNext map[string]time.Time
+	// scheduled stores the slots of deferred workloads by UID
+	scheduled map[types.UID]time.Time
+}
+
+func newPatchPacer(perMinute, perMinutePerNamespace int) *patchPacer {
+	p := &patchPacer{
+		namespaceNext: make(map[string]time.Time),
+		scheduled:     make(map[types.UID]time.Time),
+	}
+	if perMinute > 0 {
+		p.interval = time.Minute / time.Duration(perMinute)
+	}
+	if perMinutePerNamespace > 0 {
+		p.namespaceInterval = time.Minute / time.Duration(perMinutePerNamespace)
+	}
+	return p
+}
+
+// wait returns the duration until the given workload may be patched. It returns false if it may be patched now, which
+// uses up the current slot.
+func (p *patchPacer) wait(log logr.Logger, kind string, obj client.Object, now time.Time) (time.Duration, bool) {
+	if p == nil || isNewWorkload(obj, now) {
+		return 0, false
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	defer func() { pacedPatchesPending.Set(float64(len(p.scheduled))) }()
+
+	if slot, ok := p.scheduled[obj.GetUID()]; ok {
+		if !now.Before(slot) {
+			delete(p.scheduled, obj.GetUID())
+			return 0, false
+		}
+		return slot.Sub(now), true
+	}
+	p.prune(now)
+
+	slot := now
+	if p.next.After(slot) {
+		slot = p.next
+	}
+	if next := p.namespaceNext[obj.GetNamespace()]; next.After(slot) {
+		slot = next
+	}
+	if slot.After(now) {
+		// spread deferred patches within their slot, so that they don't hit the API server at the same time
+		if jitter := p.slotLength(); jitter > 0 {
+			slot = slot.Add(time.Duration(rand.Int63n(int64(jitter))))
+		}
+	}
+	if p.interval > 0 {
+		p.next = slot.Add(p.interval)
+	}
+	if p.namespaceInterval > 0 {
+		p.namespaceNext[obj.GetNamespace()] = slot.Add(p.namespaceInterval)
+	}
+
+	if !slot.After(now) {
+		return 0, false
+	}
+	p.scheduled[obj.GetUID()] = slot
+	log.Info("Pacing patches, deferring patch", "scheduled", slot, "requeueAfter", slot.Sub(now))
+	pacedPatchesTotal.WithLabelValues(kind).Inc()
+	return slot.Sub(now), true
+}
+
+// forget removes the slot of the given workload, e.g., when it is deleted.
+func (p *patchPacer) forget(uid types.UID) {
+	if p == nil {
+		return
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	delete(p.scheduled, uid)
+	pacedPatchesPending.Set(float64(len(p.scheduled)))
+}
+
+// slotLength returns the length of the shortest configured slot. p.lock must be held.
+func (p *patchPacer) slotLength() time.Duration {
+	if p.interval > 0 && (p.namespaceInterval <= 0 || p.interval < p.namespaceInterval) {
+		return p.interval
+	}
+	return p.namespaceInterval
+}
+
+// prune removes slots that passed long ago, e.g., of workloads that were patched by someone else in the meantime, and
+// the next slots of namespaces without pending patches. p.lock must be held.
+func (p *patchPacer) prune(now time.Time) {
+	for uid, slot := range p.scheduled {
+		if now.Sub(slot) > time.Hour {
+			delete(p.scheduled, uid)
+		}
+	}
+	for namespace, next := range p.namespaceNext {
+		if now.After(next) {
+			delete(p.namespaceNext, namespace)
+		}
+	}
+}
+
+// isNewWorkload checks whether the given workload was created recently and has never been patched. Patching it doesn't
+// cause a costly rollout.
+func isNewWorkload(obj client.Object, now time.Time) bool {
+	if _, ok := obj.GetAnnotations()[ImagesHashAnnotation]; ok {
+		return false
+	}
+	return now.Sub(obj.GetCreationTimestamp().Time) < newWorkloadPacingGracePeriod
+}
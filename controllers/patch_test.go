@@ -0,0 +1,330 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/google/go-containerregistry/pkg/name"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/timebertt/image-clone-controller/pkg/test"
+)
+
+const rewrittenImage = "registry.example.com/index_docker_io/library/nginx:1.23"
+
+// rewriteFirstContainer returns a copy of the given deployment with the first container rewritten, the images hash annotation, and
+// the cleanup finalizer.
+func rewriteFirstContainer(before *appsv1.Deployment) *appsv1.Deployment {
+	obj := before.DeepCopy()
+	obj.Spec.Template.Spec.Containers[0].Image = rewrittenImage
+	obj.Annotations = map[string]string{ImagesHashAnnotation: "hash"}
+	obj.Finalizers = []string{FinalizerName}
+	return obj
+}
+
+func TestPatchData(t *testing.T) {
+	before := test.NewDeployment("default", "app", "nginx:1.23", "busybox:1.35")
+	before.ResourceVersion = "42"
+	obj := rewriteFirstContainer(before)
+	c := newTestController(t)
+
+	tests := []struct {
+		strategy PatchStrategy
+		data     func() ([]byte, error)
+		want     string
+	}{
+		{
+			strategy: PatchStrategyStrategic,
+			data: func() ([]byte, error) {
+				return client.StrategicMergeFrom(before, client.MergeFromWithOptimisticLock{}).Data(obj)
+			},
+			want: `{"metadata":{"annotations":{"image-clone.timebertt.dev/images-hash":"hash"},"finalizers":["image-clone.timebertt.dev/cleanup"],"resourceVersion":"42"},` +
+				`"spec":{"template":{"spec":{"$setElementOrder/containers":[{"name":"container-0"},{"name":"container-1"}],` +
+				`"containers":[{"image":"` + rewrittenImage + `","name":"container-0"}]}}}}`,
+		},
+		{
+			strategy: PatchStrategyMerge,
+			data: func() ([]byte, error) {
+				return client.MergeFromWithOptions(before, client.MergeFromWithOptimisticLock{}).Data(obj)
+			},
+			// merge patches replace lists, so both containers are included
+			want: `{"metadata":{"annotations":{"image-clone.timebertt.dev/images-hash":"hash"},"finalizers":["image-clone.timebertt.dev/cleanup"],"resourceVersion":"42"},` +
+				`"spec":{"template":{"spec":{"containers":[{"image":"` + rewrittenImage + `","name":"container-0","resources":{}},{"image":"busybox:1.35","name":"container-1","resources":{}}]}}}}`,
+		},
+		{
+			strategy: PatchStrategyJSON,
+			data:     func() ([]byte, error) { return c.jsonPatch(obj, before) },
+			want: `[{"op":"test","path":"/metadata/resourceVersion","value":"42"},` +
+				`{"op":"add","path":"/metadata/annotations","value":{"image-clone.timebertt.dev/images-hash":"hash"}},` +
+				`{"op":"add","path":"/metadata/finalizers","value":["image-clone.timebertt.dev/cleanup"]},` +
+				`{"op":"test","path":"/spec/template/spec/containers/0/image","value":"nginx:1.23"},` +
+				`{"op":"replace","path":"/spec/template/spec/containers/0/image","value":"` + rewrittenImage + `"}]`,
+		},
+		{
+			strategy: PatchStrategyApply,
+			data: func() ([]byte, error) {
+				applyConfig, err := c.applyConfiguration(obj, before)
+				if err != nil {
+					return nil, err
+				}
+				return json.Marshal(applyConfig)
+			},
+			// the unchanged container is omitted, so that the controller doesn't take ownership of its image
+			want: `{"apiVersion":"apps/v1","kind":"Deployment","metadata":{"annotations":{"image-clone.timebertt.dev/images-hash":"hash"},` +
+				`"finalizers":["image-clone.timebertt.dev/cleanup"],"name":"app","namespace":"default","resourceVersion":"42"},` +
+				`"spec":{"template":{"spec":{"containers":[{"image":"` + rewrittenImage + `","name":"container-0"}]}}}}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.strategy), func(t *testing.T) {
+			data, err := tt.data()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.want {
+				t.Errorf("patch data =\n%s\nwant\n%s", data, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyConfigurationKeepsAppliedContainers(t *testing.T) {
+	before := test.NewDeployment("default", "app", "nginx:1.23", "registry.example.com/index_docker_io/library/busybox:1.35")
+	// the second container was rewritten by an earlier apply
+	before.ManagedFields = []metav1.ManagedFieldsEntry{{
+		Manager:    string(fieldOwner),
+		Operation:  metav1.ManagedFieldsOperationApply,
+		FieldsType: "FieldsV1",
+		FieldsV1: &metav1.FieldsV1{Raw: []byte(`{"f:spec":{"f:template":{"f:spec":{"f:containers":{` +
+			`"k:{\"name\":\"container-1\"}":{".":{},"f:image":{},"f:name":{}}}}}}}`)},
+	}}
+	obj := rewriteFirstContainer(before)
+	c := newTestController(t)
+
+	applyConfig, err := c.applyConfiguration(obj, before)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(applyConfig.Object["spec"])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// omitting the second container would remove its image
+	want := `{"template":{"spec":{"containers":[{"image":"` + rewrittenImage + `","name":"container-0"},` +
+		`{"image":"registry.example.com/index_docker_io/library/busybox:1.35","name":"container-1"}]}}}`
+	if string(data) != want {
+		t.Errorf("apply configuration spec =\n%s\nwant\n%s", data, want)
+	}
+}
+
+func TestStrategicMergePatchIsMinimal(t *testing.T) {
+	before := test.NewDeployment("default", "app", "nginx:1.23", "busybox:1.35")
+	before.ResourceVersion = "42"
+	for i := 0; i < 300; i++ {
+		before.Spec.Template.Spec.Containers[0].Env = append(before.Spec.Template.Spec.Containers[0].Env,
+			corev1.EnvVar{Name: fmt.Sprintf("VAR_%d", i), Value: strings.Repeat("x", 100)})
+	}
+	obj := rewriteFirstContainer(before)
+
+	data, err := client.StrategicMergeFrom(before, client.MergeFromWithOptimisticLock{}).Data(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	patch := struct {
+		Spec struct {
+			Template struct {
+				Spec struct {
+					Containers []map[string]interface{} `json:"containers"`
+				} `json:"spec"`
+			} `json:"template"`
+		} `json:"spec"`
+	}{}
+	if err := json.Unmarshal(data, &patch); err != nil {
+		t.Fatal(err)
+	}
+	containers := patch.Spec.Template.Spec.Containers
+	if len(containers) != 1 || len(containers[0]) != 2 || containers[0]["name"] != "container-0" || containers[0]["image"] != rewrittenImage {
+		t.Errorf("patch contains containers %v, want only name and image of the rewritten container", containers)
+	}
+	if strings.Contains(string(data), "VAR_") {
+		t.Errorf("patch of %d bytes contains unrelated template fields", len(data))
+	}
+}
+
+// rejectingClient rejects the first patch as too large, like the API server rejects patches exceeding its limits.
+type rejectingClient struct {
+	client.Client
+	patches int
+}
+
+func (c *rejectingClient) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	c.patches++
+	if c.patches == 1 {
+		return apierrors.NewRequestEntityTooLargeError("limit is 3145728")
+	}
+	return c.Client.Patch(ctx, obj, patch, opts...)
+}
+
+func TestPatchWorkloadFallsBackToContainerPatches(t *testing.T) {
+	for _, strategy := range []PatchStrategy{PatchStrategyStrategic, PatchStrategyMerge, PatchStrategyJSON} {
+		t.Run(string(strategy), func(t *testing.T) {
+			deployment := test.NewDeployment("default", "app", "nginx:1.23", "busybox:1.35")
+			c := newTestController(t, deployment)
+			c.PatchStrategy = strategy
+			rejecting := &rejectingClient{Client: c.Client}
+			c.Client = rejecting
+			recorder := c.Recorder.(*record.FakeRecorder)
+			ctx := context.Background()
+
+			before := &appsv1.Deployment{}
+			if err := c.Get(ctx, client.ObjectKeyFromObject(deployment), before); err != nil {
+				t.Fatal(err)
+			}
+			obj := rewriteFirstContainer(before)
+			obj.Spec.Template.Spec.Containers[1].Image = "registry.example.com/index_docker_io/library/busybox:1.35"
+
+			if err := c.patchWorkload(ctx, obj, before); err != nil {
+				t.Fatal(err)
+			}
+			// the rejected patch, one patch per container, and the metadata
+			if rejecting.patches != 4 {
+				t.Errorf("sent %d patches, want 4", rejecting.patches)
+			}
+
+			patched := &appsv1.Deployment{}
+			if err := c.Get(ctx, client.ObjectKeyFromObject(deployment), patched); err != nil {
+				t.Fatal(err)
+			}
+			if images := test.ContainerImages(patched); images[0] != rewrittenImage || images[1] != obj.Spec.Template.Spec.Containers[1].Image {
+				t.Errorf("patched images = %v", images)
+			}
+			if patched.Annotations[ImagesHashAnnotation] != "hash" {
+				t.Errorf("annotations = %v, want the images hash", patched.Annotations)
+			}
+
+			select {
+			case e := <-recorder.Events:
+				if !strings.Contains(e, ReasonPatchRejected) {
+					t.Errorf("event %q, want %s", e, ReasonPatchRejected)
+				}
+			default:
+				t.Errorf("no %s event was emitted", ReasonPatchRejected)
+			}
+		})
+	}
+}
+
+// patchRecordingClient records the type, data, and field manager of all patches.
+type patchRecordingClient struct {
+	client.Client
+	patches []recordedPatch
+}
+
+type recordedPatch struct {
+	patchType    types.PatchType
+	data         string
+	fieldManager string
+}
+
+func (c *patchRecordingClient) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	data, err := patch.Data(obj)
+	if err != nil {
+		return err
+	}
+	patchOpts := &client.PatchOptions{}
+	patchOpts.ApplyOptions(opts)
+	c.patches = append(c.patches, recordedPatch{patchType: patch.Type(), data: string(data), fieldManager: patchOpts.FieldManager})
+	return c.Client.Patch(ctx, obj, patch, opts...)
+}
+
+func TestMetadataPatchesUsePatchStrategy(t *testing.T) {
+	tests := []struct {
+		strategy  PatchStrategy
+		patchType types.PatchType
+		// lock is contained in patches with optimistic locking
+		lock string
+	}{
+		{strategy: PatchStrategyStrategic, patchType: types.StrategicMergePatchType, lock: `"resourceVersion":"`},
+		{strategy: PatchStrategyMerge, patchType: types.MergePatchType, lock: `"resourceVersion":"`},
+		{strategy: PatchStrategyJSON, patchType: types.JSONPatchType, lock: `{"op":"test","path":"/metadata/resourceVersion"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.strategy), func(t *testing.T) {
+			deployment := test.NewDeployment("default", "app", "nginx:1.23")
+			deployment.Finalizers = []string{FinalizerName}
+			c := newTestController(t, deployment)
+			c.PatchStrategy = tt.strategy
+			c.FailureAnnotation = true
+			recording := &patchRecordingClient{Client: c.Client}
+			c.Client = recording
+			ctx := context.Background()
+
+			obj := &appsv1.Deployment{}
+			if err := c.Get(ctx, client.ObjectKeyFromObject(deployment), obj); err != nil {
+				t.Fatal(err)
+			}
+
+			c.recordFailure(ctx, logr.Discard(), obj, errors.New("connection refused"))
+			if _, ok := obj.Annotations[LastErrorAnnotation]; !ok {
+				t.Fatal("last error annotation wasn't added")
+			}
+			if _, err := c.pruneAnnotations(ctx, logr.Discard(), obj); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := obj.Annotations[LastErrorAnnotation]; ok {
+				t.Fatal("last error annotation wasn't removed")
+			}
+			if err := c.finalizeWorkload(ctx, logr.Discard(), "Deployment", obj, &obj.Spec.Template, name.Registry{}); err != nil {
+				t.Fatal(err)
+			}
+
+			stored := &appsv1.Deployment{}
+			if err := c.Get(ctx, client.ObjectKeyFromObject(deployment), stored); err != nil {
+				t.Fatal(err)
+			}
+			if len(stored.Finalizers) > 0 || len(stored.Annotations) > 0 {
+				t.Errorf("stored finalizers = %v, annotations = %v, want none", stored.Finalizers, stored.Annotations)
+			}
+
+			if len(recording.patches) != 3 {
+				t.Fatalf("sent %d patches, want 3", len(recording.patches))
+			}
+			for _, patch := range recording.patches {
+				if patch.patchType != tt.patchType || !strings.Contains(patch.data, tt.lock) || patch.fieldManager != string(fieldOwner) {
+					t.Errorf("patch %+v doesn't use the patch strategy with optimistic locking and the controller's field manager", patch)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,330 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// PatchWindowAnnotation can be set on workloads to override the patch windows configured for their kind, see
+// PatchWindows. The value is a single window in the form <cron>;<duration>[;<timezone>] or PatchWindowAlways.
+const PatchWindowAnnotation = "image-clone.timebertt.dev/patch-window"
+
+// PatchWindowAlways can be used as the value of the PatchWindowAnnotation to patch the workload at any time.
+const PatchWindowAlways = "always"
+
+// PatchWindow is a recurring maintenance window, which opens at the times matched by a cron schedule and stays open
+// for a fixed duration. Windows may span midnight, e.g., 0 22 * * *;4h is open from 22:00 to 02:00.
+type PatchWindow struct {
+	spec     string
+	schedule *cronSchedule
+	duration time.Duration
+}
+
+func (w *PatchWindow) String() string {
+	return w.spec
+}
+
+// ParsePatchWindow parses a window in the form <cron>;<duration>[;<timezone>], e.g., 0 22 * * 1-5;4h;Europe/Berlin.
+// The cron expression consists of the five standard fields (minute, hour, day of month, month, day of week) and is
+// evaluated in the given IANA timezone, which defaults to UTC.
+func ParsePatchWindow(spec string) (*PatchWindow, error) {
+	parts := strings.Split(spec, ";")
+	if len(parts) < 2 || len(parts) > 3 {
+		return nil, fmt.Errorf("invalid patch window %q, expected <cron>;<duration>[;<timezone>]", spec)
+	}
+
+	location := time.UTC
+	if len(parts) == 3 {
+		var err error
+		if location, err = time.LoadLocation(strings.TrimSpace(parts[2])); err != nil {
+			return nil, fmt.Errorf("invalid timezone in patch window %q: %w", spec, err)
+		}
+	}
+
+	schedule, err := parseCronSchedule(parts[0], location)
+	if err != nil {
+		return nil, fmt.Errorf("invalid schedule in patch window %q: %w", spec, err)
+	}
+
+	duration, err := time.ParseDuration(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return nil, fmt.Errorf("invalid duration in patch window %q: %w", spec, err)
+	}
+	if duration <= 0 {
+		return nil, fmt.Errorf("invalid duration in patch window %q: must be positive", spec)
+	}
+
+	return &PatchWindow{spec: spec, schedule: schedule, duration: duration}, nil
+}
+
+// open checks whether the window is open at the given time, i.e., whether it opened within the last duration.
+func (w *PatchWindow) open(t time.Time) bool {
+	start := w.schedule.next(t.Add(-w.duration))
+	return !start.IsZero() && !start.After(t)
+}
+
+// PatchWindows are the windows in which workloads are patched by kind. Windows with an empty kind apply to all kinds
+// that don't have their own windows. If there are no windows for a kind, workloads of that kind are patched at any
+// time.
+type PatchWindows map[string][]*PatchWindow
+
+// ParsePatchWindows parses windows in the form [<kind>=]<cron>;<duration>[;<timezone>], e.g.,
+// DaemonSet=0 22 * * 1-5;4h;Europe/Berlin, see ParsePatchWindow.
+func ParsePatchWindows(values []string) (PatchWindows, error) {
+	windows := make(PatchWindows)
+	for _, value := range values {
+		kind, spec, ok := strings.Cut(value, "=")
+		if !ok {
+			kind, spec = "", value
+		}
+		if kind != "" && kind != "Deployment" && kind != "DaemonSet" {
+			return nil, fmt.Errorf("unsupported kind %q in patch window %q, supported kinds: [Deployment DaemonSet]", kind, value)
+		}
+
+		window, err := ParsePatchWindow(spec)
+		if err != nil {
+			return nil, err
+		}
+		windows[kind] = append(windows[kind], window)
+	}
+	return windows, nil
+}
+
+// forKind returns the windows that apply to workloads of the given kind.
+func (w PatchWindows) forKind(kind string) []*PatchWindow {
+	if windows, ok := w[kind]; ok {
+		return windows
+	}
+	return w[""]
+}
+
+// patchWindowsFor returns the windows that apply to the given workload. If its PatchWindowAnnotation is invalid, a
+// warning event is emitted and the windows of its kind are used. An empty result means the workload can be patched at
+// any time.
+func (c *ImageCloneController) patchWindowsFor(kind string, obj client.Object) []*PatchWindow {
+	value, ok := obj.GetAnnotations()[PatchWindowAnnotation]
+	if !ok {
+		return c.PatchWindows.forKind(kind)
+	}
+	if value == PatchWindowAlways {
+		return nil
+	}
+
+	window, err := ParsePatchWindow(value)
+	if err != nil {
+		// retrying doesn't help, the workload is reconciled again when the annotation is corrected
+		c.event(obj, corev1.EventTypeWarning, ReasonInvalidPatchWindow, "Invalid patch window annotation, using the configured patch windows",
+			"annotation", PatchWindowAnnotation, "value", value, eventKeyError, err.Error())
+		return c.PatchWindows.forKind(kind)
+	}
+	return []*PatchWindow{window}
+}
+
+// waitForPatchWindow checks whether patching the given workload should be deferred until one of its patch windows
+// opens. The copies have already been done at this point, so the backups exist even if the patch is deferred. If the
+// ForceSyncAnnotation was changed since the patch was deferred, the workload is patched immediately.
+func (c *ImageCloneController) waitForPatchWindow(log logr.Logger, kind string, obj client.Object, now time.Time) (time.Duration, bool) {
+	windows := c.patchWindowsFor(kind, obj)
+	if len(windows) == 0 {
+		c.patchWindowDeferred.Delete(obj.GetUID())
+		return 0, false
+	}
+
+	forceSync := obj.GetAnnotations()[ForceSyncAnnotation]
+	if deferredWith, ok := c.patchWindowDeferred.Load(obj.GetUID()); ok && deferredWith.(string) != forceSync {
+		log.Info("The " + ForceSyncAnnotation + " annotation was changed, patching outside of the patch windows")
+		c.patchWindowDeferred.Delete(obj.GetUID())
+		return 0, false
+	}
+
+	var opens time.Time
+	for _, window := range windows {
+		if window.open(now) {
+			c.patchWindowDeferred.Delete(obj.GetUID())
+			return 0, false
+		}
+		if next := window.schedule.next(now); !next.IsZero() && (opens.IsZero() || next.Before(opens)) {
+			opens = next
+		}
+	}
+	if opens.IsZero() {
+		log.Info("Patch windows never open, patching anyway", "windows", patchWindowSpecs(windows))
+		c.patchWindowDeferred.Delete(obj.GetUID())
+		return 0, false
+	}
+
+	c.patchWindowDeferred.LoadOrStore(obj.GetUID(), forceSync)
+	log.Info("Outside of patch windows, deferring patch until the next window opens", "opens", opens, "windows", patchWindowSpecs(windows))
+	patchesDeferredByWindowTotal.WithLabelValues(kind).Inc()
+	return opens.Sub(now), true
+}
+
+func patchWindowSpecs(windows []*PatchWindow) []string {
+	specs := make([]string, len(windows))
+	for i, window := range windows {
+		specs[i] = window.String()
+	}
+	return specs
+}
+
+// cronSchedule is a parsed cron expression with the five standard fields.
+type cronSchedule struct {
+	minutes, hours, daysOfMonth, months, daysOfWeek uint64
+	// daysRestricted is true if neither the day of month nor the day of week field is *. In this case, a day matches if
+	// either field matches, like in crontab(5).
+	daysRestricted bool
+	location       *time.Location
+}
+
+type cronField struct {
+	min, max int
+	names    []string
+}
+
+var (
+	cronMinutes     = cronField{min: 0, max: 59}
+	cronHours       = cronField{min: 0, max: 23}
+	cronDaysOfMonth = cronField{min: 1, max: 31}
+	cronMonths      = cronField{min: 1, max: 12, names: []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}}
+	// 7 is Sunday as well
+	cronDaysOfWeek = cronField{min: 0, max: 7, names: []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}}
+)
+
+func parseCronSchedule(expr string, location *time.Location) (*cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("expected 5 fields (minute hour day-of-month month day-of-week), got %d", len(fields))
+	}
+
+	s := &cronSchedule{location: location}
+	var err error
+	for i, f := range []struct {
+		bits  *uint64
+		field cronField
+	}{
+		{&s.minutes, cronMinutes},
+		{&s.hours, cronHours},
+		{&s.daysOfMonth, cronDaysOfMonth},
+		{&s.months, cronMonths},
+		{&s.daysOfWeek, cronDaysOfWeek},
+	} {
+		if *f.bits, err = f.field.parse(fields[i]); err != nil {
+			return nil, fmt.Errorf("invalid field %q: %w", fields[i], err)
+		}
+	}
+
+	if s.daysOfWeek&(1<<7) != 0 {
+		s.daysOfWeek |= 1 << 0
+	}
+	s.daysRestricted = !strings.HasPrefix(fields[2], "*") && !strings.HasPrefix(fields[4], "*")
+	return s, nil
+}
+
+// parse parses a comma-separated list of values, ranges, and steps, e.g., 1-5,*/15,mon.
+func (f cronField) parse(value string) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(value, ",") {
+		rangeStr, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepStr); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step %q", stepStr)
+			}
+		}
+
+		var start, end int
+		if rangeStr == "*" {
+			start, end = f.min, f.max
+		} else {
+			startStr, endStr, isRange := strings.Cut(rangeStr, "-")
+			var err error
+			if start, err = f.value(startStr); err != nil {
+				return 0, err
+			}
+			end = start
+			if isRange {
+				if end, err = f.value(endStr); err != nil {
+					return 0, err
+				}
+			} else if hasStep {
+				end = f.max
+			}
+		}
+		if start > end {
+			return 0, fmt.Errorf("invalid range %q", rangeStr)
+		}
+
+		for i := start; i <= end; i += step {
+			bits |= 1 << i
+		}
+	}
+	return bits, nil
+}
+
+func (f cronField) value(s string) (int, error) {
+	for i, n := range f.names {
+		if strings.EqualFold(s, n) {
+			return i + f.min, nil
+		}
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < f.min || v > f.max {
+		return 0, fmt.Errorf("invalid value %q, expected %d-%d", s, f.min, f.max)
+	}
+	return v, nil
+}
+
+// next returns the first time after t that matches the schedule in its location, or the zero time if there is none
+// within the next 5 years, e.g., for February 30. Times skipped by daylight saving time transitions are never matched.
+func (s *cronSchedule) next(t time.Time) time.Time {
+	t = t.In(s.location).Truncate(time.Minute).Add(time.Minute)
+	limit := t.Year() + 5
+
+	for t.Year() <= limit {
+		switch {
+		case s.months&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, s.location)
+		case !s.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, s.location)
+		case s.hours&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, s.location)
+		case s.minutes&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (s *cronSchedule) dayMatches(t time.Time) bool {
+	dom := s.daysOfMonth&(1<<uint(t.Day())) != 0
+	dow := s.daysOfWeek&(1<<uint(t.Weekday())) != 0
+	if s.daysRestricted {
+		return dom || dow
+	}
+	return dom && dow
+}
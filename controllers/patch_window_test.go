@@ -0,0 +1,155 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+
+	"github.com/timebertt/image-clone-controller/pkg/test"
+)
+
+func TestPatchWindowOpen(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	utc := func(month time.Month, day, hour, minute int) time.Time {
+		return time.Date(2022, month, day, hour, minute, 0, 0, time.UTC)
+	}
+	local := func(month time.Month, day, hour, minute int) time.Time {
+		return time.Date(2022, month, day, hour, minute, 0, 0, berlin)
+	}
+
+	tests := []struct {
+		name     string
+		window   string
+		now      time.Time
+		wantOpen bool
+	}{
+		{name: "before start", window: "0 22 * * *;4h", now: utc(7, 1, 21, 59)},
+		{name: "at start", window: "0 22 * * *;4h", now: utc(7, 1, 22, 0), wantOpen: true},
+		{name: "before midnight", window: "0 22 * * *;4h", now: utc(7, 1, 23, 59), wantOpen: true},
+		{name: "after midnight", window: "0 22 * * *;4h", now: utc(7, 2, 1, 59), wantOpen: true},
+		{name: "at end", window: "0 22 * * *;4h", now: utc(7, 2, 2, 0)},
+
+		// 2022-07-01 is a Friday, the window that opens on Friday evening spans into Saturday
+		{name: "weekday window on Saturday", window: "0 22 * * 1-5;4h", now: utc(7, 2, 1, 0), wantOpen: true},
+		{name: "weekday window on Saturday evening", window: "0 22 * * mon-fri;4h", now: utc(7, 2, 22, 30)},
+		{name: "weekday window after Sunday", window: "0 22 * * 1-5;4h", now: utc(7, 4, 1, 0)},
+
+		// Europe/Berlin is UTC+2 in summer
+		{name: "timezone before start", window: "0 22 * * *;4h;Europe/Berlin", now: utc(7, 1, 19, 59)},
+		{name: "timezone at start", window: "0 22 * * *;4h;Europe/Berlin", now: utc(7, 1, 20, 0), wantOpen: true},
+		{name: "timezone at end", window: "0 22 * * *;4h;Europe/Berlin", now: utc(7, 2, 0, 0)},
+
+		// on 2022-03-27, clocks in Europe/Berlin jump from 02:00 to 03:00, the skipped start time is never matched
+		{name: "skipped start", window: "30 2 * * *;1h;Europe/Berlin", now: local(3, 27, 3, 15)},
+		{name: "start before skipped hour", window: "30 1 * * *;2h;Europe/Berlin", now: local(3, 27, 3, 15), wantOpen: true},
+		// the window is open for its duration of elapsed time, which ends 1h later on the wall clock
+		{name: "wall clock after spring forward", window: "30 1 * * *;2h;Europe/Berlin", now: local(3, 27, 4, 15), wantOpen: true},
+		{name: "end after spring forward", window: "30 1 * * *;2h;Europe/Berlin", now: local(3, 27, 4, 30)},
+
+		// on 2022-10-30, clocks in Europe/Berlin are set back from 03:00 CEST to 02:00 CET, 01:00 CEST is 23:00 UTC
+		{name: "repeated hour first pass", window: "0 1 * * *;3h;Europe/Berlin", now: utc(10, 30, 0, 30), wantOpen: true},
+		{name: "repeated hour second pass", window: "0 1 * * *;3h;Europe/Berlin", now: utc(10, 30, 1, 30), wantOpen: true},
+		{name: "end after fall back", window: "0 1 * * *;3h;Europe/Berlin", now: utc(10, 30, 2, 0)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			window, err := ParsePatchWindow(tt.window)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if open := window.open(tt.now); open != tt.wantOpen {
+				t.Errorf("window %q open at %s = %v, want %v", tt.window, tt.now, open, tt.wantOpen)
+			}
+		})
+	}
+}
+
+func TestParsePatchWindows(t *testing.T) {
+	windows, err := ParsePatchWindows([]string{"DaemonSet=0 22 * * 1-5;4h;Europe/Berlin", "0 */6 * * *;30m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := patchWindowSpecs(windows.forKind("DaemonSet")); len(got) != 1 || got[0] != "0 22 * * 1-5;4h;Europe/Berlin" {
+		t.Errorf("DaemonSet windows = %v, want the DaemonSet window", got)
+	}
+	if got := patchWindowSpecs(windows.forKind("Deployment")); len(got) != 1 || got[0] != "0 */6 * * *;30m" {
+		t.Errorf("Deployment windows = %v, want the default window", got)
+	}
+
+	for _, invalid := range []string{
+		"0 22 * * *",
+		"0 22 * *;4h",
+		"0 24 * * *;4h",
+		"0 22 * * *;0s",
+		"0 22 * * *;4h;Mars/Olympus",
+		"5-1 22 * * *;4h",
+		"StatefulSet=0 22 * * *;4h",
+	} {
+		if _, err := ParsePatchWindows([]string{invalid}); err == nil {
+			t.Errorf("expected error for %q", invalid)
+		}
+	}
+}
+
+func TestWaitForPatchWindow(t *testing.T) {
+	daemonSet := test.NewDaemonSet("default", "app", "nginx:1.23")
+	c := newTestController(t, daemonSet)
+	windows, err := ParsePatchWindows([]string{"DaemonSet=0 22 * * *;4h;Europe/Berlin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.PatchWindows = windows
+
+	// 12:00 in Europe/Berlin, the window opens in 10 hours
+	now := time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC)
+	if requeueAfter, wait := c.waitForPatchWindow(logr.Discard(), "DaemonSet", daemonSet, now); !wait || requeueAfter != 10*time.Hour {
+		t.Errorf("waitForPatchWindow() = %s, %v, want to wait 10h", requeueAfter, wait)
+	}
+	if _, wait := c.waitForPatchWindow(logr.Discard(), "Deployment", daemonSet, now); wait {
+		t.Error("kinds without windows are deferred")
+	}
+
+	t.Run("annotation", func(t *testing.T) {
+		obj := daemonSet.DeepCopy()
+		obj.Annotations = map[string]string{PatchWindowAnnotation: PatchWindowAlways}
+		if _, wait := c.waitForPatchWindow(logr.Discard(), "DaemonSet", obj, now); wait {
+			t.Error("patch was deferred although the workload may be patched at any time")
+		}
+
+		obj.Annotations[PatchWindowAnnotation] = "0 13 * * *;1h;Europe/Berlin"
+		if requeueAfter, wait := c.waitForPatchWindow(logr.Discard(), "DaemonSet", obj, now); !wait || requeueAfter != time.Hour {
+			t.Errorf("waitForPatchWindow() = %s, %v, want to wait for the window of the annotation", requeueAfter, wait)
+		}
+	})
+
+	t.Run("force sync", func(t *testing.T) {
+		if _, wait := c.waitForPatchWindow(logr.Discard(), "DaemonSet", daemonSet, now); !wait {
+			t.Fatal("patch was not deferred")
+		}
+		daemonSet.Annotations = map[string]string{ForceSyncAnnotation: "now"}
+		if _, wait := c.waitForPatchWindow(logr.Discard(), "DaemonSet", daemonSet, now); wait {
+			t.Error("patch was deferred although the force sync annotation was changed")
+		}
+	})
+}
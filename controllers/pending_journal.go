@@ -0,0 +1,248 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const (
+	// pendingJournalKey is the key in the pending journal ConfigMap that contains the journal entries.
+	pendingJournalKey = "pending.json"
+	// pendingJournalFlushInterval is the interval in which the pending journal is persisted if it was changed.
+	pendingJournalFlushInterval = 10 * time.Second
+)
+
+var pendingJournalWorkloads = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: metricsNamespace,
+	Name:      "pending_journal_workloads",
+	Help:      "Number of workloads in the pending journal, i.e., whose images have been copied but not patched yet.",
+})
+
+func init() {
+	metrics.Registry.MustRegister(pendingJournalWorkloads)
+}
+
+// pendingJournalEntry is a workload whose images have been copied (or are being copied) but not patched yet.
+type pendingJournalEntry struct {
+	UID   types.UID `json:"uid"`
+	Since time.Time `json:"since"`
+}
+
+// pendingJournal keeps track of workloads in the copied-but-not-patched state, so that a controller crash between
+// copying the images and patching the workload doesn't leave the workload unpatched until the next resync. The
+// journal is persisted in a ConfigMap in batches, and its entries are replayed on startup by enqueuing the workloads
+// before all others are reconciled. Replaying is idempotent, as reconciling a workload again only patches the images
+// that still need to be rewritten.
+type pendingJournal struct {
+	client client.Client
+	// reader is used for reading the ConfigMap, so that we don't start an informer for all ConfigMaps.
+	reader client.Reader
+	key    client.ObjectKey
+	// kinds stores the event channels of the controllers per workload kind for replaying the journal.
+	kinds map[string]chan event.GenericEvent
+	// replayed stores the UIDs of replayed workloads, so that they skip the images hash fast path once.
+	replayed *sync.Map
+
+	lock    sync.Mutex
+	entries map[string]pendingJournalEntry
+	dirty   bool
+}
+
+func newPendingJournal(c client.Client, reader client.Reader, key client.ObjectKey, replayed *sync.Map) *pendingJournal {
+	return &pendingJournal{
+		client:   c,
+		reader:   reader,
+		key:      key,
+		kinds:    make(map[string]chan event.GenericEvent),
+		replayed: replayed,
+		entries:  make(map[string]pendingJournalEntry),
+	}
+}
+
+// pendingJournalKeyFor returns the key of the given workload in the journal.
+func pendingJournalKeyFor(kind string, key client.ObjectKey) string {
+	return kind + "/" + key.Namespace + "/" + key.Name
+}
+
+// add records that the images of the given workload have been copied but not patched yet.
+func (j *pendingJournal) add(kind string, obj client.Object) {
+	if j == nil {
+		return
+	}
+
+	key := pendingJournalKeyFor(kind, client.ObjectKeyFromObject(obj))
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if entry, ok := j.entries[key]; ok && entry.UID == obj.GetUID() {
+		return
+	}
+	j.entries[key] = pendingJournalEntry{UID: obj.GetUID(), Since: time.Now().UTC().Truncate(time.Second)}
+	j.dirty = true
+	pendingJournalWorkloads.Set(float64(len(j.entries)))
+}
+
+// remove removes the given workload from the journal, e.g., after it has been patched successfully or is gone.
+func (j *pendingJournal) remove(kind string, key client.ObjectKey) {
+	if j == nil {
+		return
+	}
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if _, ok := j.entries[pendingJournalKeyFor(kind, key)]; !ok {
+		return
+	}
+	delete(j.entries, pendingJournalKeyFor(kind, key))
+	j.dirty = true
+	pendingJournalWorkloads.Set(float64(len(j.entries)))
+}
+
+// Start implements manager.Runnable. It loads and replays the persisted journal and persists changes periodically.
+func (j *pendingJournal) Start(ctx context.Context) error {
+	log := logf.FromContext(ctx).WithValues("configMap", j.key)
+
+	persisted, err := j.load(ctx)
+	if err != nil {
+		return fmt.Errorf("error loading pending journal: %w", err)
+	}
+	if len(persisted) > 0 {
+		log.Info("Replaying pending journal", "workloads", len(persisted))
+		go j.replay(ctx, persisted)
+	}
+
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		if err := j.flush(ctx); err != nil {
+			log.Error(err, "Failed persisting pending journal")
+		}
+	}, pendingJournalFlushInterval)
+
+	// persist the latest changes on shutdown
+	flushCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := j.flush(flushCtx); err != nil {
+		log.Error(err, "Failed persisting pending journal")
+	}
+	return nil
+}
+
+func (j *pendingJournal) load(ctx context.Context) (map[string]pendingJournalEntry, error) {
+	configMap := &corev1.ConfigMap{}
+	if err := j.reader.Get(ctx, j.key, configMap); err != nil {
+		return nil, client.IgnoreNotFound(err)
+	}
+
+	persisted := make(map[string]pendingJournalEntry)
+	if data, ok := configMap.Data[pendingJournalKey]; ok {
+		if err := json.Unmarshal([]byte(data), &persisted); err != nil {
+			return nil, err
+		}
+	}
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	// entries recorded before loading the journal are more recent
+	for key, entry := range persisted {
+		if _, ok := j.entries[key]; !ok {
+			j.entries[key] = entry
+		}
+	}
+	pendingJournalWorkloads.Set(float64(len(j.entries)))
+	return persisted, nil
+}
+
+// replay enqueues the workloads of the given journal entries. Entries of workloads that are gone are removed from the
+// journal when the workloads are reconciled.
+func (j *pendingJournal) replay(ctx context.Context, entries map[string]pendingJournalEntry) {
+	for key, entry := range entries {
+		kind, rest, _ := strings.Cut(key, "/")
+		namespace, name, _ := strings.Cut(rest, "/")
+		events, ok := j.kinds[kind]
+		if !ok {
+			// the controller for the kind is disabled
+			continue
+		}
+
+		j.replayed.Store(entry.UID, true)
+		select {
+		case <-ctx.Done():
+			return
+		case events <- event.GenericEvent{Object: &metav1.PartialObjectMetadata{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, UID: entry.UID}}}:
+		}
+	}
+}
+
+func (j *pendingJournal) flush(ctx context.Context) error {
+	j.lock.Lock()
+	if !j.dirty {
+		j.lock.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(j.entries)
+	j.dirty = false
+	j.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := j.persist(ctx, string(data)); err != nil {
+		// try again in the next interval
+		j.lock.Lock()
+		j.dirty = true
+		j.lock.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (j *pendingJournal) persist(ctx context.Context, data string) error {
+	configMap := &corev1.ConfigMap{}
+	if err := j.reader.Get(ctx, j.key, configMap); err != nil {
+		if !apierrors.IsNotFound(err) {
+			return err
+		}
+
+		configMap.Namespace = j.key.Namespace
+		configMap.Name = j.key.Name
+		configMap.Data = map[string]string{pendingJournalKey: data}
+		return j.client.Create(ctx, configMap)
+	}
+
+	if configMap.Data == nil {
+		configMap.Data = make(map[string]string, 1)
+	}
+	configMap.Data[pendingJournalKey] = data
+	return j.client.Update(ctx, configMap)
+}
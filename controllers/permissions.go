@@ -0,0 +1,224 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
+)
+
+// permissionScope defines in which namespaces a feature needs its permissions.
+type permissionScope int
+
+const (
+	// scopeWatchedNamespaces requires the permissions in all WatchNamespaces, or cluster-wide if all namespaces are
+	// watched.
+	scopeWatchedNamespaces permissionScope = iota
+	// scopeCluster requires cluster-wide permissions, e.g., for cluster-scoped objects.
+	scopeCluster
+	// scopePodNamespace requires the permissions in the controller's own namespace.
+	scopePodNamespace
+)
+
+// featurePermission is a rule that the controller needs if a feature is enabled.
+type featurePermission struct {
+	// feature names the feature, usually by the flag that enables it.
+	feature         string
+	enabled         func(c *Config) bool
+	scope           permissionScope
+	group, resource string
+	verbs           []string
+}
+
+// featurePermissions are the permissions that the controller needs per feature. The ClusterRole in config/rbac is
+// generated from the kubebuilder RBAC markers (see `make manifests`), which must cover all rules listed here.
+var featurePermissions = []featurePermission{
+	{
+		feature: "--enable-deployment-controller",
+		enabled: func(c *Config) bool { return c.EnableDeployments },
+		scope:   scopeWatchedNamespaces, group: "apps", resource: "deployments", verbs: []string{"get", "list", "watch", "patch"},
+	},
+	{
+		feature: "--enable-daemonset-controller",
+		enabled: func(c *Config) bool { return c.EnableDaemonSets },
+		scope:   scopeWatchedNamespaces, group: "apps", resource: "daemonsets", verbs: []string{"get", "list", "watch", "patch"},
+	},
+	{
+		feature: "events",
+		enabled: func(c *Config) bool { return true },
+		scope:   scopeWatchedNamespaces, resource: "events", verbs: []string{"create"},
+	},
+	{
+		// events of cluster-scoped objects are created in the default namespace
+		feature: "--namespace-summary-events",
+		enabled: func(c *Config) bool { return c.NamespaceSummaryEvents },
+		scope:   scopeCluster, resource: "events", verbs: []string{"create"},
+	},
+	{
+		feature: "Namespace annotations and coverage metrics",
+		enabled: func(c *Config) bool { return !c.NamespacedRBAC },
+		scope:   scopeCluster, resource: "namespaces", verbs: []string{"get", "list", "watch"},
+	},
+	{
+		feature: "--require-platforms=auto",
+		enabled: func(c *Config) bool { return c.DetectPlatforms },
+		scope:   scopeCluster, resource: "nodes", verbs: []string{"get", "list", "watch"},
+	},
+	{
+		feature: "--replicate-pull-secret",
+		enabled: func(c *Config) bool { return c.ReplicatePullSecret.Name != "" },
+		scope:   scopeCluster, resource: "secrets", verbs: []string{"get", "list", "watch", "create", "update", "delete"},
+	},
+	{
+		feature: "--require-pull-access",
+		enabled: func(c *Config) bool { return c.RequirePullAccess && !c.NodePullCredentials },
+		scope:   scopeWatchedNamespaces, resource: "secrets", verbs: []string{"get", "list", "watch"},
+	},
+	{
+		feature: "--require-pull-access",
+		enabled: func(c *Config) bool { return c.RequirePullAccess && !c.NodePullCredentials },
+		scope:   scopeWatchedNamespaces, resource: "serviceaccounts", verbs: []string{"get", "list", "watch"},
+	},
+	{
+		feature: "--copy-history-configmap",
+		enabled: func(c *Config) bool { return c.PodNamespace != "" && c.CopyHistoryConfigMap != "" },
+		scope:   scopePodNamespace, resource: "configmaps", verbs: []string{"get", "create", "update"},
+	},
+	{
+		feature: "--pending-journal-configmap",
+		enabled: func(c *Config) bool { return c.PodNamespace != "" && c.PendingJournalConfigMap != "" },
+		scope:   scopePodNamespace, resource: "configmaps", verbs: []string{"get", "create", "update"},
+	},
+	{
+		feature: "--status-configmap",
+		enabled: func(c *Config) bool { return c.PodNamespace != "" && c.StatusConfigMap != "" },
+		scope:   scopePodNamespace, resource: "configmaps", verbs: []string{"get", "create", "update"},
+	},
+}
+
+// permission is a single permission that the controller needs for a feature. An empty namespace means cluster-wide.
+type permission struct {
+	namespace, group, resource, verb string
+}
+
+func (p permission) String() string {
+	resource := p.resource
+	if p.group != "" {
+		resource += "." + p.group
+	}
+	if p.namespace == "" {
+		return fmt.Sprintf("%s %s cluster-wide", p.verb, resource)
+	}
+	return fmt.Sprintf("%s %s in namespace %q", p.verb, resource, p.namespace)
+}
+
+// requiredPermissions returns the permissions that the enabled features need, mapped to the features that need them.
+func (c *Config) requiredPermissions() ([]permission, map[permission][]string) {
+	var (
+		permissions []permission
+		features    = make(map[permission][]string)
+	)
+	for _, fp := range featurePermissions {
+		if !fp.enabled(c) {
+			continue
+		}
+
+		var namespaces []string
+		switch fp.scope {
+		case scopeWatchedNamespaces:
+			namespaces = c.WatchNamespaces
+			if len(namespaces) == 0 {
+				namespaces = []string{""}
+			}
+		case scopeCluster:
+			namespaces = []string{""}
+		case scopePodNamespace:
+			namespaces = []string{c.PodNamespace}
+		}
+
+		for _, namespace := range namespaces {
+			for _, verb := range fp.verbs {
+				p := permission{namespace: namespace, group: fp.group, resource: fp.resource, verb: verb}
+				if _, ok := features[p]; !ok {
+					permissions = append(permissions, p)
+				}
+				features[p] = append(features[p], fp.feature)
+			}
+		}
+	}
+	return permissions, features
+}
+
+// VerifyAccess checks via SelfSubjectAccessReviews that the controller has all permissions that the enabled features
+// need. It returns an error listing all missing permissions and the features that need them.
+func VerifyAccess(ctx context.Context, c client.Client, config *Config) error {
+	permissions, features := config.requiredPermissions()
+
+	var missing []string
+	for _, p := range permissions {
+		review := &authorizationv1.SelfSubjectAccessReview{
+			Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+				ResourceAttributes: &authorizationv1.ResourceAttributes{
+					Namespace: p.namespace,
+					Group:     p.group,
+					Resource:  p.resource,
+					Verb:      p.verb,
+				},
+			},
+		}
+		if err := c.Create(ctx, review); err != nil {
+			return fmt.Errorf("error checking permission to %s: %w", p, err)
+		}
+		if !review.Status.Allowed {
+			missing = append(missing, fmt.Sprintf("%s (required for %s)", p, strings.Join(features[p], ", ")))
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("missing permissions: %s", strings.Join(missing, "; "))
+	}
+	return nil
+}
+
+// PermissionsCheck returns a readiness check that fails with the list of missing permissions until VerifyAccess
+// succeeds. Permissions are verified again on every check until they are granted, and never after that.
+func PermissionsCheck(c client.Client, config *Config) healthz.Checker {
+	var (
+		lock     sync.Mutex
+		verified bool
+	)
+	return func(req *http.Request) error {
+		lock.Lock()
+		defer lock.Unlock()
+
+		if verified {
+			return nil
+		}
+		if err := VerifyAccess(req.Context(), c, config); err != nil {
+			return err
+		}
+		verified = true
+		return nil
+	}
+}
@@ -0,0 +1,277 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/timebertt/image-clone-controller/pkg/copier"
+	"github.com/timebertt/image-clone-controller/pkg/naming"
+)
+
+// rewrite is the planned decision for a single container image.
+type rewrite struct {
+	Container containerImage
+	// Source is the image currently referenced by the container.
+	Source name.Reference
+	// BackedUp is true if Source already references the backup registry. Destination is not set in this case.
+	BackedUp bool
+	// Excluded is true if Source matches an exclude pattern. Destination is not set in this case.
+	Excluded bool
+	// ProhibitedBy is the pattern of MirrorProhibitedFile that matches Source if mirroring it is prohibited. Destination
+	// is not set in this case.
+	ProhibitedBy string
+	// SkipReason is set if the image is not copied, i.e., if BackedUp or Excluded is true or ProhibitedBy is set.
+	SkipReason SkipReason
+	// Original is the image that Destination is derived from. It only differs from Source for images in a previous
+	// backup registry.
+	Original    name.Reference
+	Destination name.Tag
+	// Digest is the digest that Source resolved to when planning, see resolveDigests. The image is copied by this digest
+	// and the container references it, so that the container runs exactly the copied image even if the destination tag
+	// is overwritten later on. It is empty if the digest couldn't be resolved.
+	Digest v1.Hash
+
+	// Copied is set when executing the rewrite. It is false if the destination already existed, i.e., the image is only
+	// rewritten without copying anything.
+	Copied bool
+	// Stats is set when executing the rewrite if the image was copied, see copier.ImageStats.
+	Stats *copier.ImageStats
+}
+
+// image returns the image that the container is rewritten to, i.e., the destination tag pinned to the resolved digest,
+// e.g., registry.example.com/backup/docker.io/library/nginx:1.25@sha256:33cef..., or only the destination tag if the
+// digest is unknown.
+func (r rewrite) image() string {
+	if r.Digest == (v1.Hash{}) {
+		return r.Destination.Name()
+	}
+	return r.Destination.Name() + "@" + r.Digest.String()
+}
+
+// pinnedDestination returns the destination referenced by the resolved digest, or the destination tag if the digest
+// is unknown.
+func (r rewrite) pinnedDestination() name.Reference {
+	if r.Digest == (v1.Hash{}) {
+		return r.Destination
+	}
+	return r.Destination.Context().Digest(r.Digest.String())
+}
+
+// pinnedTag returns the tag of the given image if it references a tag pinned to a digest like the images that
+// containers are rewritten to, see rewrite.image.
+func pinnedTag(ref name.Reference) (name.Tag, bool) {
+	digest, ok := ref.(name.Digest)
+	if !ok {
+		return name.Tag{}, false
+	}
+	tagged, _, _ := strings.Cut(digest.String(), "@")
+	i := strings.LastIndex(tagged, ":")
+	if i <= strings.LastIndex(tagged, "/") {
+		return name.Tag{}, false
+	}
+	return digest.Context().Tag(tagged[i+1:]), true
+}
+
+// containerImage references a container in a pod template that the controller rewrites.
+type containerImage struct {
+	// List is the container list of the pod template that the container belongs to, Index its index in this list.
+	List       containerList
+	Index      int
+	Name       string
+	Image      string
+	PullPolicy corev1.PullPolicy
+}
+
+// containerImages returns all containers in the given pod template that the controller rewrites.
+func (c *ImageCloneController) containerImages(template *corev1.PodTemplateSpec) []containerImage {
+	images := make([]containerImage, 0, len(template.Spec.Containers))
+	forEachContainer(template, func(list containerList, index int, container containerFields) {
+		// ephemeral containers in pod templates only affect future pods, so they could be rewritten like other containers,
+		// but debug containers are out of scope by default
+		if list == containerListEphemeralContainers && !c.RewriteEphemeralContainers {
+			return
+		}
+		images = append(images, containerImage{List: list, Index: index, Name: container.Name, Image: *container.Image, PullPolicy: *container.ImagePullPolicy})
+	})
+	return images
+}
+
+// setImage sets the image of the referenced container in the given pod template.
+func (ci containerImage) setImage(template *corev1.PodTemplateSpec, image string) {
+	if container, ok := containerAt(template, ci.List, ci.Index); ok {
+		*container.Image = image
+	}
+}
+
+// setPullPolicy sets the image pull policy of the referenced container in the given pod template.
+func (ci containerImage) setPullPolicy(template *corev1.PodTemplateSpec, policy corev1.PullPolicy) {
+	if container, ok := containerAt(template, ci.List, ci.Index); ok {
+		*container.ImagePullPolicy = policy
+	}
+}
+
+// pullPolicy returns the image pull policy that should be set for the given rewrite, or an empty string if the pull
+// policy should not be changed.
+// Destination tags of images referenced by tag are overwritten when the source tag changes, so nodes need to pull them
+// every time to not run stale images. Destination tags of images referenced by digest never change.
+func (c *ImageCloneController) pullPolicy(r rewrite) corev1.PullPolicy {
+	if _, ok := r.Original.(name.Digest); ok {
+		if c.SetPullPolicyIfNotPresent {
+			return corev1.PullIfNotPresent
+		}
+		return ""
+	}
+	if c.SetPullPolicyAlways {
+		return corev1.PullAlways
+	}
+	return ""
+}
+
+// planRewrites decides how the images of all containers in the given pod template need to be rewritten to reference
+// the given backup registry. It doesn't have any side effects, i.e., it neither modifies the template nor contacts any
+// registry. Resolving the source digests (see resolveDigests), copying images and applying the rewrites is up to the
+// caller.
+// Containers with invalid image references are skipped and returned separately, as retrying doesn't help until the
+// workload is corrected.
+func (c *ImageCloneController) planRewrites(template *corev1.PodTemplateSpec, backupRegistry name.Registry, prefix string, digests sourceDigests) ([]rewrite, []*InvalidImageError, error) {
+	containers := c.containerImages(template)
+	plan := make([]rewrite, 0, len(containers))
+	var invalid []*InvalidImageError
+	for _, container := range containers {
+		r, err := c.planRewrite(container.Image, backupRegistry, prefix, digests)
+		if err != nil {
+			var invalidErr *InvalidImageError
+			if errors.As(err, &invalidErr) {
+				invalidErr.Container = container.Name
+				invalid = append(invalid, invalidErr)
+				continue
+			}
+			return nil, nil, &ContainerError{Container: container.Name, err: err}
+		}
+		r.Container = container
+		plan = append(plan, r)
+	}
+	return plan, invalid, nil
+}
+
+// resolveDigests resolves the source digests of all rewrites in the given plan that copy images, see rewrite.Digest.
+// Rewrites that were recently found to be up to date reuse the digest of that decision instead of contacting the
+// source registry again. Digests that can't be resolved, e.g., because the source image doesn't exist or the controller
+// doesn't contact source registries, are left empty; copying the image reports missing source images.
+func (c *ImageCloneController) resolveDigests(ctx context.Context, log logr.Logger, plan []rewrite) {
+	for i := range plan {
+		r := &plan[i]
+		if r.Destination == (name.Tag{}) {
+			continue
+		}
+		if digest, ok := c.Decisions.upToDateDigest(*r, time.Now()); ok {
+			r.Digest = digest
+			continue
+		}
+		if !c.contactsSourceRegistries() {
+			continue
+		}
+
+		digest, exists, err := c.Copier.Resolve(ctx, r.Source)
+		if err != nil {
+			log.V(1).Info("Failed resolving digest of source image", "container", r.Container.Name, "image", r.Source.String(), "error", err.Error())
+			continue
+		}
+		if exists {
+			r.Digest = digest
+		}
+	}
+}
+
+// InvalidImageError is returned for containers whose image can't be parsed, e.g., because of unresolved template
+// variables like registry.example.com/app:${TAG}.
+type InvalidImageError struct {
+	Container string
+	Image     string
+
+	err error
+}
+
+func (e *InvalidImageError) Error() string {
+	return fmt.Sprintf("container %q has an invalid image reference %q: %v", e.Container, e.Image, e.err)
+}
+
+func (e *InvalidImageError) Unwrap() error {
+	return e.err
+}
+
+func (c *ImageCloneController) planRewrite(image string, backupRegistry name.Registry, prefix string, digests sourceDigests) (rewrite, error) {
+	srcImg, err := name.ParseReference(image)
+	if err != nil {
+		return rewrite{}, &InvalidImageError{Image: image, err: err}
+	}
+
+	if naming.SameRegistry(srcImg.Context().Registry, backupRegistry) && (naming.HasPrefix(srcImg, prefix) || c.RepositoryMappings.IsDestination(srcImg)) {
+		return rewrite{Source: srcImg, BackedUp: true, SkipReason: SkipReasonAlreadyBackup}, nil
+	}
+	pattern, prohibited, err := c.mirrorProhibited(srcImg)
+	if err != nil {
+		return rewrite{}, err
+	}
+	if prohibited {
+		return rewrite{Source: srcImg, ProhibitedBy: pattern, SkipReason: SkipReasonMirrorProhibited}, nil
+	}
+	if reason, excluded := c.excludeReason(srcImg); excluded {
+		return rewrite{Source: srcImg, Excluded: true, SkipReason: reason}, nil
+	}
+
+	if naming.SameRegistry(srcImg.Context().Registry, backupRegistry) {
+		// the workload's destination prefix was added or changed, only migrate images below the new prefix if their
+		// original reference can be determined unambiguously
+		encodedRegistry, _, _ := strings.Cut(naming.StripPrefix(srcImg.Context().RepositoryStr(), prefix), "/")
+		if !naming.LooksLikeEncodedRegistry(encodedRegistry) {
+			return rewrite{Source: srcImg, BackedUp: true, SkipReason: SkipReasonAlreadyBackup}, nil
+		}
+	}
+
+	originalImg := srcImg
+	// images in the default backup registry are migrated to the namespace's backup registry if it is overridden, and
+	// images in the backup registry are migrated below the workload's destination prefix
+	if c.isPreviousBackupRegistry(srcImg.Context().Registry) || naming.SameRegistry(srcImg.Context().Registry, c.BackupRegistry) || naming.SameRegistry(srcImg.Context().Registry, backupRegistry) {
+		originalImg, err = c.originalImage(srcImg, prefix, digests)
+		if err != nil {
+			return rewrite{}, fmt.Errorf("failed mapping image %q from previous backup registry to its original reference: %w", srcImg.Name(), err)
+		}
+	} else if naming.LooksLikeBackupImage(srcImg, prefix) {
+		return rewrite{}, &ImageFromPreviousBackupRegistryError{Image: srcImg.Name()}
+	}
+
+	dstImg, err := c.destinationImage(originalImg, backupRegistry, prefix)
+	if err != nil {
+		return rewrite{}, fmt.Errorf("failed rewriting image %q: %w", srcImg.Name(), err)
+	}
+	if dstImg.Name() == srcImg.Name() {
+		return rewrite{}, &DestinationEqualsSourceError{Image: srcImg.Name()}
+	}
+
+	return rewrite{Source: srcImg, Original: originalImg, Destination: dstImg}, nil
+}
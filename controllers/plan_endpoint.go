@@ -0,0 +1,228 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+
+	"github.com/timebertt/image-clone-controller/pkg/copier"
+)
+
+const (
+	// PlanPath is the path of the dry-run plan endpoint. POST requests with a Deployment or DaemonSet manifest (YAML or
+	// JSON) return the WorkloadPlan for it.
+	PlanPath = "/debug/plan"
+	// maxPlanManifestSize is the maximum size of manifests accepted by the plan endpoint.
+	maxPlanManifestSize = 1 << 20
+)
+
+// PlanAction is the planned action for a container image in a WorkloadPlan.
+type PlanAction string
+
+const (
+	// PlanActionRewrite is used for images that are copied to the destination (unless it exists already) and rewritten.
+	PlanActionRewrite PlanAction = "rewrite"
+	// PlanActionSkip is used for images that are deliberately not copied, see ContainerPlan.SkipReason.
+	PlanActionSkip PlanAction = "skip"
+	// PlanActionError is used for images that can't be rewritten, e.g., invalid image references, see ContainerPlan.Error.
+	PlanActionError PlanAction = "error"
+)
+
+// WorkloadPlan describes what the controller would do to a workload with its live configuration. It is determined
+// without contacting any registry, so checks that happen while copying (e.g., image size, platforms, denied digests,
+// existence in the backup registry with Offline or RewriteOnlyPreapproved) are not reflected.
+type WorkloadPlan struct {
+	Kind              string `json:"kind"`
+	Namespace         string `json:"namespace,omitempty"`
+	Name              string `json:"name"`
+	BackupRegistry    string `json:"backupRegistry"`
+	DestinationPrefix string `json:"destinationPrefix,omitempty"`
+	// Skipped is set if the whole workload is not reconciled, e.g., because of its namespace.
+	Skipped    string          `json:"skipped,omitempty"`
+	Containers []ContainerPlan `json:"containers"`
+	// Warnings are issues that would be reported via warning events, e.g., invalid annotations.
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// ContainerPlan is the planned action for a single container image.
+type ContainerPlan struct {
+	Container   string     `json:"container"`
+	List        string     `json:"list"`
+	Original    string     `json:"original"`
+	Destination string     `json:"destination,omitempty"`
+	Action      PlanAction `json:"action"`
+	SkipReason  SkipReason `json:"skipReason,omitempty"`
+	// PullPolicy is the pull policy that is set along with the rewrite, if it is changed.
+	PullPolicy corev1.PullPolicy `json:"pullPolicy,omitempty"`
+	Error      string            `json:"error,omitempty"`
+}
+
+// UnsupportedKindError is returned by decodeWorkload for manifests of kinds that the controller doesn't reconcile.
+type UnsupportedKindError struct {
+	APIVersion, Kind string
+	Supported        []string
+}
+
+func (e *UnsupportedKindError) Error() string {
+	return fmt.Sprintf("unsupported kind %q in apiVersion %q, supported kinds: %v", e.Kind, e.APIVersion, e.Supported)
+}
+
+// decodeWorkload decodes the given YAML or JSON manifest of a workload kind that is enabled in the configuration.
+func (c *ImageCloneController) decodeWorkload(manifest []byte) (string, client.Object, *corev1.PodTemplateSpec, error) {
+	typeMeta := metav1.TypeMeta{}
+	if err := yaml.Unmarshal(manifest, &typeMeta); err != nil {
+		return "", nil, nil, fmt.Errorf("error decoding manifest: %w", err)
+	}
+
+	supported := sets.NewString()
+	if c.EnableDeployments {
+		supported.Insert("Deployment")
+	}
+	if c.EnableDaemonSets {
+		supported.Insert("DaemonSet")
+	}
+	if typeMeta.APIVersion != appsv1.SchemeGroupVersion.String() || !supported.Has(typeMeta.Kind) {
+		return "", nil, nil, &UnsupportedKindError{APIVersion: typeMeta.APIVersion, Kind: typeMeta.Kind, Supported: supported.List()}
+	}
+
+	var (
+		obj      client.Object
+		template *corev1.PodTemplateSpec
+	)
+	switch typeMeta.Kind {
+	case "Deployment":
+		deployment := &appsv1.Deployment{}
+		obj, template = deployment, &deployment.Spec.Template
+	case "DaemonSet":
+		daemonSet := &appsv1.DaemonSet{}
+		obj, template = daemonSet, &daemonSet.Spec.Template
+	}
+	if err := yaml.Unmarshal(manifest, obj); err != nil {
+		return "", nil, nil, fmt.Errorf("error decoding %s: %w", typeMeta.Kind, err)
+	}
+	return typeMeta.Kind, obj, template, nil
+}
+
+// PlanWorkload determines the WorkloadPlan for the given workload using the logic shared with reconciliations, see
+// targetFor and planRewrite. Unlike reconciliations, it doesn't copy images, patch the workload, emit events, or record
+// metrics. The workload's namespace is read with the given reader.
+func (c *ImageCloneController) PlanWorkload(ctx context.Context, reader client.Reader, kind string, obj client.Object, template *corev1.PodTemplateSpec) (*WorkloadPlan, error) {
+	plan := &WorkloadPlan{
+		Kind:           kind,
+		Namespace:      obj.GetNamespace(),
+		Name:           obj.GetName(),
+		BackupRegistry: c.BackupRegistry.RegistryStr(),
+		Containers:     []ContainerPlan{},
+	}
+
+	target, err := c.targetFor(ctx, reader, obj, true)
+	if err != nil {
+		return nil, err
+	}
+	plan.Warnings = append(plan.Warnings, target.Warnings...)
+	if target.Skipped != "" {
+		plan.Skipped = target.Skipped
+		return plan, nil
+	}
+	backupRegistry, prefix := target.BackupRegistry, target.Prefix
+	plan.BackupRegistry = backupRegistry.RegistryStr()
+	plan.DestinationPrefix = prefix
+
+	digests := sourceDigestsOf(obj)
+	for _, container := range c.containerImages(template) {
+		containerPlan := ContainerPlan{Container: container.Name, List: string(container.List), Original: container.Image}
+
+		r, err := c.planRewrite(container.Image, backupRegistry, prefix, digests)
+		switch {
+		case err != nil:
+			containerPlan.Action, containerPlan.Error = PlanActionError, err.Error()
+			var invalidErr *InvalidImageError
+			if errors.As(err, &invalidErr) {
+				containerPlan.Error = invalidErr.Unwrap().Error()
+			}
+		case r.SkipReason != "":
+			containerPlan.Action, containerPlan.SkipReason = PlanActionSkip, r.SkipReason
+		default:
+			r.Container = container
+			if manager, ok := c.imageFieldManager(obj, container); ok {
+				containerPlan.Action, containerPlan.SkipReason = PlanActionSkip, SkipReasonGitOpsSkip
+				plan.Warnings = append(plan.Warnings, fmt.Sprintf("image of container %q is owned by the respected field manager %q", container.Name, manager))
+				break
+			}
+			containerPlan.Action, containerPlan.Destination = PlanActionRewrite, r.Destination.Name()
+			if policy := c.pullPolicy(r); policy != "" && policy != container.PullPolicy {
+				containerPlan.PullPolicy = policy
+			}
+		}
+		plan.Containers = append(plan.Containers, containerPlan)
+	}
+	return plan, nil
+}
+
+// planHandler serves the WorkloadPlan for workload manifests posted to PlanPath. Unsupported kinds are rejected with
+// 422, so that CI pipelines can distinguish them from malformed manifests.
+func (c *ImageCloneController) planHandler(reader client.Reader, token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !copier.AuthorizeDebugRequest(w, r, token) {
+			return
+		}
+
+		manifest, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxPlanManifestSize))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("error reading manifest: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		kind, obj, template, err := c.decodeWorkload(manifest)
+		if err != nil {
+			var unsupportedErr *UnsupportedKindError
+			if errors.As(err, &unsupportedErr) {
+				http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		plan, err := c.PlanWorkload(r.Context(), reader, kind, obj, template)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(plan)
+	})
+}
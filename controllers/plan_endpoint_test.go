@@ -0,0 +1,134 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/timebertt/image-clone-controller/pkg/test"
+)
+
+func TestPlanWorkloadDoesNotEmitEvents(t *testing.T) {
+	namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team", Annotations: map[string]string{BackupRegistryAnnotation: "not a registry"}}}
+	deployment := test.NewDeployment("team", "app", "nginx:1.25")
+	deployment.Annotations = map[string]string{DestinationPrefixAnnotation: "Invalid Prefix"}
+	c := newTestController(t, namespace, deployment)
+	backupRegistry, err := name.NewRegistry("registry.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.BackupRegistry = backupRegistry
+	recorder := c.Recorder.(*record.FakeRecorder)
+
+	plan, err := c.PlanWorkload(context.Background(), c.Client, "Deployment", deployment, &deployment.Spec.Template)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Warnings) != 2 || plan.BackupRegistry != "registry.example.com" || plan.DestinationPrefix != "" {
+		t.Errorf("plan = %+v, want warnings for both annotations and the defaults", plan)
+	}
+	if len(plan.Containers) != 1 || plan.Containers[0].Action != PlanActionRewrite {
+		t.Errorf("containers = %+v, want a rewrite", plan.Containers)
+	}
+	if len(recorder.Events) != 0 {
+		t.Errorf("planning emitted %d events, want none", len(recorder.Events))
+	}
+
+	// reconciliations report the same warnings as events
+	target, err := c.targetFor(context.Background(), c.Client, deployment, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(target.Warnings) != 2 || len(recorder.Events) != 2 {
+		t.Errorf("reconciliation reported %d warnings and %d events, want 2 each", len(target.Warnings), len(recorder.Events))
+	}
+	for len(recorder.Events) > 0 {
+		if e := <-recorder.Events; !strings.Contains(e, ReasonInvalidBackupRegistryAnnotation) && !strings.Contains(e, ReasonInvalidDestinationPrefix) {
+			t.Errorf("unexpected event %q", e)
+		}
+	}
+}
+
+func TestPlanWorkloadSkippedNamespace(t *testing.T) {
+	namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team", Annotations: map[string]string{SkipAnnotation: "true"}}}
+	deployment := test.NewDeployment("team", "app", "nginx:1.25")
+	c := newTestController(t, namespace, deployment)
+
+	plan, err := c.PlanWorkload(context.Background(), c.Client, "Deployment", deployment, &deployment.Spec.Template)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.Skipped == "" || len(plan.Containers) != 0 {
+		t.Errorf("plan = %+v, want the workload to be skipped", plan)
+	}
+
+	// workloads that are being deleted are finalized anyway
+	now := metav1.Now()
+	deployment.DeletionTimestamp = &now
+	target, err := c.targetFor(context.Background(), c.Client, deployment, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target.Skipped != "" {
+		t.Errorf("deleted workload was skipped: %s", target.Skipped)
+	}
+}
+
+func TestPlanHandlerToken(t *testing.T) {
+	c := newTestController(t)
+	manifest := `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      containers:
+      - name: app
+        image: nginx:1.25
+`
+
+	for _, tt := range []struct {
+		name, token, authorization string
+		want                       int
+	}{
+		{name: "no token configured", want: http.StatusOK},
+		{name: "token configured", token: "secret", authorization: "Bearer secret", want: http.StatusOK},
+		{name: "token missing", token: "secret", want: http.StatusUnauthorized},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, PlanPath, strings.NewReader(manifest))
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			rec := httptest.NewRecorder()
+			c.planHandler(c.Client, tt.token).ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.want, rec.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/google/go-containerregistry/pkg/name"
+
+	"github.com/timebertt/image-clone-controller/pkg/test"
+)
+
+func TestPlanRewritesEquivalentBackupRegistry(t *testing.T) {
+	backupRegistry, err := name.NewRegistry("registry.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	images := []string{
+		"registry.example.com/ghcr_io/app:v1",
+		"Registry.Example.com/ghcr_io/app:v1",
+		"registry.example.com:443/ghcr_io/app:v1",
+		"REGISTRY.EXAMPLE.COM:443/ghcr_io/app:v1",
+	}
+	deployment := test.NewDeployment("default", "app", images...)
+	c := newTestController(t, deployment)
+	c.BackupRegistry = backupRegistry
+
+	plan, _, err := c.planRewrites(&deployment.Spec.Template, backupRegistry, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, r := range plan {
+		if !r.BackedUp || r.SkipReason != SkipReasonAlreadyBackup {
+			t.Errorf("image %s is not recognized as backed up", images[i])
+		}
+	}
+
+	// comparisons never change the images as written in the workload
+	if _, err := c.reconcilePodTemplate(context.Background(), logr.Discard(), deployment, &deployment.Spec.Template, backupRegistry, ""); err != nil {
+		t.Fatal(err)
+	}
+	for i, got := range test.ContainerImages(deployment) {
+		if got != images[i] {
+			t.Errorf("image %s was changed to %s", images[i], got)
+		}
+	}
+
+	// other registries are rewritten
+	plan, _, err = c.planRewrites(&test.NewDeployment("default", "other", "registry.example.com:5000/app:v1").Spec.Template, backupRegistry, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan[0].BackedUp || plan[0].Destination.Name() != "registry.example.com/registry_example_com_5000/app:v1" {
+		t.Errorf("plan = %+v, want a rewrite to the backup registry", plan[0])
+	}
+}
+
+func TestReconcilePinsResolvedDigest(t *testing.T) {
+	upstream, backup := newTestRegistry(t), newTestRegistry(t)
+	img, err := upstream.SeedImage("upstream/app:v1", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deployment := test.NewDeployment("default", "app", upstream.Registry.RegistryStr()+"/upstream/app:v1")
+	c := newTestController(t, deployment)
+	c.BackupRegistry = backup.Registry
+	c.Decisions = &RewriteDecisions{TTL: time.Hour}
+
+	rewritten, err := c.reconcilePodTemplate(context.Background(), logr.Discard(), deployment, &deployment.Spec.Template, backup.Registry, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rewritten) != 1 || rewritten[0].Digest != digest {
+		t.Fatalf("rewritten = %+v, want the resolved digest %s", rewritten, digest)
+	}
+	image := test.ContainerImages(deployment)[0]
+	if want := rewritten[0].Destination.Name() + "@" + digest.String(); image != want {
+		t.Errorf("image = %s, want %s", image, want)
+	}
+	if got, err := test.Digest(image); err != nil || got != digest {
+		t.Errorf("digest of rewritten image = %s (error: %v), want %s", got, err, digest)
+	}
+
+	// the pinned image is recognized as backed up
+	plan, _, err := c.planRewrites(&deployment.Spec.Template, backup.Registry, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !plan[0].BackedUp {
+		t.Errorf("pinned image %s is not recognized as backed up", image)
+	}
+
+	// up-to-date decisions carry the digest, so the source tag isn't resolved again until they expire
+	if _, err := upstream.SeedImage("upstream/app:v1", 1); err != nil {
+		t.Fatal(err)
+	}
+	other := test.NewDeployment("default", "other", upstream.Registry.RegistryStr()+"/upstream/app:v1")
+	if _, err := c.reconcilePodTemplate(context.Background(), logr.Discard(), other, &other.Spec.Template, backup.Registry, ""); err != nil {
+		t.Fatal(err)
+	}
+	if got := test.ContainerImages(other)[0]; got != image {
+		t.Errorf("image = %s, want the image of the up-to-date decision %s", got, image)
+	}
+}
+
+func TestPinnedTag(t *testing.T) {
+	const digest = "sha256:33cef2fd3a1f6e5bbb5d4ff2bd6ab0d8a89f1bea7bcf6a1b3f7ce33ae2e3a6a3"
+	for _, tt := range []struct {
+		image, want string
+	}{
+		{"registry.example.com/docker.io/library/nginx:1.25@" + digest, "registry.example.com/docker.io/library/nginx:1.25"},
+		{"registry.example.com:5000/app:v1@" + digest, "registry.example.com:5000/app:v1"},
+		{"registry.example.com:5000/app@" + digest, ""},
+		{"registry.example.com/app:v1", ""},
+	} {
+		ref, err := name.ParseReference(tt.image)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tag, ok := pinnedTag(ref)
+		if got := tag.Name(); ok != (tt.want != "") || (ok && got != tt.want) {
+			t.Errorf("pinnedTag(%s) = %s, %t, want %q", tt.image, got, ok, tt.want)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/go-logr/logr"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	corev1 "k8s.io/api/core/v1"
+	toolscache "k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/timebertt/image-clone-controller/pkg/copier"
+)
+
+// DetectPlatforms is the value of the --require-platforms flag for detecting the required platforms from the labels of
+// the cluster's Nodes.
+const DetectPlatforms = "auto"
+
+//+kubebuilder:rbac:groups="",resources=nodes,verbs=get;list;watch
+
+// ParseRequiredPlatforms parses platforms in the form <os>/<arch>[/<variant>], e.g., linux/arm64/v8. If the only value
+// is DetectPlatforms, detect is true and the required platforms are detected from the cluster's Nodes instead.
+func ParseRequiredPlatforms(values []string) (platforms []v1.Platform, detect bool, err error) {
+	if len(values) == 1 && values[0] == DetectPlatforms {
+		return nil, true, nil
+	}
+
+	for _, value := range values {
+		platform, err := v1.ParsePlatform(value)
+		if err != nil {
+			return nil, false, fmt.Errorf("invalid platform %q: %w", value, err)
+		}
+		if platform.OS == "" || platform.Architecture == "" {
+			return nil, false, fmt.Errorf("invalid platform %q, expected <os>/<arch>[/<variant>] or %q", value, DetectPlatforms)
+		}
+		platforms = append(platforms, *platform)
+	}
+	return platforms, false, nil
+}
+
+// IncompletePlatformsError is returned for images that don't provide all required platforms if EnforcePlatforms is
+// enabled.
+type IncompletePlatformsError struct {
+	Image   string
+	Missing []v1.Platform
+}
+
+func (e *IncompletePlatformsError) Error() string {
+	return fmt.Sprintf("image %q doesn't provide the required platforms %s", e.Image, platformsString(e.Missing))
+}
+
+// IsIncompletePlatforms checks whether the given error indicates that an image doesn't provide all required platforms.
+func IsIncompletePlatforms(err error) bool {
+	var incompleteErr *IncompletePlatformsError
+	return errors.As(err, &incompleteErr)
+}
+
+func platformsString(platforms []v1.Platform) string {
+	s := make([]string, 0, len(platforms))
+	for _, p := range platforms {
+		s = append(s, p.String())
+	}
+	return strings.Join(s, ",")
+}
+
+// nodePlatforms keeps track of the platforms of the cluster's Nodes based on their well-known os and arch labels.
+type nodePlatforms struct {
+	reader client.Reader
+
+	lock      sync.RWMutex
+	platforms []v1.Platform
+}
+
+// newNodePlatforms recomputes the platforms whenever Nodes are added, changed or deleted.
+func newNodePlatforms(ctx context.Context, c cache.Cache) (*nodePlatforms, error) {
+	n := &nodePlatforms{reader: c}
+
+	informer, err := c.GetInformer(ctx, &corev1.Node{})
+	if err != nil {
+		return nil, err
+	}
+	recompute := func() {
+		// listing from the cache only fails if the cache is not started, keep the previous platforms in this case
+		_ = n.recompute(context.Background())
+	}
+	informer.AddEventHandler(toolscache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { recompute() },
+		UpdateFunc: func(interface{}, interface{}) { recompute() },
+		DeleteFunc: func(interface{}) { recompute() },
+	})
+	return n, nil
+}
+
+func (n *nodePlatforms) recompute(ctx context.Context) error {
+	nodeList := &corev1.NodeList{}
+	if err := n.reader.List(ctx, nodeList); err != nil {
+		return err
+	}
+
+	seen := make(map[string]v1.Platform)
+	for _, node := range nodeList.Items {
+		nodeOS, arch := node.Labels[corev1.LabelOSStable], node.Labels[corev1.LabelArchStable]
+		if nodeOS == "" || arch == "" {
+			continue
+		}
+		platform := v1.Platform{OS: nodeOS, Architecture: arch}
+		seen[platform.String()] = platform
+	}
+
+	platforms := make([]v1.Platform, 0, len(seen))
+	for _, platform := range seen {
+		platforms = append(platforms, platform)
+	}
+	sort.Slice(platforms, func(i, j int) bool {
+		return platforms[i].String() < platforms[j].String()
+	})
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.platforms = platforms
+	return nil
+}
+
+func (n *nodePlatforms) get() []v1.Platform {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	return n.platforms
+}
+
+// requiredPlatforms returns the platforms that copied images need to provide. It is empty if the check is disabled.
+func (c *ImageCloneController) requiredPlatforms() []v1.Platform {
+	if c.nodePlatforms != nil {
+		return c.nodePlatforms.get()
+	}
+	return c.RequiredPlatforms
+}
+
+// checkPlatforms verifies that the copied image of the given rewrite provides all required platforms. The destination
+// is checked instead of the source, as it has the same digest and doesn't cause additional requests to the source
+// registry. Missing platforms are reported via an event and a metric. If EnforcePlatforms is enabled, an
+// *IncompletePlatformsError is returned, so that the image is not rewritten.
+func (c *ImageCloneController) checkPlatforms(ctx context.Context, log logr.Logger, obj client.Object, r rewrite) error {
+	required := c.requiredPlatforms()
+	if len(required) == 0 {
+		return nil
+	}
+
+	provided, err := c.Copier.Platforms(ctx, r.pinnedDestination())
+	if err != nil {
+		// the check is best effort, the image has been copied successfully
+		log.Error(err, "Failed checking platforms of copied image")
+		return nil
+	}
+	if provided == nil {
+		log.V(1).Info("Platforms of copied image can't be determined, skipping platform check")
+		return nil
+	}
+
+	missing := copier.MissingPlatforms(provided, required)
+	if len(missing) == 0 {
+		return nil
+	}
+
+	for _, platform := range missing {
+		incompletePlatformImagesTotal.WithLabelValues(platform.String()).Inc()
+	}
+	log.Info("Image doesn't provide all required platforms", "missingPlatforms", platformsString(missing))
+
+	if c.EnforcePlatforms {
+		c.event(obj, corev1.EventTypeWarning, ReasonIncompletePlatforms, "Not rewriting image that doesn't provide all required platforms",
+			eventKeyContainer, r.Container.Name, eventKeySource, r.Source.String(), eventKeyDestination, r.Destination.Name(), "missingPlatforms", platformsString(missing))
+		return &IncompletePlatformsError{Image: r.Source.Name(), Missing: missing}
+	}
+
+	c.event(obj, corev1.EventTypeWarning, ReasonIncompletePlatforms, "Image doesn't provide all required platforms, the backup copy is incomplete",
+		eventKeyContainer, r.Container.Name, eventKeySource, r.Source.String(), eventKeyDestination, r.Destination.Name(), "missingPlatforms", platformsString(missing))
+	return nil
+}
@@ -0,0 +1,126 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/go-logr/logr"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var workloadsPendingApproval = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: metricsNamespace,
+	Name:      "workloads_pending_approval",
+	Help:      "Number of workloads with images that are blocked until they are pre-approved, i.e., pushed to the backup registry.",
+})
+
+func init() {
+	metrics.Registry.MustRegister(workloadsPendingApproval)
+}
+
+// PendingApprovalError is returned by reconcilePodTemplate with RewriteOnlyPreapproved if some images have not been
+// pre-approved yet, i.e., their destination images don't exist in the backup registry. The other images are rewritten
+// anyway.
+type PendingApprovalError struct {
+	Images []string
+}
+
+func (e *PendingApprovalError) Error() string {
+	return fmt.Sprintf("%d images have not been pre-approved in the backup registry: %s", len(e.Images), strings.Join(e.Images, ", "))
+}
+
+// errNotPreapproved is returned by rewritePreapproved if the destination image doesn't exist or doesn't match the
+// source digest.
+var errNotPreapproved = errors.New("image has not been pre-approved in the backup registry")
+
+// rewritePreapproved checks whether the destination image of the given rewrite has been pre-approved, i.e., pushed to
+// the backup registry by a separate pipeline. It never copies any image. The source registry is only contacted for
+// resolving the source digest if PreapprovalVerifyDigests is enabled, in which case the destination image must match
+// the current source digest.
+func (c *ImageCloneController) rewritePreapproved(ctx context.Context, log logr.Logger, r rewrite) error {
+	dstDigest, exists, err := c.Copier.Exists(ctx, r.Destination)
+	if err != nil {
+		return fmt.Errorf("error checking if image %q exists in the backup registry: %w", r.Destination.Name(), err)
+	}
+	if !exists {
+		return errNotPreapproved
+	}
+
+	if c.PreapprovalVerifyDigests {
+		srcDigest, err := c.sourceDigest(ctx, r)
+		if err != nil {
+			return err
+		}
+		if srcDigest != dstDigest {
+			log.Info("Pre-approved image doesn't match the source digest", "destination", r.Destination.Name(), "sourceDigest", srcDigest.String(), "destinationDigest", dstDigest.String())
+			return errNotPreapproved
+		}
+	}
+
+	log.Info("Image has been pre-approved in the backup registry, rewriting it without copying", "destination", r.Destination.Name())
+	return nil
+}
+
+// sourceDigest returns the digest of the source image of the given rewrite. Images referenced by digest are not
+// resolved.
+func (c *ImageCloneController) sourceDigest(ctx context.Context, r rewrite) (v1.Hash, error) {
+	if digest, ok := r.Original.(name.Digest); ok {
+		return v1.NewHash(digest.DigestStr())
+	}
+
+	digest, exists, err := c.Copier.Exists(ctx, r.Source)
+	if err != nil {
+		return v1.Hash{}, fmt.Errorf("error resolving digest of image %q: %w", r.Source.Name(), err)
+	}
+	if !exists {
+		return v1.Hash{}, fmt.Errorf("source image %q doesn't exist", r.Source.Name())
+	}
+	return digest, nil
+}
+
+// contactsSourceRegistries returns true if images may be copied from their source registries.
+func (c *ImageCloneController) contactsSourceRegistries() bool {
+	return !c.Offline && !c.RewriteOnlyPreapproved
+}
+
+// pendingApprovals tracks the workloads that are blocked until their images are pre-approved.
+type pendingApprovals struct {
+	workloads sync.Map
+}
+
+// set records whether the given workload is blocked until its images are pre-approved.
+func (p *pendingApprovals) set(kind string, key client.ObjectKey, pending bool) {
+	workload := kind + "/" + key.String()
+	if pending {
+		if _, loaded := p.workloads.LoadOrStore(workload, true); !loaded {
+			workloadsPendingApproval.Inc()
+		}
+		return
+	}
+	if _, loaded := p.workloads.LoadAndDelete(workload); loaded {
+		workloadsPendingApproval.Dec()
+	}
+}
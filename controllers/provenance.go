@@ -0,0 +1,74 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"encoding/json"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/timebertt/image-clone-controller/pkg/version"
+)
+
+// LastRewriteAnnotation is set on workloads in the same patch that rewrites their images. It contains the provenance of
+// the last rewrite as compact JSON, i.e., the controller's version, the time, and the rewritten containers, so that
+// image changes can be attributed to this controller if multiple tools mutate workloads.
+const LastRewriteAnnotation = "image-clone.timebertt.dev/last-rewrite"
+
+// lastRewrite is the value of the LastRewriteAnnotation.
+type lastRewrite struct {
+	Version    string                 `json:"version"`
+	Timestamp  time.Time              `json:"timestamp"`
+	Containers []lastRewriteContainer `json:"containers"`
+}
+
+type lastRewriteContainer struct {
+	Name        string `json:"name"`
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	// Size and Layers are only set if the image was copied in this rewrite, see copier.ImageStats.
+	Size   int64 `json:"size,omitempty"`
+	Layers int   `json:"layers,omitempty"`
+}
+
+// setLastRewrite sets the LastRewriteAnnotation for the given rewrites on obj.
+func setLastRewrite(obj client.Object, rewritten []rewrite, now time.Time) error {
+	value := lastRewrite{
+		Version:    version.Version,
+		Timestamp:  now.UTC().Truncate(time.Second),
+		Containers: make([]lastRewriteContainer, 0, len(rewritten)),
+	}
+	for _, r := range rewritten {
+		container := lastRewriteContainer{
+			Name:        r.Container.Name,
+			Source:      r.Source.String(),
+			Destination: r.Destination.String(),
+		}
+		if r.Stats != nil {
+			container.Size, container.Layers = r.Stats.Size, r.Stats.Layers
+		}
+		value.Containers = append(value.Containers, container)
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	setAnnotation(obj, LastRewriteAnnotation, string(data))
+	return nil
+}
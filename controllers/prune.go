@@ -0,0 +1,111 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/go-logr/logr"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// ForceSyncAcknowledgedAnnotation is set on workloads when the controller has observed the current value of their
+// ForceSyncAnnotation. Both annotations are removed once ForceSyncRetention has passed since then, so that
+// acknowledged markers don't accumulate on workloads.
+const ForceSyncAcknowledgedAnnotation = "image-clone.timebertt.dev/force-sync-acknowledged"
+
+// forceSyncAcknowledgement is the value of the ForceSyncAcknowledgedAnnotation.
+type forceSyncAcknowledgement struct {
+	Value     string    `json:"value"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// acknowledgeForceSync records the current value of the ForceSyncAnnotation of the given workload in the
+// ForceSyncAcknowledgedAnnotation and removes acknowledgements of removed values. It returns the remaining time until
+// both annotations are removed by pruneAnnotations, or due if the ForceSyncRetention has passed. Changes are included
+// in the following patch.
+func (c *ImageCloneController) acknowledgeForceSync(obj client.Object, now time.Time) (remaining time.Duration, due bool) {
+	if c.ForceSyncRetention <= 0 {
+		return 0, false
+	}
+
+	annotations := obj.GetAnnotations()
+	value, ok := annotations[ForceSyncAnnotation]
+	if !ok {
+		if _, ok := annotations[ForceSyncAcknowledgedAnnotation]; ok {
+			delete(annotations, ForceSyncAcknowledgedAnnotation)
+			obj.SetAnnotations(annotations)
+		}
+		return 0, false
+	}
+
+	ack := forceSyncAcknowledgement{}
+	if err := json.Unmarshal([]byte(annotations[ForceSyncAcknowledgedAnnotation]), &ack); err != nil || ack.Value != value {
+		// the value was changed or never acknowledged, invalid acknowledgements are overwritten
+		data, err := json.Marshal(forceSyncAcknowledgement{Value: value, Timestamp: now.UTC().Truncate(time.Second)})
+		if err != nil {
+			return 0, false
+		}
+		setAnnotation(obj, ForceSyncAcknowledgedAnnotation, string(data))
+		return c.ForceSyncRetention, false
+	}
+
+	if elapsed := now.Sub(ack.Timestamp); elapsed < c.ForceSyncRetention {
+		return c.ForceSyncRetention - elapsed, false
+	}
+	return 0, true
+}
+
+// pruneAnnotations removes stale controller annotations from the given workload, whose images are up to date: the
+// LastErrorAnnotation if it couldn't be removed by the previous patch (e.g., server-side apply doesn't remove fields
+// owned by other field managers), and the ForceSyncAnnotation along with its acknowledgement once ForceSyncRetention has
+// passed. Annotations are removed using the configured PatchStrategy, server-side apply falls back to a merge patch for
+// annotations owned by users like the ForceSyncAnnotation (see removeUnowned). Changing annotations doesn't increment
+// the generation, and the resulting reconciliation finds nothing to prune, so the workload converges.
+func (c *ImageCloneController) pruneAnnotations(ctx context.Context, log logr.Logger, obj client.Object) (ctrl.Result, error) {
+	before := obj.DeepCopyObject().(client.Object)
+	annotations := obj.GetAnnotations()
+	delete(annotations, LastErrorAnnotation)
+	obj.SetAnnotations(annotations)
+
+	result := ctrl.Result{}
+	remaining, due := c.acknowledgeForceSync(obj, time.Now())
+	if _, deferred := c.patchWindowDeferred.Load(obj.GetUID()); due && !deferred {
+		// removing the value would bypass the patch window, see waitForPatchWindow
+		log.Info("Removing acknowledged "+ForceSyncAnnotation+" annotation", "retention", c.ForceSyncRetention)
+		annotations := obj.GetAnnotations()
+		delete(annotations, ForceSyncAnnotation)
+		delete(annotations, ForceSyncAcknowledgedAnnotation)
+		obj.SetAnnotations(annotations)
+	} else if remaining > 0 {
+		result.RequeueAfter = remaining
+	}
+
+	if apiequality.Semantic.DeepEqual(before, obj) {
+		return result, nil
+	}
+
+	log.V(1).Info("Pruning controller annotations")
+	if err := c.patch(ctx, obj, before); err != nil {
+		return ctrl.Result{}, err
+	}
+	return result, nil
+}
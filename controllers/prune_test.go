@@ -0,0 +1,149 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/timebertt/image-clone-controller/pkg/test"
+)
+
+func TestAcknowledgeForceSync(t *testing.T) {
+	now := time.Date(2022, 7, 1, 12, 0, 0, 0, time.UTC)
+	c := newTestController(t)
+	c.ForceSyncRetention = time.Hour
+
+	obj := test.NewDeployment("default", "app", "nginx:1.23")
+	obj.Annotations = map[string]string{ForceSyncAnnotation: "1"}
+	if remaining, due := c.acknowledgeForceSync(obj, now); due || remaining != time.Hour {
+		t.Errorf("acknowledgeForceSync() = %s, %v, want the full retention", remaining, due)
+	}
+	ack := forceSyncAcknowledgement{}
+	if err := json.Unmarshal([]byte(obj.Annotations[ForceSyncAcknowledgedAnnotation]), &ack); err != nil || ack.Value != "1" || !ack.Timestamp.Equal(now) {
+		t.Fatalf("acknowledgement = %q (error: %v), want value 1 at %s", obj.Annotations[ForceSyncAcknowledgedAnnotation], err, now)
+	}
+
+	if remaining, due := c.acknowledgeForceSync(obj, now.Add(20*time.Minute)); due || remaining != 40*time.Minute {
+		t.Errorf("acknowledgeForceSync() = %s, %v, want the remaining retention", remaining, due)
+	}
+	if _, due := c.acknowledgeForceSync(obj, now.Add(time.Hour)); !due {
+		t.Error("acknowledgement is not due after the retention")
+	}
+
+	// changing the value restarts the retention
+	obj.Annotations[ForceSyncAnnotation] = "2"
+	if remaining, due := c.acknowledgeForceSync(obj, now.Add(2*time.Hour)); due || remaining != time.Hour {
+		t.Errorf("acknowledgeForceSync() = %s, %v, want the full retention for the changed value", remaining, due)
+	}
+
+	// acknowledgements of removed values are removed
+	delete(obj.Annotations, ForceSyncAnnotation)
+	c.acknowledgeForceSync(obj, now)
+	if _, ok := obj.Annotations[ForceSyncAcknowledgedAnnotation]; ok {
+		t.Error("acknowledgement of a removed value was kept")
+	}
+
+	c.ForceSyncRetention = 0
+	obj.Annotations[ForceSyncAnnotation] = "3"
+	c.acknowledgeForceSync(obj, now)
+	if _, ok := obj.Annotations[ForceSyncAcknowledgedAnnotation]; ok {
+		t.Error("value was acknowledged although pruning is disabled")
+	}
+}
+
+func TestPruneAnnotationsConverges(t *testing.T) {
+	upstream, backup := newTestRegistry(t), newTestRegistry(t)
+	if _, err := upstream.SeedImage("upstream/app:v1", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	deployment := test.NewDeployment("default", "app", upstream.Registry.RegistryStr()+"/upstream/app:v1")
+	deployment.Annotations = map[string]string{
+		ForceSyncAnnotation: "1",
+		LastErrorAnnotation: "error copying image: connection refused",
+	}
+	c := newTestController(t, deployment, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}})
+	c.BackupRegistry = backup.Registry
+	c.ForceSyncRetention = time.Hour
+
+	ctx := context.Background()
+	key := client.ObjectKeyFromObject(deployment)
+	// reconcile returns the stored object after reconciling it
+	reconcile := func() *appsv1.Deployment {
+		t.Helper()
+		if _, err := c.ReconcileDeployment(ctx, ctrl.Request{NamespacedName: key}); err != nil {
+			t.Fatal(err)
+		}
+		stored := &appsv1.Deployment{}
+		if err := c.Get(ctx, key, stored); err != nil {
+			t.Fatal(err)
+		}
+		return stored
+	}
+	// reconcileSteady asserts that reconciling again doesn't change the stored object
+	reconcileSteady := func(before *appsv1.Deployment) {
+		t.Helper()
+		if after := reconcile(); after.ResourceVersion != before.ResourceVersion {
+			t.Errorf("workload was patched again (resourceVersion %s -> %s), annotations: %v", before.ResourceVersion, after.ResourceVersion, after.Annotations)
+		}
+	}
+
+	stored := reconcile()
+	if image := stored.Spec.Template.Spec.Containers[0].Image; !strings.HasPrefix(image, backup.Registry.RegistryStr()+"/") {
+		t.Fatalf("image %s was not rewritten", image)
+	}
+	if _, ok := stored.Annotations[LastErrorAnnotation]; ok {
+		t.Error("last-error annotation was kept on a healthy workload")
+	}
+	if _, ok := stored.Annotations[ForceSyncAcknowledgedAnnotation]; !ok {
+		t.Fatal("force-sync annotation was not acknowledged")
+	}
+	reconcileSteady(stored)
+
+	// let the retention pass
+	ack := forceSyncAcknowledgement{Value: "1", Timestamp: time.Now().Add(-2 * time.Hour).UTC().Truncate(time.Second)}
+	data, err := json.Marshal(ack)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored.Annotations[ForceSyncAcknowledgedAnnotation] = string(data)
+	if err := c.Update(ctx, stored); err != nil {
+		t.Fatal(err)
+	}
+
+	stored = reconcile()
+	var keys []string
+	for key := range stored.Annotations {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if want := []string{ImagesHashAnnotation, LastRewriteAnnotation}; strings.Join(keys, ",") != strings.Join(want, ",") {
+		t.Errorf("annotations = %v, want only %v", keys, want)
+	}
+	reconcileSteady(stored)
+}
@@ -0,0 +1,63 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"k8s.io/apimachinery/pkg/util/sets"
+
+	"github.com/timebertt/image-clone-controller/pkg/naming"
+)
+
+// publicRegistries are well-known public registries that are most likely not meant as backup registry, including all
+// aliases of Docker Hub.
+var publicRegistries = naming.WellKnownRegistries().Union(sets.NewString(
+	"registry-1.docker.io",
+	"registry.hub.docker.com",
+))
+
+// PublicBackupRegistryError is returned by CheckPublicBackupRegistry if the backup registry is a well-known public
+// registry.
+type PublicBackupRegistryError struct {
+	Registry string
+}
+
+func (e *PublicBackupRegistryError) Error() string {
+	return fmt.Sprintf("backup registry %q is a well-known public registry, which is most likely a misconfiguration: "+
+		"source images would be copied into the public registry under rewritten names, use --allow-public-backup if this is intended", e.Registry)
+}
+
+// CheckPublicBackupRegistry returns a *PublicBackupRegistryError if the given backup registry is a well-known public
+// registry, e.g., docker.io or ghcr.io.
+func CheckPublicBackupRegistry(registry name.Registry) error {
+	if publicRegistries.Has(naming.CanonicalRegistry(registry.RegistryStr())) {
+		return &PublicBackupRegistryError{Registry: registry.RegistryStr()}
+	}
+	return nil
+}
+
+// DestinationEqualsSourceError is returned when planning a rewrite whose destination equals the source image. Copying
+// it would overwrite the source image with itself, which indicates a misconfigured backup registry.
+type DestinationEqualsSourceError struct {
+	Image string
+}
+
+func (e *DestinationEqualsSourceError) Error() string {
+	return fmt.Sprintf("destination of image %q equals its source, refusing to copy it onto itself, the backup registry seems to be misconfigured", e.Image)
+}
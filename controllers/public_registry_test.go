@@ -0,0 +1,75 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestCheckPublicBackupRegistry(t *testing.T) {
+	tests := []struct {
+		registry   string
+		wantPublic bool
+	}{
+		{registry: "docker.io", wantPublic: true},
+		{registry: "index.docker.io", wantPublic: true},
+		{registry: "registry-1.docker.io", wantPublic: true},
+		{registry: "ghcr.io", wantPublic: true},
+		{registry: "GHCR.io", wantPublic: true},
+		{registry: "registry.example.com"},
+		{registry: "localhost:5000"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.registry, func(t *testing.T) {
+			registry, err := name.NewRegistry(tt.registry)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = CheckPublicBackupRegistry(registry)
+			var publicErr *PublicBackupRegistryError
+			if isPublic := errors.As(err, &publicErr); isPublic != tt.wantPublic {
+				t.Errorf("CheckPublicBackupRegistry() = %v, want public registry error: %v", err, tt.wantPublic)
+			}
+		})
+	}
+}
+
+func TestNamespaceBackupRegistryPublic(t *testing.T) {
+	c := newTestController(t)
+	c.BackupRegistry = name.MustParseReference("registry.example.com/app").Context().Registry
+	namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default", Annotations: map[string]string{BackupRegistryAnnotation: "ghcr.io"}}}
+
+	if _, err := c.namespaceBackupRegistry(namespace); err == nil {
+		t.Error("public backup registry of namespace was accepted")
+	}
+
+	c.AllowPublicBackup = true
+	registry, err := c.namespaceBackupRegistry(namespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if registry.RegistryStr() != "ghcr.io" {
+		t.Errorf("backup registry = %s, want ghcr.io", registry)
+	}
+}
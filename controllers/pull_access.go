@@ -0,0 +1,239 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/timebertt/image-clone-controller/pkg/naming"
+)
+
+// pullAccessRequeueInterval is the interval for checking again whether the pods of a workload can pull from the backup
+// registry. Changes of secrets and service accounts in the workload's namespace trigger reconciliations right away,
+// this only catches changes that are not reflected in them, e.g., node credentials.
+const pullAccessRequeueInterval = 10 * time.Minute
+
+var workloadsMissingPullAccess = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: metricsNamespace,
+	Name:      "workloads_missing_pull_access",
+	Help:      "Number of workloads whose patch is deferred because their pods can't pull from the backup registry.",
+})
+
+func init() {
+	metrics.Registry.MustRegister(workloadsMissingPullAccess)
+}
+
+//+kubebuilder:rbac:groups="",resources=secrets;serviceaccounts,verbs=get;list;watch
+
+// checkPullAccess checks with RequirePullAccess whether the pods of the given workload have credentials for the given
+// backup registry, i.e., whether a pull secret of the pod template or its service account contains credentials for it.
+// Otherwise, rewriting the images turns a working workload into ImagePullBackOff. It returns the name of the pull
+// secret that is missing or doesn't contain credentials, which is empty if no specific secret is expected.
+func (c *ImageCloneController) checkPullAccess(ctx context.Context, obj client.Object, template *corev1.PodTemplateSpec, backupRegistry name.Registry) (bool, string, error) {
+	if !c.RequirePullAccess || c.NodePullCredentials {
+		return true, "", nil
+	}
+
+	secretNames := sets.NewString()
+	for _, ref := range template.Spec.ImagePullSecrets {
+		secretNames.Insert(ref.Name)
+	}
+
+	// secrets and service accounts are only cached as metadata, see SetupWithManager
+	reader := c.uncachedReader()
+	serviceAccount := &corev1.ServiceAccount{}
+	if err := reader.Get(ctx, client.ObjectKey{Namespace: obj.GetNamespace(), Name: serviceAccountName(template)}, serviceAccount); err != nil {
+		if !apierrors.IsNotFound(err) {
+			return false, "", fmt.Errorf("error reading service account: %w", err)
+		}
+	} else {
+		for _, ref := range serviceAccount.ImagePullSecrets {
+			secretNames.Insert(ref.Name)
+		}
+	}
+
+	for _, secretName := range secretNames.List() {
+		secret := &corev1.Secret{}
+		if err := reader.Get(ctx, client.ObjectKey{Namespace: obj.GetNamespace(), Name: secretName}, secret); err != nil {
+			if apierrors.IsNotFound(err) {
+				continue
+			}
+			return false, "", fmt.Errorf("error reading pull secret %q: %w", secretName, err)
+		}
+		if hasCredentialsFor(secret, backupRegistry) {
+			return true, "", nil
+		}
+	}
+
+	// the replicated pull secret is the one that provides access to the backup registry
+	return false, c.ReplicatePullSecret.Name, nil
+}
+
+// uncachedReader returns the reader for objects that are not cached by the manager, see apiReader.
+func (c *ImageCloneController) uncachedReader() client.Reader {
+	if c.apiReader == nil {
+		return c.Client
+	}
+	return c.apiReader
+}
+
+func serviceAccountName(template *corev1.PodTemplateSpec) string {
+	if template.Spec.ServiceAccountName != "" {
+		return template.Spec.ServiceAccountName
+	}
+	if template.Spec.DeprecatedServiceAccount != "" {
+		return template.Spec.DeprecatedServiceAccount
+	}
+	return "default"
+}
+
+// hasCredentialsFor checks whether the given pull secret contains credentials for the given registry. Like the kubelet,
+// keys of the docker config may contain a scheme, a path, and wildcards in the host.
+func hasCredentialsFor(secret *corev1.Secret, registry name.Registry) bool {
+	var auths map[string]json.RawMessage
+	switch secret.Type {
+	case corev1.SecretTypeDockerConfigJson:
+		config := struct {
+			Auths map[string]json.RawMessage `json:"auths"`
+		}{}
+		if err := json.Unmarshal(secret.Data[corev1.DockerConfigJsonKey], &config); err != nil {
+			return false
+		}
+		auths = config.Auths
+	case corev1.SecretTypeDockercfg:
+		if err := json.Unmarshal(secret.Data[corev1.DockerConfigKey], &auths); err != nil {
+			return false
+		}
+	default:
+		return false
+	}
+
+	host := naming.CanonicalRegistry(registry.RegistryStr())
+	for key := range auths {
+		key = strings.TrimPrefix(strings.TrimPrefix(key, "https://"), "http://")
+		key, _, _ = strings.Cut(key, "/")
+		if matched, _ := path.Match(naming.CanonicalRegistry(key), host); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// missingPullAccess tracks the workloads whose patch is deferred because of missing pull access by kind, namespace,
+// and name, so that they are reconciled again when secrets or service accounts in their namespace change.
+type missingPullAccess struct {
+	lock      sync.Mutex
+	workloads map[string]map[string]sets.String
+}
+
+// set records whether the patch of the given workload is deferred because of missing pull access.
+func (m *missingPullAccess) set(kind string, key client.ObjectKey, missing bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	defer func() { workloadsMissingPullAccess.Set(float64(m.len())) }()
+
+	namespaces := m.workloads[kind]
+	if !missing {
+		if namespaces[key.Namespace].Has(key.Name) {
+			namespaces[key.Namespace].Delete(key.Name)
+			if namespaces[key.Namespace].Len() == 0 {
+				delete(namespaces, key.Namespace)
+			}
+		}
+		return
+	}
+
+	if m.workloads == nil {
+		m.workloads = make(map[string]map[string]sets.String)
+	}
+	if namespaces == nil {
+		namespaces = make(map[string]sets.String)
+		m.workloads[kind] = namespaces
+	}
+	if namespaces[key.Namespace] == nil {
+		namespaces[key.Namespace] = sets.NewString()
+	}
+	namespaces[key.Namespace].Insert(key.Name)
+}
+
+// len returns the number of tracked workloads. m.lock must be held.
+func (m *missingPullAccess) len() int {
+	n := 0
+	for _, namespaces := range m.workloads {
+		for _, names := range namespaces {
+			n += names.Len()
+		}
+	}
+	return n
+}
+
+// enqueueWorkloads maps secrets and service accounts to the workloads of the given kind in their namespace whose patch
+// is deferred because of missing pull access.
+func (m *missingPullAccess) enqueueWorkloads(kind string) handler.EventHandler {
+	return handler.EnqueueRequestsFromMapFunc(func(obj client.Object) []reconcile.Request {
+		m.lock.Lock()
+		defer m.lock.Unlock()
+
+		names := m.workloads[kind][obj.GetNamespace()]
+		requests := make([]reconcile.Request, 0, names.Len())
+		for _, workload := range names.List() {
+			requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: obj.GetNamespace(), Name: workload}})
+		}
+		return requests
+	})
+}
+
+// waitForPullAccess checks whether patching the given workload should be deferred because its pods can't pull from
+// the given backup registry, see checkPullAccess. The copies have already been done at this point, so the workload is
+// patched as soon as the pull secret becomes available.
+func (c *ImageCloneController) waitForPullAccess(ctx context.Context, log logr.Logger, kind string, obj client.Object, template *corev1.PodTemplateSpec, backupRegistry name.Registry) (time.Duration, bool, error) {
+	ok, secret, err := c.checkPullAccess(ctx, obj, template, backupRegistry)
+	if err != nil {
+		return 0, false, err
+	}
+	c.missingPullAccess.set(kind, client.ObjectKeyFromObject(obj), !ok)
+	if ok {
+		return 0, false, nil
+	}
+
+	keysAndValues := []string{"registry", backupRegistry.RegistryStr(), "serviceAccount", serviceAccountName(template)}
+	if secret != "" {
+		keysAndValues = append(keysAndValues, "secret", secret)
+	}
+	log.Info("Pods can't pull from the backup registry, deferring patch", "registry", backupRegistry.RegistryStr(), "secret", secret, "requeueAfter", pullAccessRequeueInterval)
+	c.event(obj, corev1.EventTypeWarning, ReasonMissingPullAccess, "No pull secret with credentials for the backup registry is available to the pods, deferring patch",
+		keysAndValues...)
+	return pullAccessRequeueInterval, true, nil
+}
@@ -0,0 +1,70 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/timebertt/image-clone-controller/pkg/test"
+)
+
+func TestCheckPullAccessReadsFromAPIServer(t *testing.T) {
+	backupRegistry, err := name.NewRegistry("registry.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deployment := test.NewDeployment("default", "app", "nginx:1.23")
+	// the controller's client only caches the metadata of secrets and service accounts
+	c := newTestController(t, deployment)
+	c.RequirePullAccess = true
+	c.ReplicatePullSecret.Name = "backup-registry"
+
+	serviceAccount := &corev1.ServiceAccount{
+		ObjectMeta:       metav1.ObjectMeta{Namespace: "default", Name: "default"},
+		ImagePullSecrets: []corev1.LocalObjectReference{{Name: "backup-registry"}},
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "backup-registry"},
+		Type:       corev1.SecretTypeDockerConfigJson,
+		Data:       map[string][]byte{corev1.DockerConfigJsonKey: []byte(`{"auths":{"registry.example.com":{"auth":"dXNlcjpwYXNz"}}}`)},
+	}
+	c.apiReader = fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithObjects(serviceAccount, secret).Build()
+
+	allowed, missing, err := c.checkPullAccess(context.Background(), deployment, &deployment.Spec.Template, backupRegistry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !allowed {
+		t.Errorf("pull access was denied, missing secret %q", missing)
+	}
+
+	// other registries are not covered by the secret
+	otherRegistry, err := name.NewRegistry("registry.example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if allowed, missing, err := c.checkPullAccess(context.Background(), deployment, &deployment.Spec.Template, otherRegistry); err != nil || allowed || missing != "backup-registry" {
+		t.Errorf("checkPullAccess() = %v, %q, %v, want missing secret backup-registry", allowed, missing, err)
+	}
+}
@@ -0,0 +1,217 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// PullSecretControllerName is the name of the pull secret replication controller.
+const PullSecretControllerName = "pull-secret"
+
+const (
+	// ReplicatedFromAnnotation is set on replicated pull secrets and contains the namespace and name of the source
+	// secret. Existing secrets without this annotation are owned by someone else and never touched.
+	ReplicatedFromAnnotation = "image-clone.timebertt.dev/replicated-from"
+	// PullSecretHashAnnotation is set on replicated pull secrets and contains a hash of the source secret's content.
+	PullSecretHashAnnotation = "image-clone.timebertt.dev/pull-secret-hash"
+)
+
+// PullSecretController replicates the pull secret for the backup registry to all namespaces, so that it can be
+// referenced by workloads regardless of whether they were patched by the ImageCloneController.
+type PullSecretController struct {
+	client.Client
+
+	// Source is the secret that is replicated.
+	Source types.NamespacedName
+	// CascadeDelete enables deleting replicated secrets when the source secret is deleted.
+	CascadeDelete bool
+	// IgnoredNamespaces are the namespaces that the secret is not replicated to, see Config.IgnoredNamespaces.
+	IgnoredNamespaces sets.String
+
+	// secrets caches the source secret and the secrets with the same name in other namespaces, i.e., the replicas and
+	// conflicting secrets. Other secrets are neither cached nor watched.
+	secrets cache.Cache
+}
+
+//+kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch;create;update;delete
+
+// SetupWithManager sets up the controller with the Manager.
+func (c *PullSecretController) SetupWithManager(mgr ctrl.Manager) error {
+	var err error
+	c.secrets, err = cache.New(mgr.GetConfig(), cache.Options{
+		Scheme: mgr.GetScheme(),
+		Mapper: mgr.GetRESTMapper(),
+		SelectorsByObject: cache.SelectorsByObject{
+			&corev1.Secret{}: {Field: fields.OneTermEqualSelector("metadata.name", c.Source.Name)},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("error creating pull secret cache: %w", err)
+	}
+	if err := mgr.Add(c.secrets); err != nil {
+		return err
+	}
+
+	return ctrl.NewControllerManagedBy(mgr).
+		Named(PullSecretControllerName).
+		For(&corev1.Namespace{}, builder.WithPredicates(predicate.ResourceVersionChangedPredicate{})).
+		Watches(source.NewKindWithCache(&corev1.Secret{}, c.secrets), handler.EnqueueRequestsFromMapFunc(c.mapSecretToNamespaces)).
+		Complete(c)
+}
+
+// mapSecretToNamespaces maps changes of the source secret to all namespaces and changes of replicated secrets to
+// their namespace.
+func (c *PullSecretController) mapSecretToNamespaces(obj client.Object) []reconcile.Request {
+	if client.ObjectKeyFromObject(obj) != c.Source {
+		if obj.GetName() != c.Source.Name || obj.GetAnnotations()[ReplicatedFromAnnotation] != c.Source.String() {
+			return nil
+		}
+		return []reconcile.Request{{NamespacedName: types.NamespacedName{Name: obj.GetNamespace()}}}
+	}
+
+	namespaces := &corev1.NamespaceList{}
+	if err := c.List(context.Background(), namespaces); err != nil {
+		logf.Log.Error(err, "Failed listing namespaces")
+		return nil
+	}
+
+	requests := make([]reconcile.Request, 0, len(namespaces.Items))
+	for _, namespace := range namespaces.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: namespace.Name}})
+	}
+	return requests
+}
+
+// Reconcile ensures that the source secret is replicated to the requested namespace.
+func (c *PullSecretController) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := logf.FromContext(ctx)
+
+	if c.IgnoredNamespaces.Has(req.Name) || req.Name == c.Source.Namespace {
+		return reconcile.Result{}, nil
+	}
+
+	namespace := &corev1.Namespace{}
+	if err := c.Get(ctx, req.NamespacedName, namespace); err != nil {
+		return reconcile.Result{}, client.IgnoreNotFound(err)
+	}
+	if namespace.DeletionTimestamp != nil {
+		return reconcile.Result{}, nil
+	}
+
+	replica := &corev1.Secret{}
+	if err := c.secrets.Get(ctx, client.ObjectKey{Namespace: req.Name, Name: c.Source.Name}, replica); err != nil {
+		if !apierrors.IsNotFound(err) {
+			return reconcile.Result{}, fmt.Errorf("error reading pull secret: %w", err)
+		}
+		replica = nil
+	}
+
+	if replica != nil && replica.Annotations[ReplicatedFromAnnotation] != c.Source.String() {
+		// don't fight other tools managing a secret with the same name
+		log.V(1).Info("Pull secret is not managed by this controller, skipping")
+		return reconcile.Result{}, nil
+	}
+
+	sourceSecret := &corev1.Secret{}
+	if err := c.secrets.Get(ctx, c.Source, sourceSecret); err != nil {
+		if !apierrors.IsNotFound(err) {
+			return reconcile.Result{}, fmt.Errorf("error reading source pull secret: %w", err)
+		}
+
+		if c.CascadeDelete && replica != nil {
+			log.Info("Source pull secret was deleted, deleting replicated pull secret")
+			return reconcile.Result{}, client.IgnoreNotFound(c.Delete(ctx, replica, client.Preconditions{UID: &replica.UID}))
+		}
+		return reconcile.Result{}, nil
+	}
+
+	hash := secretHash(sourceSecret)
+
+	if replica == nil {
+		replica = &corev1.Secret{}
+		replica.Namespace = req.Name
+		replica.Name = c.Source.Name
+		replica.Type = sourceSecret.Type
+		replica.Data = sourceSecret.Data
+		setAnnotation(replica, ReplicatedFromAnnotation, c.Source.String())
+		setAnnotation(replica, PullSecretHashAnnotation, hash)
+
+		log.Info("Creating replicated pull secret")
+		if err := c.Create(ctx, replica); err != nil && !apierrors.IsAlreadyExists(err) {
+			return reconcile.Result{}, fmt.Errorf("error creating pull secret: %w", err)
+		}
+		return reconcile.Result{}, nil
+	}
+
+	if replica.Annotations[PullSecretHashAnnotation] == hash && secretHash(replica) == hash {
+		return reconcile.Result{}, nil
+	}
+
+	if replica.Type != sourceSecret.Type {
+		// the type of secrets is immutable, recreate it in the next reconciliation
+		log.Info("Type of source pull secret changed, deleting replicated pull secret")
+		return reconcile.Result{Requeue: true}, client.IgnoreNotFound(c.Delete(ctx, replica, client.Preconditions{UID: &replica.UID}))
+	}
+
+	// use optimistic locking, the update fails if the secret was changed in the meantime
+	replica.Data = sourceSecret.Data
+	setAnnotation(replica, PullSecretHashAnnotation, hash)
+
+	log.Info("Updating replicated pull secret")
+	if err := c.Update(ctx, replica); err != nil {
+		return reconcile.Result{}, fmt.Errorf("error updating pull secret: %w", err)
+	}
+	return reconcile.Result{}, nil
+}
+
+// secretHash calculates a hash of the given secret's type and data.
+func secretHash(secret *corev1.Secret) string {
+	keys := make([]string, 0, len(secret.Data))
+	for key := range secret.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	h := sha256.New()
+	h.Write([]byte(string(secret.Type) + "\n"))
+	for _, key := range keys {
+		h.Write([]byte(key + "\n"))
+		h.Write(secret.Data[key])
+		h.Write([]byte("\n"))
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
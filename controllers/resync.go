@@ -0,0 +1,228 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	"github.com/timebertt/image-clone-controller/pkg/copier"
+)
+
+// ResyncPath is the path that the resync trigger is served on. POST requests start a full resync, GET requests return
+// its progress.
+const ResyncPath = "/debug/resync"
+
+var resyncWorkloads = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: metricsNamespace,
+	Name:      "resync_workloads",
+	Help:      "Number of workloads of the current or last full resync that have been enqueued or are remaining.",
+}, []string{"state"})
+
+func init() {
+	metrics.Registry.MustRegister(resyncWorkloads)
+}
+
+// ResyncProgress describes the progress of a full resync.
+type ResyncProgress struct {
+	Running   bool      `json:"running"`
+	Started   time.Time `json:"started,omitempty"`
+	Enqueued  int       `json:"enqueued"`
+	Remaining int       `json:"remaining"`
+}
+
+// resyncKind is a workload kind that is resynced by sending its objects to the kind's controller via events.
+type resyncKind struct {
+	name   string
+	list   client.ObjectList
+	events chan event.GenericEvent
+}
+
+// resyncer enqueues all workloads spread over a configurable duration with jitter, so that a full resync doesn't
+// cause load spikes on the registries. Resynced workloads skip the images hash fast path once.
+type resyncer struct {
+	reader client.Reader
+	kinds  []resyncKind
+	// filter selects the workloads that are reconciled by this replica
+	filter predicate.Predicate
+	spread time.Duration
+	// pending stores the UIDs of workloads that are enqueued by the resync but have not been reconciled yet.
+	pending *sync.Map
+	// passes aggregates the events of resyncs per namespace, if set
+	passes *bulkPasses
+
+	lock     sync.Mutex
+	ctx      context.Context
+	progress ResyncProgress
+}
+
+// Start implements manager.Runnable. It only stores the context for resyncs, which are triggered via the handler.
+func (r *resyncer) Start(ctx context.Context) error {
+	r.lock.Lock()
+	r.ctx = ctx
+	r.lock.Unlock()
+
+	<-ctx.Done()
+	return nil
+}
+
+// trigger starts a full resync. If a resync is already running, it doesn't start another one.
+func (r *resyncer) trigger() (ResyncProgress, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.ctx == nil {
+		return r.progress, fmt.Errorf("controller is not running")
+	}
+	if r.progress.Running {
+		return r.progress, nil
+	}
+
+	type workload struct {
+		obj    client.Object
+		events chan event.GenericEvent
+	}
+	var (
+		items []workload
+		// keys are the workloads of the pass
+		keys []string
+	)
+	for _, kind := range r.kinds {
+		list := kind.list.DeepCopyObject().(client.ObjectList)
+		if err := r.reader.List(r.ctx, list); err != nil {
+			return r.progress, err
+		}
+		for _, obj := range workloads(list) {
+			if !r.filter.Generic(event.GenericEvent{Object: obj}) {
+				// ignored namespace or other shard, never reconciled
+				continue
+			}
+			items = append(items, workload{obj: obj, events: kind.events})
+			keys = append(keys, bulkPassKey(kind.name, client.ObjectKeyFromObject(obj)))
+		}
+	}
+	// interleave kinds and namespaces
+	rand.Shuffle(len(items), func(i, j int) { items[i], items[j] = items[j], items[i] })
+
+	started := time.Now()
+	passID := fmt.Sprintf("resync-%d", started.Unix())
+	r.passes.start(passID, "full resync", keys)
+	r.progress = ResyncProgress{Running: true, Started: started, Remaining: len(items)}
+	r.updateMetrics()
+
+	ctx := r.ctx
+	go func() {
+		log := logf.FromContext(ctx)
+		log.Info("Starting full resync", "workloads", len(items), "spread", r.spread)
+
+		var interval time.Duration
+		if len(items) > 0 {
+			interval = r.spread / time.Duration(len(items))
+		}
+		for i, w := range items {
+			delay := time.Duration(i) * interval
+			if interval > 0 {
+				delay += time.Duration(rand.Int63n(int64(interval)))
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Until(started.Add(delay))):
+			}
+
+			r.pending.Store(w.obj.GetUID(), true)
+			w.events <- event.GenericEvent{Object: w.obj}
+
+			r.lock.Lock()
+			r.progress.Enqueued++
+			r.progress.Remaining--
+			r.updateMetrics()
+			r.lock.Unlock()
+		}
+
+		r.lock.Lock()
+		r.progress.Running = false
+		r.lock.Unlock()
+		r.passes.allEnqueued(passID)
+		r.passes.finishAfter(passID, bulkPassFlushTimeout)
+		log.Info("Finished full resync", "workloads", len(items))
+	}()
+
+	return r.progress, nil
+}
+
+// updateMetrics updates the progress metrics. r.lock must be held.
+func (r *resyncer) updateMetrics() {
+	resyncWorkloads.WithLabelValues("enqueued").Set(float64(r.progress.Enqueued))
+	resyncWorkloads.WithLabelValues("remaining").Set(float64(r.progress.Remaining))
+}
+
+func (r *resyncer) getProgress() ResyncProgress {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.progress
+}
+
+// handler returns an http.Handler that starts a resync on POST requests and returns its progress on GET requests.
+// Requests must authenticate with the given bearer token.
+func (r *resyncer) handler(token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !copier.AuthorizeDebugRequest(w, req, token) {
+			return
+		}
+
+		var progress ResyncProgress
+		switch req.Method {
+		case http.MethodGet:
+			progress = r.getProgress()
+		case http.MethodPost:
+			var err error
+			if progress, err = r.trigger(); err != nil {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(progress)
+	})
+}
+
+// resyncPending checks whether the given workload was enqueued by a full resync and hasn't been reconciled since.
+func (c *ImageCloneController) resyncPending(uid types.UID) bool {
+	_, pending := c.resyncing.LoadAndDelete(uid)
+	return pending
+}
@@ -0,0 +1,138 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var (
+	retryBudgetRetriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "retry_budget_retries_total",
+		Help:      "Total number of retries of failing workloads that were allowed or throttled by the retry budget.",
+	}, []string{"result"})
+
+	retryBudgetTokens = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "retry_budget_tokens",
+		Help:      "Number of retries of failing workloads that the retry budget currently allows.",
+	})
+)
+
+func init() {
+	metrics.Registry.MustRegister(retryBudgetRetriesTotal, retryBudgetTokens)
+}
+
+// retryBudget is a token bucket shared by all reconcilers that limits the retries of failing workloads, so that a
+// sustained outage (e.g., of the backup registry) doesn't flood the API server and registries with retries. Workloads
+// that are not known to be failing (e.g., newly created ones) are never throttled. A nil budget never throttles.
+type retryBudget struct {
+	// perMinute is the number of retries per minute that the budget refills, it is also the capacity of the bucket.
+	perMinute float64
+
+	lock   sync.Mutex
+	tokens float64
+	last   time.Time
+	// failing stores the UIDs of workloads whose last reconciliation failed.
+	failing map[types.UID]struct{}
+}
+
+func newRetryBudget(perMinute int) *retryBudget {
+	retryBudgetTokens.Set(float64(perMinute))
+	return &retryBudget{
+		perMinute: float64(perMinute),
+		tokens:    float64(perMinute),
+		last:      time.Now(),
+		failing:   make(map[types.UID]struct{}),
+	}
+}
+
+// allow returns true if the given workload may be reconciled now. Retries of failing workloads consume a token.
+func (b *retryBudget) allow(uid types.UID) bool {
+	if b == nil {
+		return true
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if _, ok := b.failing[uid]; !ok {
+		return true
+	}
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Minutes() * b.perMinute
+	if b.tokens > b.perMinute {
+		b.tokens = b.perMinute
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		retryBudgetRetriesTotal.WithLabelValues("throttled").Inc()
+		retryBudgetTokens.Set(b.tokens)
+		return false
+	}
+	b.tokens--
+	retryBudgetRetriesTotal.WithLabelValues("allowed").Inc()
+	retryBudgetTokens.Set(b.tokens)
+	return true
+}
+
+// failed records that reconciling the given workload failed, so that its retries are subject to the budget.
+func (b *retryBudget) failed(uid types.UID) {
+	if b == nil {
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.failing[uid] = struct{}{}
+}
+
+// recovered records that the given workload was reconciled successfully. If it was failing before, the budget is
+// refilled completely, as the outage is probably over and the remaining failing workloads should recover quickly.
+func (b *retryBudget) recovered(uid types.UID) {
+	if b == nil {
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if _, ok := b.failing[uid]; !ok {
+		return
+	}
+	delete(b.failing, uid)
+	b.tokens = b.perMinute
+	retryBudgetTokens.Set(b.tokens)
+}
+
+// forget removes the given workload from the budget without refilling it, e.g., when it is deleted.
+func (b *retryBudget) forget(uid types.UID) {
+	if b == nil {
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	delete(b.failing, uid)
+}
@@ -0,0 +1,85 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"time"
+
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// rolloutRequeueInterval is the interval for checking again whether a rollout has finished if WaitForRollout is
+// enabled. Status changes don't trigger reconciliations, so we need to poll.
+const rolloutRequeueInterval = 15 * time.Second
+
+// waitForRollout checks whether patching the given workload should be delayed because a rollout is in progress.
+// Patching during a rollout starts a second rollout, which doubles the number of surge pods. Patching is delayed for
+// at most WaitForRolloutTimeout.
+func (c *ImageCloneController) waitForRollout(log logr.Logger, kind string, obj client.Object) (time.Duration, bool) {
+	if !c.WaitForRollout || !rolloutInProgress(obj) {
+		c.rolloutWaitingSince.Delete(obj.GetUID())
+		return 0, false
+	}
+
+	since, _ := c.rolloutWaitingSince.LoadOrStore(obj.GetUID(), time.Now())
+	if time.Since(since.(time.Time)) >= c.WaitForRolloutTimeout {
+		log.Info("Rollout didn't finish in time, patching anyway", "timeout", c.WaitForRolloutTimeout)
+		c.rolloutWaitingSince.Delete(obj.GetUID())
+		return 0, false
+	}
+
+	log.Info("Rollout is in progress, delaying patch", "requeueAfter", rolloutRequeueInterval)
+	delayedPatchesTotal.WithLabelValues(kind).Inc()
+	return rolloutRequeueInterval, true
+}
+
+// rolloutInProgress checks whether the given workload is currently rolling out, similar to kubectl rollout status.
+func rolloutInProgress(obj client.Object) bool {
+	switch o := obj.(type) {
+	case *appsv1.Deployment:
+		if o.Status.ObservedGeneration < o.Generation {
+			return true
+		}
+		for _, condition := range o.Status.Conditions {
+			if condition.Type == appsv1.DeploymentProgressing && condition.Status == corev1.ConditionFalse &&
+				condition.Reason == "ProgressDeadlineExceeded" {
+				// the rollout is stuck, waiting doesn't help
+				return false
+			}
+		}
+		replicas := int32(1)
+		if o.Spec.Replicas != nil {
+			replicas = *o.Spec.Replicas
+		}
+		return o.Status.UpdatedReplicas < replicas || o.Status.Replicas > o.Status.UpdatedReplicas ||
+			o.Status.AvailableReplicas < o.Status.UpdatedReplicas
+	case *appsv1.DaemonSet:
+		if o.Status.ObservedGeneration < o.Generation {
+			return true
+		}
+		if o.Spec.UpdateStrategy.Type == appsv1.OnDeleteDaemonSetStrategyType {
+			// pods are only replaced when they are deleted manually, so there is no rollout
+			return false
+		}
+		return o.Status.UpdatedNumberScheduled < o.Status.DesiredNumberScheduled ||
+			o.Status.NumberAvailable < o.Status.DesiredNumberScheduled
+	}
+	return false
+}
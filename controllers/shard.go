@@ -0,0 +1,164 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+)
+
+// ShardOf returns the shard of the workload with the given namespace and name if workloads are distributed across the
+// given number of shards.
+func ShardOf(namespace, name string, shards int) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(namespace + "/" + name))
+	return int(h.Sum32() % uint32(shards))
+}
+
+// ShardOrdinal returns the ordinal of the given StatefulSet pod name, e.g., 2 for image-clone-controller-2.
+func ShardOrdinal(podName string) (int, error) {
+	i := strings.LastIndex(podName, "-")
+	if i < 0 {
+		return 0, fmt.Errorf("pod name %q doesn't end with a StatefulSet ordinal", podName)
+	}
+	ordinal, err := strconv.Atoi(podName[i+1:])
+	if err != nil || ordinal < 0 {
+		return 0, fmt.Errorf("pod name %q doesn't end with a StatefulSet ordinal", podName)
+	}
+	return ordinal, nil
+}
+
+// ValidateShard verifies that the given shard index is valid for the given number of shards.
+func ValidateShard(index, count int) error {
+	if count < 1 {
+		return fmt.Errorf("shard count must be at least 1, got %d", count)
+	}
+	if index < 0 || index >= count {
+		return fmt.Errorf("shard index must be between 0 and %d, got %d", count-1, index)
+	}
+	return nil
+}
+
+// sharded returns true if workloads are distributed across multiple replicas.
+func (c *Config) sharded() bool {
+	return c.ShardCount > 1
+}
+
+// ownsWorkload checks whether the given workload belongs to this replica's shard.
+func (c *ImageCloneController) ownsWorkload(obj client.Object) bool {
+	return !c.sharded() || ShardOf(obj.GetNamespace(), obj.GetName(), c.ShardCount) == c.ShardIndex
+}
+
+// workloadFilter returns the predicate for all watches of workloads. It filters workloads in ignored namespaces and
+// workloads of other shards, so that they never enter the queue.
+func (c *ImageCloneController) workloadFilter() predicate.Predicate {
+	return predicate.And(c.namespacePredicate(), predicate.NewPredicateFuncs(c.ownsWorkload))
+}
+
+// shardConfigMapName returns the name of a ConfigMap holding per-replica state, e.g., the pending journal. Each shard
+// uses its own ConfigMap, so that replicas don't overwrite each other's state.
+func (c *Config) shardConfigMapName(name string) string {
+	if !c.sharded() {
+		return name
+	}
+	return fmt.Sprintf("%s-shard-%d", name, c.ShardIndex)
+}
+
+// workloadManager returns the manager for the controllers and the runnables that track individual workloads. If
+// workloads are sharded, they run on every replica, as each replica reconciles its own shard. Leader election is only
+// used for the remaining singleton tasks, e.g., the coverage reporter.
+func (c *ImageCloneController) workloadManager(mgr manager.Manager) manager.Manager {
+	if !c.sharded() {
+		return mgr
+	}
+	return everyReplicaManager{Manager: mgr}
+}
+
+// everyReplicaManager adds all runnables so that they run regardless of leader election.
+type everyReplicaManager struct {
+	manager.Manager
+}
+
+func (m everyReplicaManager) Add(r manager.Runnable) error {
+	return m.Manager.Add(everyReplicaRunnable{Runnable: r})
+}
+
+// everyReplicaRunnable is a runnable that doesn't need leader election.
+type everyReplicaRunnable struct {
+	manager.Runnable
+}
+
+func (everyReplicaRunnable) NeedLeaderElection() bool {
+	return false
+}
+
+// shardWorkloadsCollector exposes the number of workloads per kind that belong to this replica's shard.
+type shardWorkloadsCollector struct {
+	reader     client.Reader
+	controller *ImageCloneController
+	kinds      map[string]client.ObjectList
+	desc       *prometheus.Desc
+}
+
+func newShardWorkloadsCollector(reader client.Reader, controller *ImageCloneController, kinds map[string]client.ObjectList) *shardWorkloadsCollector {
+	return &shardWorkloadsCollector{
+		reader:     reader,
+		controller: controller,
+		kinds:      kinds,
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "", "shard_workloads"),
+			"Number of workloads that belong to the shard of this replica.",
+			[]string{"shard", "kind"}, nil,
+		),
+	}
+}
+
+func (s *shardWorkloadsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- s.desc
+}
+
+func (s *shardWorkloadsCollector) Collect(ch chan<- prometheus.Metric) {
+	// lists are served from the cache, so this is cheap
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	shard := strconv.Itoa(s.controller.ShardIndex)
+	for kind, list := range s.kinds {
+		list = list.DeepCopyObject().(client.ObjectList)
+		if err := s.reader.List(ctx, list); err != nil {
+			ch <- prometheus.NewInvalidMetric(s.desc, err)
+			return
+		}
+
+		count := 0
+		for _, obj := range workloads(list) {
+			if !s.controller.ignoredNamespaces.Has(obj.GetNamespace()) && s.controller.ownsWorkload(obj) {
+				count++
+			}
+		}
+		ch <- prometheus.MustNewConstMetric(s.desc, prometheus.GaugeValue, float64(count), shard, kind)
+	}
+}
@@ -0,0 +1,29 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// AllowLargeImagesAnnotation can be set to "true" on workloads to copy their images regardless of the maximum image
+// size.
+const AllowLargeImagesAnnotation = "image-clone.timebertt.dev/allow-large"
+
+func allowsLargeImages(obj client.Object) bool {
+	return obj.GetAnnotations()[AllowLargeImagesAnnotation] == "true"
+}
@@ -0,0 +1,91 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// SkipReason describes why a container image is deliberately not copied to the backup registry. It distinguishes
+// images that are already protected from images that are intentionally left unprotected.
+type SkipReason string
+
+const (
+	// SkipReasonAlreadyBackup is used for images that already reference the backup registry.
+	SkipReasonAlreadyBackup SkipReason = "already-backup"
+	// SkipReasonExcludedPattern is used for images whose repository matches an exclude pattern.
+	SkipReasonExcludedPattern SkipReason = "excluded-pattern"
+	// SkipReasonExcludedRegistry is used for images whose registry host matches an exclude pattern, e.g., provider
+	// images.
+	SkipReasonExcludedRegistry SkipReason = "excluded-registry"
+	// SkipReasonMirrorProhibited is used for images whose repository must not be mirrored, e.g., for license
+	// compliance.
+	SkipReasonMirrorProhibited SkipReason = "mirror-prohibited"
+	// SkipReasonDeniedDigest is used for images with a denylisted digest.
+	SkipReasonDeniedDigest SkipReason = "denied-digest"
+	// SkipReasonTooLarge is used for images that exceed the maximum image size.
+	SkipReasonTooLarge SkipReason = "too-large"
+	// SkipReasonIncompletePlatforms is used for images that don't provide all required platforms.
+	SkipReasonIncompletePlatforms SkipReason = "incomplete-platforms"
+	// SkipReasonOfflineMissing is used for images that don't exist in the backup registry in offline mode.
+	SkipReasonOfflineMissing SkipReason = "offline-missing"
+	// SkipReasonPendingApproval is used for images that have not been pre-approved in the backup registry with
+	// RewriteOnlyPreapproved.
+	SkipReasonPendingApproval SkipReason = "pending-approval"
+	// SkipReasonDigestDivergence is used for images whose destination tag serves a different digest than the source
+	// image with StrictDigestConsistency.
+	SkipReasonDigestDivergence SkipReason = "digest-divergence"
+	// SkipReasonGitOpsSkip is used for images that are owned by a respected field manager, e.g., a GitOps controller.
+	SkipReasonGitOpsSkip SkipReason = "gitops-skip"
+)
+
+// SkipReasons contains all known skip reasons.
+var SkipReasons = []SkipReason{
+	SkipReasonAlreadyBackup,
+	SkipReasonExcludedPattern,
+	SkipReasonExcludedRegistry,
+	SkipReasonMirrorProhibited,
+	SkipReasonDeniedDigest,
+	SkipReasonTooLarge,
+	SkipReasonIncompletePlatforms,
+	SkipReasonOfflineMissing,
+	SkipReasonPendingApproval,
+	SkipReasonDigestDivergence,
+	SkipReasonGitOpsSkip,
+}
+
+var skippedImagesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "skipped_images_total",
+	Help:      "Total number of container images that were not copied to the backup registry per skip reason.",
+}, []string{"reason"})
+
+func init() {
+	metrics.Registry.MustRegister(skippedImagesTotal)
+	// initialize all reasons, so that rates can be calculated from the first skip on
+	for _, reason := range SkipReasons {
+		skippedImagesTotal.WithLabelValues(string(reason))
+	}
+}
+
+// recordSkip records that an image was skipped for the given reason. It returns a logger that includes the reason.
+func recordSkip(log logr.Logger, reason SkipReason) logr.Logger {
+	skippedImagesTotal.WithLabelValues(string(reason)).Inc()
+	return log.WithValues("skipReason", reason)
+}
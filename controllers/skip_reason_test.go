@@ -0,0 +1,145 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/timebertt/image-clone-controller/pkg/copier"
+	"github.com/timebertt/image-clone-controller/pkg/test"
+)
+
+func TestSkipReasons(t *testing.T) {
+	upstream := newTestRegistry(t)
+	if _, err := upstream.SeedImage("upstream/app:v1", 1); err != nil {
+		t.Fatal(err)
+	}
+	source := upstream.Registry.RegistryStr() + "/upstream/app:v1"
+
+	// writeFile writes the given content to a temporary file and returns its path
+	writeFile := func(t *testing.T, content string) string {
+		file := filepath.Join(t.TempDir(), "list")
+		if err := os.WriteFile(file, []byte(content+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+
+	tests := []struct {
+		reason SkipReason
+		// setup configures the controller and the workload, so that the workload's image is skipped for reason
+		setup func(t *testing.T, c *ImageCloneController, deployment *appsv1.Deployment, backup *test.Registry)
+	}{
+		{SkipReasonAlreadyBackup, func(t *testing.T, c *ImageCloneController, deployment *appsv1.Deployment, backup *test.Registry) {
+			deployment.Spec.Template.Spec.Containers[0].Image = backup.Registry.RegistryStr() + "/ghcr_io/upstream/app:v1"
+		}},
+		{SkipReasonExcludedPattern, func(t *testing.T, c *ImageCloneController, deployment *appsv1.Deployment, backup *test.Registry) {
+			c.ExcludeImages = []string{upstream.Registry.RegistryStr() + "/upstream"}
+		}},
+		{SkipReasonExcludedRegistry, func(t *testing.T, c *ImageCloneController, deployment *appsv1.Deployment, backup *test.Registry) {
+			c.ExcludeImages = []string{upstream.Registry.RegistryStr()}
+		}},
+		{SkipReasonMirrorProhibited, func(t *testing.T, c *ImageCloneController, deployment *appsv1.Deployment, backup *test.Registry) {
+			c.MirrorProhibitedFile = writeFile(t, upstream.Registry.RegistryStr()+"/upstream/app")
+		}},
+		{SkipReasonDeniedDigest, func(t *testing.T, c *ImageCloneController, deployment *appsv1.Deployment, backup *test.Registry) {
+			digest, err := test.Digest(source)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.Copier = &copier.Copier{Options: copier.Options{DenylistedDigestsFile: writeFile(t, digest.String())}}
+		}},
+		{SkipReasonTooLarge, func(t *testing.T, c *ImageCloneController, deployment *appsv1.Deployment, backup *test.Registry) {
+			c.Copier = &copier.Copier{Options: copier.Options{MaxImageSize: 1}}
+		}},
+		{SkipReasonIncompletePlatforms, func(t *testing.T, c *ImageCloneController, deployment *appsv1.Deployment, backup *test.Registry) {
+			// random images don't specify a platform
+			c.RequiredPlatforms = []v1.Platform{{OS: "linux", Architecture: "arm64"}}
+			c.EnforcePlatforms = true
+		}},
+		{SkipReasonOfflineMissing, func(t *testing.T, c *ImageCloneController, deployment *appsv1.Deployment, backup *test.Registry) {
+			c.Offline = true
+		}},
+		{SkipReasonPendingApproval, func(t *testing.T, c *ImageCloneController, deployment *appsv1.Deployment, backup *test.Registry) {
+			c.RewriteOnlyPreapproved = true
+		}},
+		{SkipReasonDigestDivergence, func(t *testing.T, c *ImageCloneController, deployment *appsv1.Deployment, backup *test.Registry) {
+			c.StrictDigestConsistency = true
+			// the destination tag is overwritten right after copying
+			overwritten, err := random.Image(1024, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.Copier = &copier.Copier{Transport: &overwritingTransport{RoundTripper: http.DefaultTransport, registry: backup.Registry, image: overwritten}}
+		}},
+		{SkipReasonGitOpsSkip, func(t *testing.T, c *ImageCloneController, deployment *appsv1.Deployment, backup *test.Registry) {
+			c.RespectFieldManagers = []string{"argocd-controller"}
+			deployment.ManagedFields = []metav1.ManagedFieldsEntry{
+				managedFieldsEntry("argocd-controller", metav1.ManagedFieldsOperationUpdate, "container-0", time.Now()),
+			}
+		}},
+	}
+
+	if len(tests) != len(SkipReasons) {
+		t.Fatalf("tests cover %d skip reasons, want all %d", len(tests), len(SkipReasons))
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.reason), func(t *testing.T) {
+			// copies of other tests must not exist in the backup registry
+			backup := newTestRegistry(t)
+			deployment := test.NewDeployment("default", "app", source)
+			c := newTestController(t, deployment)
+			c.BackupRegistry = backup.Registry
+			tt.setup(t, c, deployment, backup)
+			image := deployment.Spec.Template.Spec.Containers[0].Image
+
+			before := make(map[SkipReason]float64, len(SkipReasons))
+			for _, reason := range SkipReasons {
+				before[reason] = testutil.ToFloat64(skippedImagesTotal.WithLabelValues(string(reason)))
+			}
+
+			// some skips are reported as errors, e.g., in offline mode, the image is not rewritten in any case
+			_, _ = c.reconcilePodTemplate(context.Background(), logr.Discard(), deployment, &deployment.Spec.Template, backup.Registry, "")
+			if got := deployment.Spec.Template.Spec.Containers[0].Image; got != image {
+				t.Errorf("skipped image was rewritten to %s", got)
+			}
+
+			for _, reason := range SkipReasons {
+				want := before[reason]
+				if reason == tt.reason {
+					want++
+				}
+				if got := testutil.ToFloat64(skippedImagesTotal.WithLabelValues(string(reason))); got != want {
+					t.Errorf("skipped images with reason %s = %v, want %v", reason, got, want)
+				}
+			}
+		})
+	}
+}
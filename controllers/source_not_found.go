@@ -0,0 +1,59 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/timebertt/image-clone-controller/pkg/copier"
+)
+
+// sourceNotFoundRequeue checks whether the given error was caused by a missing source image and whether obj was
+// updated within the configured grace period. If so, it returns the duration after which the object should be retried.
+func (c *ImageCloneController) sourceNotFoundRequeue(obj client.Object, err error) (time.Duration, bool) {
+	if c.SourceNotFoundGracePeriod <= 0 || !copier.IsSourceNotFound(err) {
+		return 0, false
+	}
+
+	if time.Since(lastUpdateTime(obj)) > c.SourceNotFoundGracePeriod {
+		return 0, false
+	}
+
+	return wait.Jitter(c.SourceNotFoundRetryInterval, 0.5), true
+}
+
+// lastUpdateTime returns the time of the last update to the given object's spec or metadata based on its managed
+// fields. Updates to the status subresource are ignored, as they are frequently performed by other controllers.
+// The controller's own updates (e.g. the LastErrorAnnotation) are ignored as well, so that they don't restart the grace
+// period. If the object doesn't have any managed fields, its creation time is returned.
+func lastUpdateTime(obj client.Object) time.Time {
+	lastUpdate := obj.GetCreationTimestamp().Time
+
+	for _, entry := range obj.GetManagedFields() {
+		if entry.Subresource != "" || entry.Time == nil || entry.Manager == string(fieldOwner) {
+			continue
+		}
+		if entry.Time.After(lastUpdate) {
+			lastUpdate = entry.Time.Time
+		}
+	}
+
+	return lastUpdate
+}
@@ -0,0 +1,70 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/timebertt/image-clone-controller/pkg/copier"
+	"github.com/timebertt/image-clone-controller/pkg/test"
+)
+
+func TestSourceNotFoundRequeue(t *testing.T) {
+	now := time.Now()
+	err := &copier.SourceNotFoundError{Source: "registry.example.com/app:v2"}
+
+	for _, tc := range []struct {
+		name    string
+		entries []metav1.ManagedFieldsEntry
+		requeue bool
+	}{
+		{
+			name:    "recent user update",
+			entries: []metav1.ManagedFieldsEntry{managedFieldsEntry("kubectl", metav1.ManagedFieldsOperationUpdate, "container-0", now.Add(-time.Minute))},
+			requeue: true,
+		},
+		{
+			name:    "old user update",
+			entries: []metav1.ManagedFieldsEntry{managedFieldsEntry("kubectl", metav1.ManagedFieldsOperationUpdate, "container-0", now.Add(-time.Hour))},
+		},
+		{
+			name: "recent controller update",
+			entries: []metav1.ManagedFieldsEntry{
+				managedFieldsEntry("kubectl", metav1.ManagedFieldsOperationUpdate, "container-0", now.Add(-time.Hour)),
+				managedFieldsEntry(string(fieldOwner), metav1.ManagedFieldsOperationUpdate, "container-0", now.Add(-time.Minute)),
+				managedFieldsEntry(string(fieldOwner), metav1.ManagedFieldsOperationApply, "container-0", now.Add(-time.Minute)),
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newTestController(t)
+			c.SourceNotFoundGracePeriod = 10 * time.Minute
+			c.SourceNotFoundRetryInterval = time.Minute
+
+			deployment := test.NewDeployment("default", "app", "registry.example.com/app:v2")
+			deployment.CreationTimestamp = metav1.NewTime(now.Add(-2 * time.Hour))
+			deployment.ManagedFields = tc.entries
+
+			if _, requeue := c.sourceNotFoundRequeue(deployment, err); requeue != tc.requeue {
+				t.Errorf("requeue = %t, want %t", requeue, tc.requeue)
+			}
+		})
+	}
+}
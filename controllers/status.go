@@ -0,0 +1,284 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/yaml"
+
+	"github.com/timebertt/image-clone-controller/pkg/copier"
+)
+
+const (
+	// statusKey is the key in the status ConfigMap that contains the activity summary.
+	statusKey = "status.yaml"
+	// statusWindowMinutes is the number of minutes that image counts are summarized for.
+	statusWindowMinutes = 60
+	// maxStatusFailures is the number of failed copies that are kept for the status summary.
+	maxStatusFailures = 10
+	// statusHealthTimeout is the timeout for checking the backup registry's health before writing the summary.
+	statusHealthTimeout = 10 * time.Second
+)
+
+type imageResult int
+
+const (
+	imageCopied imageResult = iota
+	imageSkipped
+	imageFailed
+)
+
+// StatusSummary is the summary of recent activity written to the status ConfigMap.
+type StatusSummary struct {
+	// WorkloadsProcessed is the number of workload reconciliations since the controller started.
+	WorkloadsProcessed int64                `json:"workloadsProcessed"`
+	LastHour           StatusImageCounts    `json:"lastHour"`
+	RecentFailures     []StatusFailure      `json:"recentFailures"`
+	BackupRegistry     StatusRegistryHealth `json:"backupRegistry"`
+}
+
+// StatusImageCounts counts the images that have been handled by the controller.
+type StatusImageCounts struct {
+	Copied int `json:"copied"`
+	// Skipped counts images that have not been copied, e.g., because they already existed in the backup registry, are
+	// excluded, too large or denylisted.
+	Skipped int `json:"skipped"`
+	Failed  int `json:"failed"`
+}
+
+// StatusFailure describes a failed copy.
+type StatusFailure struct {
+	Time      time.Time `json:"time"`
+	Workload  string    `json:"workload"`
+	Container string    `json:"container"`
+	Image     string    `json:"image"`
+	Reason    string    `json:"reason"`
+}
+
+// StatusRegistryHealth describes the result of the last health check of the backup registry.
+type StatusRegistryHealth struct {
+	Name    string `json:"name"`
+	Healthy bool   `json:"healthy"`
+	Error   string `json:"error,omitempty"`
+}
+
+// statusBucket counts the images handled in a single minute.
+type statusBucket struct {
+	minute int64
+	counts StatusImageCounts
+}
+
+// statusReporter summarizes the recent activity of the controller in a ConfigMap for clusters without a monitoring
+// stack. The ConfigMap is written at most once per interval and only if the summary changed.
+type statusReporter struct {
+	client client.Client
+	// reader is used for reading the ConfigMap, so that we don't start an informer for all ConfigMaps.
+	reader   client.Reader
+	key      client.ObjectKey
+	interval time.Duration
+	registry name.Registry
+	// checker checks the health of the registry with the copier's credentials and transport
+	checker *copier.Copier
+
+	lock               sync.Mutex
+	workloadsProcessed int64
+	buckets            [statusWindowMinutes]statusBucket
+	failures           []StatusFailure
+	// lastWritten is the last summary that was persisted successfully
+	lastWritten string
+}
+
+func newStatusReporter(c client.Client, reader client.Reader, key client.ObjectKey, interval time.Duration, registry name.Registry, checker *copier.Copier) *statusReporter {
+	return &statusReporter{
+		client:   c,
+		reader:   reader,
+		key:      key,
+		interval: interval,
+		registry: registry,
+		checker:  checker,
+	}
+}
+
+// workloadProcessed counts a workload reconciliation. It is a no-op if the status ConfigMap is disabled.
+func (s *statusReporter) workloadProcessed() {
+	if s == nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.workloadsProcessed++
+}
+
+// recordImage counts an image handled by the controller. It is a no-op if the status ConfigMap is disabled.
+func (s *statusReporter) recordImage(result imageResult) {
+	if s == nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	minute := time.Now().Unix() / 60
+	bucket := &s.buckets[minute%statusWindowMinutes]
+	if bucket.minute != minute {
+		*bucket = statusBucket{minute: minute}
+	}
+
+	switch result {
+	case imageCopied:
+		bucket.counts.Copied++
+	case imageSkipped:
+		bucket.counts.Skipped++
+	case imageFailed:
+		bucket.counts.Failed++
+	}
+}
+
+// recordFailure counts a failed copy and keeps it for the summary. It is a no-op if the status ConfigMap is disabled.
+func (s *statusReporter) recordFailure(obj client.Object, container, image string, err error) {
+	if s == nil {
+		return
+	}
+	s.recordImage(imageFailed)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.failures = append(s.failures, StatusFailure{
+		Time:      time.Now().UTC().Truncate(time.Second),
+		Workload:  client.ObjectKeyFromObject(obj).String(),
+		Container: container,
+		Image:     image,
+		Reason:    err.Error(),
+	})
+	if len(s.failures) > maxStatusFailures {
+		s.failures = s.failures[len(s.failures)-maxStatusFailures:]
+	}
+}
+
+// Start implements manager.Runnable. It writes the summary periodically.
+func (s *statusReporter) Start(ctx context.Context) error {
+	log := logf.FromContext(ctx).WithValues("configMap", s.key)
+
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		if err := s.write(ctx); err != nil {
+			log.Error(err, "Failed writing status summary")
+		}
+	}, s.interval)
+	return nil
+}
+
+// summary returns the current summary including the given backup registry health.
+func (s *statusReporter) summary(health StatusRegistryHealth) StatusSummary {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	summary := StatusSummary{
+		WorkloadsProcessed: s.workloadsProcessed,
+		RecentFailures:     make([]StatusFailure, 0, len(s.failures)),
+		BackupRegistry:     health,
+	}
+
+	minute := time.Now().Unix() / 60
+	for _, bucket := range s.buckets {
+		if bucket.minute > minute-statusWindowMinutes {
+			summary.LastHour.Copied += bucket.counts.Copied
+			summary.LastHour.Skipped += bucket.counts.Skipped
+			summary.LastHour.Failed += bucket.counts.Failed
+		}
+	}
+
+	// most recent failures first
+	for i := len(s.failures) - 1; i >= 0; i-- {
+		summary.RecentFailures = append(summary.RecentFailures, s.failures[i])
+	}
+	return summary
+}
+
+func (s *statusReporter) checkHealth(ctx context.Context) StatusRegistryHealth {
+	ctx, cancel := context.WithTimeout(ctx, statusHealthTimeout)
+	defer cancel()
+
+	health := StatusRegistryHealth{Name: s.registry.Name(), Healthy: true}
+	if err := s.checker.CheckRegistry(ctx, logf.FromContext(ctx), s.registry, false); err != nil {
+		health.Healthy = false
+		health.Error = err.Error()
+	}
+	return health
+}
+
+func (s *statusReporter) write(ctx context.Context) error {
+	data, err := yaml.Marshal(s.summary(s.checkHealth(ctx)))
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	unchanged := s.lastWritten == string(data)
+	s.lock.Unlock()
+	if unchanged {
+		return nil
+	}
+
+	// retry with the latest version if the ConfigMap was changed or created concurrently
+	if err := retry.OnError(retry.DefaultRetry, func(err error) bool {
+		return apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err)
+	}, func() error {
+		return s.persist(ctx, string(data))
+	}); err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	s.lastWritten = string(data)
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *statusReporter) persist(ctx context.Context, data string) error {
+	configMap := &corev1.ConfigMap{}
+	if err := s.reader.Get(ctx, s.key, configMap); err != nil {
+		if !apierrors.IsNotFound(err) {
+			return err
+		}
+
+		configMap.Namespace = s.key.Namespace
+		configMap.Name = s.key.Name
+		configMap.Data = map[string]string{statusKey: data}
+		return s.client.Create(ctx, configMap)
+	}
+
+	if configMap.Data[statusKey] == data {
+		return nil
+	}
+	if configMap.Data == nil {
+		configMap.Data = make(map[string]string, 1)
+	}
+	configMap.Data[statusKey] = data
+	return s.client.Update(ctx, configMap)
+}
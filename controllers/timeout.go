@@ -0,0 +1,46 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"time"
+)
+
+// maxPatchBudget is the maximum duration that is reserved for patching partial progress before ReconcileTimeout.
+const maxPatchBudget = 30 * time.Second
+
+// withReconcileTimeout applies ReconcileTimeout to the given context. It returns the context for the whole
+// reconciliation and a context for copying images, which expires a bit earlier to leave time for patching the images
+// that have been copied so far.
+func (c *ImageCloneController) withReconcileTimeout(ctx context.Context) (reconcileCtx, copyCtx context.Context, cancel context.CancelFunc) {
+	if c.ReconcileTimeout <= 0 {
+		return ctx, ctx, func() {}
+	}
+
+	budget := c.ReconcileTimeout / 10
+	if budget > maxPatchBudget {
+		budget = maxPatchBudget
+	}
+
+	reconcileCtx, cancelReconcile := context.WithTimeout(ctx, c.ReconcileTimeout)
+	copyCtx, cancelCopy := context.WithTimeout(reconcileCtx, c.ReconcileTimeout-budget)
+	return reconcileCtx, copyCtx, func() {
+		cancelCopy()
+		cancelReconcile()
+	}
+}
@@ -0,0 +1,98 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+)
+
+var droppedWorkloadUpdatesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "dropped_workload_updates_total",
+	Help:      "Total number of workload spec updates that were not reconciled because their images were unchanged and already backed up.",
+}, []string{"kind"})
+
+func init() {
+	metrics.Registry.MustRegister(droppedWorkloadUpdatesTotal)
+}
+
+// specChangedPredicate lets through workload updates that change the spec like predicate.GenerationChangedPredicate.
+// With DropImageUnchangedUpdates, it drops updates that don't change any container image or pull policy if all images
+// were patched by the controller and reference the default backup registry, e.g., updates of env vars or resources.
+// Creations and updates without the old object always pass. Drift of dropped workloads, e.g., deleted backup images, is
+// only corrected by full resyncs, which bypass this predicate.
+func (c *ImageCloneController) specChangedPredicate() predicate.Predicate {
+	// the API server increments metadata.generation when setting the deletionTimestamp on objects with finalizers, so
+	// the GenerationChangedPredicate also lets through deletion events that need cleanup
+	generationChanged := predicate.GenerationChangedPredicate{}
+	if !c.DropImageUnchangedUpdates {
+		return generationChanged
+	}
+
+	return predicate.Funcs{
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			if !generationChanged.Update(e) {
+				return false
+			}
+			if c.imagesBackedUpAndUnchanged(e) {
+				droppedWorkloadUpdatesTotal.WithLabelValues(kindOf(e.ObjectNew)).Inc()
+				return false
+			}
+			return true
+		},
+	}
+}
+
+// imagesBackedUpAndUnchanged checks whether the given update doesn't change the images of the workload and all of them
+// already reference the default backup registry. Workloads using another backup registry, e.g., via
+// BackupRegistryAnnotation, are always reconciled.
+func (c *ImageCloneController) imagesBackedUpAndUnchanged(e event.UpdateEvent) bool {
+	if e.ObjectOld == nil || e.ObjectNew == nil {
+		return false
+	}
+	oldTemplate, newTemplate := podTemplateOf(e.ObjectOld), podTemplateOf(e.ObjectNew)
+	if oldTemplate == nil || newTemplate == nil {
+		return false
+	}
+
+	oldImages, newImages := c.containerImages(oldTemplate), c.containerImages(newTemplate)
+	if len(oldImages) != len(newImages) {
+		return false
+	}
+	for i := range newImages {
+		if oldImages[i] != newImages[i] {
+			return false
+		}
+	}
+
+	// the hash verifies that the controller patched the images last, e.g., that no image was skipped
+	if e.ObjectNew.GetAnnotations()[ImagesHashAnnotation] != c.imagesHash(newTemplate) {
+		return false
+	}
+	prefix := c.BackupRegistry.RegistryStr() + "/"
+	for _, container := range newImages {
+		if !strings.HasPrefix(container.Image, prefix) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,122 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/go-logr/logr"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/timebertt/image-clone-controller/pkg/copier"
+	"github.com/timebertt/image-clone-controller/pkg/naming"
+)
+
+// copyFunc copies the given source image to the given destination, see copier.Copier.Copy and CopyAsync.
+type copyFunc func(ctx context.Context, log logr.Logger, src name.Reference, dst name.Tag) (bool, error)
+
+// validateBackupReference verifies that an image which is already referencing the backup registry exists, e.g., to
+// detect workloads that were manually edited to point to the backup registry.
+// If HealBackupReferences is enabled and the repository name was produced by naming.Destination, a missing image is
+// copied from its original source. Existing images are never overwritten, but reported if their digest is denylisted.
+func (c *ImageCloneController) validateBackupReference(ctx context.Context, log logr.Logger, obj client.Object, container string, img name.Reference, backupRegistry name.Registry, prefix string, copyImage copyFunc) error {
+	digest, exists, err := c.Copier.Exists(copier.WithOperation(ctx, copier.OperationVerify), img)
+	if err != nil {
+		// don't block reconciliation if the backup registry is temporarily unavailable
+		log.Error(err, "Failed checking if image exists in the backup registry")
+		return nil
+	}
+	if exists {
+		c.reportDenied(log, obj, container, img, digest)
+		return nil
+	}
+
+	healable := false
+	var originalImg name.Reference
+	// images that are pinned to a digest are healed by copying exactly this digest to their tag
+	dstTag, pinned := pinnedTag(img)
+	if !pinned {
+		dstTag, _ = img.(name.Tag)
+	}
+	// in offline mode, we can't copy missing images from their source
+	if c.HealBackupReferences && c.contactsSourceRegistries() && (naming.LooksLikeBackupImage(img, prefix) || c.RepositoryMappings.IsDestination(img)) {
+		if originalImg, err = c.originalImage(img, prefix, sourceDigestsOf(obj)); err == nil {
+			// only heal images whose name matches exactly what we would have produced from the original image
+			dstImg, err := c.destinationImage(originalImg, backupRegistry, prefix)
+			healable = err == nil && dstTag != (name.Tag{}) && dstImg.Name() == dstTag.Name()
+		}
+	}
+
+	missingBackupImagesTotal.WithLabelValues(strconv.FormatBool(healable)).Inc()
+	if !healable {
+		c.event(obj, corev1.EventTypeWarning, ReasonBackupImageMissing, "Image references the backup registry but doesn't exist",
+			eventKeyContainer, container, eventKeyImage, img.Name())
+		return nil
+	}
+
+	log = log.WithValues("original", originalImg.Name())
+	log.Info("Image is missing in the backup registry, copying it from its original source")
+	// nobody is waiting for healing images, don't delay copies of new workloads
+	ctx = copier.WithPriority(ctx, copier.PriorityBackground)
+	if pinned {
+		pinnedDigest, err := v1.NewHash(img.Identifier())
+		if err != nil {
+			return err
+		}
+		ctx = copier.WithSourceDigest(ctx, pinnedDigest)
+	}
+	if _, err := copyImage(ctx, log, originalImg, dstTag); err != nil {
+		return fmt.Errorf("error healing missing image %q from %q: %w", img.Name(), originalImg.Name(), err)
+	}
+
+	c.event(obj, corev1.EventTypeNormal, ReasonHealedBackupImage, "Copied missing image from its original source",
+		eventKeyContainer, container, eventKeySource, originalImg.Name(), eventKeyDestination, img.Name())
+	return nil
+}
+
+// checkDeniedBackupReference reports images already referencing the backup registry that have a denylisted digest, e.g.,
+// if the digest was added to the denylist after the image was copied.
+func (c *ImageCloneController) checkDeniedBackupReference(ctx context.Context, log logr.Logger, obj client.Object, container string, img name.Reference) {
+	digest, exists, err := c.Copier.Exists(copier.WithOperation(ctx, copier.OperationVerify), img)
+	if err != nil {
+		log.Error(err, "Failed resolving digest of image in the backup registry")
+		return
+	}
+	if exists {
+		c.reportDenied(log, obj, container, img, digest)
+	}
+}
+
+func (c *ImageCloneController) reportDenied(log logr.Logger, obj client.Object, container string, img name.Reference, digest v1.Hash) {
+	denied, err := c.Copier.Denied(digest)
+	if err != nil {
+		log.Error(err, "Failed checking if image is denylisted")
+		return
+	}
+	if !denied {
+		return
+	}
+
+	deniedImagesTotal.WithLabelValues("true").Inc()
+	c.event(obj, corev1.EventTypeWarning, ReasonDeniedImage, "Image has a denylisted digest",
+		eventKeyContainer, container, eventKeyImage, img.Name(), "digest", digest.String())
+}
@@ -14,11 +14,18 @@ See the License for the specific language governing permissions and
 limitations under the License.
 */
 
+//go:generate bin/controller-gen rbac:roleName=controller paths=./...
+
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
+	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/google/go-containerregistry/pkg/name"
 	"go.uber.org/zap/zapcore"
@@ -27,14 +34,22 @@ import (
 	// to ensure that exec-entrypoint and run can make use of them.
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
 	"github.com/timebertt/image-clone-controller/controllers"
+	"github.com/timebertt/image-clone-controller/pkg/copier"
+	"github.com/timebertt/image-clone-controller/pkg/naming"
+	"github.com/timebertt/image-clone-controller/pkg/notify"
 	//+kubebuilder:scaffold:imports
 )
 
@@ -54,12 +69,365 @@ func main() {
 	var enableLeaderElection bool
 	var probeAddr string
 	var backupRegistry string
+	var enableDeployments bool
+	var enableDaemonSets bool
+	var cleanupOnDelete bool
+	var skipStartupChecks bool
+	var allowPublicBackup bool
+	var startupCheckPush bool
+	var copyProgressInterval time.Duration
+	var copyProgressBytes string
+	var copyStallTimeout time.Duration
+	var storageFullProbeInterval time.Duration
+	var registryHostRewrites stringSliceFlag
+	var sourceNotFoundGracePeriod time.Duration
+	var sourceNotFoundRetryInterval time.Duration
+	var previousBackupRegistries stringSliceFlag
+	var repositoryMappings stringSliceFlag
+	var requirePlatforms stringSliceFlag
+	var enforcePlatforms bool
+	var annotatedEvents bool
+	var namespaceSummaryEvents bool
+	var watchNamespaces stringSliceFlag
+	var namespacedRBAC bool
+	var enableDebugEndpoint bool
+	var debugEndpointToken string
+	var asyncCopies bool
+	var copyPendingRequeueInterval time.Duration
+	var validateBackupReferences bool
+	var healBackupReferences bool
+	var reconcileTimeout time.Duration
+	var failureAnnotation bool
+	var failureAnnotationThreshold time.Duration
+	var registryClientCerts stringSliceFlag
+	var rewriteEphemeralContainers bool
+	var notifyURL string
+	var sourceCredentials stringSliceFlag
+	var patchStrategy string
+	var digestTagStyle string
+	var replicatePullSecret string
+	var replicatePullSecretCascadeDelete bool
+	var copyReferrers bool
+	var copyParentIndex bool
+	var userAgentPrefix string
+	var maxImageSize string
+	var maxCopyBytesPerHour string
+	var reservedInteractiveCopyBytesPerHour string
+	var denylistedDigestsFile string
+	var mirrorProhibitedFile string
+	var configFile string
+	var rewriteLoopThreshold int
+	var setPullPolicy stringSliceFlag
+	var excludeImages stringSliceFlag
+	var skipProviderImages bool
+	var respectFieldManagers stringSliceFlag
+	var registryConcurrency stringSliceFlag
+	var registryCheckConcurrency stringSliceFlag
+	var coverageInterval time.Duration
+	var copyHistoryConfigMap string
+	var pendingJournalConfigMap string
+	var statusConfigMap string
+	var statusUpdateInterval time.Duration
+	var offline bool
+	var resyncSpread time.Duration
+	var cacheResyncPeriod time.Duration
+	var waitForRollout bool
+	var preserveShortNames bool
+	var waitForRolloutTimeout time.Duration
+	var patchWindows stringArrayFlag
+	var busyMarkers stringArrayFlag
+	var busyMarkerMaxDelay time.Duration
+	var requirePullAccess bool
+	var nodePullCredentials bool
+	var offlineRequeueInterval time.Duration
+	var rewriteOnlyPreapproved bool
+	var retryBudget int
+	var retryBudgetRequeueInterval time.Duration
+	var preapprovalVerifyDigests bool
+	var strictDigestConsistency bool
+	var shardCount int
+	var maxPatchesPerMinute int
+	var maxPatchesPerMinutePerNamespace int
+	var dropImageUnchangedUpdates bool
+	var shardIndex int
+	var preapprovalRequeueInterval time.Duration
+	var forceBlobDownloadsViaRegistry bool
+	var blobRedirectRequeueInterval time.Duration
+	var coverageNamespaceLimit int
+	var readyWithoutSync bool
+	var dedupe bool
+	var dedupeDryRun bool
+	var dedupeDelete bool
+	var dedupeChunkSize int64
+	var exportMapping string
+	var initialSyncThreshold int
+	var rewriteLoopWindow time.Duration
+	var rewriteDecisionTTL time.Duration
+	var forceSyncRetention time.Duration
+	var maxConcurrentCopies int
+	var mirrorAnnotatedArtifacts stringSliceFlag
+	var reservedInteractiveCopies int
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
 	flag.StringVar(&backupRegistry, "backup-registry", "localhost:5001", "The registry to copy images to.")
+	flag.BoolVar(&allowPublicBackup, "allow-public-backup", false,
+		"Allow well-known public registries (e.g., docker.io or ghcr.io) as backup registry, which is refused by default as it is most likely a misconfiguration.")
+	flag.BoolVar(&enableDeployments, "enable-deployment-controller", true, "Enable copying images of Deployments.")
+	flag.BoolVar(&enableDaemonSets, "enable-daemonset-controller", true, "Enable copying images of DaemonSets.")
+	flag.BoolVar(&cleanupOnDelete, "cleanup-on-delete", false,
+		"Delete copied images from the backup registry when the last workload referencing them is deleted.")
+	flag.BoolVar(&skipStartupChecks, "skip-startup-checks", false,
+		"Skip verifying that the backup registry is reachable and credentials are configured on startup.")
+	flag.BoolVar(&startupCheckPush, "startup-check-push", false,
+		"Verify write access to the backup registry on startup by pushing and deleting a test image to "+copier.CheckRepository+".")
+	flag.DurationVar(&copyProgressInterval, "copy-progress-interval", 30*time.Second,
+		"The interval in which the progress of running image copies is logged. Set to 0 to disable logging in an interval.")
+	flag.StringVar(&copyProgressBytes, "copy-progress-bytes", "512Mi",
+		"The number of transferred bytes after which the progress of running image copies is logged in addition to --copy-progress-interval. "+
+			"Set to 0 to only log in an interval. Progress tracking is disabled if both are set to 0.")
+	flag.DurationVar(&copyStallTimeout, "copy-stall-timeout", 2*time.Minute,
+		"Cancel and retry image copies that didn't transfer any bytes for this duration. Set to 0 to disable stall detection.")
+	flag.DurationVar(&storageFullProbeInterval, "storage-full-probe-interval", copier.DefaultStorageFullProbeInterval,
+		"Interval of probe copies to a destination registry that ran out of storage. Other copies to it are stopped until a probe copy succeeds.")
+	flag.Var(&registryHostRewrites, "registry-host-rewrite",
+		"Pull images of a source registry host from a different host, e.g., localhost:5001=registry.registry.svc.cluster.local:5000. "+
+			"Prefix the pull host with http:// for registries without TLS. Can be specified multiple times.")
+	flag.DurationVar(&sourceNotFoundGracePeriod, "source-not-found-grace-period", 5*time.Minute,
+		"Duration after the last update of a workload in which missing source images are retried quickly without emitting warning events. "+
+			"Set to 0 to disable.")
+	flag.DurationVar(&sourceNotFoundRetryInterval, "source-not-found-retry-interval", 10*time.Second,
+		"Interval in which missing source images are retried during the grace period (with jitter).")
+	flag.Var(&repositoryMappings, "repository-mapping",
+		"Copy images of a source repository to a fixed destination repository in the backup registry instead of the default naming scheme, "+
+			"e.g., docker.io/library/nginx=base/nginx. Can be specified multiple times or comma-separated.")
+	flag.Var(&requirePlatforms, "require-platforms",
+		"Platforms that copied images need to provide, e.g., linux/amd64,linux/arm64. Missing platforms are reported via warning events "+
+			"and the image_clone_incomplete_platform_images_total metric. Set to \""+controllers.DetectPlatforms+"\" to require the platforms of the cluster's Nodes.")
+	flag.Var(&watchNamespaces, "watch-namespaces",
+		"Only watch and reconcile workloads in the given namespaces. Can be specified multiple times or comma-separated. Defaults to all namespaces.")
+	flag.BoolVar(&namespacedRBAC, "namespaced-rbac", false,
+		"Only use namespaced permissions in the namespaces given by --watch-namespaces, e.g., granted via Roles. "+
+			"Features that require cluster-scoped permissions are disabled, and the permissions are verified on startup.")
+	flag.BoolVar(&annotatedEvents, "annotated-events", false,
+		"Add the structured fields of events (e.g., container, source, destination, error) as annotations with the "+controllers.EventAnnotationPrefix+" prefix.")
+	flag.BoolVar(&namespaceSummaryEvents, "namespace-summary-events", true,
+		"During the initial sync and full resyncs, emit one summary event per namespace on the Namespace object instead of Normal events per workload. "+
+			"Warning events are still emitted per workload.")
+	flag.BoolVar(&enforcePlatforms, "enforce-platforms", false,
+		"Don't rewrite images that don't provide all platforms required by --require-platforms. The images are still copied.")
+	flag.Var(&previousBackupRegistries, "previous-backup-registries",
+		"Registries that were used as backup registry before. Images referencing them are mapped back to their original "+
+			"reference and copied to the current backup registry. Can be specified multiple times.")
+	flag.BoolVar(&enableDebugEndpoint, "enable-debug-endpoint", false,
+		"Serve a JSON snapshot of the copier's internal state on "+copier.DebugPath+" of the metrics endpoint.")
+	flag.StringVar(&debugEndpointToken, "debug-endpoint-token", "",
+		"Require requests to the debug endpoint to authenticate with this bearer token.")
+	flag.BoolVar(&asyncCopies, "async-copies", false,
+		"Copy images in the background instead of blocking reconciliations. Workloads are reconciled again as soon as their copies have finished.")
+	flag.DurationVar(&copyPendingRequeueInterval, "copy-pending-requeue-interval", time.Minute,
+		"Interval in which workloads waiting for background copies are requeued in case a completion notification is missed.")
+	flag.BoolVar(&validateBackupReferences, "validate-backup-references", false,
+		"Verify that images already referencing the backup registry exist and emit warning events for missing images.")
+	flag.BoolVar(&healBackupReferences, "heal-backup-references", false,
+		"Copy missing images referencing the backup registry from their original source if the repository name is recognizable. "+
+			"Requires --validate-backup-references.")
+	flag.DurationVar(&reconcileTimeout, "reconcile-timeout", 30*time.Minute,
+		"Maximum duration of a single reconciliation. When it expires, the images that have been copied so far are patched "+
+			"and the workload is requeued. Set to 0 to disable.")
+	flag.BoolVar(&failureAnnotation, "failure-annotation", false,
+		"Record sustained copy failures in the "+controllers.LastErrorAnnotation+" annotation on workloads, e.g., for alerting.")
+	flag.DurationVar(&failureAnnotationThreshold, "failure-annotation-threshold", 15*time.Minute,
+		"Duration for which copying images of a workload needs to fail before the failure is recorded in an annotation.")
+	flag.Var(&registryClientCerts, "registry-client-cert",
+		"Present a TLS client certificate to a registry host, e.g., registry.example.com=/certs/tls.crt:/certs/tls.key. "+
+			"Certificates are reloaded when the files change. Can be specified multiple times.")
+	flag.BoolVar(&rewriteEphemeralContainers, "rewrite-ephemeral-containers", false,
+		"Also copy and rewrite images of ephemeral containers in pod templates.")
+	flag.StringVar(&notifyURL, "notify-url", "",
+		"POST notifications about copies and patched workloads as CloudEvents to this URL. Notifications are disabled by default.")
+	flag.Var(&sourceCredentials, "source-credentials",
+		"Basic auth credentials for pulling from a registry host, e.g., registry.example.com=user:/secrets/password. "+
+			"The password is read from the given file, which is read again when it changes. Can be specified multiple times.")
+	flag.StringVar(&patchStrategy, "patch-strategy", string(controllers.PatchStrategyStrategic),
+		fmt.Sprintf("Strategy for patching workloads, one of %v. All strategies use optimistic locking.", controllers.PatchStrategies))
+	flag.StringVar(&digestTagStyle, "digest-tag-style", string(naming.DigestTagStylePrefixed),
+		fmt.Sprintf("How images referenced by digest are represented in destination tags, one of %v. %s uses the full digest (sha256_<hex>), "+
+			"%s the hex digest only, and %s the original tag and the first 12 hex characters for images referenced by tag and digest (e.g., 1.25-33cef0123456), "+
+			"storing the full digest in the %s annotation.", naming.DigestTagStyles, naming.DigestTagStylePrefixed,
+			naming.DigestTagStyleSHAOnly, naming.DigestTagStyleOriginalTagPlusDigest, controllers.SourceDigestsAnnotation))
+	flag.StringVar(&replicatePullSecret, "replicate-pull-secret", "",
+		"Replicate the given pull secret (<namespace>/<name>) to all namespaces. Disabled by default.")
+	flag.BoolVar(&replicatePullSecretCascadeDelete, "replicate-pull-secret-cascade-delete", false,
+		"Delete replicated pull secrets when the source secret is deleted.")
+	flag.BoolVar(&copyReferrers, "copy-referrers", false,
+		"Copy referrers of images (OCI 1.1 artifacts like SBOMs or signatures) along with the images.")
+	flag.StringVar(&userAgentPrefix, "user-agent-prefix", copier.DefaultUserAgentPrefix,
+		"Product name in the User-Agent of all registry requests, which is followed by the version, the workload kind, and the operation, e.g., "+
+			copier.DefaultUserAgentPrefix+"/v0.1.0 (Deployment; copy-pull). Set it to distinguish multiple instances in the registry's access logs.")
+	flag.BoolVar(&copyParentIndex, "copy-parent-index", false,
+		"If a container pins a platform image of a multi-platform index by digest, look for the index among the tags of the source repository and copy it along, "+
+			"so that the backup registry contains all platforms. The container is still rewritten to the pinned digest.")
+	flag.StringVar(&denylistedDigestsFile, "denylisted-digests-file", "",
+		"File containing image digests that are never copied, one per line. Workloads referencing them keep their source "+
+			"image and get a DeniedImage warning event. The file is reloaded when it changes.")
+	flag.StringVar(&mirrorProhibitedFile, "mirror-prohibited-file", "",
+		"File containing repository patterns that must never be mirrored to the backup registry (e.g., for license compliance), one per line "+
+			"in the same syntax as --exclude-images. Workloads referencing them keep their source image and get a MirrorProhibited warning event. "+
+			"The file is reloaded when it changes.")
+	flag.StringVar(&maxImageSize, "max-image-size", "0",
+		"Maximum size of images that are copied (e.g., 10Gi), for manifest lists the largest image is used. Larger images "+
+			"are not copied unless the workload is annotated with "+controllers.AllowLargeImagesAnnotation+"=true. Set to 0 to disable the limit.")
+	flag.StringVar(&maxCopyBytesPerHour, "max-copy-bytes-per-hour", "0",
+		"Maximum number of bytes that image copies may transfer within a sliding window of one hour (e.g., 500Gi). While "+
+			"the budget is exhausted, new copies are deferred and retried later, copies in progress are not aborted. Set to 0 to disable the budget.")
+	flag.StringVar(&reservedInteractiveCopyBytesPerHour, "reserved-interactive-copy-bytes-per-hour", "0",
+		"Part of --max-copy-bytes-per-hour that is reserved for copies of new or changed workloads, which background copies "+
+			"(e.g., healing or migrating images) can't use.")
+	flag.IntVar(&maxConcurrentCopies, "max-concurrent-copies", 0,
+		"Maximum number of concurrent image copies. Set to 0 to not limit concurrent copies.")
+	flag.IntVar(&reservedInteractiveCopies, "reserved-interactive-copies", 1,
+		"Number of copy slots reserved for copies of new or changed workloads, which background copies (e.g., healing "+
+			"or migrating images) can't use. Only used if --max-concurrent-copies is set.")
+	flag.Var(&registryConcurrency, "per-registry-concurrency",
+		"Maximum number of concurrent image copies to a destination registry host in addition to --max-concurrent-copies, "+
+			fmt.Sprintf("e.g., registry.example.com=4. Defaults to %d for the backup registry. Can be specified multiple times.", copier.DefaultBackupRegistryConcurrency))
+	flag.Var(&registryCheckConcurrency, "per-registry-check-concurrency",
+		"Maximum number of concurrent checks whether an image exists against a registry host, e.g., registry.example.com=20. "+
+			fmt.Sprintf("Defaults to %d for the backup registry. Can be specified multiple times.", copier.DefaultBackupRegistryCheckConcurrency))
+	flag.IntVar(&rewriteLoopThreshold, "rewrite-loop-threshold", 5,
+		"Stop patching a workload if the same container was rewritten from the same source to the same destination more "+
+			"often than this within --rewrite-loop-window, e.g., because a mutating webhook reverts the rewrites. Set to 0 to disable loop detection.")
+	flag.DurationVar(&rewriteLoopWindow, "rewrite-loop-window", 10*time.Minute,
+		"The window for detecting rewrite loops.")
+	flag.DurationVar(&rewriteDecisionTTL, "rewrite-decision-ttl", 0,
+		"Skip checking the registries for images that were copied or found in the backup registry within this duration. "+
+			"Changing the "+controllers.ForceSyncAnnotation+" annotation of a workload or the source credentials checks them again. Set to 0 to always check the registries.")
+	flag.DurationVar(&forceSyncRetention, "force-sync-retention", 24*time.Hour,
+		"Remove the "+controllers.ForceSyncAnnotation+" annotation from workloads this long after the controller has "+
+			"acknowledged it in the "+controllers.ForceSyncAcknowledgedAnnotation+" annotation. Set to 0 to keep the annotations.")
+	flag.Var(&setPullPolicy, "set-pull-policy",
+		"Set the image pull policy of rewritten containers: "+string(corev1.PullAlways)+" for images referenced by tag (their "+
+			"destination tag is overwritten when the source tag changes), "+string(corev1.PullIfNotPresent)+" for images "+
+			"referenced by digest (their destination tag never changes). Can be specified multiple times to enable both.")
+	flag.Var(&excludeImages, "exclude-images",
+		"Patterns of images that are not copied, e.g., registry.example.com/internal/*. Patterns match the repository "+
+			"including the registry host or any of its parent paths. Can be specified multiple times.")
+	flag.BoolVar(&skipProviderImages, "skip-provider-images", true,
+		"Don't copy well-known provider-internal images that can't be pulled from outside the provider's network: "+
+			strings.Join(controllers.ProviderImages, ", ")+".")
+	flag.Var(&respectFieldManagers, "respect-field-managers",
+		"Names of field managers whose container images are never rewritten, e.g., trusted operators that expect to own "+
+			"the image field. Can be specified multiple times.")
+	flag.Var(&mirrorAnnotatedArtifacts, "mirror-annotated-artifacts",
+		"Annotation keys whose values on workloads reference OCI artifacts (e.g., Helm charts via oci://registry/chart:1.2.3) "+
+			"that are mirrored to the backup registry using the same naming scheme as images. The annotations are not modified, "+
+			"and failures only result in warning events. Can be specified multiple times.")
+	flag.BoolVar(&preserveShortNames, "preserve-short-names", false,
+		"Mirror the literal reference of Docker Hub images in destination repositories, e.g., nginx is copied to docker_io/nginx "+
+			"instead of index_docker_io/library/nginx.")
+	flag.BoolVar(&waitForRollout, "wait-for-rollout", false,
+		"Delay patching workloads while a rollout is in progress, so that patching doesn't start a second rollout with additional surge pods.")
+	flag.DurationVar(&waitForRolloutTimeout, "wait-for-rollout-timeout", 10*time.Minute,
+		"Maximum duration for delaying a patch because of a rollout, after which the workload is patched anyway.")
+	flag.Var(&patchWindows, "patch-window",
+		"Maintenance window in the form [<kind>=]<cron>;<duration>[;<timezone>], e.g., DaemonSet=0 22 * * 1-5;4h;Europe/Berlin. "+
+			"Images are copied immediately, but patching workloads is deferred until one of the windows for their kind opens. "+
+			"Windows without a kind apply to kinds without their own windows. Workloads can override the windows with the "+
+			controllers.PatchWindowAnnotation+" annotation. Can be specified multiple times.")
+	flag.Var(&busyMarkers, "busy-marker",
+		"Marker in the form annotation:<key>[=<value>] or condition:<type>[=<status>] indicating that another mutator (e.g., a "+
+			"VerticalPodAutoscaler updater) is updating a workload. Patching marked workloads is deferred until the marker clears. "+
+			"Can be specified multiple times.")
+	flag.DurationVar(&busyMarkerMaxDelay, "busy-marker-max-delay", 5*time.Minute,
+		"Maximum duration for deferring a patch because of a busy marker, after which the workload is patched anyway. Workloads "+
+			"can override it with the "+controllers.BusyMaxDelayAnnotation+" annotation.")
+	flag.BoolVar(&requirePullAccess, "require-pull-access", false,
+		"Defer patching workloads whose pods don't have credentials for the backup registry, i.e., none of the image pull secrets of "+
+			"their pod template or service account contains credentials for it. Images are still copied.")
+	flag.BoolVar(&nodePullCredentials, "node-pull-credentials", false,
+		"Assert that all nodes have credentials for the backup registry, which satisfies --require-pull-access for all workloads.")
+	flag.DurationVar(&resyncSpread, "resync-spread", 10*time.Minute,
+		"Duration over which a full resync triggered via the debug endpoint enqueues all workloads.")
+	flag.DurationVar(&cacheResyncPeriod, "cache-resync-period", 0,
+		"Period in which the informers resync all cached workloads, which reconciles them again. Set to 0 to disable periodic resyncs.")
+	flag.BoolVar(&offline, "offline", false,
+		"Never contact source registries, e.g., in air-gapped clusters. Images are only rewritten if they already exist in the backup registry.")
+	flag.DurationVar(&offlineRequeueInterval, "offline-requeue-interval", 10*time.Minute,
+		"Interval for checking again whether missing images have been added to the backup registry in offline mode.")
+	flag.IntVar(&retryBudget, "retry-budget", 60,
+		"Number of retries of failing workloads per minute shared by all controllers, further retries are deferred by --retry-budget-requeue-interval. "+
+			"Newly created workloads are never throttled. Set to 0 to disable the retry budget.")
+	flag.DurationVar(&retryBudgetRequeueInterval, "retry-budget-requeue-interval", 5*time.Minute,
+		"Interval for retrying failing workloads that exceeded the --retry-budget.")
+	flag.BoolVar(&rewriteOnlyPreapproved, "rewrite-only-preapproved", false,
+		"Never copy images. Images are only rewritten if they have been pre-approved, i.e., pushed to the backup registry by a separate pipeline.")
+	flag.BoolVar(&preapprovalVerifyDigests, "preapproval-verify-digests", false,
+		"With --rewrite-only-preapproved, resolve the digest of images referenced by tag in the source registry and only rewrite them "+
+			"if the pre-approved image matches it.")
+	flag.DurationVar(&preapprovalRequeueInterval, "preapproval-requeue-interval", 10*time.Minute,
+		"Interval for checking again whether images pending approval have been added to the backup registry with --rewrite-only-preapproved.")
+	flag.BoolVar(&strictDigestConsistency, "strict-digest-consistency", false,
+		"Before patching, verify that the destination tag of every copied image serves the resolved source digest. "+
+			"Images whose destination tag serves a different digest are not rewritten, unless the workload is annotated with "+
+			controllers.AllowDigestDivergenceAnnotation+"=true.")
+	flag.BoolVar(&dropImageUnchangedUpdates, "drop-image-unchanged-updates", false,
+		"Don't reconcile workload updates that don't change any container image if all images already reference the backup registry. "+
+			"Drift of such workloads, e.g., backup images deleted by a garbage collection, is only corrected by full resyncs.")
+	flag.IntVar(&maxPatchesPerMinute, "max-patches-per-minute", 0,
+		"Maximum number of patches rewriting images per minute, further patches are deferred with jitter while images are still copied right away. "+
+			"Workloads created within the last 5 minutes are never deferred. Set to 0 to disable pacing.")
+	flag.IntVar(&maxPatchesPerMinutePerNamespace, "max-patches-per-minute-per-namespace", 0,
+		"Maximum number of patches rewriting images per minute and namespace, see --max-patches-per-minute. Set to 0 to disable pacing per namespace.")
+	flag.IntVar(&shardCount, "shard-count", 1,
+		"Distribute workloads across the given number of replicas by the hash of their namespace and name. "+
+			"Leader election is then only used for singleton background tasks.")
+	flag.IntVar(&shardIndex, "shard-index", -1,
+		"The shard of workloads that this replica reconciles with --shard-count. "+
+			"Defaults to the StatefulSet ordinal of the pod name given by the POD_NAME environment variable or the hostname.")
+	flag.BoolVar(&forceBlobDownloadsViaRegistry, "force-blob-downloads-via-registry", false,
+		"Don't follow redirects of blob downloads to different hosts (e.g., presigned URLs of S3 or GCS), so that blobs are only "+
+			"downloaded from registries serving them via their own endpoint. Copies from registries that redirect blob downloads fail instead.")
+	flag.DurationVar(&blobRedirectRequeueInterval, "blob-redirect-requeue-interval", 30*time.Minute,
+		"Interval for retrying copies that failed because a blob download was redirected to an unreachable host, e.g., blocked by an egress firewall.")
+	flag.StringVar(&copyHistoryConfigMap, "copy-history-configmap", "",
+		"Name of a ConfigMap in the controller's namespace for persisting the last successful copy of images referenced by tag. "+
+			"The age of backup copies is exposed in the image_clone_backup_age_seconds metric. Disabled by default.")
+	flag.StringVar(&pendingJournalConfigMap, "pending-journal-configmap", "",
+		"Name of a ConfigMap in the controller's namespace for journaling workloads whose images have been copied but not patched yet. "+
+			"On startup, journaled workloads are reconciled first, so that a crash between copying and patching doesn't leave them unpatched. Disabled by default.")
+	flag.StringVar(&statusConfigMap, "status-configmap", "image-clone-status",
+		"Name of a ConfigMap in the controller's namespace that is updated with a summary of the controller's recent activity. "+
+			"Set to an empty string to disable it, e.g., in large clusters.")
+	flag.DurationVar(&statusUpdateInterval, "status-update-interval", 30*time.Second,
+		"Minimum interval between updates of the status ConfigMap.")
+	flag.DurationVar(&coverageInterval, "coverage-interval", time.Minute,
+		"The interval in which the protection coverage metrics are calculated from the cache. Set to 0 to disable them.")
+	flag.IntVar(&coverageNamespaceLimit, "coverage-namespace-limit", 20,
+		"Number of namespaces with the most containers that are exposed individually in the protection coverage metrics, "+
+			"the remaining namespaces are aggregated as \"other\".")
+	flag.BoolVar(&readyWithoutSync, "ready-without-sync", false,
+		"Report the controller as ready right after startup instead of waiting for the initial sync of all workloads.")
+	flag.IntVar(&initialSyncThreshold, "initial-sync-threshold", 0,
+		"Number of workloads that may still be pending in the initial sync when the controller is reported as ready.")
+	flag.BoolVar(&dedupe, "dedupe", false,
+		"Run the one-shot maintenance task that merges duplicate Docker Hub repositories in the backup registry "+
+			"(e.g., registry-1_docker_io/...) into the canonical repositories (index_docker_io/...) and exit. "+
+			"Running it again resumes an interrupted run.")
+	flag.BoolVar(&dedupeDryRun, "dedupe-dry-run", false,
+		"Only log the changes that --dedupe would make.")
+	flag.BoolVar(&dedupeDelete, "dedupe-delete", false,
+		"Delete duplicate images with --dedupe once they are merged and not referenced by any workload anymore.")
+	flag.Int64Var(&dedupeChunkSize, "dedupe-chunk-size", controllers.DefaultListChunkSize,
+		"Number of workloads that --dedupe lists and processes at once, which bounds the memory usage in large namespaces.")
+	flag.StringVar(&exportMapping, "export-mapping", "",
+		"Write a JSON manifest mapping the original references of all images in the backup registry to their backup destinations "+
+			"and digests to the given file (- for stdout) and exit. The manifest is generated from the backup registry, "+
+			"workloads in the cluster are only used as hints if the cluster is reachable.")
+	flag.StringVar(&configFile, configFileFlag, "",
+		"Path to a YAML file mapping flag names to values. Flags specified on the command line take precedence.")
 	opts := zap.Options{
 		Development: true,
 		TimeEncoder: zapcore.ISO8601TimeEncoder,
@@ -67,10 +435,26 @@ func main() {
 	opts.BindFlags(flag.CommandLine)
 	flag.Parse()
 
+	if configFile != "" {
+		if err := applyConfigFile(flag.CommandLine, configFile); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 	klog.SetLogger(ctrl.Log)
 
-	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
+	if namespacedRBAC && len(watchNamespaces) == 0 {
+		setupLog.Error(fmt.Errorf("--namespaced-rbac requires --watch-namespaces"), "invalid namespaced RBAC mode")
+		os.Exit(1)
+	}
+	if rewriteOnlyPreapproved && offline {
+		setupLog.Error(fmt.Errorf("--rewrite-only-preapproved and --offline are mutually exclusive"), "invalid pre-approval mode")
+		os.Exit(1)
+	}
+
+	mgrOptions := ctrl.Options{
 		Scheme:                        scheme,
 		MetricsBindAddress:            metricsAddr,
 		Port:                          9443,
@@ -78,9 +462,25 @@ func main() {
 		LeaderElection:                enableLeaderElection,
 		LeaderElectionID:              "image-clone-controller",
 		LeaderElectionReleaseOnCancel: true,
-	})
-	if err != nil {
-		setupLog.Error(err, "unable to start manager")
+		SyncPeriod:                    &cacheResyncPeriod,
+	}
+	switch len(watchNamespaces) {
+	case 0:
+	case 1:
+		mgrOptions.Namespace = watchNamespaces[0]
+	default:
+		mgrOptions.NewCache = cache.MultiNamespacedCacheBuilder(watchNamespaces)
+	}
+	// strip fields that are never read from cached workloads to reduce memory usage on large clusters
+	mgrOptions.NewCache = controllers.NewCacheFunc(mgrOptions.NewCache, respectFieldManagers)
+
+	if err := controllers.ValidatePatchStrategy(controllers.PatchStrategy(patchStrategy)); err != nil {
+		setupLog.Error(err, "invalid patch strategy")
+		os.Exit(1)
+	}
+
+	if err := naming.ValidateDigestTagStyle(naming.DigestTagStyle(digestTagStyle)); err != nil {
+		setupLog.Error(err, "invalid digest tag style")
 		os.Exit(1)
 	}
 
@@ -90,29 +490,514 @@ func main() {
 		os.Exit(1)
 	}
 
-	if err = (&controllers.ImageCloneController{
-		Client:         mgr.GetClient(),
-		Recorder:       mgr.GetEventRecorderFor(controllers.ImageCloneControllerName + "-controller"),
+	if !allowPublicBackup {
+		if err := controllers.CheckPublicBackupRegistry(parsedRegistry); err != nil {
+			setupLog.Error(err, "refusing public backup registry")
+			os.Exit(1)
+		}
+	}
+
+	var parsedPreviousBackupRegistries []name.Registry
+	for _, previous := range previousBackupRegistries {
+		previousRegistry, err := name.NewRegistry(previous)
+		if err != nil {
+			setupLog.Error(err, "failed to parse previous backup registry")
+			os.Exit(1)
+		}
+		if strings.EqualFold(previousRegistry.RegistryStr(), parsedRegistry.RegistryStr()) {
+			setupLog.Error(fmt.Errorf("previous backup registry %q equals the current backup registry", previous), "invalid previous backup registries")
+			os.Exit(1)
+		}
+		parsedPreviousBackupRegistries = append(parsedPreviousBackupRegistries, previousRegistry)
+	}
+
+	parsedRepositoryMappings, err := naming.ParseRepositoryMappings(repositoryMappings, parsedRegistry)
+	if err != nil {
+		setupLog.Error(err, "failed to parse repository mappings")
+		os.Exit(1)
+	}
+
+	parsedPatchWindows, err := controllers.ParsePatchWindows(patchWindows)
+	if err != nil {
+		setupLog.Error(err, "failed to parse patch windows")
+		os.Exit(1)
+	}
+
+	parsedBusyMarkers, err := controllers.ParseBusyMarkers(busyMarkers)
+	if err != nil {
+		setupLog.Error(err, "failed to parse busy markers")
+		os.Exit(1)
+	}
+
+	parsedRequiredPlatforms, detectPlatforms, err := controllers.ParseRequiredPlatforms(requirePlatforms)
+	if err != nil {
+		setupLog.Error(err, "failed to parse required platforms")
+		os.Exit(1)
+	}
+
+	parsedRegistryHostRewrites, err := copier.ParseRegistryHostRewrites(registryHostRewrites)
+	if err != nil {
+		setupLog.Error(err, "failed to parse registry host rewrites")
+		os.Exit(1)
+	}
+
+	parsedRegistryClientCerts, err := copier.ParseRegistryClientCertificates(registryClientCerts)
+	if err != nil {
+		setupLog.Error(err, "failed to parse registry client certificates")
+		os.Exit(1)
+	}
+
+	parsedSourceCredentials, err := copier.ParseSourceCredentials(sourceCredentials)
+	if err != nil {
+		setupLog.Error(err, "failed to parse source credentials")
+		os.Exit(1)
+	}
+
+	parsedCopyProgressBytes, err := resource.ParseQuantity(copyProgressBytes)
+	if err != nil {
+		setupLog.Error(err, "failed to parse copy progress bytes")
+		os.Exit(1)
+	}
+
+	parsedMaxImageSize, err := resource.ParseQuantity(maxImageSize)
+	if err != nil {
+		setupLog.Error(err, "failed to parse max image size")
+		os.Exit(1)
+	}
+
+	parsedMaxCopyBytesPerHour, err := resource.ParseQuantity(maxCopyBytesPerHour)
+	if err != nil {
+		setupLog.Error(err, "failed to parse max copy bytes per hour")
+		os.Exit(1)
+	}
+	parsedReservedInteractiveCopyBytesPerHour, err := resource.ParseQuantity(reservedInteractiveCopyBytesPerHour)
+	if err != nil {
+		setupLog.Error(err, "failed to parse reserved interactive copy bytes per hour")
+		os.Exit(1)
+	}
+	if parsedMaxCopyBytesPerHour.Value() > 0 && (parsedReservedInteractiveCopyBytesPerHour.Value() < 0 ||
+		parsedReservedInteractiveCopyBytesPerHour.Value() >= parsedMaxCopyBytesPerHour.Value()) {
+		setupLog.Error(fmt.Errorf("must be between 0 and %s, got %s", maxCopyBytesPerHour, reservedInteractiveCopyBytesPerHour), "invalid reserved interactive copy bytes per hour")
+		os.Exit(1)
+	}
+
+	if denylistedDigestsFile != "" {
+		// fail early on invalid denylists
+		if _, err := copier.ReadDigestDenylist(denylistedDigestsFile); err != nil {
+			setupLog.Error(err, "failed to read denylisted digests")
+			os.Exit(1)
+		}
+	}
+	if mirrorProhibitedFile != "" {
+		if _, err := controllers.ReadMirrorProhibitedPatterns(mirrorProhibitedFile); err != nil {
+			setupLog.Error(err, "failed to read mirror prohibited repositories")
+			os.Exit(1)
+		}
+	}
+
+	if maxConcurrentCopies > 0 && (reservedInteractiveCopies < 0 || reservedInteractiveCopies >= maxConcurrentCopies) {
+		setupLog.Error(fmt.Errorf("must be between 0 and %d, got %d", maxConcurrentCopies-1, reservedInteractiveCopies), "invalid reserved interactive copies")
+		os.Exit(1)
+	}
+
+	parsedRegistryConcurrency, err := copier.ParseRegistryConcurrency(registryConcurrency)
+	if err != nil {
+		setupLog.Error(err, "failed to parse per-registry concurrency")
+		os.Exit(1)
+	}
+	parsedRegistryCheckConcurrency, err := copier.ParseRegistryConcurrency(registryCheckConcurrency)
+	if err != nil {
+		setupLog.Error(err, "failed to parse per-registry check concurrency")
+		os.Exit(1)
+	}
+	backupRegistryHost := strings.ToLower(parsedRegistry.RegistryStr())
+	if _, ok := parsedRegistryConcurrency[backupRegistryHost]; !ok {
+		parsedRegistryConcurrency[backupRegistryHost] = copier.DefaultBackupRegistryConcurrency
+	}
+	if _, ok := parsedRegistryCheckConcurrency[backupRegistryHost]; !ok {
+		parsedRegistryCheckConcurrency[backupRegistryHost] = copier.DefaultBackupRegistryCheckConcurrency
+	}
+
+	var setPullPolicyAlways, setPullPolicyIfNotPresent bool
+	for _, policy := range setPullPolicy {
+		switch corev1.PullPolicy(policy) {
+		case corev1.PullAlways:
+			setPullPolicyAlways = true
+		case corev1.PullIfNotPresent:
+			setPullPolicyIfNotPresent = true
+		default:
+			setupLog.Error(fmt.Errorf("expected %s or %s, got %q", corev1.PullAlways, corev1.PullIfNotPresent, policy), "invalid pull policy")
+			os.Exit(1)
+		}
+	}
+
+	if skipProviderImages {
+		excludeImages = append(excludeImages, controllers.ProviderImages...)
+	}
+	if err := controllers.ValidateExcludePatterns(excludeImages); err != nil {
+		setupLog.Error(err, "invalid exclude patterns")
+		os.Exit(1)
+	}
+
+	if err := controllers.ValidateArtifactAnnotations(mirrorAnnotatedArtifacts); err != nil {
+		setupLog.Error(err, "invalid annotations for mirroring artifacts")
+		os.Exit(1)
+	}
+
+	if shardCount > 1 && shardIndex < 0 {
+		podName := os.Getenv("POD_NAME")
+		if podName == "" {
+			podName, _ = os.Hostname()
+		}
+		shardIndex, err = controllers.ShardOrdinal(podName)
+		if err != nil {
+			setupLog.Error(err, "failed to derive shard index, specify it via --shard-index")
+			os.Exit(1)
+		}
+	}
+	if shardCount <= 1 {
+		shardCount, shardIndex = 1, 0
+	}
+	if err := controllers.ValidateShard(shardIndex, shardCount); err != nil {
+		setupLog.Error(err, "invalid shard")
+		os.Exit(1)
+	}
+
+	var parsedReplicatePullSecret types.NamespacedName
+	if replicatePullSecret != "" {
+		secretNamespace, secretName, ok := strings.Cut(replicatePullSecret, "/")
+		if !ok || secretNamespace == "" || secretName == "" {
+			setupLog.Error(fmt.Errorf("expected <namespace>/<name>, got %q", replicatePullSecret), "invalid pull secret to replicate")
+			os.Exit(1)
+		}
+		parsedReplicatePullSecret = types.NamespacedName{Namespace: secretNamespace, Name: secretName}
+	}
+
+	config := &controllers.Config{
 		BackupRegistry: parsedRegistry,
 		PodNamespace:   os.Getenv("POD_NAMESPACE"),
-	}).SetupWithManager(mgr); err != nil {
+		PatchStrategy:  controllers.PatchStrategy(patchStrategy),
+
+		AllowPublicBackup: allowPublicBackup,
+
+		EnableDeployments: enableDeployments,
+		EnableDaemonSets:  enableDaemonSets,
+
+		SourceNotFoundGracePeriod:   sourceNotFoundGracePeriod,
+		SourceNotFoundRetryInterval: sourceNotFoundRetryInterval,
+		CleanupOnDelete:             cleanupOnDelete,
+		PreviousBackupRegistries:    parsedPreviousBackupRegistries,
+		AsyncCopies:                 asyncCopies,
+		CopyPendingRequeueInterval:  copyPendingRequeueInterval,
+		ValidateBackupReferences:    validateBackupReferences,
+		HealBackupReferences:        healBackupReferences,
+		RewriteEphemeralContainers:  rewriteEphemeralContainers,
+		ReconcileTimeout:            reconcileTimeout,
+		FailureAnnotation:           failureAnnotation,
+		FailureAnnotationThreshold:  failureAnnotationThreshold,
+		RewriteLoopThreshold:        rewriteLoopThreshold,
+		RewriteLoopWindow:           rewriteLoopWindow,
+		ForceSyncRetention:          forceSyncRetention,
+		SetPullPolicyAlways:         setPullPolicyAlways,
+		SetPullPolicyIfNotPresent:   setPullPolicyIfNotPresent,
+		ExcludeImages:               excludeImages,
+		MirrorProhibitedFile:        mirrorProhibitedFile,
+		RespectFieldManagers:        respectFieldManagers,
+		CoverageInterval:            coverageInterval,
+		CopyHistoryConfigMap:        copyHistoryConfigMap,
+		PendingJournalConfigMap:     pendingJournalConfigMap,
+		StatusConfigMap:             statusConfigMap,
+		StatusUpdateInterval:        statusUpdateInterval,
+		Offline:                     offline,
+		ResyncSpread:                resyncSpread,
+		WaitForRollout:              waitForRollout,
+		PreserveShortNames:          preserveShortNames,
+		DigestTagStyle:              naming.DigestTagStyle(digestTagStyle),
+		WaitForRolloutTimeout:       waitForRolloutTimeout,
+		PatchWindows:                parsedPatchWindows,
+		RepositoryMappings:          parsedRepositoryMappings,
+		RequiredPlatforms:           parsedRequiredPlatforms,
+		DetectPlatforms:             detectPlatforms,
+		EnforcePlatforms:            enforcePlatforms,
+		AnnotatedEvents:             annotatedEvents,
+		NamespaceSummaryEvents:      namespaceSummaryEvents,
+		DropImageUnchangedUpdates:   dropImageUnchangedUpdates,
+		ShardCount:                  shardCount,
+		ShardIndex:                  shardIndex,
+		WatchNamespaces:             watchNamespaces,
+		NamespacedRBAC:              namespacedRBAC,
+		OfflineRequeueInterval:      offlineRequeueInterval,
+		RewriteOnlyPreapproved:      rewriteOnlyPreapproved,
+		RetryBudget:                 retryBudget,
+		RetryBudgetRequeueInterval:  retryBudgetRequeueInterval,
+		PreapprovalVerifyDigests:    preapprovalVerifyDigests,
+		StrictDigestConsistency:     strictDigestConsistency,
+		PreapprovalRequeueInterval:  preapprovalRequeueInterval,
+		BlobRedirectRequeueInterval: blobRedirectRequeueInterval,
+		CoverageNamespaceLimit:      coverageNamespaceLimit,
+		ReadyWithoutSync:            readyWithoutSync,
+		InitialSyncThreshold:        initialSyncThreshold,
+		MirrorAnnotatedArtifacts:    mirrorAnnotatedArtifacts,
+
+		MaxPatchesPerMinute:             maxPatchesPerMinute,
+		MaxPatchesPerMinutePerNamespace: maxPatchesPerMinutePerNamespace,
+		BusyMarkers:                     parsedBusyMarkers,
+		BusyMarkerMaxDelay:              busyMarkerMaxDelay,
+		RequirePullAccess:               requirePullAccess,
+		NodePullCredentials:             nodePullCredentials,
+
+		CopierOptions: copier.Options{
+			ProgressInterval:                    copyProgressInterval,
+			ProgressBytes:                       parsedCopyProgressBytes.Value(),
+			StallTimeout:                        copyStallTimeout,
+			RegistryHostRewrites:                parsedRegistryHostRewrites,
+			SourceCredentials:                   parsedSourceCredentials,
+			MaxConcurrentCopies:                 maxConcurrentCopies,
+			ReservedInteractiveCopies:           reservedInteractiveCopies,
+			RegistryConcurrency:                 parsedRegistryConcurrency,
+			RegistryCheckConcurrency:            parsedRegistryCheckConcurrency,
+			MaxImageSize:                        parsedMaxImageSize.Value(),
+			MaxCopyBytesPerHour:                 parsedMaxCopyBytesPerHour.Value(),
+			ReservedInteractiveCopyBytesPerHour: parsedReservedInteractiveCopyBytesPerHour.Value(),
+			CopyReferrers:                       copyReferrers,
+			CopyParentIndex:                     copyParentIndex,
+			UserAgentPrefix:                     userAgentPrefix,
+			DenylistedDigestsFile:               denylistedDigestsFile,
+			StorageFullProbeInterval:            storageFullProbeInterval,
+			RegistryClientCertificates:          parsedRegistryClientCerts,
+			ForceBlobDownloadsViaRegistry:       forceBlobDownloadsViaRegistry,
+		},
+		NotifyURL:                        notifyURL,
+		DebugEndpoint:                    enableDebugEndpoint,
+		DebugEndpointToken:               debugEndpointToken,
+		ReplicatePullSecret:              parsedReplicatePullSecret,
+		ReplicatePullSecretCascadeDelete: replicatePullSecretCascadeDelete,
+	}
+
+	config.DisableClusterScopedFeatures(setupLog)
+
+	ctx := ctrl.SetupSignalHandler()
+
+	imageCopier := &copier.Copier{
+		Options:      config.CopierOptions,
+		AsyncContext: ctx,
+		Transport:    copier.NewTransport(config.CopierOptions.RegistryClientCertificates),
+	}
+
+	if !skipStartupChecks {
+		// the checks use the copier's credentials and client certificates, so they run after all flags are parsed
+		if err := runStartupChecks(ctx, imageCopier, config, startupCheckPush); err != nil {
+			setupLog.Error(err, "startup checks failed, use --skip-startup-checks to skip them")
+			os.Exit(1)
+		}
+	}
+
+	if exportMapping != "" {
+		// the manager is not created, so that the mapping manifest can be exported without a cluster
+		if err := exportMappingManifest(ctx, imageCopier, config, exportMapping); err != nil {
+			setupLog.Error(err, "exporting mapping manifest failed")
+			os.Exit(1)
+		}
+		return
+	}
+
+	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), mgrOptions)
+	if err != nil {
+		setupLog.Error(err, "unable to start manager")
+		os.Exit(1)
+	}
+
+	if config.NamespacedRBAC {
+		setupLog.Info("verifying permissions in watched namespaces", "namespaces", config.WatchNamespaces)
+		verifyCtx, cancel := context.WithTimeout(ctx, time.Minute)
+		err := controllers.VerifyAccess(verifyCtx, mgr.GetClient(), config)
+		cancel()
+		if err != nil {
+			setupLog.Error(err, "insufficient permissions for namespaced RBAC mode")
+			os.Exit(1)
+		}
+	}
+
+	if config.DebugEndpoint {
+		if err := mgr.AddMetricsExtraHandler(copier.DebugPath, imageCopier.DebugHandler(config.DebugEndpointToken)); err != nil {
+			setupLog.Error(err, "unable to set up debug endpoint")
+			os.Exit(1)
+		}
+		if err := mgr.AddMetricsExtraHandler(controllers.ConfigPath, controllers.ConfigHandler(config, config.DebugEndpointToken)); err != nil {
+			setupLog.Error(err, "unable to set up config endpoint")
+			os.Exit(1)
+		}
+	}
+
+	var notifier notify.Sink = notify.NopSink{}
+	if config.NotifyURL != "" {
+		httpSink := &notify.HTTPSink{URL: config.NotifyURL, Log: ctrl.Log.WithName("notify")}
+		if err := mgr.Add(httpSink); err != nil {
+			setupLog.Error(err, "unable to set up notifications")
+			os.Exit(1)
+		}
+		notifier = httpSink
+	}
+
+	// the decisions are shared by all consumers of the rewrite decision logic
+	var decisions *controllers.RewriteDecisions
+	if rewriteDecisionTTL > 0 {
+		decisions = &controllers.RewriteDecisions{TTL: rewriteDecisionTTL}
+		for _, creds := range parsedSourceCredentials {
+			creds.OnChange = decisions.Invalidate
+		}
+	}
+
+	imageCloneController := &controllers.ImageCloneController{
+		Client:    mgr.GetClient(),
+		Recorder:  mgr.GetEventRecorderFor(controllers.ImageCloneControllerName + "-controller"),
+		Copier:    imageCopier,
+		Decisions: decisions,
+		Notifier:  notifier,
+		Config:    *config,
+	}
+
+	if dedupe {
+		// the manager's cache is not started for one-shot tasks
+		directClient, err := client.New(mgr.GetConfig(), client.Options{Scheme: mgr.GetScheme(), Mapper: mgr.GetRESTMapper()})
+		if err != nil {
+			setupLog.Error(err, "unable to create client")
+			os.Exit(1)
+		}
+		imageCloneController.Client = directClient
+
+		if err := imageCloneController.Dedupe(ctx, ctrl.Log.WithName("dedupe"), controllers.DedupeOptions{
+			DryRun:           dedupeDryRun,
+			DeleteDuplicates: dedupeDelete,
+			ChunkSize:        dedupeChunkSize,
+		}); err != nil {
+			setupLog.Error(err, "deduplication failed")
+			os.Exit(1)
+		}
+		return
+	}
+
+	setupLog.Info("configuring controllers", "deployments", enableDeployments, "daemonSets", enableDaemonSets)
+	if err = imageCloneController.SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", controllers.ImageCloneControllerName)
 		os.Exit(1)
 	}
+
+	if config.ReplicatePullSecret.Name != "" {
+		if err = (&controllers.PullSecretController{
+			Client:            mgr.GetClient(),
+			Source:            config.ReplicatePullSecret,
+			CascadeDelete:     config.ReplicatePullSecretCascadeDelete,
+			IgnoredNamespaces: config.IgnoredNamespaces(),
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", controllers.PullSecretControllerName)
+			os.Exit(1)
+		}
+	}
+
+	setupLog.Info("effective configuration", "snapshot", config.Snapshot())
 	//+kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
 		setupLog.Error(err, "unable to set up health check")
 		os.Exit(1)
 	}
-	if err := mgr.AddReadyzCheck("readyz", healthz.Ping); err != nil {
+	readyzCheck := healthz.Ping
+	if !config.ReadyWithoutSync {
+		var lease *client.ObjectKey
+		if enableLeaderElection && config.PodNamespace != "" && shardCount <= 1 {
+			// standby replicas are ready as long as the leader is active, shards reconcile their workloads themselves
+			lease = &client.ObjectKey{Namespace: config.PodNamespace, Name: mgrOptions.LeaderElectionID}
+		}
+		readyzCheck = imageCloneController.ReadyzCheck(mgr.GetAPIReader(), lease)
+	}
+	if err := mgr.AddReadyzCheck("readyz", readyzCheck); err != nil {
 		setupLog.Error(err, "unable to set up ready check")
 		os.Exit(1)
 	}
+	// the controller is not ready as long as any enabled feature lacks permissions
+	if err := mgr.AddReadyzCheck("permissions", controllers.PermissionsCheck(mgr.GetClient(), config)); err != nil {
+		setupLog.Error(err, "unable to set up permissions check")
+		os.Exit(1)
+	}
 
 	setupLog.Info("starting manager")
-	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
+	if err := mgr.Start(ctx); err != nil {
 		setupLog.Error(err, "problem running manager")
 		os.Exit(1)
 	}
 }
+
+// exportMappingManifest writes the mapping manifest of the backup registry to the given file, see
+// controllers.MappingManifest. If the cluster is reachable, its workloads are used as hints.
+func exportMappingManifest(ctx context.Context, imageCopier *copier.Copier, config *controllers.Config, path string) error {
+	log := ctrl.Log.WithName("mapping-manifest")
+	imageCloneController := &controllers.ImageCloneController{Copier: imageCopier, Config: *config}
+
+	var hints client.Reader
+	if restConfig, err := ctrl.GetConfig(); err != nil {
+		log.Info("No cluster configured, generating mapping manifest from the backup registry only", "error", err.Error())
+	} else if directClient, err := client.New(restConfig, client.Options{Scheme: scheme}); err != nil {
+		log.Info("Cluster is not reachable, generating mapping manifest from the backup registry only", "error", err.Error())
+	} else {
+		hints = directClient
+	}
+
+	manifest, err := imageCloneController.MappingManifest(ctx, log, hints, controllers.DefaultListChunkSize)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	if path == "-" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+func runStartupChecks(ctx context.Context, imageCopier *copier.Copier, config *controllers.Config, push bool) error {
+	if err := controllers.ValidateBackupRegistry(config.NamingConfig(config.BackupRegistry, "")); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	setupLog.Info("checking backup registry", "registry", config.BackupRegistry.Name(), "push", push)
+	return imageCopier.CheckRegistry(ctx, setupLog, config.BackupRegistry, push)
+}
+
+// stringSliceFlag is a flag.Value for flags that can be specified multiple times or with comma-separated values.
+type stringSliceFlag []string
+
+func (s *stringSliceFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringSliceFlag) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*s = append(*s, v)
+		}
+	}
+	return nil
+}
+
+// stringArrayFlag is a flag.Value for flags that can be specified multiple times, whose values may contain commas.
+type stringArrayFlag []string
+
+func (s *stringArrayFlag) String() string {
+	return strings.Join(*s, " ")
+}
+
+func (s *stringArrayFlag) Set(value string) error {
+	if value = strings.TrimSpace(value); value != "" {
+		*s = append(*s, value)
+	}
+	return nil
+}
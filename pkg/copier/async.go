@@ -0,0 +1,159 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package copier
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// ErrCopyPending is returned by CopyAsync if the copy is still running in the background.
+var ErrCopyPending = errors.New("copy is pending")
+
+// IsCopyPending checks whether the given error indicates that a copy is still running in the background.
+func IsCopyPending(err error) bool {
+	return errors.Is(err, ErrCopyPending)
+}
+
+// asyncResultTTL is the duration for which the result of an asynchronous copy is returned to callers waiting for the
+// copy. Afterwards, the copy is started again.
+const asyncResultTTL = time.Minute
+
+type asyncCopies struct {
+	lock    sync.Mutex
+	running map[string]*runningCopy
+	results map[string]asyncResult
+}
+
+type runningCopy struct {
+	// sources are the source references of all callers waiting for the copy, they are published on completion
+	sources []string
+}
+
+type asyncResult struct {
+	copied   bool
+	err      error
+	stats    *ImageStats
+	finished time.Time
+}
+
+// CopyAsync copies the given source image to the given destination in the background. It returns ErrCopyPending until
+// the copy has finished, afterwards it returns the copy's result. Concurrent calls for the same destination share a
+// single copy.
+// The shared copy doesn't use the context of any caller, so cancelled callers don't affect the other callers. Failed
+// copies return their error to all callers until the result expires. Callers ignoring the size limit (see
+// WithoutSizeLimit) don't share copies with other callers, as the limit changes the result.
+// When a copy has finished, the source references of all callers waiting for it are passed to OnCopyFinished.
+func (c *Copier) CopyAsync(ctx context.Context, log logr.Logger, src name.Reference, dst name.Tag) (bool, error) {
+	key := dst.Name()
+	if sizeLimitDisabled(ctx) {
+		key += " (without size limit)"
+	}
+
+	c.async.lock.Lock()
+	defer c.async.lock.Unlock()
+
+	if result, ok := c.async.results[key]; ok {
+		if time.Since(result.finished) < asyncResultTTL {
+			if result.stats != nil {
+				recordImageStats(ctx, dst, *result.stats)
+			}
+			return result.copied, result.err
+		}
+		delete(c.async.results, key)
+	}
+
+	if running, ok := c.async.running[key]; ok {
+		running.sources = appendIfMissing(running.sources, src.String())
+		return false, ErrCopyPending
+	}
+
+	if c.async.running == nil {
+		c.async.running = make(map[string]*runningCopy)
+		c.async.results = make(map[string]asyncResult)
+	}
+	running := &runningCopy{sources: []string{src.String()}}
+	c.async.running[key] = running
+
+	// the copy outlives the reconciliation that started it
+	copyCtx := c.AsyncContext
+	if copyCtx == nil {
+		copyCtx = context.Background()
+	}
+	copyCtx = WithPriority(copyCtx, priorityFrom(ctx))
+	copyCtx = withPrefetched(copyCtx, ctx)
+	if sizeLimitDisabled(ctx) {
+		copyCtx = WithoutSizeLimit(copyCtx)
+	}
+	copyCtx = WithImageStats(copyCtx)
+	if digest, ok := sourceDigestFrom(ctx); ok {
+		copyCtx = WithSourceDigest(copyCtx, digest)
+	}
+	if kind, ok := ctx.Value(kindKey{}).(string); ok {
+		copyCtx = WithKind(copyCtx, kind)
+	}
+
+	go func() {
+		copied, err := c.Copy(copyCtx, log, src, dst)
+		if err != nil {
+			log.Error(err, "Failed copying image asynchronously")
+		}
+
+		c.async.lock.Lock()
+		delete(c.async.running, key)
+		c.async.pruneResults()
+		result := asyncResult{copied: copied, err: err, finished: time.Now()}
+		if stats, ok := ImageStatsFrom(copyCtx, dst); ok {
+			result.stats = &stats
+		}
+		c.async.results[key] = result
+		sources := running.sources
+		c.async.lock.Unlock()
+
+		if c.OnCopyFinished != nil {
+			for _, source := range sources {
+				c.OnCopyFinished(source)
+			}
+		}
+	}()
+
+	return false, ErrCopyPending
+}
+
+// pruneResults deletes expired results of destinations that have not been requested again. It must be called with the
+// lock held.
+func (a *asyncCopies) pruneResults() {
+	for key, result := range a.results {
+		if time.Since(result.finished) >= asyncResultTTL {
+			delete(a.results, key)
+		}
+	}
+}
+
+func appendIfMissing(s []string, v string) []string {
+	for _, existing := range s {
+		if existing == v {
+			return s
+		}
+	}
+	return append(s, v)
+}
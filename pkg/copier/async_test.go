@@ -0,0 +1,163 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package copier
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// waitForCopies waits until the given number of sources were published by OnCopyFinished and returns them sorted.
+func waitForCopies(t *testing.T, finished <-chan string, n int) []string {
+	t.Helper()
+
+	var sources []string
+	for len(sources) < n {
+		select {
+		case source := <-finished:
+			sources = append(sources, source)
+		case <-time.After(10 * time.Second):
+			t.Fatalf("only %d of %d sources were published by OnCopyFinished", len(sources), n)
+		}
+	}
+	sort.Strings(sources)
+	return sources
+}
+
+// gateTransport holds back all requests until it is opened.
+type gateTransport struct {
+	open chan struct{}
+}
+
+func (t *gateTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	<-t.open
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestCopyAsync(t *testing.T) {
+	upstream := newTestRegistryHost(t)
+	img, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag, err := name.NewTag(upstream.RegistryStr()+"/library/app:v1", name.Insecure)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(tag, img); err != nil {
+		t.Fatal(err)
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pinned := tag.Context().Digest(digest.String())
+
+	// newCopier returns a copier with a fresh backup registry and the destination of the given repository in it. The
+	// copier doesn't send any request until the returned func is called, so that all waiters join the running copies.
+	newCopier := func(t *testing.T, repository string) (*Copier, name.Tag, func(), <-chan string) {
+		finished := make(chan string, 10)
+		dst, err := name.NewTag(newTestRegistryHost(t).RegistryStr()+"/"+repository+":v1", name.Insecure)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gate := &gateTransport{open: make(chan struct{})}
+		c := &Copier{Transport: gate, OnCopyFinished: func(source string) { finished <- source }}
+		return c, dst, func() { close(gate.open) }, finished
+	}
+
+	t.Run("cancelled waiter", func(t *testing.T) {
+		c, dst, start, finished := newCopier(t, "library/app")
+
+		// the copy is started by a reconciliation that is cancelled right away, e.g., because its timeout is reached
+		cancelled, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err := c.CopyAsync(cancelled, logr.Discard(), tag, dst); !IsCopyPending(err) {
+			t.Fatalf("first waiter got error %v, want pending copy", err)
+		}
+		if _, err := c.CopyAsync(context.Background(), logr.Discard(), pinned, dst); !IsCopyPending(err) {
+			t.Fatalf("second waiter got error %v, want pending copy", err)
+		}
+
+		start()
+
+		// both waiters are notified once, although they share a single copy
+		want := []string{pinned.String(), tag.String()}
+		sort.Strings(want)
+		if sources := waitForCopies(t, finished, 2); strings.Join(sources, ",") != strings.Join(want, ",") {
+			t.Errorf("published sources = %v, want %v", sources, want)
+		}
+		for _, ctx := range []context.Context{cancelled, context.Background()} {
+			copied, err := c.CopyAsync(ctx, logr.Discard(), tag, dst)
+			if err != nil || !copied {
+				t.Errorf("waiter got copied = %v, error = %v, want the result of the successful copy", copied, err)
+			}
+		}
+	})
+
+	t.Run("failed copy", func(t *testing.T) {
+		c, dst, start, finished := newCopier(t, "library/missing")
+		missing := tag.Context().Tag("missing")
+
+		for _, src := range []name.Reference{missing, missing} {
+			if _, err := c.CopyAsync(context.Background(), logr.Discard(), src, dst); !IsCopyPending(err) {
+				t.Fatalf("waiter got error %v, want pending copy", err)
+			}
+		}
+		start()
+		waitForCopies(t, finished, 1)
+
+		// every waiter gets the error to emit its own event
+		for i := 0; i < 2; i++ {
+			if _, err := c.CopyAsync(context.Background(), logr.Discard(), missing, dst); err == nil || IsCopyPending(err) {
+				t.Errorf("waiter %d got error %v, want the error of the failed copy", i, err)
+			}
+		}
+	})
+
+	t.Run("size limit", func(t *testing.T) {
+		c, dst, start, finished := newCopier(t, "library/app")
+		c.MaxImageSize = 1
+
+		limited, unlimited := context.Background(), WithoutSizeLimit(context.Background())
+		for _, ctx := range []context.Context{limited, unlimited} {
+			if _, err := c.CopyAsync(ctx, logr.Discard(), tag, dst); !IsCopyPending(err) {
+				t.Fatalf("waiter got error %v, want pending copy", err)
+			}
+		}
+		start()
+
+		// the waiters don't share the copy, so both copies publish the source
+		waitForCopies(t, finished, 2)
+
+		if _, err := c.CopyAsync(limited, logr.Discard(), tag, dst); !IsImageTooLarge(err) {
+			t.Errorf("waiter with size limit got error %v, want image too large", err)
+		}
+		if copied, err := c.CopyAsync(unlimited, logr.Discard(), tag, dst); err != nil || !copied {
+			t.Errorf("waiter without size limit got copied = %v, error = %v, want a successful copy", copied, err)
+		}
+	})
+}
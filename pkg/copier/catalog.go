@@ -0,0 +1,47 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package copier
+
+import (
+	"context"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func (c *Copier) remoteOptions(ctx context.Context) []remote.Option {
+	return []remote.Option{
+		remote.WithContext(ctx),
+		remote.WithAuthFromKeychain(c.keychain()),
+		remote.WithTransport(c.transport()),
+	}
+}
+
+// Repositories lists all repositories in the given registry using the catalog API. Not all registries support it.
+func (c *Copier) Repositories(ctx context.Context, registry name.Registry) ([]string, error) {
+	return remote.Catalog(ctx, registry, c.remoteOptions(ctx)...)
+}
+
+// Tags lists all tags in the given repository.
+func (c *Copier) Tags(ctx context.Context, repository name.Repository) ([]string, error) {
+	return remote.ListWithContext(ctx, repository, c.remoteOptions(ctx)...)
+}
+
+// Delete deletes the manifest with the given digest. Registries remove all tags referencing it.
+func (c *Copier) Delete(ctx context.Context, digest name.Digest) error {
+	return remote.Delete(digest, c.remoteOptions(ctx)...)
+}
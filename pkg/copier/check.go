@@ -0,0 +1,80 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package copier
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-logr/logr"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+// CheckRepository is the repository used for verifying write access to the backup registry.
+const CheckRepository = "image-clone-controller/startup-check"
+
+// checkTag is the tag of the test image pushed to the CheckRepository. It is fixed, so that at most one test image is
+// left behind in registries that don't support deleting images.
+const checkTag = "latest"
+
+// CheckRegistry verifies that the given registry is reachable and that we can authenticate against it with the
+// copier's credentials and transport.
+// If push is true, it additionally pushes and deletes a tiny test image to the CheckRepository to verify write access.
+func (c *Copier) CheckRegistry(ctx context.Context, log logr.Logger, registry name.Registry, push bool) error {
+	repo, err := name.NewRepository(registry.RegistryStr() + "/" + CheckRepository)
+	if err != nil {
+		return err
+	}
+
+	auth, err := c.keychain().Resolve(registry)
+	if err != nil {
+		return fmt.Errorf("failed resolving credentials for registry %q: %w", registry.Name(), err)
+	}
+
+	// creating the transport pings the registry's /v2/ endpoint and performs the auth handshake
+	scopes := []string{repo.Scope(transport.PullScope)}
+	if push {
+		scopes = []string{repo.Scope(transport.PushScope)}
+	}
+	if _, err := transport.NewWithContext(ctx, registry, auth, c.transport(), scopes); err != nil {
+		return fmt.Errorf("failed connecting to registry %q, please check that the registry address is correct and reachable and that credentials are configured: %w", registry.Name(), err)
+	}
+
+	if !push {
+		return nil
+	}
+
+	tag := repo.Tag(checkTag)
+	if err := remote.Write(tag, empty.Image, c.remoteOptions(ctx)...); err != nil {
+		return fmt.Errorf("failed pushing test image %q, please check that the configured credentials grant write access: %w", tag.Name(), err)
+	}
+
+	digest, err := empty.Image.Digest()
+	if err != nil {
+		return err
+	}
+	// registries like registry:2 reject deleting tags, deleting the manifest removes the tag as well
+	if err := c.Delete(ctx, repo.Digest(digest.String())); err != nil {
+		// not all registries support deleting images, write access is verified anyway
+		log.Info("Failed deleting test image from registry", "image", tag.Name(), "error", err.Error())
+	}
+
+	return nil
+}
@@ -0,0 +1,80 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package copier
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+
+	"github.com/timebertt/image-clone-controller/pkg/test"
+)
+
+// recordingTransport records the method, path, and User-Agent of all requests.
+type recordingTransport struct {
+	lock     sync.Mutex
+	requests []*http.Request
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.lock.Lock()
+	t.requests = append(t.requests, req)
+	t.lock.Unlock()
+	return remote.DefaultTransport.RoundTrip(req)
+}
+
+func TestCheckRegistryPush(t *testing.T) {
+	reg, err := test.NewRegistry()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reg.Close()
+
+	rt := &recordingTransport{}
+	c := &Copier{Transport: rt}
+	if err := c.CheckRegistry(context.Background(), logr.Discard(), reg.Registry, true); err != nil {
+		t.Fatalf("CheckRegistry returned error: %v", err)
+	}
+
+	digest, err := empty.Image.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var deleted bool
+	for _, req := range rt.requests {
+		if !strings.HasPrefix(req.Header.Get("User-Agent"), DefaultUserAgentPrefix) {
+			t.Errorf("request %s %s was not sent via the copier's transport, User-Agent: %q", req.Method, req.URL.Path, req.Header.Get("User-Agent"))
+		}
+		if req.Method != http.MethodDelete {
+			continue
+		}
+		if want := "/v2/" + CheckRepository + "/manifests/" + digest.String(); req.URL.Path != want {
+			t.Errorf("test image was deleted via %q, want %q", req.URL.Path, want)
+		}
+		deleted = true
+	}
+	if !deleted {
+		t.Error("test image was not deleted")
+	}
+}
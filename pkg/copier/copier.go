@@ -0,0 +1,462 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package copier implements copying images from their source registries to the backup registry.
+//
+// Memory model: copies must stream layers from the source to the destination registry. Layers of remote images are
+// fetched lazily by remote.Write, so only manifests and configs are held in memory. Code in the copy path must never
+// read complete layers into memory (e.g., via io.ReadAll). Features that need random access to layer contents must
+// spill them to a temporary file instead. TestCopyMemoryBounded guards this.
+package copier
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// Options configures the behavior of a Copier.
+type Options struct {
+	// ProgressInterval configures how often the progress of running copies is logged. Zero disables logging in an
+	// interval.
+	ProgressInterval time.Duration
+	// ProgressBytes configures after how many transferred bytes the progress of running copies is logged in addition to
+	// ProgressInterval, so that fast copies of large images are reported more often. Zero disables it.
+	ProgressBytes int64
+	// StallTimeout configures after which duration without any transferred bytes a copy is considered stalled and
+	// cancelled. Zero disables stall detection.
+	StallTimeout time.Duration
+	// RegistryHostRewrites maps source registry hosts to the registry that should be used for pulling images instead.
+	// This allows pulling images that are referenced via a host that is not reachable from the controller, e.g.,
+	// localhost registries. Rewrites don't affect the destination of copied images.
+	RegistryHostRewrites map[string]name.Registry
+	// SourceCredentials are static credentials per registry host, which are used before the default keychain.
+	SourceCredentials map[string]*StaticCredentials
+	// MaxConcurrentCopies limits the number of concurrent copies. Zero means unlimited.
+	// ReservedInteractiveCopies is the number of copy slots that are reserved for copies with PriorityInteractive, so
+	// that background copies can't delay copies of new workloads. Background copies also yield to interactive copies
+	// waiting for a slot.
+	MaxConcurrentCopies       int
+	ReservedInteractiveCopies int
+	// RegistryConcurrency limits the number of concurrent copies per destination registry host in addition to
+	// MaxConcurrentCopies, see ParseRegistryConcurrency. RegistryCheckConcurrency limits the number of concurrent
+	// existence checks per registry host. Hosts without a limit are not limited.
+	RegistryConcurrency      map[string]int
+	RegistryCheckConcurrency map[string]int
+	// MaxCopyBytesPerHour is the maximum number of bytes that copies transfer within a sliding window of one hour. New
+	// copies are deferred with an *EgressBudgetExhaustedError while the budget is exhausted, copies in progress are never
+	// aborted. Zero disables the budget.
+	// ReservedInteractiveCopyBytesPerHour is the part of the budget that is reserved for copies with PriorityInteractive.
+	MaxCopyBytesPerHour                 int64
+	ReservedInteractiveCopyBytesPerHour int64
+	// MaxImageSize is the maximum size of images that are copied, see WithoutSizeLimit. Zero disables the limit.
+	MaxImageSize int64
+	// CopyReferrers enables copying the referrers of copied images (OCI 1.1 artifacts like SBOMs) to the destination
+	// repository.
+	CopyReferrers bool
+	// CopyParentIndex enables copying the index containing a platform image that the source references by digest along
+	// with it, so that the backup registry contains all platforms of the image, see copyParentIndex.
+	CopyParentIndex bool
+	// ForceBlobDownloadsViaRegistry refuses to follow redirects of blob downloads to different hosts (e.g., presigned
+	// URLs of S3 or GCS), so that blobs are only downloaded from registries that serve them via their own endpoint.
+	// Copies from registries that redirect blob downloads fail with a *BlobRedirectError instead.
+	ForceBlobDownloadsViaRegistry bool
+	// RegistryClientCertificates are the client certificates per registry host for creating the Transport, see
+	// NewTransport.
+	RegistryClientCertificates map[string]ClientCertificate
+	// DenylistedDigestsFile is a file containing digests that are never copied, see ReadDigestDenylist. The file is
+	// reloaded when it changes.
+	DenylistedDigestsFile string
+	// StorageFullProbeInterval is the interval of probe copies to a destination registry that ran out of storage, see
+	// StorageFullError. Defaults to DefaultStorageFullProbeInterval.
+	StorageFullProbeInterval time.Duration
+	// UserAgentPrefix is the product name in the User-Agent of all registry requests, e.g., for distinguishing multiple
+	// instances in the registry's access logs, see userAgentTransport. Defaults to DefaultUserAgentPrefix.
+	UserAgentPrefix string
+}
+
+// Copier copies images from their source registries to the backup registry.
+type Copier struct {
+	Options
+
+	// Transport is the base transport for all registry requests, see NewTransport. Defaults to remote.DefaultTransport.
+	Transport http.RoundTripper
+
+	// AsyncContext is used for copies started by CopyAsync, as they outlive the reconciliation that started them.
+	// Defaults to context.Background().
+	AsyncContext context.Context
+	// OnCopyFinished is called with the source references of copies started by CopyAsync when they have finished.
+	OnCopyFinished func(source string)
+
+	headCapabilities headCapabilities
+	copies           copyStates
+	async            asyncCopies
+	slots            copySlots
+	denylist         digestDenylist
+	repositories     repositoryLocks
+	registries       registryLimits
+	egress           egressBudget
+	storage          storageBreakers
+	partialUploads   partialUploads
+}
+
+// Copy copies the given source image or index to the given destination. If the destination already exists or could
+// be tagged from an existing manifest, no blobs are transferred and copied is false.
+// Copies to the same destination repository are serialized, copies to different repositories run in parallel, limited
+// by MaxConcurrentCopies and RegistryConcurrency of the destination registry.
+// If the source image or one of its platform images has a denylisted digest, a *DeniedImageError is returned.
+// If the copy doesn't make progress for the configured StallTimeout, it is cancelled and a *StallError is returned.
+// If the egress budget is exhausted, the copy is not started and an *EgressBudgetExhaustedError is returned.
+// If a blob download redirected to a different host fails, a *BlobRedirectError is returned.
+// If the destination registry ran out of storage, a *StorageFullError is returned, and further copies to it are not
+// started until a probe copy succeeds.
+// The source digest is resolved once (unless it is given by WithSourceDigest), and all following steps (checking the
+// denylist, retagging and transferring the image) use that digest, so that the destination never holds a different
+// digest than the one that was checked.
+// When retrying the copy, blobs that have already been uploaded to the destination are not uploaded again, as
+// remote.Write checks for existing blobs before uploading them.
+func (c *Copier) Copy(ctx context.Context, log logr.Logger, src name.Reference, dst name.Tag) (copied bool, err error) {
+	srcDigest, upToDate, err := c.resolve(ctx, src, dst)
+	if srcDigest != (v1.Hash{}) {
+		// neither retag nor rewrite images with a denylisted digest
+		if err := c.checkDenied(src.Name(), srcDigest); err != nil {
+			return false, err
+		}
+	}
+	if err != nil {
+		log.Error(err, "Failed checking if image already exists in backup registry, copying anyway")
+	} else if upToDate {
+		log.V(1).Info("Image already exists in backup registry, skipping copy")
+		return false, nil
+	} else if srcDigest != (v1.Hash{}) {
+		retagged, err := c.retag(ctx, srcDigest, dst)
+		if err != nil {
+			log.Error(err, "Failed retagging existing image in backup registry, copying anyway")
+		} else if retagged {
+			prefetchedFrom(ctx).forget(dst)
+			log.Info("Image with the same digest already exists in backup registry, retagged it instead of copying")
+			retagsTotal.WithLabelValues(registryLabel(src.Context().Registry)).Inc()
+			return false, nil
+		}
+	}
+
+	// the destination is written even if the transfer fails midway
+	defer prefetchedFrom(ctx).forget(dst)
+	_, pinned := src.(name.Digest)
+	return true, c.transfer(ctx, log, anchorDigest(src, srcDigest), pinned, dst)
+}
+
+// anchorDigest returns the given source image referenced by the given resolved digest, so that the copy transfers
+// exactly the content that has been checked, even if the source tag is moved to a different digest in the meantime.
+// The source is returned unchanged if it couldn't be resolved, so that the copy reports missing source images.
+func anchorDigest(src name.Reference, digest v1.Hash) name.Reference {
+	if _, ok := src.(name.Digest); ok || digest == (v1.Hash{}) {
+		return src
+	}
+	return src.Context().Digest(digest.String())
+}
+
+// transfer copies the given source image to the given destination, see Copy.
+// pinned indicates that the caller referenced the source by digest, as src is always anchored to a digest.
+func (c *Copier) transfer(ctx context.Context, log logr.Logger, src name.Reference, pinned bool, dst name.Tag) (err error) {
+	// copies that have started are never aborted by the budget, so it is only checked before starting
+	if err := c.egress.check(log, time.Now(), c.MaxCopyBytesPerHour, c.ReservedInteractiveCopyBytesPerHour, priorityFrom(ctx)); err != nil {
+		return err
+	}
+	if err := c.storage.check(dst.Context().Registry, time.Now(), c.storageFullProbeInterval()); err != nil {
+		return err
+	}
+	defer func() {
+		err = c.storage.record(log, dst.Context().Registry, time.Now(), c.storageFullProbeInterval(), err)
+	}()
+
+	// wait for other copies to the same repository before occupying a copy slot
+	unlock, err := c.repositories.acquire(ctx, dst.Context().Name())
+	if err != nil {
+		return fmt.Errorf("failed waiting for other copies to repository %q: %w", dst.Context().Name(), err)
+	}
+	defer unlock()
+
+	// wait for the destination registry before occupying a copy slot, so that copies to other registries can proceed
+	releaseRegistry, err := c.registries.acquire(ctx, registryOperationPush, dst.Context().Registry, c.RegistryConcurrency)
+	if err != nil {
+		return fmt.Errorf("failed waiting for other copies to registry %q: %w", dst.Context().RegistryStr(), err)
+	}
+	defer releaseRegistry()
+
+	release, err := c.slots.acquire(ctx, c.MaxConcurrentCopies, c.ReservedInteractiveCopies, priorityFrom(ctx))
+	if err != nil {
+		return fmt.Errorf("failed waiting for a free copy slot: %w", err)
+	}
+	defer release()
+
+	sourceRegistry := registryLabel(src.Context().Registry)
+	active := c.copies.start(src.Name(), dst.Name())
+	defer func() {
+		copiesTotal.WithLabelValues(sourceRegistry, resultLabel(err)).Inc()
+		c.copies.finish(active, err)
+	}()
+
+	bytesTotal := copyBytesTotal.WithLabelValues(sourceRegistry)
+	count := func(n int) {
+		bytesTotal.Add(float64(n))
+		c.egress.add(time.Now(), int64(n))
+	}
+	existingBytesTotal := copyExistingBlobBytesTotal.WithLabelValues(sourceRegistry)
+	resumedBytesTotal := copyResumedBlobBytesTotal.WithLabelValues(sourceRegistry)
+
+	uploads := c.partialUploads.start(dst.Context().Name())
+	defer func() { c.partialUploads.finish(dst.Context().Name(), uploads, err) }()
+	rt := &countingTransport{
+		base:     c.transport(),
+		count:    count,
+		existing: func(n int64) { existingBytesTotal.Add(float64(n)) },
+		resumed:  func(n int64) { resumedBytesTotal.Add(float64(n)) },
+		uploads:  uploads,
+	}
+
+	if c.ProgressInterval <= 0 && c.ProgressBytes <= 0 && c.StallTimeout <= 0 {
+		return c.copy(ctx, log, src, pinned, dst, rt, nil)
+	}
+
+	tracker := newProgressTracker(dst.Name(), c.ProgressBytes)
+	defer tracker.done()
+	c.copies.setTracker(active, tracker)
+	rt.count = func(n int) {
+		count(n)
+		tracker.add(n)
+	}
+
+	if c.StallTimeout <= 0 {
+		return c.copy(ctx, log, src, pinned, dst, rt, tracker)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stalled := tracker.cancelOnStall(ctx, cancel, c.StallTimeout)
+
+	if err := c.copy(ctx, log, src, pinned, dst, rt, tracker); err != nil {
+		if stalled() {
+			copyStallsTotal.Inc()
+			return &StallError{Timeout: c.StallTimeout, LastProgress: tracker.lastProgressTime(), err: err}
+		}
+		return err
+	}
+
+	return nil
+}
+
+type sourceDigestKey struct{}
+
+// WithSourceDigest returns a context that makes Copier.Copy copy the given digest of the source image instead of
+// resolving the source reference again, e.g., because the caller references the copied image by this digest.
+func WithSourceDigest(ctx context.Context, digest v1.Hash) context.Context {
+	return context.WithValue(ctx, sourceDigestKey{}, digest)
+}
+
+func sourceDigestFrom(ctx context.Context) (v1.Hash, bool) {
+	digest, ok := ctx.Value(sourceDigestKey{}).(v1.Hash)
+	return digest, ok && digest != (v1.Hash{})
+}
+
+// resolve returns the digest of the source image and checks whether the destination already exists with the same
+// digest. The returned digest is empty if the source image doesn't exist. A digest given by WithSourceDigest is used
+// without resolving the source image.
+func (c *Copier) resolve(ctx context.Context, src name.Reference, dst name.Tag) (srcDigest v1.Hash, upToDate bool, err error) {
+	srcDigest, exists := sourceDigestFrom(ctx)
+	if !exists {
+		srcDigest, exists, err = c.Resolve(ctx, src)
+	}
+	if err != nil || !exists {
+		// let the copy report missing source images
+		return v1.Hash{}, false, err
+	}
+
+	dstDigest, exists, err := c.Exists(ctx, dst)
+	if err != nil {
+		return srcDigest, false, err
+	}
+	return srcDigest, exists && dstDigest == srcDigest, nil
+}
+
+// retag tags an existing manifest with the given digest in the destination repository with the destination tag,
+// e.g., if a workload switches to a different tag of the same image. This only uploads the manifest instead of
+// copying any blobs. It returns false if the destination repository doesn't contain a manifest with the given digest.
+func (c *Copier) retag(ctx context.Context, digest v1.Hash, dst name.Tag) (bool, error) {
+	ctx = WithOperation(ctx, OperationCopyPush)
+	options := []remote.Option{
+		remote.WithContext(ctx),
+		remote.WithAuthFromKeychain(c.keychain()),
+		remote.WithTransport(c.transport()),
+	}
+
+	desc, err := remote.Get(dst.Context().Digest(digest.String()), options...)
+	if err != nil {
+		if IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	if err := remote.Tag(dst, desc, options...); err != nil {
+		return false, fmt.Errorf("failed tagging existing manifest: %w", err)
+	}
+	return true, nil
+}
+
+func (c *Copier) copy(ctx context.Context, log logr.Logger, src name.Reference, pinned bool, dst name.Tag, rt http.RoundTripper, tracker *progressTracker) error {
+	ctx = withCopyOperation(ctx, dst.Context().Registry)
+	options := []remote.Option{
+		remote.WithContext(ctx),
+		remote.WithAuthFromKeychain(c.keychain()),
+		remote.WithTransport(rt),
+	}
+
+	pullSrc, err := c.pullReference(src)
+	if err != nil {
+		return err
+	}
+
+	desc, err := remote.Get(pullSrc, options...)
+	if err != nil {
+		if IsNotFound(err) {
+			return &SourceNotFoundError{Source: pullSrc.Name(), err: err}
+		}
+		return fmt.Errorf("fetching %q: %w", pullSrc.Name(), c.wrapAuthError(pullSrc.Context().Registry, err))
+	}
+
+	digests, err := manifestDigests(desc)
+	if err != nil {
+		return err
+	}
+	if err := c.checkDenied(src.Name(), digests...); err != nil {
+		return err
+	}
+
+	if err := c.checkSize(ctx, src.Name(), desc); err != nil {
+		if IsImageTooLarge(err) {
+			imagesTooLargeTotal.WithLabelValues(registryLabel(src.Context().Registry)).Inc()
+		}
+		return err
+	}
+
+	encrypted, err := hasEncryptedLayers(desc)
+	if err != nil {
+		return fmt.Errorf("failed checking for encrypted layers of %q: %w", pullSrc.Name(), err)
+	}
+	if encrypted {
+		log.V(1).Info("Image has encrypted layers, copying it verbatim and verifying its digest")
+	}
+
+	pinnedPlatform := pinsPlatformImage(pinned, desc)
+	var parentIndex v1.Hash
+	if pinnedPlatform && c.CopyParentIndex {
+		// copy all platforms, but keep the destination tag referencing the pinned platform image
+		if parentIndex, err = c.copyParentIndex(ctx, log, pullSrc.Context(), desc.Digest, dst.Context(), options); err != nil {
+			log.Error(err, "Failed copying parent index of pinned platform image, copying only the pinned platform image")
+		}
+	}
+
+	if tracker != nil && (c.ProgressInterval > 0 || c.ProgressBytes > 0) {
+		tracker.setTotal(totalSize(desc))
+		stop := tracker.logPeriodically(log, c.ProgressInterval)
+		defer stop()
+	}
+
+	switch desc.MediaType {
+	case types.OCIImageIndex, types.DockerManifestList:
+		idx, err := desc.ImageIndex()
+		if err != nil {
+			return err
+		}
+		if err := remote.WriteIndex(dst, idx, options...); err != nil {
+			return fmt.Errorf("failed to copy index: %w", err)
+		}
+	case types.DockerManifestSchema1, types.DockerManifestSchema1Signed:
+		// schema 1 images can only be copied by crane, which handles them specially
+		if err := crane.Copy(pullSrc.Name(), dst.Name(), crane.WithContext(ctx), crane.WithTransport(rt), crane.WithAuthFromKeychain(c.keychain())); err != nil {
+			return fmt.Errorf("failed to copy schema 1 image: %w", err)
+		}
+	default:
+		// assume anything else is an image, since some registries don't set mediaTypes properly
+		img, err := desc.Image()
+		if err != nil {
+			return err
+		}
+		if err := remote.Write(dst, img, options...); err != nil {
+			return fmt.Errorf("failed to copy image: %w", err)
+		}
+	}
+
+	if encrypted {
+		// the wrapped keys are part of the manifests, any change would break decrypting the image
+		verifyOptions := append(options[:len(options):len(options)], remote.WithContext(WithOperation(ctx, OperationVerify)))
+		if err := verifyDigest(dst, desc.Digest, verifyOptions); err != nil {
+			return err
+		}
+	}
+
+	observeImageStats(ctx, log, src, dst, desc, pinnedPlatform, parentIndex)
+
+	if c.CopyReferrers {
+		copied, err := c.copyReferrers(ctx, log, pullSrc.Context(), desc.Digest, dst.Context(), options)
+		if err != nil {
+			return err
+		}
+		if copied > 0 {
+			log.Info("Copied referrers of image", "referrers", copied)
+			referrersCopiedTotal.WithLabelValues(registryLabel(src.Context().Registry)).Add(float64(copied))
+		}
+	}
+
+	return nil
+}
+
+func (c *Copier) transport() http.RoundTripper {
+	base := c.Transport
+	if base == nil {
+		base = remote.DefaultTransport
+	}
+	prefix := c.UserAgentPrefix
+	if prefix == "" {
+		prefix = DefaultUserAgentPrefix
+	}
+	return &userAgentTransport{base: &redirectTransport{base: base, refuse: c.ForceBlobDownloadsViaRegistry}, prefix: prefix}
+}
+
+// StallError is returned by Copier.Copy if a copy was cancelled because it didn't make any progress.
+type StallError struct {
+	Timeout      time.Duration
+	LastProgress time.Time
+
+	err error
+}
+
+func (e *StallError) Error() string {
+	return fmt.Sprintf("copy stalled: no bytes transferred for %s since %s: %v", e.Timeout, e.LastProgress.Format(time.RFC3339), e.err)
+}
+
+func (e *StallError) Unwrap() error {
+	return e.err
+}
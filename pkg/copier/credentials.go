@@ -0,0 +1,153 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package copier
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+// StaticCredentials are basic auth credentials for a registry. The password is read from a file to keep it out of the
+// process arguments.
+type StaticCredentials struct {
+	Username     string
+	PasswordFile string
+	// OnChange is called when the password file was changed after it has been read, e.g., to invalidate cached
+	// results of requests with the previous password. Optional.
+	OnChange func()
+
+	lock     sync.Mutex
+	password string
+	modTime  time.Time
+}
+
+// ParseSourceCredentials parses the given credentials of the form <registry-host>=<username>:<password-file>.
+func ParseSourceCredentials(credentials []string) (map[string]*StaticCredentials, error) {
+	result := make(map[string]*StaticCredentials, len(credentials))
+
+	for _, c := range credentials {
+		host, userPass, ok := strings.Cut(c, "=")
+		username, passwordFile, ok2 := strings.Cut(userPass, ":")
+		if !ok || !ok2 || host == "" || username == "" || passwordFile == "" {
+			return nil, fmt.Errorf("invalid source credentials %q, expected format <registry-host>=<username>:<password-file>", c)
+		}
+
+		registry, err := name.NewRegistry(host)
+		if err != nil {
+			return nil, fmt.Errorf("invalid registry host in source credentials %q: %w", c, err)
+		}
+		key := strings.ToLower(registry.RegistryStr())
+		if _, ok := result[key]; ok {
+			return nil, fmt.Errorf("duplicate source credentials for registry host %q", host)
+		}
+
+		creds := &StaticCredentials{Username: username, PasswordFile: passwordFile}
+		// fail early on unreadable password files
+		if _, err := creds.Authorization(); err != nil {
+			return nil, fmt.Errorf("invalid source credentials for registry host %q: %w", host, err)
+		}
+		result[key] = creds
+	}
+
+	return result, nil
+}
+
+// Authorization implements authn.Authenticator. The password file is read again when it changes.
+func (s *StaticCredentials) Authorization() (*authn.AuthConfig, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	info, err := os.Stat(s.PasswordFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading password file %q: %w", s.PasswordFile, err)
+	}
+
+	if s.modTime.IsZero() || info.ModTime().After(s.modTime) {
+		password, err := os.ReadFile(s.PasswordFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed reading password file %q: %w", s.PasswordFile, err)
+		}
+		changed := !s.modTime.IsZero() && strings.TrimSpace(string(password)) != s.password
+		s.password, s.modTime = strings.TrimSpace(string(password)), info.ModTime()
+		if changed && s.OnChange != nil {
+			s.OnChange()
+		}
+	}
+
+	return &authn.AuthConfig{Username: s.Username, Password: s.password}, nil
+}
+
+func (s *StaticCredentials) String() string {
+	return fmt.Sprintf("user %q with password file %q", s.Username, s.PasswordFile)
+}
+
+// staticKeychain resolves registries to configured static credentials.
+type staticKeychain map[string]*StaticCredentials
+
+func (k staticKeychain) Resolve(resource authn.Resource) (authn.Authenticator, error) {
+	if creds, ok := k[strings.ToLower(resource.RegistryStr())]; ok {
+		return creds, nil
+	}
+	return authn.Anonymous, nil
+}
+
+// keychain returns a keychain that consults the configured SourceCredentials before the default keychain.
+func (c *Copier) keychain() authn.Keychain {
+	if len(c.SourceCredentials) == 0 {
+		return authn.DefaultKeychain
+	}
+	return authn.NewMultiKeychain(staticKeychain(c.SourceCredentials), authn.DefaultKeychain)
+}
+
+// AuthError is returned if a registry denied access. It states which credential source was used.
+type AuthError struct {
+	Registry         string
+	CredentialSource string
+
+	err error
+}
+
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("authentication to registry %q using %s failed: %v", e.Registry, e.CredentialSource, e.err)
+}
+
+func (e *AuthError) Unwrap() error {
+	return e.err
+}
+
+// wrapAuthError wraps the given error in an *AuthError if it indicates that the registry denied access.
+func (c *Copier) wrapAuthError(registry name.Registry, err error) error {
+	var terr *transport.Error
+	if !errors.As(err, &terr) || (terr.StatusCode != http.StatusUnauthorized && terr.StatusCode != http.StatusForbidden) {
+		return err
+	}
+
+	source := "credentials from the default keychain"
+	if creds, ok := c.SourceCredentials[strings.ToLower(registry.RegistryStr())]; ok {
+		source = "source credentials for " + creds.String()
+	}
+	return &AuthError{Registry: registry.RegistryStr(), CredentialSource: source, err: err}
+}
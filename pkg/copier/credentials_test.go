@@ -0,0 +1,67 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package copier
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStaticCredentialsOnChange(t *testing.T) {
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	writePassword := func(password string, modTime time.Time) {
+		t.Helper()
+		if err := os.WriteFile(passwordFile, []byte(password+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(passwordFile, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	changes := 0
+	creds := &StaticCredentials{Username: "user", PasswordFile: passwordFile, OnChange: func() { changes++ }}
+	now := time.Now()
+	writePassword("first", now)
+
+	authorize := func(want string) {
+		t.Helper()
+		auth, err := creds.Authorization()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if auth.Password != want {
+			t.Errorf("password = %q, want %q", auth.Password, want)
+		}
+	}
+
+	authorize("first")
+	if changes != 0 {
+		t.Errorf("OnChange was called %d times when reading the password initially, want 0", changes)
+	}
+
+	// touching the file without changing the password is not a change
+	writePassword("first", now.Add(time.Minute))
+	authorize("first")
+	writePassword("second", now.Add(2*time.Minute))
+	authorize("second")
+	if changes != 1 {
+		t.Errorf("OnChange was called %d times, want 1", changes)
+	}
+}
@@ -0,0 +1,176 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package copier
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DebugPath is the path that the debug handler is served on.
+const DebugPath = "/debug/copier"
+
+// maxRecentFailures is the number of failed copies that are kept for the debug state.
+const maxRecentFailures = 20
+
+// DebugState is a snapshot of the copier's internal state for debugging purposes.
+type DebugState struct {
+	ActiveCopies   []CopyState `json:"activeCopies"`
+	RecentFailures []CopyState `json:"recentFailures"`
+	// HeadUnsupportedRegistries are the registries that don't support HEAD requests for manifests.
+	HeadUnsupportedRegistries []string `json:"headUnsupportedRegistries"`
+	// RegistryLimits are the per-registry concurrency limits that have been used so far, including the number of waiting
+	// operations.
+	RegistryLimits []RegistryLimitState `json:"registryLimits"`
+}
+
+// CopyState describes a running or failed copy.
+type CopyState struct {
+	Source      string    `json:"source"`
+	Destination string    `json:"destination"`
+	Started     time.Time `json:"started"`
+	Finished    time.Time `json:"finished,omitempty"`
+	// TransferredBytes is only set for active copies if progress tracking is enabled.
+	TransferredBytes int64  `json:"transferredBytes,omitempty"`
+	Error            string `json:"error,omitempty"`
+}
+
+// copyStates keeps track of active and recently failed copies.
+type copyStates struct {
+	lock     sync.Mutex
+	active   map[string]*activeCopy
+	failures []CopyState
+}
+
+type activeCopy struct {
+	state   CopyState
+	tracker *progressTracker
+}
+
+func (s *copyStates) start(source, destination string) *activeCopy {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.active == nil {
+		s.active = make(map[string]*activeCopy)
+	}
+	a := &activeCopy{state: CopyState{Source: source, Destination: destination, Started: time.Now()}}
+	s.active[destination] = a
+	return a
+}
+
+func (s *copyStates) setTracker(a *activeCopy, tracker *progressTracker) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	a.tracker = tracker
+}
+
+func (s *copyStates) finish(a *activeCopy, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.active[a.state.Destination] == a {
+		delete(s.active, a.state.Destination)
+	}
+	if err == nil {
+		return
+	}
+
+	failure := a.state
+	failure.Finished = time.Now()
+	failure.Error = err.Error()
+	s.failures = append(s.failures, failure)
+	if len(s.failures) > maxRecentFailures {
+		s.failures = s.failures[len(s.failures)-maxRecentFailures:]
+	}
+}
+
+// DebugState returns a snapshot of the copier's internal state.
+func (c *Copier) DebugState() DebugState {
+	state := DebugState{
+		ActiveCopies:              []CopyState{},
+		RecentFailures:            []CopyState{},
+		HeadUnsupportedRegistries: []string{},
+	}
+
+	c.copies.lock.Lock()
+	for _, a := range c.copies.active {
+		copyState := a.state
+		if a.tracker != nil {
+			copyState.TransferredBytes = atomic.LoadInt64(&a.tracker.transferred)
+		}
+		state.ActiveCopies = append(state.ActiveCopies, copyState)
+	}
+	state.RecentFailures = append(state.RecentFailures, c.copies.failures...)
+	c.copies.lock.Unlock()
+
+	sort.Slice(state.ActiveCopies, func(i, j int) bool {
+		return state.ActiveCopies[i].Started.Before(state.ActiveCopies[j].Started)
+	})
+
+	c.headCapabilities.unsupported.Range(func(key, _ any) bool {
+		state.HeadUnsupportedRegistries = append(state.HeadUnsupportedRegistries, key.(string))
+		return true
+	})
+	sort.Strings(state.HeadUnsupportedRegistries)
+
+	state.RegistryLimits = c.registries.state()
+
+	return state
+}
+
+// DebugHandler returns a read-only http.Handler serving the copier's DebugState as JSON. If token is not empty,
+// requests must authenticate with it as a bearer token.
+func (c *Copier) DebugHandler(token string) http.Handler {
+	return NewDebugHandler(token, func() interface{} {
+		return c.DebugState()
+	})
+}
+
+// NewDebugHandler returns a read-only handler that serves the result of the given function as JSON. If token is not
+// empty, requests must present it as a bearer token.
+func NewDebugHandler(token string, state func() interface{}) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !AuthorizeDebugRequest(w, r, token) {
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(state())
+	})
+}
+
+// AuthorizeDebugRequest checks that the given request presents the given token as a bearer token. If the token is empty,
+// all requests are authorized. Otherwise, it responds with 401 and returns false.
+func AuthorizeDebugRequest(w http.ResponseWriter, r *http.Request, token string) bool {
+	if token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
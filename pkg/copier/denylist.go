@@ -0,0 +1,141 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package copier
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// DeniedImageError is returned by Copier.Copy if the source image has a denylisted digest.
+type DeniedImageError struct {
+	Image  string
+	Digest v1.Hash
+}
+
+func (e *DeniedImageError) Error() string {
+	return fmt.Sprintf("image %q has the denylisted digest %s", e.Image, e.Digest)
+}
+
+// IsDeniedImage checks whether the given error indicates that an image was not copied because of a denylisted digest.
+func IsDeniedImage(err error) bool {
+	var deniedErr *DeniedImageError
+	return errors.As(err, &deniedErr)
+}
+
+// ReadDigestDenylist reads the given denylist file, which contains one digest per line. Empty lines and lines starting
+// with # are ignored.
+func ReadDigestDenylist(file string) (map[v1.Hash]struct{}, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	digests := make(map[v1.Hash]struct{})
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		digest, err := v1.NewHash(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid digest in line %d of denylist %q: %w", line, file, err)
+		}
+		digests[digest] = struct{}{}
+	}
+	return digests, scanner.Err()
+}
+
+// digestDenylist holds the digests of Options.DenylistedDigestsFile and reloads them when the file changes.
+type digestDenylist struct {
+	lock    sync.Mutex
+	digests map[v1.Hash]struct{}
+	modTime time.Time
+}
+
+// Denied checks whether the given digest is listed in DenylistedDigestsFile. It returns an error if the file can't be
+// read, so that denylisted images are never copied by accident.
+func (c *Copier) Denied(digest v1.Hash) (bool, error) {
+	if c.DenylistedDigestsFile == "" {
+		return false, nil
+	}
+
+	d := &c.denylist
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	modTime, err := latestModTime(c.DenylistedDigestsFile)
+	if err != nil {
+		return false, fmt.Errorf("failed reading denylist: %w", err)
+	}
+	if d.digests == nil || !modTime.Equal(d.modTime) {
+		digests, err := ReadDigestDenylist(c.DenylistedDigestsFile)
+		if err != nil {
+			return false, fmt.Errorf("failed reading denylist: %w", err)
+		}
+		d.digests, d.modTime = digests, modTime
+	}
+
+	_, denied := d.digests[digest]
+	return denied, nil
+}
+
+// checkDenied returns a *DeniedImageError if any of the given digests is denylisted.
+func (c *Copier) checkDenied(image string, digests ...v1.Hash) error {
+	for _, digest := range digests {
+		denied, err := c.Denied(digest)
+		if err != nil {
+			return err
+		}
+		if denied {
+			return &DeniedImageError{Image: image, Digest: digest}
+		}
+	}
+	return nil
+}
+
+// manifestDigests returns the digest of the given descriptor and, for indices, the digests of all child manifests.
+func manifestDigests(desc *remote.Descriptor) ([]v1.Hash, error) {
+	digests := []v1.Hash{desc.Digest}
+
+	switch desc.MediaType {
+	case types.OCIImageIndex, types.DockerManifestList:
+		idx, err := desc.ImageIndex()
+		if err != nil {
+			return nil, err
+		}
+		manifest, err := idx.IndexManifest()
+		if err != nil {
+			return nil, err
+		}
+		for _, child := range manifest.Manifests {
+			digests = append(digests, child.Digest)
+		}
+	}
+	return digests, nil
+}
@@ -0,0 +1,165 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package copier
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// tagSwappingTransport moves the given tag to another image after the first request for its manifest has been
+// answered, like an upstream push during the copy.
+type tagSwappingTransport struct {
+	http.RoundTripper
+	tag     name.Tag
+	swapped v1.Image
+	once    sync.Once
+	err     error
+}
+
+func (t *tagSwappingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err == nil && req.URL.Host == t.tag.RegistryStr() && req.URL.Path == "/v2/"+t.tag.RepositoryStr()+"/manifests/"+t.tag.TagStr() {
+		t.once.Do(func() {
+			t.err = remote.Write(t.tag, t.swapped)
+		})
+	}
+	return resp, err
+}
+
+func TestCopyAnchorsSourceDigest(t *testing.T) {
+	upstream, backup := newTestRegistryHost(t), newTestRegistryHost(t)
+	src, err := name.NewTag(upstream.RegistryStr()+"/upstream/app:v1", name.Insecure)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst, err := name.NewTag(backup.RegistryStr()+"/upstream/app:v1", name.Insecure)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	original, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(src, original); err != nil {
+		t.Fatal(err)
+	}
+	originalDigest, err := original.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	swapped, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	swappedDigest, err := swapped.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transport := &tagSwappingTransport{RoundTripper: http.DefaultTransport, tag: src, swapped: swapped}
+	c := &Copier{Transport: transport}
+	if _, err := c.Copy(context.Background(), logr.Discard(), src, dst); err != nil {
+		t.Fatal(err)
+	}
+	if transport.err != nil {
+		t.Fatalf("error moving the source tag: %v", transport.err)
+	}
+
+	// the tag was moved during the copy
+	if desc, err := remote.Head(src); err != nil || desc.Digest != swappedDigest {
+		t.Fatalf("source digest = %v (error: %v), want the swapped digest %s", desc, err, swappedDigest)
+	}
+	desc, err := remote.Head(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc.Digest != originalDigest {
+		t.Errorf("destination digest = %s, want the originally resolved digest %s", desc.Digest, originalDigest)
+	}
+}
+
+func TestAnchorDigest(t *testing.T) {
+	digest := v1.Hash{Algorithm: "sha256", Hex: "33cef2fd3a1f6e5bbb5d4ff2bd6ab0d8a89f1bea7bcf6a1b3f7ce33ae2e3a6a3"}
+	tag := name.MustParseReference("ghcr.io/upstream/app:v1")
+	pinned := name.MustParseReference("ghcr.io/upstream/app@sha256:0000000000000000000000000000000000000000000000000000000000000000")
+
+	if got := anchorDigest(tag, digest); got.String() != "ghcr.io/upstream/app@"+digest.String() {
+		t.Errorf("anchorDigest(%s) = %s, want the resolved digest", tag, got)
+	}
+	// images referenced by digest are transferred as specified
+	if got := anchorDigest(pinned, digest); got != pinned {
+		t.Errorf("anchorDigest(%s) = %s, want it unchanged", pinned, got)
+	}
+	// unresolved images are left to the transfer, which reports them as missing
+	if got := anchorDigest(tag, v1.Hash{}); got != tag {
+		t.Errorf("anchorDigest(%s) without digest = %s, want it unchanged", tag, got)
+	}
+}
+
+func TestCopyWithSourceDigest(t *testing.T) {
+	upstream, backup := newTestRegistryHost(t), newTestRegistryHost(t)
+	src, err := name.NewTag(upstream.RegistryStr()+"/upstream/app:v1", name.Insecure)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst, err := name.NewTag(backup.RegistryStr()+"/upstream/app:v1", name.Insecure)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	planned, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(src, planned); err != nil {
+		t.Fatal(err)
+	}
+	plannedDigest, err := planned.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the tag was moved after the caller resolved it
+	moved, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(src, moved); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &Copier{}
+	if _, err := c.Copy(WithSourceDigest(context.Background(), plannedDigest), logr.Discard(), src, dst); err != nil {
+		t.Fatal(err)
+	}
+	desc, err := remote.Head(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc.Digest != plannedDigest {
+		t.Errorf("destination digest = %s, want the given source digest %s", desc.Digest, plannedDigest)
+	}
+}
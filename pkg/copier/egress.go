@@ -0,0 +1,126 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package copier
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+const (
+	// egressWindow is the sliding window of the egress budget.
+	egressWindow = time.Hour
+	// egressBucket is the granularity of the sliding window.
+	egressBucket  = time.Minute
+	egressBuckets = int64(egressWindow / egressBucket)
+)
+
+// EgressBudgetExhaustedError is returned by Copier.Copy if a copy was not started because the bytes transferred within
+// the last hour exceed MaxCopyBytesPerHour. The copy should be retried after RetryAfter.
+type EgressBudgetExhaustedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *EgressBudgetExhaustedError) Error() string {
+	return fmt.Sprintf("egress budget exhausted, retry after %s", e.RetryAfter.Round(time.Second))
+}
+
+// IsEgressBudgetExhausted checks whether the given error indicates that a copy was deferred because of the egress
+// budget.
+func IsEgressBudgetExhausted(err error) bool {
+	var budgetErr *EgressBudgetExhaustedError
+	return errors.As(err, &budgetErr)
+}
+
+// egressBudget tracks the bytes transferred by copies in a sliding window of one hour with per-minute buckets.
+type egressBudget struct {
+	lock sync.Mutex
+	// buckets are the transferred bytes per minute, indexed by minute modulo egressBuckets
+	buckets [egressBuckets]int64
+	// minutes are the minutes (since the epoch) of the buckets, to detect stale buckets
+	minutes [egressBuckets]int64
+	// throttled is true while copies are deferred, so that throttling is only announced once
+	throttled bool
+}
+
+func (b *egressBudget) add(now time.Time, n int64) {
+	minute := now.Unix() / int64(egressBucket/time.Second)
+	i := minute % egressBuckets
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.minutes[i] != minute {
+		b.minutes[i], b.buckets[i] = minute, 0
+	}
+	b.buckets[i] += n
+}
+
+// check returns an *EgressBudgetExhaustedError if a copy of the given priority must not start, because the bytes
+// transferred in the sliding window reach the given limit. Background copies must leave the reserved bytes to
+// interactive copies. Zero limit disables the budget. Throttling is announced once per period via log.
+func (b *egressBudget) check(log logr.Logger, now time.Time, limit, reserved int64, p Priority) error {
+	if limit <= 0 {
+		return nil
+	}
+
+	minute := now.Unix() / int64(egressBucket/time.Second)
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	var used int64
+	for i := range b.buckets {
+		if minute-b.minutes[i] < egressBuckets {
+			used += b.buckets[i]
+		}
+	}
+	if used < limit-reserved && b.throttled {
+		// copies of all priorities may start again
+		b.throttled = false
+		egressThrottled.Set(0)
+	}
+	if p == PriorityBackground {
+		limit -= reserved
+	}
+	if used < limit {
+		return nil
+	}
+
+	// the budget frees up as the oldest buckets leave the window
+	var (
+		retryAfter time.Duration
+		remaining  = used
+	)
+	for m := minute - egressBuckets + 1; m <= minute && remaining >= limit; m++ {
+		if i := m % egressBuckets; b.minutes[i] == m {
+			remaining -= b.buckets[i]
+		}
+		retryAfter = time.Unix((m+egressBuckets)*int64(egressBucket/time.Second), 0).Sub(now)
+	}
+
+	copiesDeferredTotal.WithLabelValues(p.String()).Inc()
+	if !b.throttled {
+		b.throttled = true
+		egressThrottled.Set(1)
+		log.Info("Egress budget exhausted, deferring new copies", "priority", p.String(), "usedBytes", used, "limitBytes", limit, "retryAfter", retryAfter.Round(time.Second))
+	}
+	return &EgressBudgetExhaustedError{RetryAfter: retryAfter}
+}
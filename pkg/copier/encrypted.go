@@ -0,0 +1,102 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package copier
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// Encrypted images (ocicrypt) have layers with media types like application/vnd.oci.image.layer.v1.tar+gzip+encrypted.
+// The wrapped keys for decrypting the layers are stored in the annotations of the layer descriptors, so any change to
+// the manifests or layers of encrypted images breaks decrypting them. Hence, encrypted images are always copied
+// verbatim, and features that modify images (e.g., recompressing layers or adding annotations) must skip images for
+// which hasEncryptedLayers returns true.
+
+// IsEncryptedLayer checks whether the given layer media type denotes an encrypted layer.
+func IsEncryptedLayer(mediaType types.MediaType) bool {
+	return strings.HasSuffix(string(mediaType), "+encrypted")
+}
+
+// hasEncryptedLayers checks whether the given image or any image of the given index has encrypted layers. For indices,
+// only the manifests of the images are fetched.
+func hasEncryptedLayers(desc *remote.Descriptor) (bool, error) {
+	switch desc.MediaType {
+	case types.OCIImageIndex, types.DockerManifestList:
+	case types.DockerManifestSchema1, types.DockerManifestSchema1Signed:
+		return false, nil
+	default:
+		img, err := desc.Image()
+		if err != nil {
+			return false, err
+		}
+		return manifestHasEncryptedLayers(img)
+	}
+
+	idx, err := desc.ImageIndex()
+	if err != nil {
+		return false, err
+	}
+	indexManifest, err := idx.IndexManifest()
+	if err != nil {
+		return false, err
+	}
+
+	for _, child := range indexManifest.Manifests {
+		if !child.MediaType.IsImage() {
+			continue
+		}
+		img, err := idx.Image(child.Digest)
+		if err != nil {
+			return false, err
+		}
+		if encrypted, err := manifestHasEncryptedLayers(img); err != nil || encrypted {
+			return encrypted, err
+		}
+	}
+	return false, nil
+}
+
+func manifestHasEncryptedLayers(img v1.Image) (bool, error) {
+	manifest, err := img.Manifest()
+	if err != nil {
+		return false, err
+	}
+	for _, layer := range manifest.Layers {
+		if IsEncryptedLayer(layer.MediaType) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// verifyDigest checks that the given destination has the given digest, i.e., that the image was copied verbatim.
+func verifyDigest(dst name.Tag, digest v1.Hash, options []remote.Option) error {
+	desc, err := remote.Head(dst, options...)
+	if err != nil {
+		return fmt.Errorf("failed verifying digest of copied image: %w", err)
+	}
+	if desc.Digest != digest {
+		return fmt.Errorf("digest of copied image %q is %s instead of the source digest %s, but encrypted images must be copied verbatim", dst.Name(), desc.Digest, digest)
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package copier
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+const (
+	encryptedLayerMediaType types.MediaType = "application/vnd.oci.image.layer.v1.tar+gzip+encrypted"
+	// wrappedKeysAnnotation carries the wrapped keys of encrypted layers
+	wrappedKeysAnnotation = "org.opencontainers.image.enc.keys.jwe"
+)
+
+// encryptedImage returns a synthetic OCI image whose second layer is encrypted.
+func encryptedImage(t *testing.T) v1.Image {
+	t.Helper()
+
+	plain, err := random.Layer(1024, types.OCILayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := random.Layer(1024, encryptedLayerMediaType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := mutate.ConfigMediaType(mutate.MediaType(empty.Image, types.OCIManifestSchema1), types.OCIConfigJSON)
+	img, err := mutate.Append(base,
+		mutate.Addendum{Layer: plain},
+		mutate.Addendum{Layer: encrypted, Annotations: map[string]string{wrappedKeysAnnotation: "ZXhhbXBsZQ=="}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+func TestHasEncryptedLayers(t *testing.T) {
+	reg := newTestRegistryHost(t)
+	plain, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted := encryptedImage(t)
+
+	tests := []struct {
+		name          string
+		tag           string
+		write         func(ref name.Reference) error
+		wantEncrypted bool
+	}{
+		{name: "plain image", tag: "plain", write: func(ref name.Reference) error { return remote.Write(ref, plain) }},
+		{name: "encrypted image", tag: "encrypted", write: func(ref name.Reference) error { return remote.Write(ref, encrypted) }, wantEncrypted: true},
+		{
+			name: "index with encrypted image",
+			tag:  "index",
+			write: func(ref name.Reference) error {
+				idx := mutate.AppendManifests(mutate.IndexMediaType(empty.Index, types.OCIImageIndex),
+					mutate.IndexAddendum{Add: plain}, mutate.IndexAddendum{Add: encrypted})
+				return remote.WriteIndex(ref, idx)
+			},
+			wantEncrypted: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ref, err := name.NewTag(reg.RegistryStr()+"/library/app:"+tt.tag, name.Insecure)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := tt.write(ref); err != nil {
+				t.Fatal(err)
+			}
+			desc, err := remote.Get(ref)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			encrypted, err := hasEncryptedLayers(desc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if encrypted != tt.wantEncrypted {
+				t.Errorf("hasEncryptedLayers() = %v, want %v", encrypted, tt.wantEncrypted)
+			}
+		})
+	}
+}
+
+func TestCopyEncryptedImage(t *testing.T) {
+	upstream, backup := newTestRegistryHost(t), newTestRegistryHost(t)
+	src, err := name.NewTag(upstream.RegistryStr()+"/vendor/app:v1", name.Insecure)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst, err := name.NewTag(backup.RegistryStr()+"/vendor/app:v1", name.Insecure)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(src, encryptedImage(t)); err != nil {
+		t.Fatal(err)
+	}
+	srcDesc, err := remote.Head(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &Copier{}
+	if _, err := c.Copy(context.Background(), logr.Discard(), src, dst); err != nil {
+		t.Fatal(err)
+	}
+
+	// the copy is verbatim, including the wrapped keys
+	img, err := remote.Image(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if digest != srcDesc.Digest {
+		t.Errorf("destination digest = %s, want source digest %s", digest, srcDesc.Digest)
+	}
+	manifest, err := img.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if layer := manifest.Layers[1]; layer.MediaType != encryptedLayerMediaType || layer.Annotations[wrappedKeysAnnotation] == "" {
+		t.Errorf("encrypted layer = %+v, want media type %s and wrapped keys", layer, encryptedLayerMediaType)
+	}
+
+	// copies that change the digest are detected
+	if err := verifyDigest(dst, v1.Hash{Algorithm: "sha256", Hex: strings.Repeat("0", 64)}, nil); err == nil {
+		t.Error("expected error for copy with a different digest")
+	}
+}
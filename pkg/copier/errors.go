@@ -0,0 +1,80 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package copier
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+// SourceNotFoundError is returned by Copier.Copy if the source image doesn't exist.
+type SourceNotFoundError struct {
+	Source string
+
+	err error
+}
+
+func (e *SourceNotFoundError) Error() string {
+	return fmt.Sprintf("source image %q not found: %v", e.Source, e.err)
+}
+
+func (e *SourceNotFoundError) Unwrap() error {
+	return e.err
+}
+
+// IsSourceNotFound checks whether the given error indicates that the source image of a copy doesn't exist.
+func IsSourceNotFound(err error) bool {
+	var notFound *SourceNotFoundError
+	return errors.As(err, &notFound)
+}
+
+// IsNotFound checks whether the given registry error indicates that the requested manifest doesn't exist.
+func IsNotFound(err error) bool {
+	var terr *transport.Error
+	if !errors.As(err, &terr) {
+		return false
+	}
+	if terr.StatusCode == http.StatusNotFound {
+		return true
+	}
+	for _, diagnostic := range terr.Errors {
+		if diagnostic.Code == transport.ManifestUnknownErrorCode || diagnostic.Code == transport.NameUnknownErrorCode {
+			return true
+		}
+	}
+	return false
+}
+
+// IsUnsupported checks whether the given registry error indicates that the requested operation is not supported.
+func IsUnsupported(err error) bool {
+	var terr *transport.Error
+	if !errors.As(err, &terr) {
+		return false
+	}
+	if terr.StatusCode == http.StatusMethodNotAllowed {
+		return true
+	}
+	for _, diagnostic := range terr.Errors {
+		if diagnostic.Code == transport.UnsupportedErrorCode {
+			return true
+		}
+	}
+	return false
+}
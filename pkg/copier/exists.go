@@ -0,0 +1,134 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package copier
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+// headCapabilities caches which registries don't support HEAD requests for manifests.
+type headCapabilities struct {
+	unsupported sync.Map
+}
+
+func (h *headCapabilities) supported(registry name.Registry) bool {
+	_, unsupported := h.unsupported.Load(registry.RegistryStr())
+	return !unsupported
+}
+
+func (h *headCapabilities) setUnsupported(registry name.Registry) {
+	h.unsupported.Store(registry.RegistryStr(), struct{}{})
+}
+
+// Exists checks whether the given image exists and returns its digest. It uses HEAD requests for checking the
+// manifest, but falls back to GET requests for registries that don't support HEAD requests properly, e.g., registries
+// that respond with 405 or 401 to HEAD but 200 to GET requests. Such registries are remembered to avoid sending two
+// requests for every check.
+// Checks are limited by RegistryCheckConcurrency per registry.
+// If the context was returned by Prefetch, the prefetched result is returned without sending any request.
+func (c *Copier) Exists(ctx context.Context, ref name.Reference) (v1.Hash, bool, error) {
+	if result, ok := prefetchedFrom(ctx).get(ref); ok {
+		return result.digest, result.exists, nil
+	}
+	ctx = withDefaultOperation(ctx, OperationHeadCheck)
+
+	registry := ref.Context().Registry
+	release, err := c.registries.acquire(ctx, registryOperationCheck, registry, c.RegistryCheckConcurrency)
+	if err != nil {
+		return v1.Hash{}, false, fmt.Errorf("failed waiting for other checks against registry %q: %w", registry.RegistryStr(), err)
+	}
+	defer release()
+
+	options := []remote.Option{
+		remote.WithContext(ctx),
+		remote.WithAuthFromKeychain(c.keychain()),
+		remote.WithTransport(c.transport()),
+	}
+
+	headFailed := false
+	if c.headCapabilities.supported(registry) {
+		desc, err := remote.Head(ref, options...)
+		if err == nil {
+			return desc.Digest, true, nil
+		}
+		if IsNotFound(err) {
+			return v1.Hash{}, false, nil
+		}
+		if !headUnsupported(err) {
+			return v1.Hash{}, false, err
+		}
+		headFailed = true
+	}
+
+	desc, err := remote.Get(ref, options...)
+	if err != nil {
+		if IsNotFound(err) {
+			if headFailed {
+				c.headCapabilities.setUnsupported(registry)
+			}
+			return v1.Hash{}, false, nil
+		}
+		return v1.Hash{}, false, err
+	}
+
+	if headFailed {
+		c.headCapabilities.setUnsupported(registry)
+	}
+	return desc.Digest, true, nil
+}
+
+// Resolve returns the digest of the given source image like Copy resolves it, i.e., via the configured registry host
+// rewrites. Images referenced by digest are immutable and not resolved. It returns false if the image doesn't exist.
+func (c *Copier) Resolve(ctx context.Context, src name.Reference) (v1.Hash, bool, error) {
+	if digest, ok := src.(name.Digest); ok {
+		hash, err := v1.NewHash(digest.DigestStr())
+		if err != nil {
+			return v1.Hash{}, false, err
+		}
+		return hash, true, nil
+	}
+
+	pullSrc, err := c.pullReference(src)
+	if err != nil {
+		return v1.Hash{}, false, err
+	}
+	return c.Exists(ctx, pullSrc)
+}
+
+// headUnsupported checks whether the given error of a HEAD request indicates that the registry doesn't support HEAD
+// requests for manifests.
+func headUnsupported(err error) bool {
+	var terr *transport.Error
+	if !errors.As(err, &terr) {
+		return false
+	}
+
+	switch terr.StatusCode {
+	case http.StatusMethodNotAllowed, http.StatusUnauthorized, http.StatusNotImplemented:
+		return true
+	}
+	return false
+}
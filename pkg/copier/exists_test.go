@@ -0,0 +1,119 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package copier
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// newHeadQuirkRegistry starts an in-process registry that responds to HEAD requests for manifests with the given
+// status code, unless it is 200. It returns the registry and a counter of HEAD requests for manifests.
+func newHeadQuirkRegistry(t *testing.T, headStatus int) (name.Registry, *int32) {
+	t.Helper()
+
+	var heads int32
+	backend := registry.New(registry.Logger(log.New(io.Discard, "", 0)))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead && strings.Contains(r.URL.Path, "/manifests/") {
+			atomic.AddInt32(&heads, 1)
+			if headStatus != http.StatusOK {
+				w.WriteHeader(headStatus)
+				return
+			}
+		}
+		backend.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	reg, err := name.NewRegistry(strings.TrimPrefix(server.URL, "http://"), name.Insecure)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reg, &heads
+}
+
+func TestExists(t *testing.T) {
+	tests := []struct {
+		name       string
+		headStatus int
+		// wantHeadSupported is whether HEAD requests are still sent after the first check
+		wantHeadSupported bool
+	}{
+		{name: "HEAD ok", headStatus: http.StatusOK, wantHeadSupported: true},
+		{name: "HEAD 405", headStatus: http.StatusMethodNotAllowed},
+		{name: "HEAD 401 but GET ok", headStatus: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg, heads := newHeadQuirkRegistry(t, tt.headStatus)
+			c := &Copier{}
+			ctx := context.Background()
+
+			existing, err := name.NewTag(reg.RegistryStr()+"/library/app:v1", name.Insecure)
+			if err != nil {
+				t.Fatal(err)
+			}
+			img, err := random.Image(1024, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := remote.Write(existing, img); err != nil {
+				t.Fatal(err)
+			}
+			wantDigest, err := img.Digest()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			digest, exists, err := c.Exists(ctx, existing)
+			if err != nil {
+				t.Fatalf("Exists returned error for existing image: %v", err)
+			}
+			if !exists || digest != wantDigest {
+				t.Errorf("Exists = (%s, %v), want (%s, true)", digest, exists, wantDigest)
+			}
+			if got := c.headCapabilities.supported(reg); got != tt.wantHeadSupported {
+				t.Errorf("HEAD supported = %v, want %v", got, tt.wantHeadSupported)
+			}
+
+			headsBefore := atomic.LoadInt32(heads)
+			_, exists, err = c.Exists(ctx, existing.Context().Tag("missing"))
+			if err != nil {
+				t.Fatalf("Exists returned error for missing image: %v", err)
+			}
+			if exists {
+				t.Error("Exists = true for missing image")
+			}
+			if sentHead := atomic.LoadInt32(heads) > headsBefore; sentHead != tt.wantHeadSupported {
+				t.Errorf("HEAD request sent after first check = %v, want %v", sentHead, tt.wantHeadSupported)
+			}
+		})
+	}
+}
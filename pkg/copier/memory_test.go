@@ -0,0 +1,368 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package copier
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// sparseThreshold is the size above which sparseRegistry doesn't store the contents of blobs.
+const sparseThreshold = 1 << 20
+
+// zeroReader returns an endless stream of zeros.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+var zeroChunk = make([]byte, 32*1024)
+
+// sparseBlob is a blob stored by sparseRegistry. Blobs larger than sparseThreshold consist of zeros only, so only their
+// size is stored.
+type sparseBlob struct {
+	data []byte
+	size int64
+}
+
+func (b sparseBlob) reader() io.Reader {
+	if b.data != nil {
+		return bytes.NewReader(b.data)
+	}
+	return io.LimitReader(zeroReader{}, b.size)
+}
+
+// sparseUpload receives the contents of a blob upload. It only buffers the contents as long as they are smaller than
+// sparseThreshold and fails if larger contents are not zeros.
+type sparseUpload struct {
+	hash hash.Hash
+	size int64
+	data []byte
+}
+
+func (u *sparseUpload) Write(p []byte) (int, error) {
+	if u.data != nil && int64(len(u.data)+len(p)) > sparseThreshold {
+		if !isZero(u.data) {
+			return 0, errors.New("sparse blob contains non-zero bytes")
+		}
+		u.data = nil
+	}
+	if u.size+int64(len(p)) <= sparseThreshold {
+		u.data = append(u.data, p...)
+	} else if !isZero(p) {
+		return 0, errors.New("sparse blob contains non-zero bytes")
+	}
+	u.size += int64(len(p))
+	return u.hash.Write(p)
+}
+
+func isZero(p []byte) bool {
+	for len(p) > 0 {
+		n := len(p)
+		if n > len(zeroChunk) {
+			n = len(zeroChunk)
+		}
+		if !bytes.Equal(p[:n], zeroChunk[:n]) {
+			return false
+		}
+		p = p[n:]
+	}
+	return true
+}
+
+// sparseRegistry serves manifests via the in-memory registry but handles blobs itself, so that images with multi-GB
+// layers of zeros can be copied without the registry holding the layers in memory.
+type sparseRegistry struct {
+	http.Handler
+
+	lock    sync.Mutex
+	blobs   map[string]sparseBlob
+	uploads map[string]*sparseUpload
+	nextID  int
+}
+
+func newSparseRegistry(t *testing.T) (*sparseRegistry, name.Registry) {
+	t.Helper()
+
+	r := &sparseRegistry{
+		Handler: registry.New(registry.Logger(log.New(io.Discard, "", 0))),
+		blobs:   map[string]sparseBlob{},
+		uploads: map[string]*sparseUpload{},
+	}
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+
+	reg, err := name.NewRegistry(strings.TrimPrefix(server.URL, "http://"), name.Insecure)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r, reg
+}
+
+func (r *sparseRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	i := strings.LastIndex(req.URL.Path, "/blobs/")
+	if i < 0 {
+		r.Handler.ServeHTTP(w, req)
+		return
+	}
+	repo := strings.TrimPrefix(req.URL.Path[:i], "/v2/")
+	blob := req.URL.Path[i+len("/blobs/"):]
+
+	if blob == "uploads" || strings.HasPrefix(blob, "uploads/") {
+		r.serveUpload(w, req, repo, strings.TrimPrefix(strings.TrimPrefix(blob, "uploads"), "/"))
+		return
+	}
+
+	r.lock.Lock()
+	b, ok := r.blobs[repo+"@"+blob]
+	r.lock.Unlock()
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = io.WriteString(w, `{"errors":[{"code":"BLOB_UNKNOWN"}]}`)
+		return
+	}
+
+	w.Header().Set("Content-Length", fmt.Sprint(b.size))
+	w.Header().Set("Docker-Content-Digest", blob)
+	if req.Method == http.MethodHead {
+		return
+	}
+	_, _ = io.Copy(w, b.reader())
+}
+
+func (r *sparseRegistry) serveUpload(w http.ResponseWriter, req *http.Request, repo, id string) {
+	r.lock.Lock()
+	if req.Method == http.MethodPost {
+		// cross-repository mounts are not supported, which falls back to a regular upload
+		r.nextID++
+		id = fmt.Sprint(r.nextID)
+		r.uploads[id] = &sparseUpload{hash: sha256.New(), data: []byte{}}
+	}
+	upload, ok := r.uploads[id]
+	r.lock.Unlock()
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if _, err := io.Copy(upload, req.Body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	location := "/v2/" + repo + "/blobs/uploads/" + id
+	switch req.Method {
+	case http.MethodPost, http.MethodPatch:
+		w.Header().Set("Location", location)
+		w.Header().Set("Range", fmt.Sprintf("0-%d", upload.size-1))
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodPut:
+		digest := "sha256:" + fmt.Sprintf("%x", upload.hash.Sum(nil))
+		if req.URL.Query().Get("digest") != digest {
+			http.Error(w, "digest mismatch", http.StatusBadRequest)
+			return
+		}
+		r.storeBlob(repo, digest, sparseBlob{data: upload.data, size: upload.size})
+		r.lock.Lock()
+		delete(r.uploads, id)
+		r.lock.Unlock()
+		w.Header().Set("Docker-Content-Digest", digest)
+		w.Header().Set("Location", "/v2/"+repo+"/blobs/"+digest)
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (r *sparseRegistry) storeBlob(repo, digest string, blob sparseBlob) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.blobs[repo+"@"+digest] = blob
+}
+
+func (r *sparseRegistry) hasBlob(repo string, digest v1.Hash) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	_, ok := r.blobs[repo+"@"+digest.String()]
+	return ok
+}
+
+// seedSparseImage stores an image with a single layer of the given number of zeros in the given repository and returns
+// the digests of its manifest and layer.
+func (r *sparseRegistry) seedSparseImage(t *testing.T, repo, tag string, layerSize int64) (v1.Hash, v1.Hash) {
+	t.Helper()
+
+	layerHash := sha256.New()
+	if _, err := io.Copy(layerHash, io.LimitReader(zeroReader{}, layerSize)); err != nil {
+		t.Fatal(err)
+	}
+	layer := v1.Hash{Algorithm: "sha256", Hex: fmt.Sprintf("%x", layerHash.Sum(nil))}
+
+	config, err := json.Marshal(v1.ConfigFile{
+		Architecture: "amd64",
+		OS:           "linux",
+		RootFS:       v1.RootFS{Type: "layers", DiffIDs: []v1.Hash{layer}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	configDigest, configSize, err := v1.SHA256(bytes.NewReader(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.storeBlob(repo, configDigest.String(), sparseBlob{data: config, size: configSize})
+	r.storeBlob(repo, layer.String(), sparseBlob{size: layerSize})
+
+	manifest, err := json.Marshal(v1.Manifest{
+		SchemaVersion: 2,
+		MediaType:     types.DockerManifestSchema2,
+		Config:        v1.Descriptor{MediaType: types.DockerConfigJSON, Size: configSize, Digest: configDigest},
+		Layers:        []v1.Descriptor{{MediaType: types.DockerLayer, Size: layerSize, Digest: layer}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestDigest, _, err := v1.SHA256(bytes.NewReader(manifest))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPut, "/v2/"+repo+"/manifests/"+tag, bytes.NewReader(manifest))
+	req.Header.Set("Content-Type", string(types.DockerManifestSchema2))
+	r.Handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("failed seeding manifest: %d %s", rec.Code, rec.Body.String())
+	}
+
+	return manifestDigest, layer
+}
+
+// heapMonitor records the maximum heap size while it is running.
+type heapMonitor struct {
+	stop chan struct{}
+	done chan struct{}
+	max  uint64
+}
+
+func startHeapMonitor() *heapMonitor {
+	m := &heapMonitor{stop: make(chan struct{}), done: make(chan struct{})}
+	go func() {
+		defer close(m.done)
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+
+		var stats runtime.MemStats
+		for {
+			runtime.ReadMemStats(&stats)
+			if stats.HeapAlloc > m.max {
+				m.max = stats.HeapAlloc
+			}
+			select {
+			case <-m.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return m
+}
+
+// Stop stops the monitor and returns the maximum heap size.
+func (m *heapMonitor) Stop() uint64 {
+	close(m.stop)
+	<-m.done
+	return m.max
+}
+
+// TestCopyMemoryBounded verifies the memory model of the package: copying an image with a multi-GB layer must stream
+// the layer instead of buffering it in memory.
+func TestCopyMemoryBounded(t *testing.T) {
+	if testing.Short() {
+		t.Skip("copies a multi-GB image")
+	}
+
+	const (
+		layerSize = 2 << 30
+		maxGrowth = 128 << 20
+	)
+
+	reg, host := newSparseRegistry(t)
+	manifestDigest, layer := reg.seedSparseImage(t, "source/app", "v1", layerSize)
+
+	src, err := name.NewTag(host.RegistryStr()+"/source/app:v1", name.Insecure)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst, err := name.NewTag(host.RegistryStr()+"/backup/app:v1", name.Insecure)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runtime.GC()
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	monitor := startHeapMonitor()
+	if _, err := (&Copier{}).Copy(context.Background(), logr.Discard(), src, dst); err != nil {
+		monitor.Stop()
+		t.Fatalf("copy failed: %v", err)
+	}
+	peak := monitor.Stop()
+
+	if peak > before.HeapAlloc && peak-before.HeapAlloc > maxGrowth {
+		t.Errorf("heap grew by %d MiB while copying a %d MiB layer, want at most %d MiB",
+			(peak-before.HeapAlloc)>>20, layerSize>>20, maxGrowth>>20)
+	}
+
+	if !reg.hasBlob("backup/app", layer) {
+		t.Error("layer wasn't copied to the destination repository")
+	}
+	desc, err := remote.Head(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc.Digest != manifestDigest {
+		t.Errorf("destination digest = %s, want %s", desc.Digest, manifestDigest)
+	}
+}
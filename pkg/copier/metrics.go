@@ -0,0 +1,186 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package copier
+
+import (
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const metricsNamespace = "image_clone"
+
+var (
+	copiesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "copies_total",
+		Help:      "Total number of image copies per source registry and result.",
+	}, []string{"source_registry", "result"})
+
+	copyBytesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "copy_bytes_total",
+		Help:      "Total number of bytes transferred by image copies per source registry.",
+	}, []string{"source_registry"})
+
+	copyExistingBlobBytesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "copy_existing_blob_bytes_total",
+		Help:      "Total number of bytes per source registry that were not transferred because the blobs already existed in the destination, e.g., layers shared with other images. Blobs uploaded by a failed attempt of the same copy are counted in copy_resumed_blob_bytes_total instead.",
+	}, []string{"source_registry"})
+
+	copyResumedBlobBytesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "copy_resumed_blob_bytes_total",
+		Help:      "Total number of bytes per source registry that were not transferred again when retrying a copy, because a failed attempt of the copy already uploaded the blobs.",
+	}, []string{"source_registry"})
+
+	copyInProgressBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "copy_in_progress_bytes",
+		Help:      "Number of bytes transferred by copies that are currently in progress.",
+	}, []string{"destination"})
+
+	retagsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "retags_total",
+		Help:      "Total number of images per source registry that were tagged from an existing manifest in the backup registry instead of being copied.",
+	}, []string{"source_registry"})
+
+	referrersCopiedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "referrers_copied_total",
+		Help:      "Total number of referrers (e.g., SBOMs attached as OCI 1.1 artifacts) per source registry that were copied along with images.",
+	}, []string{"source_registry"})
+
+	imagesTooLargeTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "images_too_large_total",
+		Help:      "Total number of images per source registry that were not copied because they exceed the maximum image size.",
+	}, []string{"source_registry"})
+
+	copyQueueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "copy_queue_depth",
+		Help:      "Number of copies per priority class that are waiting for a free copy slot.",
+	}, []string{"priority"})
+
+	copyWaitSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "copy_wait_seconds",
+		Help:      "Duration that copies per priority class waited for a free copy slot.",
+		Buckets:   []float64{0.1, 1, 5, 15, 30, 60, 300, 900},
+	}, []string{"priority"})
+
+	copiedImageSizeBytes = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "copied_image_size_bytes",
+		Help:      "Total compressed size of copied images per source registry, summed over all platforms for indices.",
+		Buckets:   prometheus.ExponentialBuckets(1<<20, 4, 8),
+	}, []string{"source_registry"})
+
+	registryQueueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "registry_queue_depth",
+		Help:      "Number of operations (push or check) per registry that are waiting for the registry's concurrency limit.",
+	}, []string{"registry", "operation"})
+
+	copyStallsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "copy_stalls_total",
+		Help:      "Total number of copies that were cancelled because they didn't make any progress.",
+	})
+
+	copiesDeferredTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "copies_deferred_total",
+		Help:      "Total number of copies per priority class that were deferred because the egress budget was exhausted.",
+	}, []string{"priority"})
+
+	egressThrottled = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "egress_throttled",
+		Help:      "Whether copies are currently deferred because the egress budget is exhausted (1) or not (0).",
+	})
+
+	storageFull = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "registry_storage_full",
+		Help:      "Whether copies to the destination registry are stopped because its storage is full (1) or not (0).",
+	}, []string{"registry"})
+
+	storageFullErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "registry_storage_full_errors_total",
+		Help:      "Total number of copies per destination registry that failed because its storage or quota was exhausted.",
+	}, []string{"registry"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(
+		copiesTotal,
+		copyBytesTotal,
+		copyInProgressBytes,
+		copyExistingBlobBytesTotal,
+		copyResumedBlobBytesTotal,
+		retagsTotal,
+		referrersCopiedTotal,
+		imagesTooLargeTotal,
+		copyQueueDepth,
+		copyWaitSeconds,
+		copiedImageSizeBytes,
+		registryQueueDepth,
+		copyStallsTotal,
+		copiesDeferredTotal,
+		egressThrottled,
+		storageFull,
+		storageFullErrorsTotal,
+	)
+}
+
+const (
+	resultSuccess = "success"
+	resultFailure = "failure"
+)
+
+func resultLabel(err error) string {
+	if err != nil {
+		return resultFailure
+	}
+	return resultSuccess
+}
+
+// dockerHubAliases are all hostnames that refer to Docker Hub.
+var dockerHubAliases = sets.NewString(
+	"docker.io",
+	"index.docker.io",
+	"registry-1.docker.io",
+	"registry.hub.docker.com",
+)
+
+// registryLabel returns a normalized registry host to be used in metric labels, so that dashboards are not split
+// across aliases of the same registry.
+func registryLabel(registry name.Registry) string {
+	host := strings.ToLower(registry.RegistryStr())
+	if dockerHubAliases.Has(host) {
+		return name.DefaultRegistry
+	}
+	return host
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package copier
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/go-logr/logr"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// maxParentIndexTags is the maximum number of tags of the source repository that are checked when looking for the
+// parent index of a platform image.
+const maxParentIndexTags = 50
+
+// pinsPlatformImage checks whether the source that was referenced by digest is a single-platform image, e.g., because
+// tooling pinned a workload to the platform image of an index instead of the index itself.
+func pinsPlatformImage(pinned bool, desc *remote.Descriptor) bool {
+	if !pinned {
+		return false
+	}
+	switch desc.MediaType {
+	case types.OCIManifestSchema1, types.DockerManifestSchema2:
+		return true
+	}
+	return false
+}
+
+// copyParentIndex looks for an index in the source repository that contains the given platform image and copies it
+// to the destination repository by digest, so that the backup registry contains all platforms of the image, while the
+// destination tag still references the pinned platform image. Indices don't reference their platform images as
+// subject, so the referrers API can't find them. Instead, the tags of the source repository are checked, starting
+// with the last ones in lexical order, which are usually the most recent versions.
+// It returns the digest of the copied index, or an empty hash if no parent index was found.
+func (c *Copier) copyParentIndex(ctx context.Context, log logr.Logger, src name.Repository, child v1.Hash, dst name.Repository, options []remote.Option) (v1.Hash, error) {
+	parent, err := c.findParentIndex(ctx, src, child, options)
+	if err != nil || parent == nil {
+		return v1.Hash{}, err
+	}
+
+	digests, err := manifestDigests(parent)
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	if err := c.checkDenied(src.Digest(parent.Digest.String()).Name(), digests...); err != nil {
+		return v1.Hash{}, err
+	}
+	if err := c.checkSize(ctx, src.Digest(parent.Digest.String()).Name(), parent); err != nil {
+		return v1.Hash{}, err
+	}
+
+	idx, err := parent.ImageIndex()
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	log.Info("Copying parent index of pinned platform image", "index", parent.Digest.String())
+	if err := remote.WriteIndex(dst.Digest(parent.Digest.String()), idx, options...); err != nil {
+		return v1.Hash{}, fmt.Errorf("failed to copy parent index: %w", err)
+	}
+	return parent.Digest, nil
+}
+
+// findParentIndex returns the first index in the source repository that contains the given platform image, or nil
+// if there is none within the first maxParentIndexTags tags.
+func (c *Copier) findParentIndex(ctx context.Context, src name.Repository, child v1.Hash, options []remote.Option) (*remote.Descriptor, error) {
+	tags, err := remote.ListWithContext(ctx, src, options...)
+	if err != nil {
+		return nil, fmt.Errorf("failed listing tags: %w", err)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(tags)))
+	if len(tags) > maxParentIndexTags {
+		tags = tags[:maxParentIndexTags]
+	}
+
+	for _, tag := range tags {
+		// only fetch the manifests of indices
+		head, err := remote.Head(src.Tag(tag), options...)
+		if err != nil || !head.MediaType.IsIndex() {
+			continue
+		}
+		desc, err := remote.Get(src.Tag(tag), options...)
+		if err != nil {
+			continue
+		}
+		indexManifest, err := v1.ParseIndexManifest(bytes.NewReader(desc.Manifest))
+		if err != nil {
+			continue
+		}
+		for _, m := range indexManifest.Manifests {
+			if m.Digest == child {
+				return desc, nil
+			}
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package copier
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func TestCopyPinnedDigest(t *testing.T) {
+	upstream := newTestRegistryHost(t)
+	repository, err := name.NewRepository(upstream.RegistryStr()+"/upstream/app", name.Insecure)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the index is tagged, the orphan platform image isn't contained in any tagged index
+	idx, err := random.Index(1024, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.WriteIndex(repository.Tag("v1"), idx); err != nil {
+		t.Fatal(err)
+	}
+	indexDigest, err := idx.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexManifest, err := idx.IndexManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	child := indexManifest.Manifests[0].Digest
+
+	orphan, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	orphanDigest, err := orphan.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(repository.Digest(orphanDigest.String()), orphan); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name            string
+		pinned          v1.Hash
+		copyParentIndex bool
+		// wantPinnedPlatform is true if the pin references a platform image, wantParentIndex is the digest of the index
+		// that is copied along with it
+		wantPinnedPlatform bool
+		wantParentIndex    v1.Hash
+	}{
+		{name: "index digest", pinned: indexDigest, copyParentIndex: true},
+		{name: "child digest", pinned: child, copyParentIndex: true, wantPinnedPlatform: true, wantParentIndex: indexDigest},
+		{name: "child digest without copying parent index", pinned: child, wantPinnedPlatform: true},
+		{name: "child digest without parent index", pinned: orphanDigest, copyParentIndex: true, wantPinnedPlatform: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backup := newTestRegistryHost(t)
+			src := repository.Digest(tt.pinned.String())
+			dst, err := name.NewTag(backup.RegistryStr()+"/upstream/app:sha256_"+tt.pinned.Hex, name.Insecure)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c := &Copier{Options: Options{CopyParentIndex: tt.copyParentIndex}}
+			ctx := WithImageStats(context.Background())
+			if _, err := c.Copy(ctx, logr.Discard(), src, dst); err != nil {
+				t.Fatal(err)
+			}
+
+			// the destination tag always references the pinned digest
+			desc, err := remote.Head(dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if desc.Digest != tt.pinned {
+				t.Errorf("destination digest = %s, want the pinned digest %s", desc.Digest, tt.pinned)
+			}
+
+			stats, ok := ImageStatsFrom(ctx, dst)
+			if !ok {
+				t.Fatal("no image stats were recorded")
+			}
+			wantParentIndex := ""
+			if tt.wantParentIndex != (v1.Hash{}) {
+				wantParentIndex = tt.wantParentIndex.String()
+			}
+			if stats.PinnedPlatform != tt.wantPinnedPlatform || stats.ParentIndex != wantParentIndex {
+				t.Errorf("stats = pinned platform %v, parent index %q, want %v, %q", stats.PinnedPlatform, stats.ParentIndex, tt.wantPinnedPlatform, wantParentIndex)
+			}
+
+			// all platforms of a copied index are available in the backup registry
+			_, err = remote.Head(dst.Context().Digest(indexDigest.String()))
+			if copiedIndex := err == nil; copiedIndex != (tt.pinned == indexDigest || tt.wantParentIndex == indexDigest) {
+				t.Errorf("index exists in the backup registry: %v (error: %v)", copiedIndex, err)
+			}
+			if tt.wantParentIndex == indexDigest {
+				for _, m := range indexManifest.Manifests {
+					if _, err := remote.Head(dst.Context().Digest(m.Digest.String())); err != nil {
+						t.Errorf("platform image %s of the parent index was not copied: %v", m.Digest, err)
+					}
+				}
+			}
+		})
+	}
+}
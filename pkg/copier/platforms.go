@@ -0,0 +1,93 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package copier
+
+import (
+	"context"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// Platforms returns the platforms that the given image or index provides. Index entries without a platform and
+// attestation manifests (platform unknown/unknown) are ignored. It returns nil if the platforms can't be determined,
+// e.g., for schema 1 images.
+func (c *Copier) Platforms(ctx context.Context, ref name.Reference) ([]v1.Platform, error) {
+	ctx = withDefaultOperation(ctx, OperationVerify)
+	desc, err := remote.Get(ref,
+		remote.WithContext(ctx),
+		remote.WithAuthFromKeychain(c.keychain()),
+		remote.WithTransport(c.transport()),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	switch desc.MediaType {
+	case types.OCIImageIndex, types.DockerManifestList:
+		idx, err := desc.ImageIndex()
+		if err != nil {
+			return nil, err
+		}
+		manifest, err := idx.IndexManifest()
+		if err != nil {
+			return nil, err
+		}
+
+		var platforms []v1.Platform
+		for _, child := range manifest.Manifests {
+			if child.Platform == nil || child.Platform.OS == "unknown" || child.Platform.Architecture == "unknown" {
+				continue
+			}
+			platforms = append(platforms, *child.Platform)
+		}
+		return platforms, nil
+	case types.DockerManifestSchema1, types.DockerManifestSchema1Signed:
+		return nil, nil
+	default:
+		img, err := desc.Image()
+		if err != nil {
+			return nil, err
+		}
+		config, err := img.ConfigFile()
+		if err != nil {
+			return nil, err
+		}
+		return []v1.Platform{{OS: config.OS, Architecture: config.Architecture, Variant: config.Variant}}, nil
+	}
+}
+
+// MissingPlatforms returns the required platforms that are not provided by any of the given platforms. A required
+// platform without a variant is satisfied by any variant of the same OS and architecture.
+func MissingPlatforms(provided, required []v1.Platform) []v1.Platform {
+	var missing []v1.Platform
+	for _, r := range required {
+		found := false
+		for _, p := range provided {
+			if p.OS == r.OS && p.Architecture == r.Architecture && (r.Variant == "" || p.Variant == r.Variant) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, r)
+		}
+	}
+	return missing
+}
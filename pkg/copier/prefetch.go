@@ -0,0 +1,124 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package copier
+
+import (
+	"context"
+	"sync"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// maxConcurrentExistenceChecks limits the number of concurrent requests sent by Prefetch.
+const maxConcurrentExistenceChecks = 10
+
+type prefetchKey struct{}
+
+// prefetchedManifests holds the results of existence checks performed by Prefetch.
+type prefetchedManifests struct {
+	results sync.Map
+}
+
+type existsResult struct {
+	digest v1.Hash
+	exists bool
+}
+
+// Prefetch checks whether the given source and destination images exist concurrently and returns a context that makes
+// Exists and Copy use the results instead of checking the images one after another. This reduces the latency of
+// reconciliations in which most images already exist in the backup registry to a single round trip.
+// Sources are checked like Copy resolves them, i.e., sources referenced by digest are not checked. Failed checks are
+// not cached, so they are retried and reported by the subsequent call. Destinations written by Copy are forgotten.
+// The returned context should only be used for a single reconciliation, as the results are not refreshed.
+func (c *Copier) Prefetch(ctx context.Context, sources, destinations []name.Reference) context.Context {
+	refs := make(map[string]name.Reference, len(sources)+len(destinations))
+	for _, src := range sources {
+		if _, ok := src.(name.Digest); ok {
+			continue
+		}
+		pullSrc, err := c.pullReference(src)
+		if err != nil {
+			continue
+		}
+		refs[pullSrc.Name()] = pullSrc
+	}
+	for _, dst := range destinations {
+		refs[dst.Name()] = dst
+	}
+
+	prefetched := &prefetchedManifests{}
+	if len(refs) == 0 {
+		return context.WithValue(ctx, prefetchKey{}, prefetched)
+	}
+
+	var (
+		wg    sync.WaitGroup
+		slots = make(chan struct{}, maxConcurrentExistenceChecks)
+	)
+	for key, ref := range refs {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(key string, ref name.Reference) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+
+			digest, exists, err := c.Exists(ctx, ref)
+			if err == nil {
+				prefetched.results.Store(key, existsResult{digest: digest, exists: exists})
+			}
+		}(key, ref)
+	}
+	wg.Wait()
+
+	return context.WithValue(ctx, prefetchKey{}, prefetched)
+}
+
+func prefetchedFrom(ctx context.Context) *prefetchedManifests {
+	prefetched, _ := ctx.Value(prefetchKey{}).(*prefetchedManifests)
+	return prefetched
+}
+
+// withPrefetched returns a context carrying the prefetched results of from, e.g., for copies that don't use the
+// caller's context.
+func withPrefetched(ctx, from context.Context) context.Context {
+	if prefetched := prefetchedFrom(from); prefetched != nil {
+		return context.WithValue(ctx, prefetchKey{}, prefetched)
+	}
+	return ctx
+}
+
+func (p *prefetchedManifests) get(ref name.Reference) (existsResult, bool) {
+	if p == nil {
+		return existsResult{}, false
+	}
+	result, ok := p.results.Load(ref.Name())
+	if !ok {
+		return existsResult{}, false
+	}
+	return result.(existsResult), true
+}
+
+// forget drops the result of the given image, e.g., after it has been written.
+func (p *prefetchedManifests) forget(ref name.Reference) {
+	if p == nil {
+		return
+	}
+	p.results.Delete(ref.Name())
+}
@@ -0,0 +1,147 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package copier
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// requestCountingTransport counts the requests sent through it.
+type requestCountingTransport struct {
+	requests int32
+}
+
+func (t *requestCountingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&t.requests, 1)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// seedImages pushes the given number of images to the given registry and returns their references.
+func seedImages(tb testing.TB, reg name.Registry, n int) []name.Reference {
+	tb.Helper()
+
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	refs := make([]name.Reference, n)
+	for i := range refs {
+		tag, err := name.NewTag(fmt.Sprintf("%s/library/app-%d:v1", reg.RegistryStr(), i), name.Insecure)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		if err := remote.Write(tag, img); err != nil {
+			tb.Fatal(err)
+		}
+		refs[i] = tag
+	}
+	return refs
+}
+
+func TestPrefetch(t *testing.T) {
+	reg := newTestRegistryHost(t)
+	existing := seedImages(t, reg, 3)
+	missing, err := name.NewTag(reg.RegistryStr()+"/library/missing:v1", name.Insecure)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pinned := existing[0].Context().Digest("sha256:" + strings.Repeat("0", 64))
+
+	counter := &requestCountingTransport{}
+	c := &Copier{Transport: counter}
+	ctx := c.Prefetch(context.Background(), []name.Reference{existing[0], pinned}, append(existing[1:], missing))
+	// sources referenced by digest are not checked
+	if _, ok := prefetchedFrom(ctx).get(pinned); ok {
+		t.Error("source referenced by digest was prefetched")
+	}
+
+	requests := atomic.LoadInt32(&counter.requests)
+	for _, ref := range append(existing, missing) {
+		_, exists, err := c.Exists(ctx, ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if wantExists := ref != missing; exists != wantExists {
+			t.Errorf("image %s exists = %v, want %v", ref, exists, wantExists)
+		}
+	}
+	if got := atomic.LoadInt32(&counter.requests) - requests; got != 0 {
+		t.Errorf("existence checks sent %d requests after prefetching, want 0", got)
+	}
+
+	// the destination is checked again after it has been written
+	if _, err := c.Copy(ctx, logr.Discard(), existing[0], missing); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists, err := c.Exists(ctx, missing); err != nil || !exists {
+		t.Errorf("copied image exists = %v, error = %v, want the image to exist", exists, err)
+	}
+}
+
+// BenchmarkExists compares checking the existence of the images of a workload one after another with prefetching them
+// against a registry with some latency.
+func BenchmarkExists(b *testing.B) {
+	const latency = 20 * time.Millisecond
+
+	backend := registry.New(registry.Logger(log.New(io.Discard, "", 0)))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(latency)
+		backend.ServeHTTP(w, r)
+	}))
+	b.Cleanup(server.Close)
+	reg, err := name.NewRegistry(strings.TrimPrefix(server.URL, "http://"), name.Insecure)
+	if err != nil {
+		b.Fatal(err)
+	}
+	refs := seedImages(b, reg, 10)
+
+	check := func(b *testing.B, c *Copier, ctx context.Context) {
+		for _, ref := range refs {
+			if _, exists, err := c.Exists(ctx, ref); err != nil || !exists {
+				b.Fatalf("image %s exists = %v, error = %v", ref, exists, err)
+			}
+		}
+	}
+
+	b.Run("sequential", func(b *testing.B) {
+		c := &Copier{}
+		for i := 0; i < b.N; i++ {
+			check(b, c, context.Background())
+		}
+	})
+	b.Run("prefetch", func(b *testing.B) {
+		c := &Copier{}
+		for i := 0; i < b.N; i++ {
+			check(b, c, c.Prefetch(context.Background(), nil, refs))
+		}
+	})
+}
@@ -0,0 +1,138 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package copier
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Priority is the priority class of a copy.
+type Priority int
+
+const (
+	// PriorityInteractive is used for copies of new or changed workloads, which are waiting for their images to be
+	// copied. This is the default priority.
+	PriorityInteractive Priority = iota
+	// PriorityBackground is used for copies that nobody is actively waiting for, e.g., healing missing images or
+	// migrating images from a previous backup registry.
+	PriorityBackground
+)
+
+func (p Priority) String() string {
+	if p == PriorityBackground {
+		return "background"
+	}
+	return "interactive"
+}
+
+type priorityKey struct{}
+
+// WithPriority returns a context that makes Copier.Copy use the given priority class.
+func WithPriority(ctx context.Context, p Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, p)
+}
+
+func priorityFrom(ctx context.Context) Priority {
+	if p, ok := ctx.Value(priorityKey{}).(Priority); ok {
+		return p
+	}
+	return PriorityInteractive
+}
+
+// copySlots limits the number of concurrent copies. A number of slots is reserved for interactive copies, and
+// background copies only start if no interactive copy is waiting for a slot. Waiting copies of the same priority are
+// started in FIFO order.
+type copySlots struct {
+	lock    sync.Mutex
+	active  int
+	waiting [2][]chan struct{}
+}
+
+// acquire waits until a copy of the given priority may start. The returned function must be called when the copy has
+// finished. If max is zero, the number of concurrent copies is not limited.
+func (s *copySlots) acquire(ctx context.Context, max, reserved int, p Priority) (func(), error) {
+	if max <= 0 {
+		return func() {}, nil
+	}
+
+	start := time.Now()
+	defer func() {
+		copyWaitSeconds.WithLabelValues(p.String()).Observe(time.Since(start).Seconds())
+	}()
+	release := func() { s.release(max, reserved) }
+
+	s.lock.Lock()
+	if len(s.waiting[p]) == 0 && s.canStart(max, reserved, p) {
+		s.active++
+		s.lock.Unlock()
+		return release, nil
+	}
+
+	granted := make(chan struct{})
+	s.waiting[p] = append(s.waiting[p], granted)
+	copyQueueDepth.WithLabelValues(p.String()).Inc()
+	s.lock.Unlock()
+
+	select {
+	case <-granted:
+		return release, nil
+	case <-ctx.Done():
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		for i, ch := range s.waiting[p] {
+			if ch == granted {
+				s.waiting[p] = append(s.waiting[p][:i], s.waiting[p][i+1:]...)
+				copyQueueDepth.WithLabelValues(p.String()).Dec()
+				return nil, ctx.Err()
+			}
+		}
+		// the slot was granted concurrently, pass it on
+		s.active--
+		s.dispatch(max, reserved)
+		return nil, ctx.Err()
+	}
+}
+
+func (s *copySlots) release(max, reserved int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.active--
+	s.dispatch(max, reserved)
+}
+
+// canStart checks whether a copy of the given priority may start now. s.lock must be held.
+func (s *copySlots) canStart(max, reserved int, p Priority) bool {
+	if p == PriorityInteractive {
+		return s.active < max
+	}
+	// background copies yield to waiting interactive copies and leave the reserved slots to interactive copies
+	return s.active < max-reserved && len(s.waiting[PriorityInteractive]) == 0
+}
+
+// dispatch starts waiting copies as long as slots are free. s.lock must be held.
+func (s *copySlots) dispatch(max, reserved int) {
+	for _, p := range []Priority{PriorityInteractive, PriorityBackground} {
+		for len(s.waiting[p]) > 0 && s.canStart(max, reserved, p) {
+			s.active++
+			close(s.waiting[p][0])
+			s.waiting[p] = s.waiting[p][1:]
+			copyQueueDepth.WithLabelValues(p.String()).Dec()
+		}
+	}
+}
@@ -0,0 +1,184 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package copier
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-logr/logr"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// progressTracker tracks the number of bytes transferred by a single copy.
+type progressTracker struct {
+	destination string
+	// logBytes is the number of transferred bytes after which the progress is logged, zero disables it
+	logBytes int64
+	// thresholdReached is signaled when logBytes have been transferred since the progress was logged last
+	thresholdReached chan struct{}
+
+	total        int64
+	transferred  int64
+	logged       int64
+	lastProgress int64
+}
+
+func newProgressTracker(destination string, logBytes int64) *progressTracker {
+	return &progressTracker{
+		destination:      destination,
+		logBytes:         logBytes,
+		thresholdReached: make(chan struct{}, 1),
+		lastProgress:     time.Now().UnixNano(),
+	}
+}
+
+func (t *progressTracker) setTotal(total int64) {
+	atomic.StoreInt64(&t.total, total)
+}
+
+func (t *progressTracker) add(n int) {
+	if n <= 0 {
+		return
+	}
+
+	transferred := atomic.AddInt64(&t.transferred, int64(n))
+	atomic.StoreInt64(&t.lastProgress, time.Now().UnixNano())
+	copyInProgressBytes.WithLabelValues(t.destination).Add(float64(n))
+
+	if t.logBytes > 0 && transferred-atomic.LoadInt64(&t.logged) >= t.logBytes {
+		select {
+		case t.thresholdReached <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// lastProgressTime returns the time when the last bytes were transferred (or when the copy was started).
+func (t *progressTracker) lastProgressTime() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&t.lastProgress))
+}
+
+func (t *progressTracker) done() {
+	copyInProgressBytes.DeleteLabelValues(t.destination)
+}
+
+// logPeriodically logs the copy progress in the given interval and whenever the tracker's logBytes have been
+// transferred since the last log, until the returned func is called. Zero disables logging in an interval.
+func (t *progressTracker) logPeriodically(log logr.Logger, interval time.Duration) func() {
+	stopCh := make(chan struct{})
+
+	go func() {
+		var tick <-chan time.Time
+		if interval > 0 {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+
+		for {
+			select {
+			case <-stopCh:
+				return
+			case <-tick:
+				t.log(log)
+			case <-t.thresholdReached:
+				t.log(log)
+			}
+		}
+	}()
+
+	return func() { close(stopCh) }
+}
+
+func (t *progressTracker) log(log logr.Logger) {
+	transferred, total := atomic.LoadInt64(&t.transferred), atomic.LoadInt64(&t.total)
+	atomic.StoreInt64(&t.logged, transferred)
+
+	keysAndValues := []interface{}{"bytesTransferred", transferred, "lastProgress", t.lastProgressTime()}
+	if total > 0 {
+		percent := float64(transferred) * 100 / float64(total)
+		if percent > 100 {
+			// transferred bytes include manifests and error responses, don't report misleading values
+			percent = 100
+		}
+		keysAndValues = append(keysAndValues, "bytesTotal", total, "percent", fmt.Sprintf("%.1f", percent))
+	}
+
+	log.Info("Copy in progress", keysAndValues...)
+}
+
+// cancelOnStall calls cancel if no bytes were transferred for the given timeout. The returned func reports whether
+// cancel was called because of a stall.
+func (t *progressTracker) cancelOnStall(ctx context.Context, cancel context.CancelFunc, timeout time.Duration) func() bool {
+	var stalled int32
+
+	go func() {
+		ticker := time.NewTicker(stallCheckInterval(timeout))
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if time.Since(t.lastProgressTime()) > timeout {
+					atomic.StoreInt32(&stalled, 1)
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	return func() bool { return atomic.LoadInt32(&stalled) == 1 }
+}
+
+// stallCheckInterval returns how often to check for stalls so that stalls are detected shortly after the timeout.
+func stallCheckInterval(timeout time.Duration) time.Duration {
+	interval := timeout / 4
+	if interval < time.Second {
+		interval = time.Second
+	}
+	return interval
+}
+
+// totalSize calculates the total size of the given image from its manifest. If the size cannot be determined without
+// fetching additional manifests (e.g., for indexes), it returns 0.
+func totalSize(desc *remote.Descriptor) int64 {
+	switch desc.MediaType {
+	case types.OCIManifestSchema1, types.DockerManifestSchema2:
+	default:
+		return 0
+	}
+
+	manifest := &v1.Manifest{}
+	if err := json.Unmarshal(desc.Manifest, manifest); err != nil {
+		return 0
+	}
+
+	total := manifest.Config.Size
+	for _, layer := range manifest.Layers {
+		total += layer.Size
+	}
+	return total
+}
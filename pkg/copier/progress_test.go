@@ -0,0 +1,165 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package copier
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/go-logr/logr/funcr"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func TestProgressTrackerLogsAfterBytes(t *testing.T) {
+	logs := make(chan string, 10)
+	log := funcr.New(func(_, args string) { logs <- args }, funcr.Options{})
+
+	tracker := newProgressTracker("registry.example.com/app:v1", 100)
+	defer tracker.done()
+	stop := tracker.logPeriodically(log, 0)
+	defer stop()
+
+	expectLog := func(want bool) {
+		t.Helper()
+		select {
+		case args := <-logs:
+			if !want {
+				t.Fatalf("unexpected progress log: %s", args)
+			}
+		case <-time.After(100 * time.Millisecond):
+			if want {
+				t.Fatal("expected progress log")
+			}
+		}
+	}
+
+	tracker.add(99)
+	expectLog(false)
+	tracker.add(1)
+	expectLog(true)
+	// the threshold counts from the last log
+	tracker.add(60)
+	expectLog(false)
+	tracker.add(60)
+	expectLog(true)
+}
+
+func TestProgressTrackerLogsInInterval(t *testing.T) {
+	logs := make(chan string, 10)
+	log := funcr.New(func(_, args string) { logs <- args }, funcr.Options{})
+
+	tracker := newProgressTracker("registry.example.com/app:v1", 0)
+	defer tracker.done()
+	stop := tracker.logPeriodically(log, 10*time.Millisecond)
+	defer stop()
+
+	tracker.add(1 << 30)
+	select {
+	case <-logs:
+	case <-time.After(time.Second):
+		t.Fatal("expected progress log in interval")
+	}
+}
+
+// freezingTransport freezes the first blob download that is larger than after bytes once after bytes have been read,
+// until the request is cancelled.
+type freezingTransport struct {
+	after  int
+	frozen int32
+}
+
+func (t *freezingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil || req.Method != http.MethodGet || !strings.Contains(req.URL.Path, "/blobs/sha256:") || resp.ContentLength <= int64(t.after) ||
+		!atomic.CompareAndSwapInt32(&t.frozen, 0, 1) {
+		return resp, err
+	}
+	resp.Body = &freezingBody{ReadCloser: resp.Body, ctx: req.Context(), remaining: t.after}
+	return resp, nil
+}
+
+type freezingBody struct {
+	io.ReadCloser
+	ctx       context.Context
+	remaining int
+}
+
+func (b *freezingBody) Read(p []byte) (int, error) {
+	if b.remaining <= 0 {
+		<-b.ctx.Done()
+		return 0, b.ctx.Err()
+	}
+	if len(p) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= n
+	return n, err
+}
+
+func TestCopyCancelledOnStall(t *testing.T) {
+	src, err := name.NewTag(newTestRegistryHost(t).RegistryStr()+"/upstream/app:v1", name.Insecure)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst, err := name.NewTag(newTestRegistryHost(t).RegistryStr()+"/upstream/app:v1", name.Insecure)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := random.Image(64*1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(src, img); err != nil {
+		t.Fatal(err)
+	}
+
+	const timeout = time.Second
+	c := &Copier{Options: Options{StallTimeout: timeout}, Transport: &freezingTransport{after: 1024}}
+
+	start := time.Now()
+	_, err = c.Copy(context.Background(), logr.Discard(), src, dst)
+	var stallErr *StallError
+	if !errors.As(err, &stallErr) {
+		t.Fatalf("error = %v, want a StallError", err)
+	}
+	// stalls are checked every second
+	if elapsed := time.Since(start); elapsed < timeout || elapsed > timeout+3*stallCheckInterval(timeout) {
+		t.Errorf("copy was cancelled after %s, want shortly after the stall timeout of %s", elapsed, timeout)
+	}
+
+	// the retry isn't affected by the stalled copy
+	if _, err := c.Copy(context.Background(), logr.Discard(), src, dst); err != nil {
+		t.Fatalf("retry failed: %v", err)
+	}
+	want, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc, err := remote.Head(dst); err != nil || desc.Digest != want {
+		t.Errorf("destination = %v (error: %v), want digest %s", desc, err, want)
+	}
+}
@@ -0,0 +1,104 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package copier
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// BlobRedirectError is returned by Copier.Copy if a registry redirected a blob download to a different host (e.g.,
+// presigned URLs of S3 or GCS) that couldn't be reached, e.g., because an egress firewall only allows the registry
+// hosts. If ForceBlobDownloadsViaRegistry is set, redirects are not followed and Refused is true.
+type BlobRedirectError struct {
+	// Registry is the host of the registry that redirected the download.
+	Registry string
+	// Host is the host that the download was redirected to.
+	Host string
+	// Refused is true if the redirect was not followed because of ForceBlobDownloadsViaRegistry.
+	Refused bool
+
+	err error
+}
+
+func (e *BlobRedirectError) Error() string {
+	if e.Refused {
+		return fmt.Sprintf("registry %q redirects blob downloads to %q instead of serving them itself, which is refused as blob downloads are forced through the registry endpoint", e.Registry, e.Host)
+	}
+	return fmt.Sprintf("registry %q redirected a blob download to %q, which is not reachable: %v; allow egress to %q or configure a proxy for it", e.Registry, e.Host, e.err, e.Host)
+}
+
+func (e *BlobRedirectError) Unwrap() error {
+	return e.err
+}
+
+// IsBlobRedirect checks whether the given error indicates that a blob download failed because of a redirect to a
+// different host.
+func IsBlobRedirect(err error) bool {
+	var redirectErr *BlobRedirectError
+	return errors.As(err, &redirectErr)
+}
+
+// redirectTransport detects failed requests to hosts that registries redirected blob downloads to. http.Client follows
+// redirects by sending new requests via the same transport, which reference the redirect response in req.Response.
+// If refuse is set, redirects of blob downloads to different hosts are not followed.
+type redirectTransport struct {
+	base   http.RoundTripper
+	refuse bool
+}
+
+func (t *redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		if origin := redirectOrigin(req); origin != req && isBlobDownload(origin) && origin.URL.Host != req.URL.Host {
+			return nil, &BlobRedirectError{Registry: origin.URL.Host, Host: req.URL.Host, err: err}
+		}
+		return resp, err
+	}
+
+	if !t.refuse || !isBlobDownload(req) {
+		return resp, nil
+	}
+	switch resp.StatusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return resp, nil
+	}
+
+	location, err := resp.Location()
+	if err != nil || location.Host == req.URL.Host {
+		return resp, nil
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+	return nil, &BlobRedirectError{Registry: req.URL.Host, Host: location.Host, Refused: true}
+}
+
+// redirectOrigin returns the request that started the chain of redirects leading to the given request.
+func redirectOrigin(req *http.Request) *http.Request {
+	for req.Response != nil && req.Response.Request != nil {
+		req = req.Response.Request
+	}
+	return req
+}
+
+func isBlobDownload(req *http.Request) bool {
+	return req.Method == http.MethodGet && strings.Contains(req.URL.Path, "/blobs/")
+}
@@ -0,0 +1,222 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package copier
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// referrersIndex is the response of the OCI 1.1 referrers API and the content of the referrers tag schema fallback.
+// go-containerregistry's v1.Descriptor doesn't support the artifactType field yet, so we use our own types to not
+// lose it when pushing the fallback index.
+type referrersIndex struct {
+	SchemaVersion  int                  `json:"schemaVersion"`
+	IndexMediaType types.MediaType      `json:"mediaType,omitempty"`
+	Manifests      []referrerDescriptor `json:"manifests"`
+}
+
+type referrerDescriptor struct {
+	MediaType    types.MediaType   `json:"mediaType"`
+	Digest       v1.Hash           `json:"digest"`
+	Size         int64             `json:"size"`
+	ArtifactType string            `json:"artifactType,omitempty"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+}
+
+// RawManifest implements remote.Taggable for pushing the fallback index.
+func (i *referrersIndex) RawManifest() ([]byte, error) {
+	return json.Marshal(i)
+}
+
+// MediaType implements remote.Taggable for pushing the fallback index.
+func (i *referrersIndex) MediaType() (types.MediaType, error) {
+	return types.OCIImageIndex, nil
+}
+
+// copyReferrers copies all referrers of the given source manifest (e.g., SBOMs or signatures attached as OCI 1.1
+// artifacts) to the destination repository. It returns the number of copied referrers.
+// If the destination registry doesn't support the referrers API, the referrers tag schema fallback is pushed, so that
+// clients can still discover the referrers.
+func (c *Copier) copyReferrers(ctx context.Context, log logr.Logger, src name.Repository, digest v1.Hash, dst name.Repository, options []remote.Option) (int, error) {
+	referrers, err := c.referrers(ctx, src, digest, options)
+	if err != nil {
+		return 0, fmt.Errorf("failed listing referrers of %q: %w", src.Digest(digest.String()).Name(), err)
+	}
+	if referrers == nil || len(referrers.Manifests) == 0 {
+		return 0, nil
+	}
+
+	for _, referrer := range referrers.Manifests {
+		if err := c.copyManifest(src.Digest(referrer.Digest.String()), dst.Digest(referrer.Digest.String()), options); err != nil {
+			return 0, fmt.Errorf("failed copying referrer %q: %w", referrer.Digest, err)
+		}
+		log.V(1).Info("Copied referrer", "digest", referrer.Digest.String(), "artifactType", referrer.ArtifactType)
+	}
+
+	supported, err := c.referrersAPISupported(ctx, dst, digest)
+	if err != nil {
+		return 0, err
+	}
+	if !supported {
+		if err := c.pushReferrersFallback(dst, digest, referrers, options); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(referrers.Manifests), nil
+}
+
+// referrers lists the referrers of the given manifest. It uses the referrers API and falls back to the referrers tag
+// schema for registries that don't support the API. It returns nil if the manifest doesn't have any referrers.
+func (c *Copier) referrers(ctx context.Context, repo name.Repository, digest v1.Hash, options []remote.Option) (*referrersIndex, error) {
+	resp, err := c.getReferrers(ctx, repo, digest)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotFound {
+		if err := transport.CheckError(resp, http.StatusOK); err != nil {
+			return nil, err
+		}
+		referrers := &referrersIndex{}
+		return referrers, json.NewDecoder(resp.Body).Decode(referrers)
+	}
+
+	// the registry doesn't support the referrers API, use the tag schema fallback
+	desc, err := remote.Get(referrersTag(repo, digest), options...)
+	if err != nil {
+		if IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	referrers := &referrersIndex{}
+	return referrers, json.Unmarshal(desc.Manifest, referrers)
+}
+
+// referrersAPISupported checks whether the given registry supports the referrers API.
+func (c *Copier) referrersAPISupported(ctx context.Context, repo name.Repository, digest v1.Hash) (bool, error) {
+	resp, err := c.getReferrers(ctx, repo, digest)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	return resp.StatusCode == http.StatusOK, nil
+}
+
+// getReferrers sends a request to the referrers API of the given registry. The caller must close the response body.
+func (c *Copier) getReferrers(ctx context.Context, repo name.Repository, digest v1.Hash) (*http.Response, error) {
+	auth, err := c.keychain().Resolve(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	rt, err := transport.NewWithContext(ctx, repo.Registry, auth, c.transport(), []string{repo.Scope(transport.PullScope)})
+	if err != nil {
+		return nil, err
+	}
+
+	u := url.URL{
+		Scheme: repo.Registry.Scheme(),
+		Host:   repo.RegistryStr(),
+		Path:   fmt.Sprintf("/v2/%s/referrers/%s", repo.RepositoryStr(), digest.String()),
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", string(types.OCIImageIndex))
+
+	return (&http.Client{Transport: rt}).Do(req)
+}
+
+// pushReferrersFallback merges the given referrers into the referrers tag schema fallback index in the given
+// repository.
+func (c *Copier) pushReferrersFallback(repo name.Repository, digest v1.Hash, referrers *referrersIndex, options []remote.Option) error {
+	tag := referrersTag(repo, digest)
+
+	merged := &referrersIndex{SchemaVersion: 2, IndexMediaType: types.OCIImageIndex}
+	desc, err := remote.Get(tag, options...)
+	if err != nil && !IsNotFound(err) {
+		return err
+	}
+	if err == nil {
+		if err := json.Unmarshal(desc.Manifest, merged); err != nil {
+			return fmt.Errorf("failed parsing referrers fallback index %q: %w", tag.Name(), err)
+		}
+	}
+
+	existing := make(map[v1.Hash]bool, len(merged.Manifests))
+	for _, referrer := range merged.Manifests {
+		existing[referrer.Digest] = true
+	}
+	for _, referrer := range referrers.Manifests {
+		if !existing[referrer.Digest] {
+			merged.Manifests = append(merged.Manifests, referrer)
+		}
+	}
+
+	if err := remote.Put(tag, merged, options...); err != nil {
+		return fmt.Errorf("failed pushing referrers fallback index %q: %w", tag.Name(), err)
+	}
+	return nil
+}
+
+// copyManifest copies the given manifest including its blobs.
+func (c *Copier) copyManifest(src, dst name.Digest, options []remote.Option) error {
+	desc, err := remote.Get(src, options...)
+	if err != nil {
+		return err
+	}
+
+	switch desc.MediaType {
+	case types.OCIImageIndex, types.DockerManifestList:
+		idx, err := desc.ImageIndex()
+		if err != nil {
+			return err
+		}
+		return remote.WriteIndex(dst, idx, options...)
+	default:
+		img, err := desc.Image()
+		if err != nil {
+			return err
+		}
+		return remote.Write(dst, img, options...)
+	}
+}
+
+// referrersTag returns the tag of the referrers tag schema fallback for the given digest, e.g., sha256-<hex>.
+func referrersTag(repo name.Repository, digest v1.Hash) name.Tag {
+	return repo.Tag(strings.Replace(digest.String(), ":", "-", 1))
+}
@@ -0,0 +1,173 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package copier
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+const (
+	// DefaultBackupRegistryConcurrency is the default limit of concurrent copies to the backup registry.
+	DefaultBackupRegistryConcurrency = 2
+	// DefaultBackupRegistryCheckConcurrency is the default limit of concurrent existence checks against the backup
+	// registry. Checks only send a single HEAD request, so they can use a higher limit than copies.
+	DefaultBackupRegistryCheckConcurrency = 10
+)
+
+// ParseRegistryConcurrency parses per-registry concurrency limits in the format <registry-host>=<limit>. The returned
+// map is keyed by the lower-case registry host.
+func ParseRegistryConcurrency(limits []string) (map[string]int, error) {
+	result := make(map[string]int, len(limits))
+
+	for _, limit := range limits {
+		host, value, ok := strings.Cut(limit, "=")
+		if !ok || host == "" || value == "" {
+			return nil, fmt.Errorf("invalid registry concurrency %q, expected format <registry-host>=<limit>", limit)
+		}
+
+		registry, err := name.NewRegistry(host)
+		if err != nil {
+			return nil, fmt.Errorf("invalid registry host in registry concurrency %q: %w", limit, err)
+		}
+		key := strings.ToLower(registry.RegistryStr())
+		if _, ok := result[key]; ok {
+			return nil, fmt.Errorf("duplicate registry concurrency for registry host %q", host)
+		}
+
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid limit in registry concurrency %q, expected a positive integer", limit)
+		}
+		result[key] = n
+	}
+
+	return result, nil
+}
+
+// registryOperation distinguishes the operations that are limited separately per registry.
+type registryOperation string
+
+const (
+	registryOperationPush  registryOperation = "push"
+	registryOperationCheck registryOperation = "check"
+)
+
+// registryLimits limits the number of concurrent operations per registry host, in addition to the global copy slots.
+// Small in-cluster registries respond with 5xx errors to bursts of parallel uploads, which are retried and make things
+// worse.
+type registryLimits struct {
+	lock   sync.Mutex
+	limits map[registryLimitKey]*registryLimit
+}
+
+type registryLimitKey struct {
+	operation registryOperation
+	registry  string
+}
+
+type registryLimit struct {
+	// ch has a capacity of the limit, holding a slot means having sent to it
+	ch chan struct{}
+	// waiting is the number of operations waiting for a slot
+	waiting int
+}
+
+// acquire blocks until the given operation may start against the given registry or the context is cancelled. The
+// returned function releases the slot. If limits has no entry for the registry, the operation is not limited.
+func (r *registryLimits) acquire(ctx context.Context, operation registryOperation, registry name.Registry, limits map[string]int) (func(), error) {
+	key := registryLimitKey{operation: operation, registry: strings.ToLower(registry.RegistryStr())}
+	max, ok := limits[key.registry]
+	if !ok || max <= 0 {
+		return func() {}, nil
+	}
+
+	r.lock.Lock()
+	if r.limits == nil {
+		r.limits = make(map[registryLimitKey]*registryLimit)
+	}
+	l, ok := r.limits[key]
+	if !ok {
+		// limits are static, so the entries are never removed
+		l = &registryLimit{ch: make(chan struct{}, max)}
+		r.limits[key] = l
+	}
+	r.lock.Unlock()
+
+	release := func() { <-l.ch }
+	select {
+	case l.ch <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	r.lock.Lock()
+	l.waiting++
+	r.lock.Unlock()
+	registryQueueDepth.WithLabelValues(key.registry, string(operation)).Inc()
+	defer func() {
+		r.lock.Lock()
+		l.waiting--
+		r.lock.Unlock()
+		registryQueueDepth.WithLabelValues(key.registry, string(operation)).Dec()
+	}()
+
+	select {
+	case l.ch <- struct{}{}:
+		return release, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// RegistryLimitState describes the usage of a per-registry concurrency limit.
+type RegistryLimitState struct {
+	Registry  string `json:"registry"`
+	Operation string `json:"operation"`
+	Limit     int    `json:"limit"`
+	Active    int    `json:"active"`
+	Waiting   int    `json:"waiting"`
+}
+
+func (r *registryLimits) state() []RegistryLimitState {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	state := make([]RegistryLimitState, 0, len(r.limits))
+	for key, l := range r.limits {
+		state = append(state, RegistryLimitState{
+			Registry:  key.registry,
+			Operation: string(key.operation),
+			Limit:     cap(l.ch),
+			Active:    len(l.ch),
+			Waiting:   l.waiting,
+		})
+	}
+	sort.Slice(state, func(i, j int) bool {
+		if state[i].Registry != state[j].Registry {
+			return state[i].Registry < state[j].Registry
+		}
+		return state[i].Operation < state[j].Operation
+	})
+	return state
+}
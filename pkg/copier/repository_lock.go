@@ -0,0 +1,73 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package copier
+
+import (
+	"context"
+	"sync"
+)
+
+// repositoryLocks serializes copies to the same destination repository, e.g., of different tags of the same image.
+// Some registries reject concurrent blob upload sessions for the same blob in one repository (409 Conflict), which
+// happens if both tags share layers. Copies to different repositories still run in parallel.
+type repositoryLocks struct {
+	lock  sync.Mutex
+	locks map[string]*repositoryLock
+}
+
+type repositoryLock struct {
+	// ch has a capacity of 1, holding the lock means having sent to it
+	ch chan struct{}
+	// refs is the number of copies holding or waiting for the lock
+	refs int
+}
+
+// acquire blocks until the lock of the given repository is acquired or the context is cancelled. The returned function
+// releases the lock.
+func (r *repositoryLocks) acquire(ctx context.Context, repository string) (func(), error) {
+	r.lock.Lock()
+	if r.locks == nil {
+		r.locks = make(map[string]*repositoryLock)
+	}
+	l, ok := r.locks[repository]
+	if !ok {
+		l = &repositoryLock{ch: make(chan struct{}, 1)}
+		r.locks[repository] = l
+	}
+	l.refs++
+	r.lock.Unlock()
+
+	unref := func() {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		l.refs--
+		if l.refs == 0 {
+			delete(r.locks, repository)
+		}
+	}
+
+	select {
+	case l.ch <- struct{}{}:
+		return func() {
+			<-l.ch
+			unref()
+		}, nil
+	case <-ctx.Done():
+		unref()
+		return nil, ctx.Err()
+	}
+}
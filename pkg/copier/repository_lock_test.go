@@ -0,0 +1,149 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package copier
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func TestRepositoryLocks(t *testing.T) {
+	locks := &repositoryLocks{}
+	ctx := context.Background()
+
+	unlock, err := locks.acquire(ctx, "registry.example.com/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// copies to other repositories are not blocked
+	unlockOther, err := locks.acquire(ctx, "registry.example.com/other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlockOther()
+
+	// waiting copies are cancelled with their context
+	cancelled, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err := locks.acquire(cancelled, "registry.example.com/app"); err == nil {
+		t.Fatal("acquired lock that is held by another copy")
+	}
+
+	acquired := make(chan func())
+	go func() {
+		unlock, err := locks.acquire(ctx, "registry.example.com/app")
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- unlock
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("acquired lock that is held by another copy")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	unlock()
+	select {
+	case unlock := <-acquired:
+		unlock()
+	case <-time.After(5 * time.Second):
+		t.Fatal("lock was not acquired after it was released")
+	}
+
+	if len(locks.locks) != 0 {
+		t.Errorf("unused locks were kept: %v", locks.locks)
+	}
+}
+
+func TestConcurrentCopiesToSameRepository(t *testing.T) {
+	upstream, backup := newTestRegistryHost(t), newTestRegistryHost(t)
+
+	// both tags share the layers of the base image, so that both copies upload the same blobs
+	base, err := random.Image(64*1024, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	images := map[string]v1.Image{}
+	for _, tag := range []string{"v1", "v2"} {
+		layer, err := random.Layer(1024, "application/vnd.docker.image.rootfs.diff.tar.gzip")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if images[tag], err = mutate.AppendLayers(base, layer); err != nil {
+			t.Fatal(err)
+		}
+		src, err := name.NewTag(upstream.RegistryStr()+"/library/app:"+tag, name.Insecure)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := remote.Write(src, images[tag]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := &Copier{}
+	var wg sync.WaitGroup
+	for tag := range images {
+		wg.Add(1)
+		go func(tag string) {
+			defer wg.Done()
+			src, err := name.NewTag(upstream.RegistryStr()+"/library/app:"+tag, name.Insecure)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			dst, err := name.NewTag(backup.RegistryStr()+"/library/app:"+tag, name.Insecure)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if _, err := c.Copy(context.Background(), logr.Discard(), src, dst); err != nil {
+				t.Errorf("copy of %s failed: %v", tag, err)
+			}
+		}(tag)
+	}
+	wg.Wait()
+
+	for tag, img := range images {
+		want, err := img.Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		dst, err := name.NewTag(backup.RegistryStr()+"/library/app:"+tag, name.Insecure)
+		if err != nil {
+			t.Fatal(err)
+		}
+		desc, err := remote.Head(dst)
+		if err != nil {
+			t.Fatalf("tag %s doesn't exist in the backup registry: %v", tag, err)
+		}
+		if desc.Digest != want {
+			t.Errorf("tag %s has digest %s, want %s", tag, desc.Digest, want)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package copier
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// ParseRegistryHostRewrites parses the given registry host rewrites of the form <source-host>=<pull-host>.
+// The pull host can be prefixed with http:// for registries that don't support TLS.
+func ParseRegistryHostRewrites(rewrites []string) (map[string]name.Registry, error) {
+	result := make(map[string]name.Registry, len(rewrites))
+
+	for _, rewrite := range rewrites {
+		from, to, ok := strings.Cut(rewrite, "=")
+		if !ok || from == "" || to == "" {
+			return nil, fmt.Errorf("invalid registry host rewrite %q, expected format <source-host>=<pull-host>", rewrite)
+		}
+
+		fromRegistry, err := name.NewRegistry(from)
+		if err != nil {
+			return nil, fmt.Errorf("invalid source host in registry host rewrite %q: %w", rewrite, err)
+		}
+		if _, ok := result[fromRegistry.RegistryStr()]; ok {
+			return nil, fmt.Errorf("duplicate registry host rewrite for %q", from)
+		}
+
+		var opts []name.Option
+		if strings.HasPrefix(to, "http://") {
+			to = strings.TrimPrefix(to, "http://")
+			opts = append(opts, name.Insecure)
+		}
+
+		toRegistry, err := name.NewRegistry(to, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pull host in registry host rewrite %q: %w", rewrite, err)
+		}
+
+		result[fromRegistry.RegistryStr()] = toRegistry
+	}
+
+	return result, nil
+}
+
+// pullReference returns the reference that should be used for pulling the given source image. If a registry host
+// rewrite is configured for the source registry, the returned reference points to the rewritten registry.
+func (c *Copier) pullReference(src name.Reference) (name.Reference, error) {
+	pullRegistry, ok := c.RegistryHostRewrites[src.Context().RegistryStr()]
+	if !ok {
+		return src, nil
+	}
+
+	repository := src.Context()
+	repository.Registry = pullRegistry
+
+	switch ref := src.(type) {
+	case name.Digest:
+		return repository.Digest(ref.DigestStr()), nil
+	case name.Tag:
+		return repository.Tag(ref.TagStr()), nil
+	default:
+		return nil, fmt.Errorf("unsupported reference type %T", src)
+	}
+}
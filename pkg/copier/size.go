@@ -0,0 +1,116 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package copier
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// ImageTooLargeError is returned by Copier.Copy if the source image is larger than Copier.MaxImageSize.
+type ImageTooLargeError struct {
+	Image string
+	Size  int64
+	Limit int64
+}
+
+func (e *ImageTooLargeError) Error() string {
+	return fmt.Sprintf("image %q is too large to be copied: size %s exceeds the limit of %s",
+		e.Image, resource.NewQuantity(e.Size, resource.BinarySI), resource.NewQuantity(e.Limit, resource.BinarySI))
+}
+
+// IsImageTooLarge checks whether the given error indicates that an image was not copied because of its size.
+func IsImageTooLarge(err error) bool {
+	var tooLargeErr *ImageTooLargeError
+	return errors.As(err, &tooLargeErr)
+}
+
+type sizeLimitKey struct{}
+
+// WithoutSizeLimit returns a context that makes Copier.Copy ignore Copier.MaxImageSize.
+func WithoutSizeLimit(ctx context.Context) context.Context {
+	return context.WithValue(ctx, sizeLimitKey{}, true)
+}
+
+func sizeLimitDisabled(ctx context.Context) bool {
+	disabled, _ := ctx.Value(sizeLimitKey{}).(bool)
+	return disabled
+}
+
+// checkSize returns an *ImageTooLargeError if the given image is larger than MaxImageSize. The size of an image is the
+// sum of its config and layer sizes, for indices the size of the largest image is used.
+func (c *Copier) checkSize(ctx context.Context, image string, desc *remote.Descriptor) error {
+	if c.MaxImageSize <= 0 || sizeLimitDisabled(ctx) {
+		return nil
+	}
+
+	size, err := imageSize(desc)
+	if err != nil {
+		return fmt.Errorf("failed determining size of image %q: %w", image, err)
+	}
+	if size > c.MaxImageSize {
+		return &ImageTooLargeError{Image: image, Size: size, Limit: c.MaxImageSize}
+	}
+	return nil
+}
+
+func imageSize(desc *remote.Descriptor) (int64, error) {
+	switch desc.MediaType {
+	case types.OCIImageIndex, types.DockerManifestList:
+	default:
+		return totalSize(desc), nil
+	}
+
+	idx, err := desc.ImageIndex()
+	if err != nil {
+		return 0, err
+	}
+	indexManifest, err := idx.IndexManifest()
+	if err != nil {
+		return 0, err
+	}
+
+	var largest int64
+	for _, child := range indexManifest.Manifests {
+		if !child.MediaType.IsImage() {
+			continue
+		}
+		// only fetches the manifest, layers are fetched lazily
+		img, err := idx.Image(child.Digest)
+		if err != nil {
+			return 0, err
+		}
+		manifest, err := img.Manifest()
+		if err != nil {
+			return 0, err
+		}
+
+		size := manifest.Config.Size
+		for _, layer := range manifest.Layers {
+			size += layer.Size
+		}
+		if size > largest {
+			largest = size
+		}
+	}
+	return largest, nil
+}
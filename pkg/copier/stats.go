@@ -0,0 +1,178 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package copier
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/go-logr/logr"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// ImageStats describes a copied image for capacity tracking. It is taken from the manifests only, so determining it
+// doesn't download any blobs.
+type ImageStats struct {
+	// Size is the total compressed size of the image's config and layers. For indices, it is the sum over all platform
+	// images.
+	Size int64
+	// Layers is the number of layers of the image. For indices, it is the sum over all platform images.
+	Layers int
+	// PinnedPlatform is true if the source referenced a single-platform image by digest. ParentIndex is the digest of
+	// the index containing it that was copied along with it, see Options.CopyParentIndex. Otherwise, the backup registry
+	// only contains the pinned platform.
+	PinnedPlatform bool
+	ParentIndex    string
+}
+
+func (s ImageStats) add(o ImageStats) ImageStats {
+	return ImageStats{Size: s.Size + o.Size, Layers: s.Layers + o.Layers}
+}
+
+var errSchema1Stats = errors.New("schema 1 manifests don't contain layer sizes")
+
+type imageStatsKey struct{}
+
+// imageStatsRecorder holds the stats of the images copied with a context, see WithImageStats.
+type imageStatsRecorder struct {
+	lock  sync.Mutex
+	stats map[string]ImageStats
+}
+
+// WithImageStats returns a context that makes Copy and CopyAsync record the ImageStats of all images they transfer with
+// it, see ImageStatsFrom. Images that already existed in the destination are not recorded.
+func WithImageStats(ctx context.Context) context.Context {
+	return context.WithValue(ctx, imageStatsKey{}, &imageStatsRecorder{stats: make(map[string]ImageStats)})
+}
+
+// ImageStatsFrom returns the stats of the image that was transferred to the given destination with the given context.
+func ImageStatsFrom(ctx context.Context, dst name.Tag) (ImageStats, bool) {
+	recorder, ok := ctx.Value(imageStatsKey{}).(*imageStatsRecorder)
+	if !ok {
+		return ImageStats{}, false
+	}
+
+	recorder.lock.Lock()
+	defer recorder.lock.Unlock()
+	stats, ok := recorder.stats[dst.Name()]
+	return stats, ok
+}
+
+func recordImageStats(ctx context.Context, dst name.Tag, stats ImageStats) {
+	recorder, ok := ctx.Value(imageStatsKey{}).(*imageStatsRecorder)
+	if !ok {
+		return
+	}
+
+	recorder.lock.Lock()
+	defer recorder.lock.Unlock()
+	recorder.stats[dst.Name()] = stats
+}
+
+// observeImageStats determines the stats of the given copied image, records them in the context, and exposes them in
+// the size metric. Failing to determine them doesn't fail the copy.
+func observeImageStats(ctx context.Context, log logr.Logger, src name.Reference, dst name.Tag, desc *remote.Descriptor, pinnedPlatform bool, parentIndex v1.Hash) {
+	stats, platforms, err := imageStats(desc)
+	if err != nil {
+		log.V(1).Info("Failed determining size of copied image", "error", err.Error())
+		return
+	}
+	stats.PinnedPlatform = pinnedPlatform
+	if parentIndex != (v1.Hash{}) {
+		stats.ParentIndex = parentIndex.String()
+	}
+
+	recordImageStats(ctx, dst, stats)
+	copiedImageSizeBytes.WithLabelValues(registryLabel(src.Context().Registry)).Observe(float64(stats.Size))
+
+	keysAndValues := []interface{}{"size", stats.Size, "layers", stats.Layers}
+	if platforms != nil {
+		keysAndValues = append(keysAndValues, "platforms", platforms)
+	}
+	if pinnedPlatform {
+		keysAndValues = append(keysAndValues, "pinnedPlatform", true, "parentIndex", stats.ParentIndex)
+	}
+	log.Info("Copied image", keysAndValues...)
+}
+
+// imageStats returns the stats of the given image and, for indices, the stats per platform. Platform images of
+// indices are fetched for their manifests, layers are not fetched.
+func imageStats(desc *remote.Descriptor) (ImageStats, map[string]ImageStats, error) {
+	switch desc.MediaType {
+	case types.OCIImageIndex, types.DockerManifestList:
+	case types.DockerManifestSchema1, types.DockerManifestSchema1Signed:
+		// the size of schema 1 layers is not part of the manifest
+		return ImageStats{}, nil, errSchema1Stats
+	default:
+		img, err := desc.Image()
+		if err != nil {
+			return ImageStats{}, nil, err
+		}
+		manifest, err := img.Manifest()
+		if err != nil {
+			return ImageStats{}, nil, err
+		}
+		return manifestStats(manifest), nil, nil
+	}
+
+	idx, err := desc.ImageIndex()
+	if err != nil {
+		return ImageStats{}, nil, err
+	}
+	indexManifest, err := idx.IndexManifest()
+	if err != nil {
+		return ImageStats{}, nil, err
+	}
+
+	var total ImageStats
+	platforms := make(map[string]ImageStats, len(indexManifest.Manifests))
+	for _, child := range indexManifest.Manifests {
+		if !child.MediaType.IsImage() {
+			continue
+		}
+		// only fetches the manifest, layers are fetched lazily
+		img, err := idx.Image(child.Digest)
+		if err != nil {
+			return ImageStats{}, nil, err
+		}
+		manifest, err := img.Manifest()
+		if err != nil {
+			return ImageStats{}, nil, err
+		}
+
+		stats := manifestStats(manifest)
+		total = total.add(stats)
+		platform := child.Digest.String()
+		if child.Platform != nil {
+			platform = child.Platform.String()
+		}
+		platforms[platform] = platforms[platform].add(stats)
+	}
+	return total, platforms, nil
+}
+
+func manifestStats(manifest *v1.Manifest) ImageStats {
+	stats := ImageStats{Size: manifest.Config.Size, Layers: len(manifest.Layers)}
+	for _, layer := range manifest.Layers {
+		stats.Size += layer.Size
+	}
+	return stats
+}
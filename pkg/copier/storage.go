@@ -0,0 +1,158 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package copier
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+// DefaultStorageFullProbeInterval is the default for Options.StorageFullProbeInterval.
+const DefaultStorageFullProbeInterval = 10 * time.Minute
+
+// storageFullMessages are substrings of error messages that registries return with DENIED if their storage or quota is
+// exhausted, e.g., Harbor's "will exceed the configured upper limit" for project quotas.
+var storageFullMessages = []string{
+	"quota",
+	"storage limit",
+	"exceed the configured upper limit",
+	"no space left on device",
+	"insufficient storage",
+}
+
+// StorageFullError is returned by Copier.Copy if the destination registry ran out of storage or quota. Further copies
+// to the registry are not started until a probe copy succeeds, which is allowed after RetryAfter.
+type StorageFullError struct {
+	Registry   string
+	RetryAfter time.Duration
+
+	err error
+}
+
+func (e *StorageFullError) Error() string {
+	if e.err == nil {
+		return fmt.Sprintf("storage of registry %q is full, not copying until a probe copy succeeds, retry after %s", e.Registry, e.RetryAfter.Round(time.Second))
+	}
+	return fmt.Sprintf("storage of registry %q is full: %v", e.Registry, e.err)
+}
+
+func (e *StorageFullError) Unwrap() error {
+	return e.err
+}
+
+// IsStorageFull checks whether the given error indicates that the destination registry ran out of storage.
+func IsStorageFull(err error) bool {
+	var storageErr *StorageFullError
+	return errors.As(err, &storageErr)
+}
+
+// isStorageFullResponse checks whether the given registry error indicates that the registry ran out of storage or
+// quota, i.e., 507 Insufficient Storage or DENIED with a quota message.
+func isStorageFullResponse(err error) bool {
+	var terr *transport.Error
+	if !errors.As(err, &terr) {
+		return false
+	}
+	if terr.StatusCode == http.StatusInsufficientStorage {
+		return true
+	}
+	for _, diagnostic := range terr.Errors {
+		if diagnostic.Code != transport.DeniedErrorCode && diagnostic.Code != transport.UnknownErrorCode {
+			continue
+		}
+		message := strings.ToLower(diagnostic.Message)
+		for _, m := range storageFullMessages {
+			if strings.Contains(message, m) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c *Copier) storageFullProbeInterval() time.Duration {
+	if c.StorageFullProbeInterval <= 0 {
+		return DefaultStorageFullProbeInterval
+	}
+	return c.StorageFullProbeInterval
+}
+
+// storageBreakers is a circuit breaker per destination registry that stops copies to registries that ran out of
+// storage, so that retries don't compete with whatever is freeing space. While a breaker is open, a single probe copy
+// is allowed per probe interval, and the breaker closes once a copy succeeds.
+type storageBreakers struct {
+	lock sync.Mutex
+	// probeAt is the time when the next probe copy is allowed per open registry.
+	probeAt map[string]time.Time
+}
+
+// check returns a *StorageFullError if copies to the given registry must not start. If a probe copy is due, it is
+// allowed and the next probe is scheduled.
+func (b *storageBreakers) check(registry name.Registry, now time.Time, interval time.Duration) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	probeAt, open := b.probeAt[registry.RegistryStr()]
+	if !open {
+		return nil
+	}
+	if !now.Before(probeAt) {
+		b.probeAt[registry.RegistryStr()] = now.Add(interval)
+		return nil
+	}
+	return &StorageFullError{Registry: registry.RegistryStr(), RetryAfter: probeAt.Sub(now)}
+}
+
+// record opens or closes the breaker of the given registry depending on the result of a copy to it. It returns the
+// error to report for the copy.
+func (b *storageBreakers) record(log logr.Logger, registry name.Registry, now time.Time, interval time.Duration, err error) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	_, open := b.probeAt[registry.RegistryStr()]
+	switch {
+	case err == nil:
+		if open {
+			delete(b.probeAt, registry.RegistryStr())
+			storageFull.WithLabelValues(registry.RegistryStr()).Set(0)
+			log.Info("Copy to registry succeeded again, resuming copies", "registry", registry.RegistryStr())
+		}
+		return nil
+	case !isStorageFullResponse(err):
+		return err
+	}
+
+	if b.probeAt == nil {
+		b.probeAt = make(map[string]time.Time)
+	}
+	b.probeAt[registry.RegistryStr()] = now.Add(interval)
+	storageFullErrorsTotal.WithLabelValues(registry.RegistryStr()).Inc()
+	if !open {
+		// only announce the outage once, not for every probe
+		storageFull.WithLabelValues(registry.RegistryStr()).Set(1)
+		log.Error(err, "Storage of registry is full, stopping copies until a probe copy succeeds", "registry", registry.RegistryStr(), "probeInterval", interval)
+	}
+	return &StorageFullError{Registry: registry.RegistryStr(), RetryAfter: interval, err: err}
+}
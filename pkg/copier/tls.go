@@ -0,0 +1,156 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package copier
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// ClientCertificate configures a TLS client certificate for requests to a registry.
+type ClientCertificate struct {
+	CertFile string
+	KeyFile  string
+}
+
+// ParseRegistryClientCertificates parses the given client certificate configurations of the form
+// <registry-host>=<cert-file>:<key-file>.
+func ParseRegistryClientCertificates(certs []string) (map[string]ClientCertificate, error) {
+	result := make(map[string]ClientCertificate, len(certs))
+
+	for _, cert := range certs {
+		host, files, ok := strings.Cut(cert, "=")
+		certFile, keyFile, ok2 := strings.Cut(files, ":")
+		if !ok || !ok2 || host == "" || certFile == "" || keyFile == "" {
+			return nil, fmt.Errorf("invalid registry client certificate %q, expected format <registry-host>=<cert-file>:<key-file>", cert)
+		}
+
+		registry, err := name.NewRegistry(host)
+		if err != nil {
+			return nil, fmt.Errorf("invalid registry host in registry client certificate %q: %w", cert, err)
+		}
+		key := strings.ToLower(registry.RegistryStr())
+		if _, ok := result[key]; ok {
+			return nil, fmt.Errorf("duplicate registry client certificate for registry host %q", host)
+		}
+
+		clientCert := ClientCertificate{CertFile: certFile, KeyFile: keyFile}
+		// fail early on invalid certificates
+		if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+			return nil, fmt.Errorf("failed loading client certificate for registry host %q: %w", host, err)
+		}
+		result[key] = clientCert
+	}
+
+	return result, nil
+}
+
+// NewTransport returns a transport based on remote.DefaultTransport that presents the given client certificates to the
+// respective registry hosts. Requests to other hosts (e.g., redirects to blob storage) use the default TLS config.
+// Certificates are reloaded when the files change.
+func NewTransport(clientCerts map[string]ClientCertificate) http.RoundTripper {
+	if len(clientCerts) == 0 {
+		return remote.DefaultTransport
+	}
+
+	t := &clientCertTransport{
+		base:  remote.DefaultTransport,
+		hosts: make(map[string]*clientCertHost, len(clientCerts)),
+	}
+	for host, cert := range clientCerts {
+		h := &clientCertHost{host: host, cert: cert}
+		hostTransport := remote.DefaultTransport.Clone()
+		if hostTransport.TLSClientConfig == nil {
+			hostTransport.TLSClientConfig = &tls.Config{}
+		}
+		hostTransport.TLSClientConfig.GetClientCertificate = h.getClientCertificate
+		h.transport = hostTransport
+		t.hosts[host] = h
+	}
+	return t
+}
+
+type clientCertTransport struct {
+	base  http.RoundTripper
+	hosts map[string]*clientCertHost
+}
+
+func (t *clientCertTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	h, ok := t.hosts[strings.ToLower(req.URL.Host)]
+	if !ok {
+		return t.base.RoundTrip(req)
+	}
+
+	resp, err := h.transport.RoundTrip(req)
+	if err != nil {
+		return nil, fmt.Errorf("request to registry %q with client certificate %q failed: %w", h.host, h.cert.CertFile, err)
+	}
+	return resp, nil
+}
+
+// clientCertHost holds the client certificate of a single registry host and reloads it when the files change.
+type clientCertHost struct {
+	host      string
+	cert      ClientCertificate
+	transport *http.Transport
+
+	lock    sync.Mutex
+	loaded  *tls.Certificate
+	modTime time.Time
+}
+
+func (h *clientCertHost) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	modTime, err := latestModTime(h.cert.CertFile, h.cert.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading client certificate %q for registry %q: %w", h.cert.CertFile, h.host, err)
+	}
+
+	if h.loaded == nil || modTime.After(h.modTime) {
+		cert, err := tls.LoadX509KeyPair(h.cert.CertFile, h.cert.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed loading client certificate %q for registry %q: %w", h.cert.CertFile, h.host, err)
+		}
+		h.loaded, h.modTime = &cert, modTime
+	}
+
+	return h.loaded, nil
+}
+
+func latestModTime(files ...string) (time.Time, error) {
+	var latest time.Time
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
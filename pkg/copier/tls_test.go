@@ -0,0 +1,193 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package copier
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeClientCertificate writes a self-signed client certificate with the given common name to the given directory.
+func writeClientCertificate(t *testing.T, dir, commonName string) ClientCertificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert := ClientCertificate{CertFile: filepath.Join(dir, "tls.crt"), KeyFile: filepath.Join(dir, "tls.key")}
+	if err := os.WriteFile(cert.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(cert.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// newClientCertServer starts a TLS server that requires a client certificate and responds with its common name.
+func newClientCertServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+type baseTransport struct {
+	hosts []string
+}
+
+func (t *baseTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.hosts = append(t.hosts, req.URL.Host)
+	return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("")), Request: req}, nil
+}
+
+func TestClientCertTransport(t *testing.T) {
+	serverA, serverB := newClientCertServer(t), newClientCertServer(t)
+	hostA, hostB := strings.TrimPrefix(serverA.URL, "https://"), strings.TrimPrefix(serverB.URL, "https://")
+	dirA, dirB := t.TempDir(), t.TempDir()
+	certA, certB := writeClientCertificate(t, dirA, "a"), writeClientCertificate(t, dirB, "b")
+
+	rt := NewTransport(map[string]ClientCertificate{hostA: certA, hostB: certB}).(*clientCertTransport)
+	base := &baseTransport{}
+	rt.base = base
+	for _, h := range rt.hosts {
+		// the test servers use self-signed certificates
+		h.transport.TLSClientConfig.InsecureSkipVerify = true
+	}
+
+	get := func(url string) (string, error) {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			return "", err
+		}
+		resp, err := rt.RoundTrip(req)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return string(body), err
+	}
+	expectCommonName := func(url, want string) {
+		t.Helper()
+		got, err := get(url)
+		if err != nil {
+			t.Fatalf("request to %s failed: %v", url, err)
+		}
+		if got != want {
+			t.Errorf("request to %s presented client certificate %q, want %q", url, got, want)
+		}
+	}
+
+	expectCommonName(serverA.URL, "a")
+	expectCommonName(serverB.URL, "b")
+
+	if _, err := get("https://registry.example.com/v2/"); err != nil {
+		t.Fatal(err)
+	}
+	if len(base.hosts) != 1 || base.hosts[0] != "registry.example.com" {
+		t.Errorf("requests to hosts without client certificate were sent to %v via the default transport, want [registry.example.com]", base.hosts)
+	}
+
+	t.Run("reload", func(t *testing.T) {
+		writeClientCertificate(t, dirA, "a2")
+		future := time.Now().Add(time.Minute)
+		if err := os.Chtimes(certA.CertFile, future, future); err != nil {
+			t.Fatal(err)
+		}
+		// the certificate is presented during the handshake of new connections
+		rt.hosts[hostA].transport.CloseIdleConnections()
+		expectCommonName(serverA.URL, "a2")
+	})
+
+	t.Run("handshake failure", func(t *testing.T) {
+		if err := os.Remove(certB.KeyFile); err != nil {
+			t.Fatal(err)
+		}
+		rt.hosts[hostB].transport.CloseIdleConnections()
+
+		_, err := get(serverB.URL)
+		if err == nil {
+			t.Fatal("expected error")
+		}
+		if !strings.Contains(err.Error(), hostB) || !strings.Contains(err.Error(), certB.CertFile) {
+			t.Errorf("error %q doesn't name the registry %q and the certificate %q", err, hostB, certB.CertFile)
+		}
+	})
+}
+
+func TestParseRegistryClientCertificates(t *testing.T) {
+	cert := writeClientCertificate(t, t.TempDir(), "a")
+	valid := "Registry.example.com=" + cert.CertFile + ":" + cert.KeyFile
+
+	certs, err := ParseRegistryClientCertificates([]string{valid})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := certs["registry.example.com"]; got != cert {
+		t.Errorf("certificate for registry.example.com = %v, want %v", got, cert)
+	}
+
+	for _, invalid := range [][]string{
+		{"registry.example.com"},
+		{"registry.example.com=" + cert.CertFile},
+		{"=" + cert.CertFile + ":" + cert.KeyFile},
+		{"registry.example.com=" + cert.CertFile + ":/does/not/exist"},
+		// duplicate hosts are detected case-insensitively
+		{valid, "registry.example.com=" + cert.CertFile + ":" + cert.KeyFile},
+	} {
+		if _, err := ParseRegistryClientCertificates(invalid); err == nil {
+			t.Errorf("expected error for %v", invalid)
+		}
+	}
+}
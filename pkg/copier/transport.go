@@ -0,0 +1,159 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package copier
+
+import (
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+)
+
+// countingTransport reports the number of bytes read from all response bodies.
+// If uploads is set, it also reports the size of blobs that already exist in the destination. remote.Write checks
+// every blob with a HEAD request before uploading it, so these blobs are not transferred again. Blobs that a previous
+// attempt of the copy uploaded before it failed are reported to resumed, all other existing blobs (e.g., layers shared
+// with other images) to existing.
+type countingTransport struct {
+	base     http.RoundTripper
+	count    func(n int)
+	existing func(n int64)
+	resumed  func(n int64)
+	uploads  *blobUploads
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.uploads != nil {
+		t.observeUpload(req)
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	if t.uploads != nil {
+		t.observeExisting(req, resp)
+	}
+	if resp.Body == nil {
+		return resp, nil
+	}
+
+	resp.Body = &countingReader{ReadCloser: resp.Body, count: t.count}
+	return resp, nil
+}
+
+// observeUpload records the blob of requests finishing an upload, which contain the blob's digest, see
+// https://github.com/opencontainers/distribution-spec/blob/main/spec.md#pushing-blobs. The blob is recorded before
+// sending the request, as the registry might store it even if the response is lost because the copy is cancelled.
+func (t *countingTransport) observeUpload(req *http.Request) {
+	if req.Method != http.MethodPut || !strings.Contains(req.URL.Path, "/blobs/uploads/") {
+		return
+	}
+	if digest := req.URL.Query().Get("digest"); digest != "" {
+		t.uploads.add(digest)
+	}
+}
+
+// observeExisting reports the size of blobs that already exist in the destination.
+func (t *countingTransport) observeExisting(req *http.Request, resp *http.Response) {
+	if req.Method != http.MethodHead || !strings.Contains(req.URL.Path, "/blobs/") ||
+		resp.StatusCode != http.StatusOK || resp.ContentLength <= 0 {
+		return
+	}
+	if t.uploads.uploadedBefore(path.Base(req.URL.Path)) {
+		t.resumed(resp.ContentLength)
+	} else {
+		t.existing(resp.ContentLength)
+	}
+}
+
+// blobUploads tracks the blobs uploaded by an attempt of a copy.
+type blobUploads struct {
+	lock sync.Mutex
+	// before are the blobs uploaded by previous failed attempts of the copy
+	before   map[string]struct{}
+	uploaded map[string]struct{}
+}
+
+func (u *blobUploads) uploadedBefore(digest string) bool {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	_, ok := u.before[digest]
+	return ok
+}
+
+func (u *blobUploads) add(digest string) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if u.uploaded == nil {
+		u.uploaded = make(map[string]struct{})
+	}
+	u.uploaded[digest] = struct{}{}
+}
+
+// all returns the blobs uploaded by this and all previous attempts of the copy.
+func (u *blobUploads) all() map[string]struct{} {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	all := make(map[string]struct{}, len(u.before)+len(u.uploaded))
+	for digest := range u.before {
+		all[digest] = struct{}{}
+	}
+	for digest := range u.uploaded {
+		all[digest] = struct{}{}
+	}
+	return all
+}
+
+// partialUploads stores the blobs uploaded by failed copies by destination repository, so that blobs skipped by the
+// next attempt can be told apart from blobs that existed for other reasons.
+type partialUploads struct {
+	blobs sync.Map
+}
+
+// start returns the blobUploads for a new attempt of a copy to the given repository.
+func (p *partialUploads) start(repository string) *blobUploads {
+	before, _ := p.blobs.LoadAndDelete(repository)
+	uploads := &blobUploads{}
+	if before != nil {
+		uploads.before = before.(map[string]struct{})
+	}
+	return uploads
+}
+
+// finish records the blobs uploaded by the given attempt of a copy to the given repository if it failed.
+func (p *partialUploads) finish(repository string, uploads *blobUploads, err error) {
+	if err == nil {
+		return
+	}
+	if all := uploads.all(); len(all) > 0 {
+		p.blobs.Store(repository, all)
+	}
+}
+
+type countingReader struct {
+	io.ReadCloser
+	count func(n int)
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		r.count(n)
+	}
+	return n, err
+}
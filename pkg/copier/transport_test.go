@@ -0,0 +1,206 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package copier
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// limitingTransport cancels the copy once limit bytes of blobs have been uploaded, like a connection that breaks down
+// midway. It cancels after the blob upload that exceeds the limit has been finished. It records the digests of all
+// successful blob uploads.
+type limitingTransport struct {
+	limit  int64
+	cancel context.CancelFunc
+
+	lock     sync.Mutex
+	bytes    int64
+	uploaded []string
+}
+
+func (t *limitingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !strings.Contains(req.URL.Path, "/blobs/uploads/") {
+		return http.DefaultTransport.RoundTrip(req)
+	}
+
+	body := &countingBody{}
+	if req.Body != nil {
+		body.ReadCloser = req.Body
+		req.Body = body
+	}
+	resp, err := http.DefaultTransport.RoundTrip(req)
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.bytes += body.n
+	if err == nil && req.Method == http.MethodPut && resp.StatusCode == http.StatusCreated {
+		t.uploaded = append(t.uploaded, req.URL.Query().Get("digest"))
+		if t.limit > 0 && t.bytes >= t.limit {
+			t.cancel()
+		}
+	}
+	return resp, err
+}
+
+// finished returns the digests of the successful blob uploads and resets them.
+func (t *limitingTransport) finished() []string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	uploaded := t.uploaded
+	t.uploaded, t.bytes = nil, 0
+	return uploaded
+}
+
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+func newTestRegistryHost(t *testing.T) name.Registry {
+	t.Helper()
+
+	server := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	t.Cleanup(server.Close)
+
+	reg, err := name.NewRegistry(strings.TrimPrefix(server.URL, "http://"), name.Insecure)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reg
+}
+
+func TestResumeCopy(t *testing.T) {
+	// separate registries, so that blobs are uploaded instead of mounted from the source repository
+	src, err := name.NewTag(newTestRegistryHost(t).RegistryStr()+"/upstream/app:v1", name.Insecure)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst, err := name.NewTag(newTestRegistryHost(t).RegistryStr()+"/backup/app:v1", name.Insecure)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const layerSize = 64 * 1024
+	img, err := random.Image(layerSize, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(src, img); err != nil {
+		t.Fatal(err)
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sizes := map[string]int64{}
+	for _, layer := range layers {
+		digest, err := layer.Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sizes[digest.String()], err = layer.Size(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	configDigest, err := img.ConfigName()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := img.RawConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sizes[configDigest.String()] = int64(len(config))
+
+	limiting := &limitingTransport{}
+	c := &Copier{Transport: limiting}
+	resumed := copyResumedBlobBytesTotal.WithLabelValues(registryLabel(src.Context().Registry))
+	existing := copyExistingBlobBytesTotal.WithLabelValues(registryLabel(src.Context().Registry))
+
+	// the first attempt is cancelled after the first layer has been uploaded
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	limiting.limit, limiting.cancel = layerSize, cancel
+	if _, err := c.Copy(ctx, logr.Discard(), src, dst); err == nil {
+		t.Fatal("expected the first attempt to fail")
+	}
+	firstUploads := limiting.finished()
+	if len(firstUploads) == 0 {
+		t.Fatal("first attempt didn't upload any blob")
+	}
+
+	resumedBefore, existingBefore := testutil.ToFloat64(resumed), testutil.ToFloat64(existing)
+	limiting.limit = 0
+	copied, err := c.Copy(context.Background(), logr.Discard(), src, dst)
+	if err != nil {
+		t.Fatalf("second attempt failed: %v", err)
+	}
+	if !copied {
+		t.Error("second attempt didn't copy the image")
+	}
+
+	// the second attempt uploads only the remainder, all other blobs were stored by the first attempt, even if their
+	// upload response was lost because of the cancellation
+	secondUploads := map[string]bool{}
+	for _, digest := range limiting.finished() {
+		secondUploads[digest] = true
+	}
+	for _, digest := range firstUploads {
+		if secondUploads[digest] {
+			t.Errorf("blob %s was uploaded by both attempts", digest)
+		}
+	}
+	if len(secondUploads) == 0 || len(secondUploads) >= len(sizes) {
+		t.Fatalf("second attempt uploaded %d of %d blobs, want some but not all", len(secondUploads), len(sizes))
+	}
+	var wantResumed int64
+	for digest, size := range sizes {
+		if !secondUploads[digest] {
+			wantResumed += size
+		}
+	}
+
+	if got := int64(testutil.ToFloat64(resumed) - resumedBefore); got != wantResumed {
+		t.Errorf("resumed bytes = %d, want %d", got, wantResumed)
+	}
+	if got := testutil.ToFloat64(existing) - existingBefore; got != 0 {
+		t.Errorf("existing bytes = %v, want 0 as all existing blobs were uploaded by the first attempt", got)
+	}
+	if _, ok := c.partialUploads.blobs.Load(dst.Context().Name()); ok {
+		t.Error("uploads of the failed attempt were kept after the copy succeeded")
+	}
+}
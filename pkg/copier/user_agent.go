@@ -0,0 +1,120 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package copier
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+
+	"github.com/timebertt/image-clone-controller/pkg/version"
+)
+
+// DefaultUserAgentPrefix is the default prefix of the User-Agent of all registry requests, see Options.UserAgentPrefix.
+const DefaultUserAgentPrefix = "image-clone-controller"
+
+// Operation labels registry requests in the User-Agent, so that registry operators can attribute them.
+type Operation string
+
+const (
+	// OperationCopyPull is used for requests pulling the source image of a copy.
+	OperationCopyPull Operation = "copy-pull"
+	// OperationCopyPush is used for requests pushing a copy to the destination, including checks for existing blobs.
+	OperationCopyPush Operation = "copy-push"
+	// OperationHeadCheck is used for existence checks of images.
+	OperationHeadCheck Operation = "head-check"
+	// OperationVerify is used for requests verifying images, e.g., their digest or platforms.
+	OperationVerify Operation = "verify"
+)
+
+type operationKey struct{}
+
+// requestOperation is the operation of requests sent with a context. Requests to pushHost are labeled with
+// OperationCopyPush instead, as copies pull from the source and push to the destination with the same context.
+type requestOperation struct {
+	operation Operation
+	pushHost  string
+}
+
+// WithOperation returns a context that labels all registry requests sent with it with the given operation.
+func WithOperation(ctx context.Context, op Operation) context.Context {
+	return context.WithValue(ctx, operationKey{}, requestOperation{operation: op})
+}
+
+// withCopyOperation returns a context that labels requests to the given destination registry with OperationCopyPush
+// and all other requests with OperationCopyPull.
+func withCopyOperation(ctx context.Context, dst name.Registry) context.Context {
+	return context.WithValue(ctx, operationKey{}, requestOperation{operation: OperationCopyPull, pushHost: dst.RegistryStr()})
+}
+
+// withDefaultOperation labels requests with the given operation unless the context already has an operation.
+func withDefaultOperation(ctx context.Context, op Operation) context.Context {
+	if _, ok := ctx.Value(operationKey{}).(requestOperation); ok {
+		return ctx
+	}
+	return WithOperation(ctx, op)
+}
+
+func operationFor(req *http.Request) Operation {
+	op, ok := req.Context().Value(operationKey{}).(requestOperation)
+	if !ok {
+		return ""
+	}
+	if op.pushHost != "" && strings.EqualFold(req.URL.Host, op.pushHost) {
+		return OperationCopyPush
+	}
+	return op.operation
+}
+
+type kindKey struct{}
+
+// WithKind returns a context that labels all registry requests sent with it with the given workload kind.
+func WithKind(ctx context.Context, kind string) context.Context {
+	return context.WithValue(ctx, kindKey{}, kind)
+}
+
+// userAgentTransport sets the User-Agent of all requests to <prefix>/<version> (<kind>; <operation>), with the kind
+// and operation taken from the request's context if set (see WithKind and WithOperation).
+// go-containerregistry sets its own User-Agent in an outer transport, which is overwritten.
+type userAgentTransport struct {
+	base   http.RoundTripper
+	prefix string
+}
+
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", t.userAgent(req))
+	return t.base.RoundTrip(req)
+}
+
+func (t *userAgentTransport) userAgent(req *http.Request) string {
+	ua := t.prefix + "/" + version.Version
+
+	var labels []string
+	if kind, ok := req.Context().Value(kindKey{}).(string); ok && kind != "" {
+		labels = append(labels, kind)
+	}
+	if op := operationFor(req); op != "" {
+		labels = append(labels, string(op))
+	}
+	if len(labels) > 0 {
+		ua += " (" + strings.Join(labels, "; ") + ")"
+	}
+	return ua
+}
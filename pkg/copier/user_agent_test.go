@@ -0,0 +1,136 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package copier
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+
+	"github.com/timebertt/image-clone-controller/pkg/version"
+)
+
+// userAgentRecordingTransport records the User-Agents of all requests per registry host.
+type userAgentRecordingTransport struct {
+	http.RoundTripper
+
+	lock       sync.Mutex
+	userAgents map[string]map[string]bool
+}
+
+func (t *userAgentRecordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.lock.Lock()
+	if t.userAgents == nil {
+		t.userAgents = make(map[string]map[string]bool)
+	}
+	if t.userAgents[req.URL.Host] == nil {
+		t.userAgents[req.URL.Host] = make(map[string]bool)
+	}
+	t.userAgents[req.URL.Host][req.Header.Get("User-Agent")] = true
+	t.lock.Unlock()
+
+	return t.RoundTripper.RoundTrip(req)
+}
+
+// reset returns the recorded User-Agents and forgets them.
+func (t *userAgentRecordingTransport) reset() map[string]map[string]bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	userAgents := t.userAgents
+	t.userAgents = nil
+	return userAgents
+}
+
+func TestUserAgent(t *testing.T) {
+	upstream, backup := newTestRegistryHost(t), newTestRegistryHost(t)
+	src, err := name.NewTag(upstream.RegistryStr()+"/upstream/app:v1", name.Insecure)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst, err := name.NewTag(backup.RegistryStr()+"/upstream/app:v1", name.Insecure)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(src, img); err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := &userAgentRecordingTransport{RoundTripper: http.DefaultTransport}
+	c := &Copier{Options: Options{UserAgentPrefix: "image-clone-controller-fleet-a"}, Transport: recorder}
+	ctx := WithKind(context.Background(), "Deployment")
+	prefix := "image-clone-controller-fleet-a/" + version.Version
+
+	// assertUserAgents asserts that exactly the given User-Agents were sent to the given registries
+	assertUserAgents := func(t *testing.T, want map[name.Registry][]string) {
+		t.Helper()
+		got := recorder.reset()
+		for registry, userAgents := range want {
+			for _, userAgent := range userAgents {
+				if !got[registry.RegistryStr()][userAgent] {
+					t.Errorf("no request with User-Agent %q was sent to %s", userAgent, registry.RegistryStr())
+				}
+				delete(got[registry.RegistryStr()], userAgent)
+			}
+		}
+		for host, userAgents := range got {
+			for userAgent := range userAgents {
+				t.Errorf("unexpected request with User-Agent %q to %s", userAgent, host)
+			}
+		}
+	}
+
+	t.Run("copy", func(t *testing.T) {
+		if _, err := c.Copy(ctx, logr.Discard(), src, dst); err != nil {
+			t.Fatal(err)
+		}
+		assertUserAgents(t, map[name.Registry][]string{
+			upstream: {prefix + " (Deployment; head-check)", prefix + " (Deployment; copy-pull)"},
+			backup:   {prefix + " (Deployment; head-check)", prefix + " (Deployment; copy-push)"},
+		})
+	})
+
+	t.Run("head check", func(t *testing.T) {
+		if _, exists, err := c.Exists(ctx, dst); err != nil || !exists {
+			t.Fatalf("Exists() = %v, %v, want the copied image", exists, err)
+		}
+		assertUserAgents(t, map[name.Registry][]string{backup: {prefix + " (Deployment; head-check)"}})
+	})
+
+	t.Run("verify", func(t *testing.T) {
+		if _, err := c.Platforms(ctx, dst); err != nil {
+			t.Fatal(err)
+		}
+		assertUserAgents(t, map[name.Registry][]string{backup: {prefix + " (Deployment; verify)"}})
+	})
+
+	t.Run("without labels", func(t *testing.T) {
+		if _, _, err := (&Copier{Transport: recorder}).Exists(WithOperation(context.Background(), ""), dst); err != nil {
+			t.Fatal(err)
+		}
+		assertUserAgents(t, map[name.Registry][]string{backup: {DefaultUserAgentPrefix + "/" + version.Version}})
+	})
+}
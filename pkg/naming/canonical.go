@@ -0,0 +1,49 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package naming
+
+import (
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// dockerHubAliases are registry hosts that are equivalent to name.DefaultRegistry.
+var dockerHubAliases = []string{"docker.io", "registry-1.docker.io", "registry.hub.docker.com"}
+
+// CanonicalRegistry returns the canonical form of the given registry host for comparing registries. It lowercases the
+// host, strips the default ports :443 and :80, and resolves aliases of Docker Hub to name.DefaultRegistry.
+// The result must only be used for comparisons, never for references written to workloads.
+func CanonicalRegistry(registry string) string {
+	registry = strings.ToLower(registry)
+	registry = strings.TrimSuffix(strings.TrimSuffix(registry, ":443"), ":80")
+	if registry == "" {
+		return name.DefaultRegistry
+	}
+	for _, alias := range dockerHubAliases {
+		if registry == alias {
+			return name.DefaultRegistry
+		}
+	}
+	return registry
+}
+
+// SameRegistry checks whether the given registries are equivalent according to CanonicalRegistry. In contrast to
+// comparing name.Registry values directly, it also ignores whether the registries are marked as insecure.
+func SameRegistry(a, b name.Registry) bool {
+	return CanonicalRegistry(a.RegistryStr()) == CanonicalRegistry(b.RegistryStr())
+}
@@ -0,0 +1,101 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package naming
+
+import (
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+func TestCanonicalRegistry(t *testing.T) {
+	tests := []struct {
+		registry, want string
+	}{
+		// host case
+		{"registry.example.com", "registry.example.com"},
+		{"Registry.Example.COM", "registry.example.com"},
+		{"GHCR.io", "ghcr.io"},
+
+		// default ports
+		{"registry.example.com:443", "registry.example.com"},
+		{"registry.example.com:80", "registry.example.com"},
+		{"Registry.Example.com:443", "registry.example.com"},
+		{"registry.example.com:5000", "registry.example.com:5000"},
+		{"registry.example.com:4430", "registry.example.com:4430"},
+		{"registry.example.com:8080", "registry.example.com:8080"},
+		{"localhost:80", "localhost"},
+		{"localhost:5001", "localhost:5001"},
+
+		// Docker Hub aliases
+		{"", name.DefaultRegistry},
+		{"index.docker.io", name.DefaultRegistry},
+		{"docker.io", name.DefaultRegistry},
+		{"Docker.IO", name.DefaultRegistry},
+		{"docker.io:443", name.DefaultRegistry},
+		{"registry-1.docker.io", name.DefaultRegistry},
+		{"registry.hub.docker.com", name.DefaultRegistry},
+		{"index.docker.io:443", name.DefaultRegistry},
+		{"mirror.docker.io", "mirror.docker.io"},
+	}
+
+	for _, tt := range tests {
+		if got := CanonicalRegistry(tt.registry); got != tt.want {
+			t.Errorf("CanonicalRegistry(%q) = %q, want %q", tt.registry, got, tt.want)
+		}
+	}
+}
+
+func TestSameRegistry(t *testing.T) {
+	registry := func(host string, opts ...name.Option) name.Registry {
+		t.Helper()
+		r, err := name.NewRegistry(host, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	backup := registry("registry.example.com")
+	for _, equivalent := range []name.Registry{
+		registry("Registry.Example.com"),
+		registry("registry.example.com:443"),
+		registry("registry.example.com", name.Insecure),
+		// registries of parsed references, which write the default registry as index.docker.io
+		name.MustParseReference("REGISTRY.example.com:443/app:v1").Context().Registry,
+	} {
+		if !SameRegistry(equivalent, backup) || !SameRegistry(backup, equivalent) {
+			t.Errorf("%q is not equivalent to %q", equivalent.RegistryStr(), backup.RegistryStr())
+		}
+	}
+	for _, other := range []name.Registry{
+		registry("registry.example.com:5000"),
+		registry("mirror.registry.example.com"),
+		registry("registry.example.org"),
+	} {
+		if SameRegistry(other, backup) {
+			t.Errorf("%q is equivalent to %q", other.RegistryStr(), backup.RegistryStr())
+		}
+	}
+
+	dockerHub := name.MustParseReference("nginx").Context().Registry
+	for _, host := range []string{"docker.io", "registry-1.docker.io", "registry.hub.docker.com", "index.docker.io:443"} {
+		if !SameRegistry(registry(host), dockerHub) {
+			t.Errorf("%q is not equivalent to Docker Hub", host)
+		}
+	}
+}
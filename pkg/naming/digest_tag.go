@@ -0,0 +1,119 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package naming
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// DigestTagStyle configures how images referenced by digest are represented in the tag of their destination image.
+type DigestTagStyle string
+
+const (
+	// DigestTagStylePrefixed uses the full digest including its algorithm, e.g., sha256_33cef.... This is the default.
+	DigestTagStylePrefixed DigestTagStyle = "prefixed"
+	// DigestTagStyleSHAOnly uses the hex-encoded digest without its algorithm, e.g., 33cef..., for tools that can't
+	// handle underscores in tags.
+	DigestTagStyleSHAOnly DigestTagStyle = "sha-only"
+	// DigestTagStyleOriginalTagPlusDigest uses the original tag and the first ShortDigestLength hex characters of the
+	// digest for images referenced by tag and digest, e.g., nginx:1.25@sha256:33cef... -> 1.25-33cef0123456. As the tag
+	// doesn't contain the full digest, it can't be mapped back to the full source reference. Images referenced by digest
+	// only and tags exceeding MaxTagLength use DigestTagStylePrefixed.
+	DigestTagStyleOriginalTagPlusDigest DigestTagStyle = "original-tag-plus-digest"
+)
+
+// DigestTagStyles are all supported digest tag styles.
+var DigestTagStyles = []DigestTagStyle{DigestTagStylePrefixed, DigestTagStyleSHAOnly, DigestTagStyleOriginalTagPlusDigest}
+
+// ValidateDigestTagStyle checks whether the given digest tag style is supported.
+func ValidateDigestTagStyle(style DigestTagStyle) error {
+	for _, s := range DigestTagStyles {
+		if s == style {
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported digest tag style %q, supported styles: %v", style, DigestTagStyles)
+}
+
+// ShortDigestLength is the number of hex characters of the digest used by DigestTagStyleOriginalTagPlusDigest.
+const ShortDigestLength = 12
+
+var (
+	// tagRegexp matches valid tags according to the distribution spec.
+	tagRegexp = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9._-]{0,127}$`)
+	// digestTagRegexp matches tags that are rewritten from digests with DigestTagStylePrefixed.
+	digestTagRegexp = regexp.MustCompile(`^sha256_[a-f0-9]{64}$`)
+	// shaOnlyTagRegexp matches tags that are rewritten from digests with DigestTagStyleSHAOnly.
+	shaOnlyTagRegexp = regexp.MustCompile(`^[a-f0-9]{64}$`)
+)
+
+// DestinationTag returns the tag of the destination image for the given source image. If the image is identified via
+// digest instead of tag, the digest is rewritten to a tag in the given style, see DigestTagStyle.
+func DestinationTag(srcImg name.Reference, style DigestTagStyle) string {
+	if digest, ok := srcImg.(name.Digest); ok {
+		return truncateTag(digestTag(digest, style))
+	}
+	return truncateTag(srcImg.Identifier())
+}
+
+// digestTag returns the destination tag for the given source image referenced by digest in the given style.
+func digestTag(digest name.Digest, style DigestTagStyle) string {
+	algorithm, hex, _ := strings.Cut(digest.DigestStr(), ":")
+	prefixed := algorithm + "_" + hex
+
+	switch style {
+	case DigestTagStyleSHAOnly:
+		if algorithm == "sha256" {
+			return hex
+		}
+	case DigestTagStyleOriginalTagPlusDigest:
+		if tag, ok := originalTag(digest); ok && len(hex) >= ShortDigestLength {
+			if t := tag + "-" + hex[:ShortDigestLength]; tagRegexp.MatchString(t) {
+				return t
+			}
+		}
+	}
+	return prefixed
+}
+
+// originalTag returns the tag of the given source image if it is referenced by tag and digest, e.g., 1.25 for
+// nginx:1.25@sha256:33cef....
+func originalTag(digest name.Digest) (string, bool) {
+	base, _, _ := strings.Cut(digest.String(), "@")
+	if i := strings.LastIndex(base, ":"); i > strings.LastIndex(base, "/") {
+		return base[i+1:], true
+	}
+	return "", false
+}
+
+// originalReference returns the reference of the given original repository for the identifier of a destination image,
+// i.e., it reverses DestinationTag. Tags of all digest tag styles are recognized, so that images copied with a
+// different style can be mapped back as well. The original tag of DigestTagStyleOriginalTagPlusDigest is returned as
+// is, as the full digest is unknown.
+func originalReference(repository, identifier string) (name.Reference, error) {
+	if digestTagRegexp.MatchString(identifier) {
+		return name.NewDigest(repository + "@" + strings.Replace(identifier, "_", ":", 1))
+	}
+	if shaOnlyTagRegexp.MatchString(identifier) {
+		return name.NewDigest(repository + "@sha256:" + identifier)
+	}
+	return name.NewTag(repository + ":" + identifier)
+}
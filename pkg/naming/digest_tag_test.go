@@ -0,0 +1,95 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package naming
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+func TestDigestTagStyles(t *testing.T) {
+	hex := strings.Repeat("0123456789abcdef", 4)
+	longTag := strings.Repeat("a", 120)
+	cfg := Config{BackupRegistry: name.MustParseReference("registry.example.com/app").Context().Registry}
+
+	tests := []struct {
+		name   string
+		source string
+		style  DigestTagStyle
+		// wantTag is the destination tag, wantOriginal the reference that the destination is mapped back to
+		wantTag, wantOriginal string
+	}{
+		{name: "tag", source: "nginx:1.25", style: DigestTagStylePrefixed, wantTag: "1.25", wantOriginal: "index.docker.io/library/nginx:1.25"},
+		{name: "tag", source: "nginx:1.25", style: DigestTagStyleSHAOnly, wantTag: "1.25", wantOriginal: "index.docker.io/library/nginx:1.25"},
+		{name: "tag", source: "nginx:1.25", style: DigestTagStyleOriginalTagPlusDigest, wantTag: "1.25", wantOriginal: "index.docker.io/library/nginx:1.25"},
+
+		{name: "digest", source: "nginx@sha256:" + hex, style: DigestTagStylePrefixed, wantTag: "sha256_" + hex, wantOriginal: "index.docker.io/library/nginx@sha256:" + hex},
+		{name: "digest", source: "nginx@sha256:" + hex, style: DigestTagStyleSHAOnly, wantTag: hex, wantOriginal: "index.docker.io/library/nginx@sha256:" + hex},
+		// without an original tag, the prefixed style is used
+		{name: "digest", source: "nginx@sha256:" + hex, style: DigestTagStyleOriginalTagPlusDigest, wantTag: "sha256_" + hex, wantOriginal: "index.docker.io/library/nginx@sha256:" + hex},
+
+		{name: "tag and digest", source: "nginx:1.25@sha256:" + hex, style: DigestTagStylePrefixed, wantTag: "sha256_" + hex, wantOriginal: "index.docker.io/library/nginx@sha256:" + hex},
+		{name: "tag and digest", source: "nginx:1.25@sha256:" + hex, style: DigestTagStyleSHAOnly, wantTag: hex, wantOriginal: "index.docker.io/library/nginx@sha256:" + hex},
+		// the tag doesn't contain the full digest, which is recorded on the workload instead
+		{name: "tag and digest", source: "nginx:1.25@sha256:" + hex, style: DigestTagStyleOriginalTagPlusDigest, wantTag: "1.25-0123456789ab", wantOriginal: "index.docker.io/library/nginx:1.25-0123456789ab"},
+		// tags exceeding the maximum tag length use the prefixed style
+		{name: "long tag and digest", source: "nginx:" + longTag + "@sha256:" + hex, style: DigestTagStyleOriginalTagPlusDigest, wantTag: "sha256_" + hex, wantOriginal: "index.docker.io/library/nginx@sha256:" + hex},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name+"/"+string(tt.style), func(t *testing.T) {
+			if err := ValidateDigestTagStyle(tt.style); err != nil {
+				t.Fatal(err)
+			}
+			src, err := name.ParseReference(tt.source)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			cfg := cfg
+			cfg.DigestTagStyle = tt.style
+			dst, err := Destination(src, cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if dst.TagStr() != tt.wantTag {
+				t.Errorf("destination tag = %s, want %s", dst.TagStr(), tt.wantTag)
+			}
+			if !tagRegexp.MatchString(dst.TagStr()) {
+				t.Errorf("destination tag %s is not a valid tag", dst.TagStr())
+			}
+
+			// destinations are mapped back regardless of the configured style
+			for _, style := range DigestTagStyles {
+				cfg.DigestTagStyle = style
+				original, err := Original(dst, cfg)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if original.Name() != tt.wantOriginal {
+					t.Errorf("original of %s with style %s = %s, want %s", dst, style, original, tt.wantOriginal)
+				}
+			}
+		})
+	}
+
+	if err := ValidateDigestTagStyle("short"); err == nil {
+		t.Error("expected error for unsupported digest tag style")
+	}
+}
@@ -0,0 +1,170 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package naming implements the mapping of source images to their destination in the backup registry, which the
+// controller uses for rewriting images. External tools (e.g., CI pipelines pre-pushing images to the backup registry)
+// can import this package to compute the exact destination that the controller expects, e.g.:
+//
+//	dst, err := naming.Map("nginx:1.23", naming.Config{BackupRegistry: registry})
+//	// dst == "<registry>/index_docker_io/library/nginx:1.23"
+//
+// The mapping is part of the package's API: changing the destination of any source image for the same Config is a
+// breaking change, as it makes the controller copy all images again.
+package naming
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// Config configures the mapping of source images to destination images.
+type Config struct {
+	// BackupRegistry is the registry that images are copied to.
+	BackupRegistry name.Registry
+	// Prefix is inserted into destination repositories after the registry, see ValidatePrefix.
+	Prefix string
+	// PreserveShortNames makes destination repositories of Docker Hub images mirror the literal image reference, e.g.,
+	// docker_io/nginx instead of index_docker_io/library/nginx.
+	PreserveShortNames bool
+	// DigestTagStyle configures how images referenced by digest are represented in destination tags. Defaults to
+	// DigestTagStylePrefixed.
+	DigestTagStyle DigestTagStyle
+	// RepositoryMappings maps source repositories to fixed destination repositories in the backup registry.
+	RepositoryMappings RepositoryMappings
+}
+
+// Map returns the destination image of the given source image, see Destination.
+func Map(src string, cfg Config) (string, error) {
+	srcImg, err := name.ParseReference(src)
+	if err != nil {
+		return "", err
+	}
+	dstImg, err := Destination(srcImg, cfg)
+	if err != nil {
+		return "", err
+	}
+	return dstImg.String(), nil
+}
+
+// Reverse returns the source image of the given destination image, see Original. It returns false if the image is not
+// in the backup registry or its repository wasn't produced by Map.
+// Images with DigestTagStyleOriginalTagPlusDigest can't be reversed to the full source reference, as the tag doesn't
+// contain the full digest. The controller records the digests of such images on the workloads.
+func Reverse(dst string, cfg Config) (string, bool) {
+	dstImg, err := name.ParseReference(dst)
+	if err != nil || !SameRegistry(dstImg.Context().Registry, cfg.BackupRegistry) {
+		return "", false
+	}
+	if !cfg.RepositoryMappings.IsDestination(dstImg) && !LooksLikeBackupImage(dstImg, cfg.Prefix) {
+		return "", false
+	}
+
+	srcImg, err := Original(dstImg, cfg)
+	if err != nil {
+		return "", false
+	}
+	return srcImg.String(), true
+}
+
+// Destination returns the destination of the given source image in the configured backup registry. Source repositories
+// with a repository mapping are copied to the mapped repository, all other images are rewritten as follows:
+// nginx                                        -> <dstRegistry>/index_docker_io/library/nginx:latest
+// nginx:1.23                                   -> <dstRegistry>/index_docker_io/library/nginx:1.23
+// nginx@sha256:33cef...                        -> <dstRegistry>/index_docker_io/library/nginx:sha256_33cef...
+// grafana/grafana:main                         -> <dstRegistry>/index_docker_io/grafana/grafana:main
+// ghcr.io/timebertt/speedtest-exporter:v0.1.0  -> <dstRegistry>/ghcr_io/timebertt/speedtest-exporter:v0.1.0
+// Registry.Example.com/foo:bar                 -> <dstRegistry>/registry_example_com/foo:bar
+// The configured prefix is inserted after the registry, e.g., <dstRegistry>/<prefix>/index_docker_io/library/nginx.
+// If PreserveShortNames is set, Docker Hub images keep their literal repository name, see shortNameRepository. Images
+// referenced by digest are represented in the configured DigestTagStyle.
+func Destination(srcImg name.Reference, cfg Config) (name.Tag, error) {
+	if dst, ok := cfg.RepositoryMappings[srcImg.Context().Name()]; ok {
+		return name.NewTag(fmt.Sprintf("%s/%s:%s", cfg.BackupRegistry.RegistryStr(), dst, DestinationTag(srcImg, cfg.DigestTagStyle)))
+	}
+
+	newRepository := EncodeRegistry(srcImg.Context().Registry.RegistryStr()) + "/" + srcImg.Context().RepositoryStr()
+	if cfg.PreserveShortNames {
+		if registry, repository, ok := shortNameRepository(srcImg); ok {
+			newRepository = EncodeRegistry(registry) + "/" + repository
+		}
+	}
+
+	// Registries require repository names to be lowercase. Repository names of source images are already lowercase
+	// (otherwise they cannot be parsed), but registry hosts might contain uppercase characters. As hostnames are
+	// case-insensitive, lowercasing the registry part can only map equivalent registries to the same repository.
+	newRepository = strings.ToLower(newRepository)
+
+	if cfg.Prefix != "" {
+		newRepository = cfg.Prefix + "/" + newRepository
+	}
+
+	if len(newRepository) > MaxRepositoryLength {
+		return name.Tag{}, fmt.Errorf("destination repository %q exceeds the maximum repository length of %d characters", newRepository, MaxRepositoryLength)
+	}
+
+	return name.NewTag(fmt.Sprintf("%s/%s:%s", cfg.BackupRegistry.RegistryStr(), newRepository, DestinationTag(srcImg, cfg.DigestTagStyle)))
+}
+
+// Original reverses Destination, i.e., returns the original source reference of an image in a (previous) backup
+// registry. The registry of the given image is not checked. Destination repositories of repository mappings are mapped
+// back to their source repository, all other images as follows (the configured prefix is removed, see StripPrefix):
+// <backupRegistry>/index_docker_io/library/nginx:1.23             -> index.docker.io/library/nginx:1.23
+// <backupRegistry>/index_docker_io/library/nginx:sha256_33cef...  -> index.docker.io/library/nginx@sha256:33cef...
+// <backupRegistry>/localhost_5001/foo:bar                         -> localhost:5001/foo:bar
+// <backupRegistry>/team-billing/ghcr_io/foo:bar                   -> ghcr.io/foo:bar
+func Original(dstImg name.Reference, cfg Config) (name.Reference, error) {
+	for src, dst := range cfg.RepositoryMappings {
+		if dstImg.Context().RepositoryStr() == dst {
+			return originalReference(src, dstImg.Identifier())
+		}
+	}
+
+	encodedRegistry, repository, ok := strings.Cut(StripPrefix(dstImg.Context().RepositoryStr(), cfg.Prefix), "/")
+	if !ok {
+		return nil, fmt.Errorf("repository %q doesn't contain an encoded registry", dstImg.Context().RepositoryStr())
+	}
+
+	return originalReference(decodeRegistry(encodedRegistry)+"/"+repository, dstImg.Identifier())
+}
+
+// shortNameRepository returns the registry and repository of the given Docker Hub image as written in the original
+// reference instead of the resolved ones, e.g.:
+// nginx:1.23                     -> docker.io, nginx
+// grafana/grafana:main           -> docker.io, grafana/grafana
+// docker.io/library/nginx:1.23   -> docker.io, library/nginx
+// index.docker.io/library/nginx  -> index.docker.io, library/nginx
+// The repositories of short names can't collide with other repositories, as Docker Hub resolves nginx to library/nginx
+// and doesn't allow other repositories without namespace.
+func shortNameRepository(srcImg name.Reference) (string, string, bool) {
+	literal := srcImg.String()
+	if srcImg.Context().RegistryStr() != name.DefaultRegistry || literal == "" {
+		return "", "", false
+	}
+
+	if i := strings.Index(literal, "@"); i >= 0 {
+		literal = literal[:i]
+	}
+	if i := strings.LastIndex(literal, ":"); i > strings.LastIndex(literal, "/") {
+		literal = literal[:i]
+	}
+
+	if registry, repository, ok := strings.Cut(literal, "/"); ok && (strings.ContainsAny(registry, ".:") || registry == "localhost") {
+		return registry, repository, true
+	}
+	return "docker.io", literal, true
+}
@@ -0,0 +1,173 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package naming
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// update regenerates the golden files. Changes to the golden files are changes of the destinations that external
+// tooling computes and need to be released accordingly.
+var update = flag.Bool("update", false, "update golden files")
+
+// goldenSources are mapped with every configuration in goldenConfigs.
+var goldenSources = []string{
+	"nginx",
+	"nginx:1.23",
+	"nginx@sha256:33cef2fd3a1f6e5bbb5d4ff2bd6ab0d8a89f1bea7bcf6a1b3f7ce33ae2e3a6a3",
+	"nginx:1.23@sha256:33cef2fd3a1f6e5bbb5d4ff2bd6ab0d8a89f1bea7bcf6a1b3f7ce33ae2e3a6a3",
+	"library/nginx:1.23",
+	"docker.io/library/nginx:1.23",
+	"index.docker.io/library/nginx:1.23",
+	"grafana/grafana:main",
+	"ghcr.io/timebertt/speedtest-exporter:v0.1.0",
+	"Registry.Example.com/foo:bar",
+	"localhost:5001/foo:bar",
+	// exceeds the maximum repository length with a prefix
+	"ghcr.io/team/" + strings.Repeat("a", 240) + ":v1",
+	"quay.io/prometheus/node-exporter:v1.3.1",
+	"registry.gitlab.com/group/app:v1",
+	"nvcr.io/nvidia/cuda:12",
+	"docker.elastic.co/elasticsearch/elasticsearch:8.3.2",
+}
+
+func goldenConfigs(t *testing.T) []struct {
+	name string
+	cfg  Config
+} {
+	backupRegistry, err := name.NewRegistry("backup.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mappings, err := ParseRepositoryMappings([]string{"quay.io/prometheus/node-exporter=monitoring/node-exporter"}, backupRegistry)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return []struct {
+		name string
+		cfg  Config
+	}{
+		{name: "default", cfg: Config{BackupRegistry: backupRegistry}},
+		{name: "prefix", cfg: Config{BackupRegistry: backupRegistry, Prefix: "team-billing"}},
+		{name: "short-names", cfg: Config{BackupRegistry: backupRegistry, PreserveShortNames: true}},
+		{name: "sha-only", cfg: Config{BackupRegistry: backupRegistry, DigestTagStyle: DigestTagStyleSHAOnly}},
+		{name: "original-tag-plus-digest", cfg: Config{BackupRegistry: backupRegistry, DigestTagStyle: DigestTagStyleOriginalTagPlusDigest}},
+		{name: "repository-mappings", cfg: Config{BackupRegistry: backupRegistry, Prefix: "team-billing", RepositoryMappings: mappings}},
+	}
+}
+
+// TestMapGolden locks the behavior of Map and Reverse, which external tooling relies on to compute the same
+// destinations as the controller.
+func TestMapGolden(t *testing.T) {
+	for _, tc := range goldenConfigs(t) {
+		t.Run(tc.name, func(t *testing.T) {
+			var out strings.Builder
+			for _, src := range goldenSources {
+				dst, err := Map(src, tc.cfg)
+				if err != nil {
+					fmt.Fprintf(&out, "%s\n  error: %v\n", src, err)
+					continue
+				}
+				fmt.Fprintf(&out, "%s\n  -> %s\n", src, dst)
+
+				if reversed, ok := Reverse(dst, tc.cfg); ok {
+					fmt.Fprintf(&out, "  <- %s\n", reversed)
+				} else {
+					fmt.Fprintf(&out, "  <- not reversible\n")
+				}
+			}
+
+			golden := filepath.Join("testdata", tc.name+".golden")
+			if *update {
+				if err := os.WriteFile(golden, []byte(out.String()), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("error reading golden file, run with -update to create it: %v", err)
+			}
+			if out.String() != string(want) {
+				t.Errorf("mapping differs from %s, run with -update if the change is intended:\n%s", golden, out.String())
+			}
+		})
+	}
+}
+
+func TestReverse(t *testing.T) {
+	cfg := Config{BackupRegistry: name.MustParseReference("backup.example.com/app").Context().Registry, Prefix: "team-billing"}
+
+	for dst, want := range map[string]string{
+		"backup.example.com/team-billing/registry_gitlab_com/group/app:v1":                  "registry.gitlab.com/group/app:v1",
+		"backup.example.com/team-billing/nvcr_io/nvidia/cuda:12":                            "nvcr.io/nvidia/cuda:12",
+		"backup.example.com/team-billing/docker_elastic_co/elasticsearch/elasticsearch:8.3": "docker.elastic.co/elasticsearch/elasticsearch:8.3",
+		"backup.example.com/team-billing/registry_example_com_5000/app:v1":                  "registry.example.com:5000/app:v1",
+		"backup.example.com/team-billing/localhost_5001/app:v1":                             "localhost:5001/app:v1",
+	} {
+		if src, ok := Reverse(dst, cfg); !ok || src != want {
+			t.Errorf("Reverse(%s) = %s, %t, want %s", dst, src, ok, want)
+		}
+	}
+
+	for _, dst := range []string{
+		// other registry
+		"registry.example.com/team-billing/index_docker_io/library/nginx:1.23",
+		// other prefix
+		"backup.example.com/team-payments/index_docker_io/library/nginx:1.23",
+		// not produced by Map
+		"backup.example.com/team-billing/nginx:1.23",
+		"backup.example.com/team-billing/team_a/nginx:1.23",
+		"not a reference",
+	} {
+		if src, ok := Reverse(dst, cfg); ok {
+			t.Errorf("Reverse(%s) = %s, want not reversible", dst, src)
+		}
+	}
+}
+
+func TestLooksLikeEncodedRegistry(t *testing.T) {
+	for encoded, want := range map[string]bool{
+		"index_docker_io":           true,
+		"ghcr_io":                   true,
+		"registry_gitlab_com":       true,
+		"nvcr_io":                   true,
+		"docker_elastic_co":         true,
+		"my-registry_example_com":   true,
+		"localhost_5001":            true,
+		"registry_example_com_5000": true,
+		"10_0_0_1_5000":             true,
+		"nginx":                     false,
+		"team-billing":              false,
+		"team_a":                    false,
+		"app_v2":                    false,
+		"registry_5000":             false,
+		"registry__example_com":     false,
+		"registry_-example_com":     false,
+	} {
+		if got := LooksLikeEncodedRegistry(encoded); got != want {
+			t.Errorf("LooksLikeEncodedRegistry(%s) = %t, want %t", encoded, got, want)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package naming
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// pathComponentRegexp matches a single path component of a repository name according to the distribution spec.
+var pathComponentRegexp = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*$`)
+
+// ValidatePrefix verifies that the given destination prefix consists of valid repository path components. Components
+// must not look like registry hosts encoded by Destination, so that rewritten images can be mapped back to their
+// original reference unambiguously.
+func ValidatePrefix(prefix string) error {
+	for _, component := range strings.Split(prefix, "/") {
+		if !pathComponentRegexp.MatchString(component) {
+			return fmt.Errorf("invalid repository path component %q", component)
+		}
+		if LooksLikeEncodedRegistry(component) {
+			return fmt.Errorf("path component %q looks like an encoded registry host", component)
+		}
+	}
+	return nil
+}
+
+// HasPrefix checks whether the repository of the given image starts with the given destination prefix.
+func HasPrefix(img name.Reference, prefix string) bool {
+	return prefix == "" || strings.HasPrefix(img.Context().RepositoryStr(), prefix+"/")
+}
+
+// StripPrefix removes a destination prefix from the given repository of an image in a backup registry.
+// The known prefixes are tried first. Otherwise, all path components before the first one that looks like an encoded
+// registry host are removed, e.g., if the prefix of a workload was changed.
+func StripPrefix(repository string, prefixes ...string) string {
+	for _, prefix := range prefixes {
+		if prefix != "" && strings.HasPrefix(repository, prefix+"/") {
+			return strings.TrimPrefix(repository, prefix+"/")
+		}
+	}
+
+	components := strings.Split(repository, "/")
+	for i := 1; i < len(components)-1; i++ {
+		if LooksLikeEncodedRegistry(components[i]) && !LooksLikeEncodedRegistry(components[0]) {
+			return strings.Join(components[i:], "/")
+		}
+	}
+	return repository
+}
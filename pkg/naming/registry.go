@@ -0,0 +1,115 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package naming
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// wellKnownRegistries are registry hosts that are commonly found in the first repository path element of images in a
+// backup registry.
+var wellKnownRegistries = sets.NewString(
+	name.DefaultRegistry,
+	"docker.io",
+	"ghcr.io",
+	"gcr.io",
+	"k8s.gcr.io",
+	"registry.k8s.io",
+	"quay.io",
+	"mcr.microsoft.com",
+	"public.ecr.aws",
+)
+
+// WellKnownRegistries returns the registry hosts that are recognized as encoded registries in destination repositories
+// regardless of their format, see LooksLikeEncodedRegistry.
+func WellKnownRegistries() sets.String {
+	return sets.NewString(wellKnownRegistries.UnsortedList()...)
+}
+
+// registryReplacer replaces . and : with _ in registry names to be used as a prefix in rewritten repository names.
+var registryReplacer = strings.NewReplacer(".", "_", ":", "_")
+
+// EncodeRegistry encodes the given registry host for the first path element of destination repositories, e.g.,
+// ghcr.io -> ghcr_io or localhost:5001 -> localhost_5001.
+func EncodeRegistry(registry string) string {
+	return registryReplacer.Replace(registry)
+}
+
+// LooksLikeBackupImage checks whether the first path element of the image's repository (after removing any of the
+// given destination prefixes) looks like a registry host encoded by Destination, i.e., whether the image was probably
+// copied to a backup registry before.
+func LooksLikeBackupImage(img name.Reference, prefixes ...string) bool {
+	repository := img.Context().RepositoryStr()
+	for _, prefix := range prefixes {
+		if prefix != "" && strings.HasPrefix(repository, prefix+"/") {
+			repository = strings.TrimPrefix(repository, prefix+"/")
+			break
+		}
+	}
+
+	encodedRegistry, _, ok := strings.Cut(repository, "/")
+	return ok && LooksLikeEncodedRegistry(encodedRegistry)
+}
+
+// LooksLikeEncodedRegistry checks whether the given path element looks like a registry host encoded by Destination.
+// Besides the well-known registries, this is the case for encoded domain names (e.g., registry_gitlab_com or nvcr_io),
+// whose last label is alphabetic like top-level domains, and for hosts with ports (e.g., localhost_5001 or
+// registry_example_com_5000). As hostnames don't contain _, repositories in the backup registry with such a first path
+// element are assumed to have been created by the controller.
+func LooksLikeEncodedRegistry(encodedRegistry string) bool {
+	if wellKnownRegistries.Has(decodeRegistry(encodedRegistry)) {
+		return true
+	}
+
+	labels := strings.Split(encodedRegistry, "_")
+	for _, label := range labels {
+		if !hostLabelRegexp.MatchString(label) {
+			return false
+		}
+	}
+
+	if last := labels[len(labels)-1]; isNumeric(last) {
+		// registries with ports
+		return len(labels) >= 3 || (len(labels) == 2 && labels[0] == "localhost")
+	}
+	return len(labels) >= 2 && topLevelDomainRegexp.MatchString(labels[len(labels)-1])
+}
+
+var (
+	// hostLabelRegexp matches a single label of an encoded registry host, registry hosts are lowercased by Destination.
+	hostLabelRegexp = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+	// topLevelDomainRegexp matches the last label of an encoded domain name.
+	topLevelDomainRegexp = regexp.MustCompile(`^[a-z]{2,}$`)
+)
+
+// decodeRegistry reverses the registry encoding of Destination. As . and : are both encoded as _, this is ambiguous in
+// theory. However, hostnames don't contain _, and a numeric last element is interpreted as port.
+func decodeRegistry(encoded string) string {
+	parts := strings.Split(encoded, "_")
+	if len(parts) > 1 && isNumeric(parts[len(parts)-1]) {
+		return strings.Join(parts[:len(parts)-1], ".") + ":" + parts[len(parts)-1]
+	}
+	return strings.Join(parts, ".")
+}
+
+func isNumeric(s string) bool {
+	return s != "" && strings.Trim(s, "0123456789") == ""
+}
@@ -0,0 +1,82 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package naming
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// RepositoryMappings maps source repositories (e.g., index.docker.io/library/nginx) to fixed destination repository
+// paths in the backup registry (e.g., base/nginx). They take precedence over destination prefixes and the default
+// naming scheme of Destination.
+type RepositoryMappings map[string]string
+
+// ParseRepositoryMappings parses mappings in the form <source-repository>=<destination-repository>, e.g.,
+// docker.io/library/nginx=base/nginx. The destination may include the host of the given backup registry, but must not
+// point to another registry. Sources and destinations must be unique.
+func ParseRepositoryMappings(values []string, backupRegistry name.Registry) (RepositoryMappings, error) {
+	mappings := make(RepositoryMappings, len(values))
+	destinations := make(map[string]string, len(values))
+
+	for _, value := range values {
+		src, dst, ok := strings.Cut(value, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid repository mapping %q, expected <source-repository>=<destination-repository>", value)
+		}
+
+		srcRepo, err := name.NewRepository(src)
+		if err != nil {
+			return nil, fmt.Errorf("invalid source repository in mapping %q: %w", value, err)
+		}
+
+		dst = strings.TrimPrefix(dst, backupRegistry.RegistryStr()+"/")
+		if first, _, _ := strings.Cut(dst, "/"); strings.ContainsAny(first, ".:") || first == "localhost" {
+			return nil, fmt.Errorf("destination repository in mapping %q must be in the backup registry %q", value, backupRegistry.RegistryStr())
+		}
+		// the destination must not collide with repositories of the default naming scheme
+		if err := ValidatePrefix(dst); err != nil {
+			return nil, fmt.Errorf("invalid destination repository in mapping %q: %w", value, err)
+		}
+		if len(dst) > MaxRepositoryLength {
+			return nil, fmt.Errorf("destination repository in mapping %q exceeds the maximum repository length of %d characters", value, MaxRepositoryLength)
+		}
+
+		if _, ok := mappings[srcRepo.Name()]; ok {
+			return nil, fmt.Errorf("duplicate repository mapping for source repository %q", srcRepo.Name())
+		}
+		if other, ok := destinations[dst]; ok {
+			return nil, fmt.Errorf("source repositories %q and %q are mapped to the same destination repository %q", other, srcRepo.Name(), dst)
+		}
+		mappings[srcRepo.Name()] = dst
+		destinations[dst] = srcRepo.Name()
+	}
+
+	return mappings, nil
+}
+
+// IsDestination checks whether the given image is the destination of a repository mapping.
+func (m RepositoryMappings) IsDestination(img name.Reference) bool {
+	for _, dst := range m {
+		if img.Context().RepositoryStr() == dst {
+			return true
+		}
+	}
+	return false
+}
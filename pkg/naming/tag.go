@@ -0,0 +1,43 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package naming
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+const (
+	// MaxTagLength is the maximum length of tags according to the distribution spec.
+	MaxTagLength = 128
+	// MaxRepositoryLength is the maximum length of repository names accepted by go-containerregistry.
+	MaxRepositoryLength = 255
+	// tagHashLength is the number of hex characters of the hash appended to truncated tags.
+	tagHashLength = 8
+)
+
+// truncateTag returns a valid tag for the given synthesized tag. All synthesized tags must be constructed using this
+// function. Tags exceeding MaxTagLength are truncated and suffixed with a short hash of the full tag, so that different
+// long tags don't collide.
+func truncateTag(tag string) string {
+	if len(tag) <= MaxTagLength {
+		return tag
+	}
+
+	sum := sha256.Sum256([]byte(tag))
+	return tag[:MaxTagLength-tagHashLength-1] + "-" + hex.EncodeToString(sum[:])[:tagHashLength]
+}
@@ -0,0 +1,68 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package naming
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTruncateTag(t *testing.T) {
+	tests := []struct {
+		name      string
+		tag       string
+		truncated bool
+	}{
+		{name: "127 characters", tag: strings.Repeat("a", 127)},
+		{name: "128 characters", tag: strings.Repeat("a", 128)},
+		{name: "129 characters", tag: strings.Repeat("a", 129), truncated: true},
+		{name: "129 characters with different suffix", tag: strings.Repeat("a", 128) + "b", truncated: true},
+		{name: "200 characters", tag: strings.Repeat("a", 200), truncated: true},
+	}
+
+	seen := map[string]string{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := truncateTag(tt.tag)
+			if !tagRegexp.MatchString(got) {
+				t.Errorf("tag %s is not a valid tag", got)
+			}
+
+			if !tt.truncated {
+				if got != tt.tag {
+					t.Errorf("truncateTag() = %s, want the tag unchanged", got)
+				}
+				return
+			}
+
+			if len(got) != MaxTagLength {
+				t.Errorf("len(truncateTag()) = %d, want %d", len(got), MaxTagLength)
+			}
+			prefix := tt.tag[:MaxTagLength-tagHashLength-1] + "-"
+			if !strings.HasPrefix(got, prefix) || len(strings.TrimPrefix(got, prefix)) != tagHashLength {
+				t.Errorf("truncateTag() = %s, want the truncated tag suffixed with a hash", got)
+			}
+			if truncateTag(tt.tag) != got {
+				t.Error("truncateTag() is not deterministic")
+			}
+			if other, ok := seen[got]; ok {
+				t.Errorf("truncateTag() = %s collides with the tag of %s", got, other)
+			}
+			seen[got] = tt.name
+		})
+	}
+}
@@ -0,0 +1,190 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// DefaultQueueSize is the default for HTTPSink.QueueSize.
+	DefaultQueueSize = 1000
+	// cloudEventsSource is the source attribute of all CloudEvents sent by the HTTPSink.
+	cloudEventsSource = "image-clone-controller"
+	// maxAttempts is the number of attempts for delivering a single notification.
+	maxAttempts = 5
+)
+
+// HTTPSink POSTs notifications as structured CloudEvents to a URL. Notifications are queued in memory and delivered
+// in the background with retries. If the queue is full, the oldest notification is dropped.
+// It must be added to the manager, as delivery only happens while it is running.
+type HTTPSink struct {
+	URL       string
+	Client    *http.Client
+	QueueSize int
+	Log       logr.Logger
+
+	lock   sync.Mutex
+	queue  []Event
+	notify chan struct{}
+}
+
+// cloudEvent is the structured mode representation of a CloudEvent.
+type cloudEvent struct {
+	SpecVersion     string    `json:"specversion"`
+	ID              string    `json:"id"`
+	Source          string    `json:"source"`
+	Type            string    `json:"type"`
+	Subject         string    `json:"subject"`
+	Time            time.Time `json:"time"`
+	DataContentType string    `json:"datacontenttype"`
+	Data            Event     `json:"data"`
+}
+
+// Notify implements Sink.
+func (h *HTTPSink) Notify(event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.init()
+
+	h.queue = append(h.queue, event)
+	if len(h.queue) > h.queueSize() {
+		// drop the oldest notification instead of blocking
+		h.Log.V(1).Info("Notification queue is full, dropping oldest notification")
+		h.queue = h.queue[1:]
+	}
+
+	select {
+	case h.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (h *HTTPSink) init() {
+	if h.notify == nil {
+		h.notify = make(chan struct{}, 1)
+	}
+}
+
+func (h *HTTPSink) queueSize() int {
+	if h.QueueSize <= 0 {
+		return DefaultQueueSize
+	}
+	return h.QueueSize
+}
+
+// Start delivers queued notifications until the context is cancelled. It implements manager.Runnable.
+func (h *HTTPSink) Start(ctx context.Context) error {
+	h.lock.Lock()
+	h.init()
+	notify := h.notify
+	h.lock.Unlock()
+
+	for {
+		event, ok := h.pop()
+		if !ok {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-notify:
+				continue
+			}
+		}
+
+		if err := h.deliver(ctx, event); err != nil {
+			h.Log.Error(err, "Failed delivering notification", "type", event.Type)
+		}
+	}
+}
+
+func (h *HTTPSink) pop() (Event, bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if len(h.queue) == 0 {
+		return Event{}, false
+	}
+	event := h.queue[0]
+	h.queue = h.queue[1:]
+	return event, true
+}
+
+// deliver sends the given notification with retries and exponential backoff.
+func (h *HTTPSink) deliver(ctx context.Context, event Event) error {
+	body, err := json.Marshal(cloudEvent{
+		SpecVersion:     "1.0",
+		ID:              string(uuid.NewUUID()),
+		Source:          cloudEventsSource,
+		Type:            event.Type,
+		Subject:         event.Kind + "/" + event.Namespace + "/" + event.Name,
+		Time:            event.Time,
+		DataContentType: "application/json",
+		Data:            event,
+	})
+	if err != nil {
+		return err
+	}
+
+	client := h.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	var lastErr error
+	backoff := wait.Backoff{Duration: time.Second, Factor: 2, Jitter: 0.1, Steps: maxAttempts}
+	err = wait.ExponentialBackoffWithContext(ctx, backoff, func() (bool, error) {
+		lastErr = h.post(ctx, client, body)
+		return lastErr == nil, nil
+	})
+	if err != nil && lastErr != nil {
+		return lastErr
+	}
+	return err
+}
+
+func (h *HTTPSink) post(ctx context.Context, client *http.Client, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/cloudevents+json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("notification endpoint responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
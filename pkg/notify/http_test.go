@@ -0,0 +1,152 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// startSink starts a sink delivering to a local test server with the given handler. It returns a channel receiving the
+// delivered CloudEvents.
+func startSink(t *testing.T, handler func(w http.ResponseWriter, attempt int32) bool) (*HTTPSink, <-chan cloudEvent) {
+	t.Helper()
+
+	delivered := make(chan cloudEvent, 10)
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/cloudevents+json" {
+			t.Errorf("unexpected request %s with content type %q", r.Method, r.Header.Get("Content-Type"))
+		}
+		if !handler(w, atomic.AddInt32(&attempts, 1)) {
+			return
+		}
+
+		event := cloudEvent{}
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Errorf("failed decoding notification: %v", err)
+		}
+		delivered <- event
+	}))
+	t.Cleanup(server.Close)
+
+	sink := &HTTPSink{URL: server.URL, Log: logr.Discard()}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- sink.Start(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return sink, delivered
+}
+
+func receive(t *testing.T, delivered <-chan cloudEvent, timeout time.Duration) cloudEvent {
+	t.Helper()
+	select {
+	case event := <-delivered:
+		return event
+	case <-time.After(timeout):
+		t.Fatal("notification was not delivered")
+		return cloudEvent{}
+	}
+}
+
+func TestHTTPSinkDelivers(t *testing.T) {
+	sink, delivered := startSink(t, func(http.ResponseWriter, int32) bool { return true })
+
+	sent := Event{
+		Type:        TypeCopySucceeded,
+		Time:        time.Date(2022, 7, 1, 12, 0, 0, 0, time.UTC),
+		Kind:        "Deployment",
+		Namespace:   "default",
+		Name:        "app",
+		Container:   "nginx",
+		Source:      "nginx:1.23",
+		Destination: "registry.example.com/index_docker_io/library/nginx:1.23",
+		Result:      "copied",
+		Duration:    1.5,
+	}
+	sink.Notify(sent)
+
+	event := receive(t, delivered, 5*time.Second)
+	if event.SpecVersion != "1.0" || event.Source != cloudEventsSource || event.ID == "" || event.DataContentType != "application/json" {
+		t.Errorf("invalid CloudEvent attributes: %+v", event)
+	}
+	if event.Type != TypeCopySucceeded || event.Subject != "Deployment/default/app" || !event.Time.Equal(sent.Time) {
+		t.Errorf("CloudEvent has type %q, subject %q, time %s, want %q, %q, %s", event.Type, event.Subject, event.Time, TypeCopySucceeded, "Deployment/default/app", sent.Time)
+	}
+
+	// type and time are only transported as CloudEvent attributes
+	want := sent
+	want.Type, want.Time = "", time.Time{}
+	if event.Data != want {
+		t.Errorf("notification data = %+v, want %+v", event.Data, want)
+	}
+}
+
+func TestHTTPSinkRetries(t *testing.T) {
+	sink, delivered := startSink(t, func(w http.ResponseWriter, attempt int32) bool {
+		if attempt == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return false
+		}
+		return true
+	})
+
+	sink.Notify(Event{Type: TypeWorkloadPatched, Kind: "DaemonSet", Namespace: "default", Name: "app"})
+	if event := receive(t, delivered, 10*time.Second); event.Type != TypeWorkloadPatched {
+		t.Errorf("delivered notification has type %q, want %q", event.Type, TypeWorkloadPatched)
+	}
+}
+
+func TestHTTPSinkDropsOldest(t *testing.T) {
+	// the sink is not started, so that notifications stay queued
+	sink := &HTTPSink{QueueSize: 2, Log: logr.Discard()}
+
+	done := make(chan struct{})
+	go func() {
+		for _, name := range []string{"first", "second", "third"} {
+			sink.Notify(Event{Type: TypeCopyFailed, Name: name})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Notify blocked on a full queue")
+	}
+
+	var names []string
+	for {
+		event, ok := sink.pop()
+		if !ok {
+			break
+		}
+		names = append(names, event.Name)
+	}
+	if len(names) != 2 || names[0] != "second" || names[1] != "third" {
+		t.Errorf("queued notifications = %v, want [second third]", names)
+	}
+}
@@ -0,0 +1,59 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package notify implements notifications about clone activity, e.g., for showing tenants when their images were
+// mirrored.
+package notify
+
+import (
+	"time"
+)
+
+// Event types of notifications.
+const (
+	TypeCopySucceeded   = "dev.timebertt.image-clone.copy.succeeded"
+	TypeCopyFailed      = "dev.timebertt.image-clone.copy.failed"
+	TypeWorkloadPatched = "dev.timebertt.image-clone.workload.patched"
+)
+
+// Event is a notification about clone activity.
+type Event struct {
+	// Type is one of the Type* constants.
+	Type string    `json:"-"`
+	Time time.Time `json:"-"`
+
+	Kind        string `json:"kind"`
+	Namespace   string `json:"namespace"`
+	Name        string `json:"name"`
+	Container   string `json:"container,omitempty"`
+	Source      string `json:"source,omitempty"`
+	Destination string `json:"destination,omitempty"`
+	Result      string `json:"result,omitempty"`
+	Error       string `json:"error,omitempty"`
+	// Duration is the duration of the copy in seconds.
+	Duration float64 `json:"duration,omitempty"`
+}
+
+// Sink receives notifications. Implementations must never block.
+type Sink interface {
+	Notify(event Event)
+}
+
+// NopSink discards all notifications.
+type NopSink struct{}
+
+// Notify implements Sink.
+func (NopSink) Notify(Event) {}
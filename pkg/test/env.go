@@ -0,0 +1,96 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package test
+
+import (
+	"context"
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/envtest"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+// Environment is a test control plane (see envtest) with a manager running against it.
+// Binaries for envtest need to be installed, e.g., using setup-envtest, and KUBEBUILDER_ASSETS needs to point to them.
+type Environment struct {
+	env    *envtest.Environment
+	cancel context.CancelFunc
+	done   chan error
+
+	// Client is a client that reads directly from the API server.
+	Client client.Client
+}
+
+// StartEnvironment starts a test control plane and a manager. setup is called to add controllers to the manager before
+// starting it.
+func StartEnvironment(setup func(mgr manager.Manager) error) (*Environment, error) {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		return nil, err
+	}
+
+	env := &envtest.Environment{}
+	restConfig, err := env.Start()
+	if err != nil {
+		return nil, fmt.Errorf("failed starting test environment: %w", err)
+	}
+
+	e := &Environment{env: env, done: make(chan error, 1)}
+	stop := func(err error) (*Environment, error) {
+		_ = env.Stop()
+		return nil, err
+	}
+
+	e.Client, err = client.New(restConfig, client.Options{Scheme: scheme})
+	if err != nil {
+		return stop(err)
+	}
+
+	mgr, err := ctrl.NewManager(restConfig, ctrl.Options{
+		Scheme:                 scheme,
+		MetricsBindAddress:     "0",
+		HealthProbeBindAddress: "0",
+	})
+	if err != nil {
+		return stop(err)
+	}
+	if err := setup(mgr); err != nil {
+		return stop(err)
+	}
+
+	var ctx context.Context
+	ctx, e.cancel = context.WithCancel(context.Background())
+	go func() {
+		e.done <- mgr.Start(ctx)
+	}()
+
+	return e, nil
+}
+
+// Stop stops the manager and the test control plane.
+func (e *Environment) Stop() error {
+	e.cancel()
+	if err := <-e.done; err != nil {
+		_ = e.env.Stop()
+		return err
+	}
+	return e.env.Stop()
+}
@@ -0,0 +1,113 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package test contains helpers for integration tests of the copy and patch flow, e.g., an in-process OCI registry
+// that can act as both fake upstream and backup registry.
+package test
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// Registry is an in-process OCI registry.
+type Registry struct {
+	server *httptest.Server
+	// Registry is the registry served by this instance. As it is served on 127.0.0.1, plain HTTP is used.
+	Registry name.Registry
+}
+
+// NewRegistry starts a new in-process OCI registry. It must be closed by the caller.
+func NewRegistry() (*Registry, error) {
+	server := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+
+	reg, err := name.NewRegistry(strings.TrimPrefix(server.URL, "http://"), name.Insecure)
+	if err != nil {
+		server.Close()
+		return nil, err
+	}
+
+	return &Registry{server: server, Registry: reg}, nil
+}
+
+// Close shuts down the registry.
+func (r *Registry) Close() {
+	r.server.Close()
+}
+
+// Reference parses the given reference relative to this registry, e.g., library/nginx:1.23.
+func (r *Registry) Reference(ref string) (name.Reference, error) {
+	return name.ParseReference(r.Registry.RegistryStr()+"/"+ref, name.Insecure)
+}
+
+// SeedImage pushes a random image with the given number of layers to the given reference relative to this registry.
+func (r *Registry) SeedImage(ref string, layers int64) (v1.Image, error) {
+	parsed, err := r.Reference(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	img, err := random.Image(1024, layers)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := remote.Write(parsed, img); err != nil {
+		return nil, fmt.Errorf("failed seeding image %q: %w", parsed.Name(), err)
+	}
+	return img, nil
+}
+
+// SeedIndex pushes a random index with the given number of images to the given reference relative to this registry.
+func (r *Registry) SeedIndex(ref string, images int64) (v1.ImageIndex, error) {
+	parsed, err := r.Reference(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	idx, err := random.Index(1024, 1, images)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := remote.WriteIndex(parsed, idx); err != nil {
+		return nil, fmt.Errorf("failed seeding index %q: %w", parsed.Name(), err)
+	}
+	return idx, nil
+}
+
+// Digest returns the digest of the given image. It returns an error if the image doesn't exist.
+func Digest(ref string) (v1.Hash, error) {
+	parsed, err := name.ParseReference(ref, name.Insecure)
+	if err != nil {
+		return v1.Hash{}, err
+	}
+
+	desc, err := remote.Head(parsed)
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	return desc.Digest, nil
+}
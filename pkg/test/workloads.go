@@ -0,0 +1,128 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package test
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// NewDeployment returns a Deployment with one container per given image.
+func NewDeployment(namespace, name string, images ...string) *appsv1.Deployment {
+	labels := map[string]string{"app": name}
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+		Spec: appsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: labels},
+			Template: podTemplate(labels, images),
+		},
+	}
+}
+
+// NewDaemonSet returns a DaemonSet with one container per given image.
+func NewDaemonSet(namespace, name string, images ...string) *appsv1.DaemonSet {
+	labels := map[string]string{"app": name}
+	return &appsv1.DaemonSet{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+		Spec: appsv1.DaemonSetSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: labels},
+			Template: podTemplate(labels, images),
+		},
+	}
+}
+
+func podTemplate(labels map[string]string, images []string) corev1.PodTemplateSpec {
+	template := corev1.PodTemplateSpec{ObjectMeta: metav1.ObjectMeta{Labels: labels}}
+	for i, image := range images {
+		template.Spec.Containers = append(template.Spec.Containers, corev1.Container{
+			Name:  fmt.Sprintf("container-%d", i),
+			Image: image,
+		})
+	}
+	return template
+}
+
+// ContainerImages returns the container images of the given workload.
+func ContainerImages(obj client.Object) []string {
+	var template *corev1.PodTemplateSpec
+	switch workload := obj.(type) {
+	case *appsv1.Deployment:
+		template = &workload.Spec.Template
+	case *appsv1.DaemonSet:
+		template = &workload.Spec.Template
+	default:
+		return nil
+	}
+
+	images := make([]string, 0, len(template.Spec.Containers))
+	for _, container := range template.Spec.Containers {
+		images = append(images, container.Image)
+	}
+	return images
+}
+
+// WaitForImages waits until the container images of the given workload match the given images.
+func WaitForImages(ctx context.Context, c client.Client, obj client.Object, timeout time.Duration, images ...string) error {
+	var lastImages []string
+	err := wait.PollImmediate(100*time.Millisecond, timeout, func() (bool, error) {
+		if err := c.Get(ctx, client.ObjectKeyFromObject(obj), obj); err != nil {
+			return false, err
+		}
+
+		lastImages = ContainerImages(obj)
+		if len(lastImages) != len(images) {
+			return false, nil
+		}
+		for i := range images {
+			if lastImages[i] != images[i] {
+				return false, nil
+			}
+		}
+		return true, nil
+	})
+	if err != nil {
+		return fmt.Errorf("images of %s were not patched to %v, last observed images %v: %w", client.ObjectKeyFromObject(obj), images, lastImages, err)
+	}
+	return nil
+}
+
+// WaitForEvent waits until an event with the given reason was recorded for the given object.
+func WaitForEvent(ctx context.Context, c client.Client, obj client.Object, reason string, timeout time.Duration) error {
+	err := wait.PollImmediate(100*time.Millisecond, timeout, func() (bool, error) {
+		events := &corev1.EventList{}
+		if err := c.List(ctx, events, client.InNamespace(obj.GetNamespace())); err != nil {
+			return false, err
+		}
+		for _, event := range events.Items {
+			if event.InvolvedObject.UID == obj.GetUID() && event.Reason == reason {
+				return true, nil
+			}
+		}
+		return false, nil
+	})
+	if err != nil {
+		return fmt.Errorf("no event with reason %q was recorded for %s: %w", reason, client.ObjectKeyFromObject(obj), err)
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+/*
+Copyright 2022 Tim Ebert.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package version exposes the version of the controller. It is injected at build time via ldflags, e.g.:
+// go build -ldflags "-X github.com/timebertt/image-clone-controller/pkg/version.Version=v0.1.0"
+package version
+
+// Version is the version of the controller. It is "dev" for builds without version information.
+var Version = "dev"